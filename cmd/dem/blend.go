@@ -0,0 +1,68 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ThomasHabets/qpov/pkg/bsp"
+	"github.com/ThomasHabets/qpov/pkg/dem"
+)
+
+// Radius of the sphere around the camera that tints the view. It needs
+// to be closer than anything else in view.
+const viewBlendRadius = 1
+
+// liquidFog is the fog seen from inside a liquid.
+type liquidFog struct {
+	distance float64
+	r, g, b  float64
+}
+
+// liquidFogs are the fogs of the liquid contents.
+var liquidFogs = map[int32]liquidFog{
+	bsp.ContentsWater: {distance: 300, r: 0.25, g: 0.2, b: 0.1},
+	bsp.ContentsSlime: {distance: 150, r: 0.05, g: 0.2, b: 0.02},
+	bsp.ContentsLava:  {distance: 60, r: 0.6, g: 0.15, b: 0},
+}
+
+// writeFog writes the fog of the view. Inside a liquid that fog replaces
+// the fog of the level.
+func writeFog(w io.Writer, state *dem.State, contents int32) {
+	if f, ok := liquidFogs[contents]; ok {
+		fmt.Fprintf(w, "fog { distance %g rgb<%g,%g,%g> }\n", f.distance, f.r, f.g, f.b)
+		return
+	}
+	if f := state.Fog; f.Density > 0 {
+		// FitzQuake uses exp2 fog with density/64 per unit.
+		fmt.Fprintf(w, "fog { distance %g rgb<%g,%g,%g> }\n", 64/f.Density, f.R, f.G, f.B)
+	}
+}
+
+// writeViewBlend writes a glowing translucent sphere around the camera,
+// tinting everything seen through it like the blend of the Quake view.
+func writeViewBlend(w io.Writer, pos dem.Vertex, b dem.Blend) {
+	if b.A <= 0 {
+		return
+	}
+	fmt.Fprintf(w, "// View blend\nsphere { <%s>, %d hollow pigment { rgbt<%.3f,%.3f,%.3f,%.3f> } finish { emission 1 diffuse 0 } no_shadow no_reflection }\n",
+		pos.String(), viewBlendRadius, b.R, b.G, b.B, 1-b.A)
+}
@@ -0,0 +1,62 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/bsp"
+	"github.com/ThomasHabets/qpov/pkg/dem"
+)
+
+func TestWriteFog(t *testing.T) {
+	fog := dem.NewState()
+	fog.Fog = dem.Fog{Density: 0.5, R: 0.1, G: 0.2, B: 0.3}
+	for _, test := range []struct {
+		name     string
+		state    *dem.State
+		contents int32
+		want     string
+	}{
+		{"no fog", dem.NewState(), bsp.ContentsEmpty, ""},
+		{"level fog", fog, bsp.ContentsEmpty, "fog { distance 128 rgb<0.1,0.2,0.3> }\n"},
+		{"water", fog, bsp.ContentsWater, "fog { distance 300 rgb<0.25,0.2,0.1> }\n"},
+		{"lava", dem.NewState(), bsp.ContentsLava, "fog { distance 60 rgb<0.6,0.15,0> }\n"},
+	} {
+		var b bytes.Buffer
+		writeFog(&b, test.state, test.contents)
+		if got := b.String(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWriteViewBlend(t *testing.T) {
+	var b bytes.Buffer
+	writeViewBlend(&b, dem.Vertex{X: 1}, dem.Blend{})
+	if b.Len() != 0 {
+		t.Errorf("Wrote %q for no blend", b.String())
+	}
+	writeViewBlend(&b, dem.Vertex{X: 1}, dem.Blend{R: 1, A: 0.25})
+	if want := "// View blend\nsphere { <1.000000,0.000000,0.000000>, 1 hollow pigment { rgbt<1.000,0.000,0.000,0.750> } finish { emission 1 diffuse 0 } no_shadow no_reflection }\n"; b.String() != want {
+		t.Errorf("Got %q, want %q", b.String(), want)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+	"github.com/ThomasHabets/qpov/pkg/sound"
+)
+
+// cameraFlags are the options of convert for where the camera is.
+type cameraFlags struct {
+	mode          *string
+	chaseDistance *float64
+	chaseHeight   *float64
+	orbitCenter   *string
+	orbitRadius   *float64
+	orbitHeight   *float64
+	orbitPeriod   *float64
+	path          *string
+
+	fov        *float64
+	aspect     *string
+	projection *string
+	stereo     *string
+	ipd        *float64
+}
+
+// Camera projections.
+const (
+	projectionPerspective = "perspective"
+	projectionEquirect    = "equirect"
+)
+
+// Stereo layouts.
+const (
+	stereoNone       = "none"
+	stereoSideBySide = "sbs"
+	stereoOverUnder  = "ou"
+)
+
+// eye is a view rendered of each frame, offset along the right of the
+// camera.
+type eye struct {
+	name   string // Added to the frame file names, unless empty.
+	offset float64
+}
+
+// cameraProfile is how the camera sees the scene.
+type cameraProfile struct {
+	fov              float64 // Horizontal field of view, or 0 for that of the camera.
+	aspectW, aspectH float64
+	spherical        bool // Equirectangular 360 degree view.
+	eyes             []eye
+}
+
+func addCameraFlags(fs *flag.FlagSet) *cameraFlags {
+	return &cameraFlags{
+		mode:          fs.String("camera", "demo", "Camera mode: demo (first person), chase, orbit or path."),
+		chaseDistance: fs.Float64("chase_distance", 100, "Distance behind the player of the chase camera."),
+		chaseHeight:   fs.Float64("chase_height", 16, "Height above the eyes of the player of the chase camera."),
+		orbitCenter:   fs.String("orbit_center", "0,0,0", "Point the orbit camera circles around, as x,y,z."),
+		orbitRadius:   fs.Float64("orbit_radius", 200, "Radius of the orbit camera."),
+		orbitHeight:   fs.Float64("orbit_height", 50, "Height of the orbit camera above the center."),
+		orbitPeriod:   fs.Float64("orbit_period", 10, "Seconds per revolution of the orbit camera, or 0 to stand still."),
+		path:          fs.String("camera_path", "", "Keyframe file of the path camera. Each line is: time x y z look_x look_y look_z fov [weight]"),
+
+		fov:        fs.Float64("camera_fov", 0, "Horizontal field of view in degrees, or 0 for the default of 100. The path camera uses the field of view of its keyframes."),
+		aspect:     fs.String("camera_aspect", "16:9", "Aspect ratio of the frames, as W:H or a number. Should match the size of the rendered frames."),
+		projection: fs.String("camera_projection", projectionPerspective, "Camera projection: perspective, or equirect for 360 degree video. Equirect frames should be rendered at 2:1."),
+		stereo:     fs.String("camera_stereo", stereoNone, "Stereo output: none, sbs (side by side) or ou (over-under). Each eye is written as a POV file, and render puts them together. Not supported with equirect."),
+		ipd:        fs.Float64("camera_ipd", 2.5, "Distance between the eyes in stereo, in Quake units."),
+	}
+}
+
+// parseVertex parses a point written as x,y,z.
+func parseVertex(s string) (dem.Vertex, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return dem.Vertex{}, fmt.Errorf("want x,y,z, got %q", s)
+	}
+	var v [3]float32
+	for n, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 32)
+		if err != nil {
+			return dem.Vertex{}, fmt.Errorf("bad coordinate in %q: %v", s, err)
+		}
+		v[n] = float32(f)
+	}
+	return dem.Vertex{X: v[0], Y: v[1], Z: v[2]}, nil
+}
+
+// parseAspect parses an aspect ratio written as W:H, or as a number.
+func parseAspect(s string) (float64, float64, error) {
+	w, h, found := strings.Cut(s, ":")
+	if !found {
+		h = "1"
+	}
+	a, err := strconv.ParseFloat(strings.TrimSpace(w), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad aspect ratio %q: %v", s, err)
+	}
+	b, err := strconv.ParseFloat(strings.TrimSpace(h), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad aspect ratio %q: %v", s, err)
+	}
+	if a <= 0 || b <= 0 {
+		return 0, 0, fmt.Errorf("bad aspect ratio %q", s)
+	}
+	return a, b, nil
+}
+
+// profile returns the camera profile of the flags.
+func (c *cameraFlags) profile() (cameraProfile, error) {
+	p := cameraProfile{fov: *c.fov}
+	if p.fov < 0 || p.fov >= 180 {
+		return p, fmt.Errorf("field of view %g not in [0,180)", p.fov)
+	}
+	var err error
+	if p.aspectW, p.aspectH, err = parseAspect(*c.aspect); err != nil {
+		return p, err
+	}
+	switch *c.projection {
+	case projectionPerspective:
+	case projectionEquirect:
+		p.spherical = true
+	default:
+		return p, fmt.Errorf("unknown camera projection %q", *c.projection)
+	}
+	switch *c.stereo {
+	case stereoNone:
+		p.eyes = []eye{{}}
+	case stereoSideBySide, stereoOverUnder:
+		p.eyes = []eye{
+			{name: *c.stereo + "-left", offset: -*c.ipd / 2},
+			{name: *c.stereo + "-right", offset: *c.ipd / 2},
+		}
+	default:
+		return p, fmt.Errorf("unknown stereo layout %q", *c.stereo)
+	}
+	if p.spherical && len(p.eyes) > 1 {
+		// Eyes moved sideways only have the right depth straight ahead
+		// in a 360 degree view, and the wrong depth behind.
+		return p, fmt.Errorf("stereo is not supported with the %s projection", projectionEquirect)
+	}
+	return p, nil
+}
+
+// eyePos returns where an eye of the camera is.
+func eyePos(cam dem.Camera, e eye) dem.Vertex {
+	if e.offset == 0 {
+		return cam.Pos
+	}
+	right := rightVector(cam.Angle)
+	return dem.Vertex{
+		X: cam.Pos.X + float32(e.offset*right.X),
+		Y: cam.Pos.Y + float32(e.offset*right.Y),
+		Z: cam.Pos.Z + float32(e.offset*right.Z),
+	}
+}
+
+// rightVector returns the unit vector to the right of a view with pitch,
+// yaw and roll angles, as Quake's AngleVectors.
+func rightVector(a dem.Vertex) sound.Vertex {
+	p := float64(a.X) * math.Pi / 180
+	y := float64(a.Y) * math.Pi / 180
+	r := float64(a.Z) * math.Pi / 180
+	return sound.Vertex{
+		X: -math.Sin(r)*math.Sin(p)*math.Cos(y) + math.Cos(r)*math.Sin(y),
+		Y: -math.Sin(r)*math.Sin(p)*math.Sin(y) - math.Cos(r)*math.Cos(y),
+		Z: -math.Sin(r) * math.Cos(p),
+	}
+}
+
+// director returns the director of the camera mode, or nil to use the view
+// of the demo.
+func (c *cameraFlags) director() (dem.Director, error) {
+	switch *c.mode {
+	case "demo":
+		return nil, nil
+	case "chase":
+		return dem.ChaseCamera{
+			Distance: *c.chaseDistance,
+			Height:   *c.chaseHeight,
+		}, nil
+	case "orbit":
+		center, err := parseVertex(*c.orbitCenter)
+		if err != nil {
+			return nil, fmt.Errorf("orbit center: %v", err)
+		}
+		return dem.OrbitCamera{
+			Center: center,
+			Radius: *c.orbitRadius,
+			Height: *c.orbitHeight,
+			Period: *c.orbitPeriod,
+		}, nil
+	case "path":
+		if *c.path == "" {
+			return nil, fmt.Errorf("path camera needs -camera_path")
+		}
+		f, err := os.Open(*c.path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		pc, err := dem.ParseCameraPath(f)
+		if err != nil {
+			return nil, fmt.Errorf("camera path %q: %v", *c.path, err)
+		}
+		return pc, nil
+	}
+	return nil, fmt.Errorf("unknown camera mode %q", *c.mode)
+}
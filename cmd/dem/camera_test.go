@@ -0,0 +1,137 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"flag"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+)
+
+func TestParseVertex(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want dem.Vertex
+		err  bool
+	}{
+		{"1,2,3", dem.Vertex{X: 1, Y: 2, Z: 3}, false},
+		{"-1.5, 0 ,1e2", dem.Vertex{X: -1.5, Z: 100}, false},
+		{"1,2", dem.Vertex{}, true},
+		{"1,2,x", dem.Vertex{}, true},
+	} {
+		got, err := parseVertex(test.in)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("parseVertex(%q): got %v %v, want %v, error %t", test.in, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestCameraProfile(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		want cameraProfile
+		err  bool
+	}{
+		{nil, cameraProfile{aspectW: 16, aspectH: 9, eyes: []eye{{}}}, false},
+		{
+			[]string{"-camera_fov", "90", "-camera_aspect", "2.35", "-camera_projection", "equirect"},
+			cameraProfile{fov: 90, aspectW: 2.35, aspectH: 1, spherical: true, eyes: []eye{{}}},
+			false,
+		},
+		{
+			[]string{"-camera_stereo", "sbs", "-camera_ipd", "3"},
+			cameraProfile{aspectW: 16, aspectH: 9, eyes: []eye{{"sbs-left", -1.5}, {"sbs-right", 1.5}}},
+			false,
+		},
+		{
+			[]string{"-camera_stereo", "ou", "-camera_aspect", "4:3"},
+			cameraProfile{aspectW: 4, aspectH: 3, eyes: []eye{{"ou-left", -1.25}, {"ou-right", 1.25}}},
+			false,
+		},
+		{[]string{"-camera_fov", "180"}, cameraProfile{}, true},
+		{[]string{"-camera_aspect", "16:0"}, cameraProfile{}, true},
+		{[]string{"-camera_aspect", "wide"}, cameraProfile{}, true},
+		{[]string{"-camera_projection", "fisheye"}, cameraProfile{}, true},
+		{[]string{"-camera_stereo", "anaglyph"}, cameraProfile{}, true},
+		{[]string{"-camera_projection", "equirect", "-camera_stereo", "sbs"}, cameraProfile{}, true},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		c := addCameraFlags(fs)
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.profile()
+		if (err != nil) != test.err {
+			t.Errorf("%q: got error %v, want error %t", test.args, err, test.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.args, got, test.want)
+		}
+	}
+}
+
+func TestEyePos(t *testing.T) {
+	for _, test := range []struct {
+		angle  dem.Vertex
+		offset float64
+		want   dem.Vertex
+	}{
+		{dem.Vertex{}, 0, dem.Vertex{X: 10, Y: 20, Z: 30}},
+		{dem.Vertex{}, 2, dem.Vertex{X: 10, Y: 18, Z: 30}},
+		{dem.Vertex{}, -2, dem.Vertex{X: 10, Y: 22, Z: 30}},
+		{dem.Vertex{X: 30, Y: 90}, 2, dem.Vertex{X: 12, Y: 20, Z: 30}},
+	} {
+		got := eyePos(dem.Camera{Pos: dem.Vertex{X: 10, Y: 20, Z: 30}, Angle: test.angle}, eye{offset: test.offset})
+		if math.Abs(float64(got.X-test.want.X)) > 1e-4 || math.Abs(float64(got.Y-test.want.Y)) > 1e-4 || math.Abs(float64(got.Z-test.want.Z)) > 1e-4 {
+			t.Errorf("angle %v offset %g: got %v, want %v", test.angle, test.offset, got, test.want)
+		}
+	}
+}
+
+func TestWritePOVCamera(t *testing.T) {
+	s := dem.NewState()
+	s.ServerInfo.Models = []string{"maps/e1m1.bsp"}
+	for _, test := range []struct {
+		name    string
+		fov     float64
+		profile cameraProfile
+		want    string
+	}{
+		{"default", 0, cameraProfile{}, "angle 100\n  location <0,0,0>\n  sky <0,0,1>\n  up <0,0,9>\n  right <-16,0,0>\n"},
+		{"profile", 0, cameraProfile{fov: 90, aspectW: 4, aspectH: 3}, "angle 90\n  location <0,0,0>\n  sky <0,0,1>\n  up <0,0,3>\n  right <-4,0,0>\n"},
+		{"camera fov", 60, cameraProfile{fov: 90, aspectW: 4, aspectH: 3}, "angle 60\n"},
+		{"equirect", 0, cameraProfile{spherical: true, aspectW: 2, aspectH: 1}, "spherical\n  angle 360 180\n  location <0,0,0>\n"},
+	} {
+		var b bytes.Buffer
+		job := &povJob{level: "maps/e1m1.bsp", prev: s, state: s, cam: dem.Camera{FOV: test.fov}}
+		if err := writePOV(&b, newModelCache(nil), job, frameOptions{camera: test.profile}); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !strings.Contains(b.String(), test.want) {
+			t.Errorf("%s: camera not %q in:\n%s", test.name, test.want, b.String())
+		}
+	}
+}
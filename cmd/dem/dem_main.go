@@ -21,7 +21,7 @@ package main
 //   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
 
 import (
-	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
@@ -38,6 +38,8 @@ import (
 	"github.com/ThomasHabets/qpov/pkg/bsp"
 	"github.com/ThomasHabets/qpov/pkg/dem"
 	"github.com/ThomasHabets/qpov/pkg/pak"
+	"github.com/ThomasHabets/qpov/pkg/particle"
+	"github.com/ThomasHabets/qpov/pkg/sound"
 )
 
 var (
@@ -53,7 +55,7 @@ var (
 func info(p pak.MultiPak, args ...string) {
 	fs := flag.NewFlagSet("info", flag.ExitOnError)
 	fs.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s -pak <pak0,pak1,...> info [options] <demofile.dem> \n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s -pak <pak0,pak1,...> info [options] <demofile.dem|.qwd|.mvd> \n", os.Args[0])
 		fs.PrintDefaults()
 	}
 	fs.Parse(args)
@@ -66,7 +68,10 @@ func info(p pak.MultiPak, args ...string) {
 	if err != nil {
 		log.Fatalf("Getting %q: %v", demo, err)
 	}
-	d := dem.Open(df)
+	d, err := openDemo(demo, df)
+	if err != nil {
+		log.Fatalf("Opening demo %q: %v", demo, err)
+	}
 
 	timeUpdates := 0
 	messages := 0
@@ -101,39 +106,113 @@ func info(p pak.MultiPak, args ...string) {
 	fmt.Printf("Time updates: %d\n", timeUpdates)
 }
 
-func genTimeFrames(from, to, fps float64) []float64 {
-	frames := []float64{}
-	frameTime := 1.0 / fps
-	frame := int(from / frameTime)
+// openDemo starts reading a demo, with the format chosen by file extension.
+func openDemo(fn string, r io.Reader) (*dem.Demo, error) {
+	switch strings.ToLower(path.Ext(fn)) {
+	case ".qwd":
+		return dem.OpenQW(r)
+	case ".mvd":
+		return dem.OpenMVD(r)
+	}
+	return dem.Open(r)
+}
+
+// readDemo opens a demo file, or a demo in the pak files.
+func readDemo(p pak.MultiPak, fn string) (*dem.Demo, error) {
+	data, err := readDemoFile(p, fn)
+	if err != nil {
+		return nil, err
+	}
+	return openDemo(fn, bytes.NewReader(data))
+}
+
+// applyDemo applies all messages of a demo to a new state, calling f
+// after each message is applied. It returns the final state.
+func applyDemo(d *dem.Demo, f func(dem.Message, *dem.State)) (*dem.State, error) {
+	s := dem.NewState()
 	for {
-		frameTime := float64(frame) / fps
-		if frameTime >= to {
-			return frames
+		block, err := d.ReadBlock()
+		if err == io.EOF {
+			return s, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := block.Messages()
+		if err != nil {
+			return nil, fmt.Errorf("getting messages: %v", err)
 		}
-		if frameTime >= from {
-			frames = append(frames, frameTime)
+		for _, msg := range msgs {
+			msg.Apply(s)
+			if f != nil {
+				f(msg, s)
+			}
 		}
-		frame++
 	}
 }
 
 func convert(p pak.MultiPak, args ...string) {
 	fs := flag.NewFlagSet("convert", flag.ExitOnError)
 	fs.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s -pak <pak0,pak1,...> convert [options] <demofile.dem> \n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s -pak <pak0,pak1,...> convert [options] <demofile.dem|.qwd|.mvd> \n", os.Args[0])
 		fs.PrintDefaults()
 	}
 	radiosity := fs.Bool("radiosity", false, "Use radiosity lighting.")
 	fps := fs.Float64("fps", 30.0, "Frames per second.")
+	motionBlurSamples := fs.Int("motion_blur", 1, "Samples per frame for motion blur, rendered as separate POV files for render to average. 1 means no motion blur.")
+	shutter := fs.Float64("shutter", 0.5, "Fraction of the frame interval that the shutter is open, with motion blur.")
 	outDir := fs.String("out", "render", "Output directory.")
 	cameraLight := fs.Bool("camera_light", false, "Add camera light.")
-	outputSound := fs.Bool("output_sound", true, "Output sounds to .wav file.")
+	outputSound := fs.Bool("output_sound", true, "Mix the sounds into sound.wav, aligned with the frames.")
+	soundVolume := fs.Float64("sound_volume", 0.7, "Volume of the sounds, as Quake's volume.")
+	musicDir := fs.String("music_dir", "", "Directory of CD tracks, named like track02.ogg, to mix into sound.wav.")
+	musicVolume := fs.Float64("music_volume", 1, "Volume of the music, as Quake's bgmvolume.")
+	ffmpeg := fs.String("ffmpeg", "ffmpeg", "Path to ffmpeg, for decoding music that isn't WAV.")
 	outputPOV := fs.Bool("output_pov", true, "Write POV files.")
+	concurrency := fs.Int("concurrency", -1, "Write this many POV files in parallel. <0 means set to number of CPUs.")
+	incremental := fs.Bool("incremental", false, "Only write POV files that changed since the last run, according to "+manifestFile+" in the output directory.")
+	mvdPlayer := fs.Int("mvd_player", 0, "Player slot to view MVD demos from.")
+	particles := fs.Bool("particles", true, "Simulate particle effects such as blood, explosions and trails.")
+	particleSeed := fs.Uint64("particle_seed", 0, "Random seed for particle effects.")
+	from := fs.Float64("from", 0, "Demo time in seconds to start rendering at.")
+	to := fs.Float64("to", math.Inf(1), "Demo time in seconds to stop rendering at.")
+	cameraSmoothing := fs.String("camera_smoothing", "linear", "How the camera moves between demo states: linear, spline or lowpass.")
+	cameraMode := addCameraFlags(fs)
+	povEntity := fs.Int("pov_entity", 0, "Entity to see the demo from, instead of the player that recorded it.")
+	povPlayer := fs.String("pov_player", "", "Name of the player to see the demo from, instead of the player that recorded it.")
+	drawViewWeapon := fs.Bool("view_weapon", true, "Draw the weapon in view, when seeing the demo as the player that recorded it.")
+	weaponSway := fs.Float64("weapon_sway", 1, "How much the weapon in view sways, as Quake's v_idlescale.")
+	viewBob := fs.Bool("view_bob", false, "Bob the view up and down when the player moves.")
+	viewRoll := fs.Bool("view_roll", false, "Roll the view when the player strafes.")
+	viewBlend := fs.Bool("view_blend", true, "Tint the view in water, slime and lava, when taking damage, picking things up and with powerups.")
+	drawHUD := fs.Bool("hud", false, "Write an overlay PNG per frame with the status bar and center prints of the player that recorded the demo, to put on top of the rendered frames.")
+	hudSize := fs.String("hud_size", "1600x900", "Size of the HUD overlays, as WxH. Should be the size of the rendered frames.")
 	fs.Parse(args)
 	if fs.NArg() == 0 {
 		log.Fatalf("Need to specify a demo name.")
 	}
 	demo := fs.Arg(0)
+	smoothing, err := dem.ParseCameraSmoothing(*cameraSmoothing)
+	if err != nil {
+		log.Fatal(err)
+	}
+	director, err := cameraMode.director()
+	if err != nil {
+		log.Fatal(err)
+	}
+	profile, err := cameraMode.profile()
+	if err != nil {
+		log.Fatal(err)
+	}
+	blur, err := newMotionBlur(*motionBlurSamples, *shutter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Rate of sub-frames, with motion blur.
+	frameRate := *fps
+	if blur != nil {
+		frameRate *= float64(blur.rate)
+	}
 
 	var df io.Reader
 	if _, err := os.Stat(demo); err == nil {
@@ -149,306 +228,272 @@ func convert(p pak.MultiPak, args ...string) {
 			log.Fatalf("Getting %q: %v", demo, err)
 		}
 	}
-	d := dem.Open(df)
+	d, err := openDemo(demo, df)
+	if err != nil {
+		log.Fatalf("Opening demo %q: %v", demo, err)
+	}
+	d.Track(*mvdPlayer)
 
-	var oldState *dem.State
-	newState := dem.NewState()
-	frameNum := 0
-	for {
-		block, err := d.ReadBlock()
-		if err == io.EOF {
-			break
+	mc := newModelCache(p)
+	var h *hud
+	if *drawHUD {
+		if h, err = loadHUD(p, *hudSize); err != nil {
+			log.Fatalf("Loading HUD: %v", err)
 		}
-		if err != nil {
-			log.Fatalf("Demo error: %v", err)
+	}
+	var pe *particleEffects
+	if *particles {
+		pe = newParticleEffects(*particleSeed)
+	}
+	// Particles at the first frame come from effects up to
+	// particle.MaxLife before it, so start playing that much earlier and
+	// only run the particles of the frames before it.
+	start := *from
+	if pe != nil && *outputPOV {
+		start = math.Max(0, *from-particle.MaxLife)
+	}
+	player, err := openPlayer(demo, d, df, start, frameRate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	player.To = *to
+	player.Smoothing = smoothing
+	player.Director = director
+	player.POVEntity = *povEntity
+	player.POVPlayer = *povPlayer
+	player.ViewBob = *viewBob
+	player.ViewRoll = *viewRoll
+	if *outputPOV {
+		player.LoadLevel = func(name string) (*bsp.BSP, error) {
+			bl, err := p.Get(name)
+			if err != nil {
+				return nil, fmt.Errorf("looking up %q: %w", name, err)
+			}
+			return bsp.Load(bl)
 		}
-		if !newState.CameraSetViewAngle {
-			newState.ViewAngle = block.Header.ViewAngle
+	}
+	var track *soundTrack
+	if *outputSound {
+		track = newSoundTrack(func(name string) (*sound.Sound, error) {
+			r, err := p.Get("sound/" + name)
+			if err != nil {
+				return nil, err
+			}
+			return sound.LoadWAV(r)
+		}, *fps)
+		track.thirdPerson = director != nil
+		track.mixer.Volume = *soundVolume
+		if *musicDir != "" {
+			ml := &musicLoader{dir: *musicDir, ffmpeg: *ffmpeg}
+			track.music = ml.load
+			track.musicVolume = *musicVolume
+			track.forceTrack = forcedTrack(d.CDTrack)
+		}
+	}
+	player.OnMessage = func(msg dem.Message, s *dem.State) {
+		if pe != nil {
+			pe.message(msg, s.Time)
+		}
+		if track != nil {
+			track.message(msg, s)
+		}
+		if !*verbose {
+			return
+		}
+		switch m := msg.(type) {
+		case *dem.MsgCameraPos:
+			fmt.Printf("Camera set to %d\n", m.Entity)
+		case *dem.MsgIntermission:
+			fmt.Printf("Intermission: %q\n", m.Text)
+		case *dem.MsgFinale:
+			fmt.Printf("Finale: %q\n", m.Text)
+		case *dem.MsgCameraOrientation:
+			fmt.Printf("Camera angle set to <%g,%g,%g>\n", m.X, m.Y, m.Z)
+		}
+	}
+	opts := frameOptions{
+		cameraLight: *cameraLight,
+		radiosity:   *radiosity,
+		thirdPerson: director != nil,
+		viewWeapon:  *drawViewWeapon && director == nil && *povEntity == 0 && *povPlayer == "",
+		weaponSway:  *weaponSway,
+		viewBob:     *viewBob,
+		viewBlend:   *viewBlend,
+		camera:      profile,
+	}
+	var fw *frameWriter
+	if *outputPOV {
+		if fw, err = newFrameWriter(mc, *outDir, opts, *concurrency, *incremental); err != nil {
+			log.Fatal(err)
 		}
-
-		seenTime := false
-		msgs, err := block.Messages()
+	}
+	for f, err := range player.Frames(frameRate) {
 		if err != nil {
-			log.Fatalf("Getting messages: %v", err)
+			log.Fatalf("Demo error: %v", err)
 		}
-		for _, msg := range msgs {
-			msg.Apply(newState)
-			if _, ok := msg.(*dem.MsgTime); ok {
-				seenTime = true
-			} else if m, ok := msg.(*dem.MsgCameraPos); ok {
-				if *verbose {
-					fmt.Printf("Camera set to %d\n", m.Entity)
-				}
-			} else if m, ok := msg.(*dem.MsgIntermission); ok {
-				if *verbose {
-					fmt.Printf("Intermission: %q\n", m.Text)
-				}
-			} else if m, ok := msg.(*dem.MsgFinale); ok {
-				if *verbose {
-					fmt.Printf("Finale: %q\n", m.Text)
-				}
-			} else if m, ok := msg.(*dem.MsgCameraOrientation); ok {
-				if *verbose {
-					fmt.Printf("Camera angle set to <%g,%g,%g>\n", m.X, m.Y, m.Z)
-				}
-			} else if m, ok := msg.(*dem.MsgSpawnBaseline); ok {
-				if false {
-					fmt.Printf("Spawning %d: %+v\n", m.Entity, newState.ServerInfo.Models[m.Model])
-				}
-			} else if m, ok := msg.(*dem.MsgPlaySound); ok {
-				if false {
-					fmt.Printf("Play sound %d: %+v at %f\n", m.Sound, newState.ServerInfo.Sounds[m.Sound], newState.Time)
-				}
-			} else if m, ok := msg.(*dem.MsgUpdate); ok {
-				if false {
-					debugEnt := uint16(1)
-					if m.Entity == debugEnt {
-						fmt.Printf("MOVE Frame %d Ent %d moved from %v %v to %v %v\n", frameNum, m.Entity,
-							oldState.Entities[m.Entity].Pos,
-							oldState.Entities[m.Entity].Angle,
-							newState.Entities[m.Entity].Pos,
-							newState.Entities[m.Entity].Angle,
-						)
-					}
-				}
+		num, sample := f.Num, -1
+		if blur != nil {
+			var sampled bool
+			if num, sample, sampled = blur.sample(f.Num); !sampled {
+				continue
 			}
 		}
-
-		if seenTime {
-			anyFrame := false
-			for n := range newState.Entities {
-				newState.Entities[n].Visible = newState.SeenEntity[uint16(n)]
-			}
-			newState.Entities[0].Visible = true // World.
-			if oldState != nil {
-				if *verbose {
-					fmt.Printf("Saw time, outputting frames between %g and %g\n",
-						oldState.Time,
-						newState.Time,
-					)
-				}
-				for _, t := range genTimeFrames(float64(oldState.Time), float64(newState.Time), *fps) {
-					// TODO: Only generate frames if client state is 2.
-					if *verbose {
-						log.Printf("Generating frame %d", frameNum)
-					}
-					if *outputPOV {
-						generateFrame(p, *outDir, oldState, newState, frameNum, t, *cameraLight, *radiosity)
-					}
-					anyFrame = true
-					frameNum++
-				}
+		if f.Time < *from {
+			pe.skip(mc, f.State)
+			continue
+		}
+		if fw != nil {
+			if *verbose {
+				log.Printf("Generating frame %d", f.Num)
 			}
-
-			// Only wipe old state if we generate any frame at all.
-			if oldState == nil || anyFrame {
-				oldState = newState.Copy()
-				newState.SeenEntity = make(map[uint16]bool)
+			generateFrame(mc, pe, fw, f, num, sample, opts)
+		}
+		if blur != nil {
+			// The rest is once per frame, at the time of the frame.
+			if sample != blur.samples/2 {
+				continue
 			}
+			frame := *f
+			frame.Num = num
+			f = &frame
 		}
-	}
-
-	if *outputSound {
-		fs, err := os.Create(path.Join(*outDir, "sound.sh"))
-		if err != nil {
-			log.Fatalf("Failed to open sounds script: %v", err)
+		if track != nil {
+			track.frame(f)
 		}
-		defer fs.Close()
-		var files []string
-		var delays []string
-		for _, s := range newState.Sounds {
-			files = append(files, newState.ServerInfo.Sounds[s.Sound.Sound])
-			delays = append(delays, fmt.Sprint(s.Time))
+		if h != nil {
+			if err := h.writeFrame(*outDir, f); err != nil {
+				log.Fatalf("Writing HUD of frame %d: %v", f.Num, err)
+			}
 		}
-		fmt.Fprintf(fs, "sox -M %s -b 16 -c 1 -r 44100 out.wav delay %s remix -p - trim 1.5\n", strings.Join(files, " "), strings.Join(delays, " "))
-	}
-}
-
-func interpolate(v0, v1 dem.Vertex, t float64) dem.Vertex {
-	return dem.Vertex{
-		X: float32(float64(v0.X) + t*float64(v1.X-v0.X)),
-		Y: float32(float64(v0.Y) + t*float64(v1.Y-v0.Y)),
-		Z: float32(float64(v0.Z) + t*float64(v1.Z-v0.Z)),
 	}
-}
-
-func posAngle(x float32) float32 {
-	if x < 0 {
-		return x + 360
+	if fw != nil {
+		if err := fw.close(); err != nil {
+			log.Fatalf("Writing frames: %v", err)
+		}
 	}
-	return x
-}
-
-func interA(a, b, t float64) float64 {
-	switch {
-	case math.Abs(float64(b-a)) < 180:
-		return a + t*(b-a)
-	case a > b:
-		b += 360
-		return a + t*(b-a)
-	default:
-		a += 360
-		return a + t*(b-a)
+	if track != nil {
+		if err := track.writeFile(path.Join(*outDir, "sound.wav")); err != nil {
+			log.Fatalf("Writing sound: %v", err)
+		}
 	}
 }
 
-func interpolateAngle(v0, v1 dem.Vertex, t float64) dem.Vertex {
-	a := dem.Vertex{
-		X: posAngle(v0.X),
-		Y: posAngle(v0.Y),
-		Z: posAngle(v0.Z),
+// openPlayer returns a player of the demo starting at time from. The demo
+// is skipped ahead to it using an index, if the demo format allows it.
+func openPlayer(fn string, d *dem.Demo, r io.Reader, from, fps float64) (*dem.Player, error) {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok || from <= 0 || strings.ToLower(path.Ext(fn)) != ".dem" {
+		p := dem.NewPlayer(d)
+		p.From = from
+		return p, nil
 	}
-	b := dem.Vertex{
-		X: posAngle(v1.X),
-		Y: posAngle(v1.Y),
-		Z: posAngle(v1.Z),
+	ix, err := dem.NewIndex(rs)
+	if err != nil {
+		return nil, fmt.Errorf("indexing demo %q: %w", fn, err)
 	}
-
-	var ret dem.Vertex
-	ret.X = float32(interA(float64(a.X), float64(b.X), t))
-	ret.Y = float32(interA(float64(a.Y), float64(b.Y), t))
-	ret.Z = float32(interA(float64(a.Z), float64(b.Z), t))
-	if true {
-		for ret.X > 180 {
-			ret.X -= 360
-		}
-		for ret.Y > 180 {
-			ret.Y -= 360
-		}
-		for ret.Z > 180 {
-			ret.Z -= 360
-		}
+	p, err := dem.NewPlayerAt(ix, from, fps)
+	if err != nil {
+		return nil, fmt.Errorf("seeking to %gs: %w", from, err)
 	}
-	return ret
+	return p, nil
 }
 
-// return true if object is moving too fast to be interpolated, and should instead jump into place.
-// This is for teleportations.
-func tooFast(s0, s1 *dem.State) bool {
-	const maxSpeed = 50.0
-	const maxAngleSpeed = 45.0
-	dx := math.Abs(float64(s0.Entities[s0.CameraEnt].Pos.X - s1.Entities[s1.CameraEnt].Pos.X))
-	dy := math.Abs(float64(s0.Entities[s0.CameraEnt].Pos.Y - s1.Entities[s1.CameraEnt].Pos.Y))
-	dz := math.Abs(float64(s0.Entities[s0.CameraEnt].Pos.Z - s1.Entities[s1.CameraEnt].Pos.Z))
-	if speed := math.Sqrt(dx*dx + dy*dy + dz*dz); speed > maxSpeed {
-		if false {
-			fmt.Printf("Speed %g %v %v\n", speed, s0.Entities[s0.CameraEnt].Pos, s1.Entities[s1.CameraEnt].Pos)
-		}
-		return true
-	}
-	dx = math.Abs(float64(s0.ViewAngle.X - s1.ViewAngle.X))
-	dy = math.Abs(float64(s0.ViewAngle.Y - s1.ViewAngle.Y))
-	dz = math.Abs(float64(s0.ViewAngle.Z - s1.ViewAngle.Z))
-	if speed := math.Sqrt(dx*dx + dy*dy + dz*dz); speed > maxAngleSpeed {
-		if false {
-			fmt.Printf("Angular speed %g\n", speed)
-		}
-		return true
-	}
-	return false
+// frameOptions are how convert writes frames.
+type frameOptions struct {
+	cameraLight bool
+	radiosity   bool
+	thirdPerson bool    // The camera is not at the camera entity, so draw it.
+	viewWeapon  bool    // Draw the weapon in view.
+	weaponSway  float64 // Idle sway of the weapon in view, as Quake's v_idlescale.
+	viewBob     bool    // The camera bobs.
+	viewBlend   bool    // Tint the view in liquids, and from flashes and powerups.
+	camera      cameraProfile
 }
 
-// generateFrame generates frame number `frameNum`
-func generateFrame(p pak.MultiPak, outDir string, oldState, newState *dem.State, frameNum int, t float64, cameraLight, radiosity bool) {
-	if newState.ServerInfo.Models == nil {
+// generateFrame does the parts of writing the POV file of a frame that
+// depend on earlier frames, and leaves the rest to the frame writer.
+// The frame is written once per eye, as sample of the frame number num if
+// motion blurred.
+func generateFrame(mc *modelCache, pe *particleEffects, fw *frameWriter, f *dem.Frame, num, sample int, opts frameOptions) {
+	if f.State.ServerInfo.Models == nil {
 		return
 	}
-	if newState.Level == nil {
-
-		bl, err := p.Get(newState.ServerInfo.Models[0])
-		if err != nil {
-			log.Fatalf("Looking up %q: %v", newState.ServerInfo.Models[0], err)
-		}
-		newState.Level, err = bsp.Load(bl)
-		if err != nil {
-			log.Fatalf("Level loading %q: %v", newState.ServerInfo.Models[0], err)
-		}
-		// TODO
-		//log.Printf("Level start pos: %s", newState.Level.StartPos.String())
-		//d.Pos().X = level.StartPos.X
-		//d.Pos().Y = level.StartPos.Y
-		//d.Pos().Z = level.StartPos.Z
-	}
-	ival := float64(t-oldState.Time) / float64(newState.Time-oldState.Time)
-	curState := newState.Copy()
-	curState.Time = t
-	curState.ViewAngle = interpolateAngle(oldState.ViewAngle, newState.ViewAngle, ival)
-	if tooFast(oldState, newState) { //, float64(newState.Time-oldState.Time)) {
-		if false {
-			fmt.Printf("Frame %d: Moving too fast, snapping.\n", frameNum)
-		}
-		if ival < 0.5 {
-			curState.ViewAngle = oldState.ViewAngle
-			curState.Entities[curState.CameraEnt].Pos = oldState.Entities[curState.CameraEnt].Pos
-		} else {
-			curState.ViewAngle = newState.ViewAngle
-			curState.Entities[curState.CameraEnt].Pos = newState.Entities[curState.CameraEnt].Pos
-		}
+	applyModelFlags(mc, f.State)
+	job := povJob{
+		level: f.State.ServerInfo.Models[0],
+		prev:  f.Prev,
+		state: f.State,
 	}
-	for n := range oldState.Entities {
-		if oldState.Entities[n].Model != newState.Entities[n].Model {
-			// If model has changed, choose nearest and stop.
-			if ival < 0.5 {
-				curState.Entities[n] = oldState.Entities[n]
-			} else {
-				curState.Entities[n] = newState.Entities[n]
-			}
-			continue
-		}
-		curState.Entities[n].Model = oldState.Entities[n].Model
-		curState.Entities[n].Pos = interpolate(oldState.Entities[n].Pos, newState.Entities[n].Pos, ival)
-		if false && n == 8 {
-			fmt.Printf("Frame %d, ent %d %v (%v -> %v by %g)\n", frameNum, n,
-				curState.Entities[n].Pos.String(),
-				oldState.Entities[n].Pos.String(),
-				newState.Entities[n].Pos.String(),
-				ival,
-			)
-		}
-		curState.Entities[n].Angle = interpolateAngle(oldState.Entities[n].Angle, newState.Entities[n].Angle, ival)
-		if ival < 0.5 {
-			curState.Entities[n].Frame = oldState.Entities[n].Frame
-			curState.Entities[n].Skin = oldState.Entities[n].Skin
-			curState.Entities[n].Color = oldState.Entities[n].Color
-		} else {
-			curState.Entities[n].Frame = newState.Entities[n].Frame
-			curState.Entities[n].Skin = newState.Entities[n].Skin
-			curState.Entities[n].Color = newState.Entities[n].Color
-		}
+	if pe != nil {
+		pe.frame(mc, f.State)
+		var b strings.Builder
+		pe.write(&b, f.State)
+		job.particles = &b
 	}
 	if *verbose {
-		fmt.Printf("Frame %d (t=%g): Pos: %v (%v -> %v, %g), viewAngle %v (%v -> %v)\n", frameNum, curState.Time,
-			curState.Entities[curState.CameraEnt].Pos,
-			oldState.Entities[curState.CameraEnt].Pos,
-			newState.Entities[curState.CameraEnt].Pos,
-			ival,
-			curState.ViewAngle,
-			oldState.ViewAngle,
-			newState.ViewAngle,
+		fmt.Printf("Frame %d (t=%g): Pos: %v (%v -> %v), viewAngle %v (%v -> %v)\n", f.Num, f.Time,
+			f.Camera.Pos,
+			f.Prev.Entities[f.State.CameraEnt].Pos,
+			f.Next.Entities[f.State.CameraEnt].Pos,
+			f.Camera.Angle,
+			f.Prev.ViewAngle,
+			f.Next.ViewAngle,
 		)
 	}
-	writePOV(path.Join(outDir, fmt.Sprintf("frame-%08d.pov", frameNum)), newState.ServerInfo.Models[0], curState, cameraLight, radiosity)
+	if opts.viewWeapon {
+		job.weapon = viewWeapon(f, opts.weaponSway, opts.viewBob)
+	}
+	eyes := opts.camera.eyes
+	if len(eyes) == 0 {
+		eyes = []eye{{}}
+	}
+	for _, e := range eyes {
+		j := job
+		j.fn = povName(num, e.name, sample)
+		j.cam = f.Camera
+		j.cam.Pos = eyePos(f.Camera, e)
+		fw.add(&j)
+	}
+}
+
+var (
+	frameNameRE  = regexp.MustCompile(`[/.-]`)
+	brushModelRE = regexp.MustCompile(`^\*(\d+)$`)
+	povTemplate  = template.Must(template.New("header").Parse(`
+{{$root := .}}
+#version {{.Version}};
+#include "rad_def.inc"
+global_settings {
+  assumed_gamma {{.Gamma}}
+  {{ if .Radiosity }}radiosity { Rad_Settings(Radiosity_Normal,off,off)}{{ end }}
+}
+#declare {{.LightStyleArray}} = array[{{len .LightStyles}}] { {{- range $i, $b := .LightStyles}}{{if $i}},{{end}}{{$b}}{{end -}} }
+#include "{{.Prefix}}progs/soldier.mdl/model.inc"
+#include "{{.Prefix}}{{.Level}}/level.inc"
+{{ range .Models }}#include "{{$root.Prefix}}{{ . }}"
+{{ end }}
+camera {
+  {{ if .Spherical }}spherical
+  angle 360 180{{ else }}angle {{.FOV}}{{ end }}
+  location <0,0,0>
+  sky <0,0,1>
+  up <0,0,{{.Up}}>
+  right <-{{.Right}},0,0>
+  look_at <{{.LookAt}}>
+  rotate <{{.AngleX}},0,0>
+  rotate <0,{{.AngleY}},0>
+  rotate <0,0,{{.AngleZ}}>
+  translate <{{.Pos}}>
 }
+`))
+)
 
 func frameName(mf string, frame int) string {
-	s := mf
-	re := regexp.MustCompile(`[/.-]`)
-	s = re.ReplaceAllString(s, "_")
+	s := frameNameRE.ReplaceAllString(mf, "_")
 	return fmt.Sprintf("demprefix_%s_%d", s, frame)
 }
 
 func validModel(m string) bool {
-	// These have grouped frames. Not yet handled.
-	if strings.Contains(m, "flame.mdl") {
-		return false
-	}
-	if strings.Contains(m, "flame2.mdl") {
-		return false
-	}
-	if strings.Contains(m, "w_spike.mdl") {
-		return false
-	}
-
 	if strings.HasSuffix(m, ".mdl") {
 		return true
 	}
@@ -458,24 +503,20 @@ func validModel(m string) bool {
 	return false
 }
 
-func writePOV(fn, texturesPath string, state *dem.State, cameraLight, radiosity bool) {
-	ufo, err := os.Create(fn)
-	if err != nil {
-		log.Fatalf("Creating %q: %v", fn, err)
-	}
-	defer ufo.Close()
-	fo := bufio.NewWriter(ufo)
-	defer fo.Flush()
-
+// writePOV writes the POV file of a frame. It doesn't change anything,
+// so frames can be written in parallel.
+func writePOV(fo io.Writer, mc *modelCache, job *povJob, opts frameOptions) error {
+	texturesPath := job.level
+	prev, state, cam := job.prev, job.state, job.cam
 	lookAt := bsp.Vertex{
 		X: 1,
 		Y: 0,
 		Z: 0,
 	}
 	pos := bsp.Vertex{
-		X: state.Entities[state.CameraEnt].Pos.X,
-		Y: state.Entities[state.CameraEnt].Pos.Y,
-		Z: state.Entities[state.CameraEnt].Pos.Z,
+		X: cam.Pos.X,
+		Y: cam.Pos.Y,
+		Z: cam.Pos.Z,
 	}
 
 	models := []string{}
@@ -492,37 +533,19 @@ func writePOV(fn, texturesPath string, state *dem.State, cameraLight, radiosity
 			}
 		}
 	}
-	eyeLevel := bsp.Vertex{
-		Z: 10,
+	fov := cam.FOV
+	if fov == 0 {
+		fov = opts.camera.fov
+	}
+	right, up := opts.camera.aspectW, opts.camera.aspectH
+	if right == 0 || up == 0 {
+		right, up = 16, 9
+	}
+	if fov == 0 {
+		fov = dem.DefaultFOV
 	}
 
-	tmpl := template.Must(template.New("header").Parse(`
-{{$root := .}}
-#version {{.Version}};
-#include "rad_def.inc"
-global_settings {
-  assumed_gamma {{.Gamma}}
-  {{ if .Radiosity }}radiosity { Rad_Settings(Radiosity_Normal,off,off)}{{ end }}
-}
-#include "{{.Prefix}}progs/soldier.mdl/model.inc"
-#include "{{.Prefix}}{{.Level}}/level.inc"
-{{ range .Models }}#include "{{$root.Prefix}}{{ . }}"
-{{ end }}
-camera {
-  angle 100
-  location <0,0,0>
-  sky <0,0,1>
-  up <0,0,9>
-  right <-16,0,0>
-  look_at <{{.LookAt}}>
-  rotate <{{.AngleX}},0,0>
-  rotate <0,{{.AngleY}},0>
-  rotate <0,0,{{.AngleZ}}>
-  translate <{{.Pos}}>
-  translate <{{.EyeLevel}}>
-}
-`))
-	if err := tmpl.Execute(fo, struct {
+	if err := povTemplate.Execute(fo, struct {
 		Gamma                  float64
 		Prefix                 string
 		Version                string
@@ -531,86 +554,138 @@ camera {
 		Pos                    string
 		LookAt                 string
 		Level                  string
-		EyeLevel               string
+		FOV                    float64
+		Spherical              bool
+		Up, Right              float64
 		Models                 []string
+		LightStyleArray        string
+		LightStyles            []float64
 	}{
 		Prefix:    *prefix,
 		Version:   *version,
 		Gamma:     *gamma,
-		Radiosity: radiosity,
+		Radiosity: opts.radiosity,
 		Level:     state.ServerInfo.Models[0],
 		Models:    models,
 		LookAt:    lookAt.String(),
-		AngleX:    float64(state.ViewAngle.Z),
-		AngleY:    float64(state.ViewAngle.X),
-		AngleZ:    float64(state.ViewAngle.Y),
+		AngleX:    float64(cam.Angle.Z),
+		AngleY:    float64(cam.Angle.X),
+		AngleZ:    float64(cam.Angle.Y),
 		Pos:       pos.String(),
-		EyeLevel:  eyeLevel.String(),
+		FOV:       fov,
+		Spherical: opts.camera.spherical,
+		Up:        up,
+		Right:     right,
+
+		LightStyleArray: bsp.LightStyleArray,
+		LightStyles:     lightStyles(state),
 	}); err != nil {
-		log.Fatalf("Executing template: %v", err)
+		return fmt.Errorf("executing template: %v", err)
 	}
-	re := regexp.MustCompile(`^\*(\d+)$`)
+	contents := state.ViewContents(cam.Pos)
+	writeFog(fo, state, contents)
 	for _, e := range state.Entities {
 		if !e.Visible {
 			continue
 		}
 		nm := e.Model
+		if int(nm) >= len(state.ServerInfo.Models) {
+			continue
+		}
 		mod := state.ServerInfo.Models[nm]
-		m := re.FindStringSubmatch(mod)
+		m := brushModelRE.FindStringSubmatch(mod)
 		if len(m) == 2 {
 			i, _ := strconv.Atoi(m[1])
 			fmt.Fprintf(fo, "%s_%d(<%v>,<0,0,0>,\"%s\")\n", bsp.ModelMacroPrefix(state.ServerInfo.Models[0]), i, e.Pos.String(), *prefix+texturesPath)
 		}
 	}
 
-	if cameraLight {
-		fmt.Fprintf(fo, "light_source { <%s> rgb<1,1,1> translate <%s> }\n", pos.String(), eyeLevel.String())
+	if opts.cameraLight {
+		fmt.Fprintf(fo, "light_source { <%s> rgb<1,1,1> }\n", pos.String())
+	}
+	if opts.viewBlend {
+		// Flashes and powerups are only seen through the eyes of the player.
+		blend := dem.ContentsBlend(contents)
+		if !opts.thirdPerson {
+			blend = state.ViewBlend(contents)
+		}
+		writeViewBlend(fo, cam.Pos, blend)
 	}
 	if *entities {
 		for n, e := range state.Entities {
-			if !e.Visible {
-				continue
-			}
-			if int(state.CameraEnt) == n {
-				continue
-			}
-			if e.Model == 0 {
-				// Unused.
-				continue
-			}
-			if int(e.Model) >= len(state.ServerInfo.Models) {
-				// TODO: this is dynamic entities?
+			if int(state.CameraEnt) == n && !opts.thirdPerson {
 				continue
 			}
-			name := state.ServerInfo.Models[e.Model]
-			frame := int(e.Frame)
-
-			//log.Printf("Entity %d has model %d of %d", n, e.Model, len(d.ServerInfo.Models))
-			//log.Printf("  Name: %q", d.ServerInfo.Models[e.Model])
-			if validModel(state.ServerInfo.Models[e.Model]) {
-				a := e.Angle
-				a.X, a.Y, a.Z = a.Z, a.X, a.Y
-				modelName := state.ServerInfo.Models[e.Model]
-				if strings.HasSuffix(modelName, ".mdl") {
-					useTextures := true // TODO
-					if useTextures {
-						skinName := path.Join(name, fmt.Sprintf("skin_%v.png", e.Skin))
-						fmt.Fprintf(fo, "// Entity %d\n%s(<%s>,<%s>,\"%s\")\n", n, frameName(name, frame), e.Pos.String(), a.String(), *prefix+skinName)
-					} else {
-						fmt.Fprintf(fo, "// Entity %d\n%s(<%s>,<%s>)\n", n, frameName(name, frame), e.Pos.String(), a.String())
-					}
-				} else if strings.HasSuffix(state.ServerInfo.Models[e.Model], ".bsp") {
-					fmt.Fprintf(fo, "// BSP Entity %d\n%s_0(<%s>,<%s>, \"%s\")\n", n, bsp.ModelMacroPrefix(modelName), e.Pos.String(), a.String(), *prefix+modelName)
-				}
+			writeEntity(fo, mc, state, fmt.Sprintf("Entity %d", n), &e)
+		}
+		for n, e := range state.StaticEntities {
+			writeEntity(fo, mc, state, fmt.Sprintf("Static entity %d", n), &e)
+		}
+		if job.weapon != nil {
+			writeEntity(fo, mc, state, "View weapon", job.weapon)
+		}
+		if job.particles != nil {
+			// Trails are particles.
+			writeModelEffects(fo, mc, nil, state)
+			io.WriteString(fo, job.particles.String())
+		} else {
+			writeModelEffects(fo, mc, prev, state)
+		}
+		writeTempEntities(fo, state)
+		writeEntityLights(fo, state)
+	}
+	return nil
+}
 
-			}
+// lightStyles returns the brightness of all light styles at the time of the state.
+func lightStyles(state *dem.State) []float64 {
+	ret := make([]float64, dem.MaxLightStyles)
+	for n := range ret {
+		ret[n] = state.LightStyle(n)
+	}
+	return ret
+}
+
+// writeEntity writes an entity model, if it's visible.
+func writeEntity(w io.Writer, mc *modelCache, state *dem.State, comment string, e *dem.Entity) {
+	if !e.Visible {
+		return
+	}
+	if e.Model == 0 {
+		// Unused.
+		return
+	}
+	if e.Opacity() == 0 {
+		// FitzQuake fully transparent entity.
+		return
+	}
+	if int(e.Model) >= len(state.ServerInfo.Models) {
+		// TODO: this is dynamic entities?
+		return
+	}
+	name := state.ServerInfo.Models[e.Model]
+	if !validModel(name) {
+		return
+	}
+	a := e.Angle
+	a.X, a.Y, a.Z = a.Z, a.X, a.Y
+	if strings.HasSuffix(name, ".mdl") {
+		frame := mc.Pose(name, int(e.Frame), state.Time)
+		useTextures := true // TODO
+		if useTextures {
+			skinName := path.Join(name, fmt.Sprintf("skin_%v.png", e.Skin))
+			fmt.Fprintf(w, "// %s\n%s(<%s>,<%s>,\"%s\")\n", comment, frameName(name, frame), e.Pos.String(), a.String(), *prefix+skinName)
+		} else {
+			fmt.Fprintf(w, "// %s\n%s(<%s>,<%s>)\n", comment, frameName(name, frame), e.Pos.String(), a.String())
 		}
+	} else if strings.HasSuffix(name, ".bsp") {
+		fmt.Fprintf(w, "// BSP %s\n%s_0(<%s>,<%s>, \"%s\")\n", comment, bsp.ModelMacroPrefix(name), e.Pos.String(), a.String(), *prefix+name)
 	}
 }
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s [global options] command [options]\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "Commands:\n  info\n  convert\nGlobal options:\n")
+	fmt.Fprintf(os.Stderr, "Commands:\n  info\n  players\n  subtitles\n  events\n  convert\n  cut\n  trim\n  concat\nGlobal options:\n")
 	flag.PrintDefaults()
 }
 
@@ -646,6 +721,18 @@ func main() {
 		convert(p, args...)
 	case "info":
 		info(p, args...)
+	case "players":
+		players(p, args...)
+	case "subtitles":
+		subtitles(p, args...)
+	case "events":
+		events(p, args...)
+	case "cut":
+		cut(p, args...)
+	case "trim":
+		trim(p, args...)
+	case "concat":
+		concat(p, args...)
 	default:
 		log.Fatalf("Unknown command %q", cmd)
 	}
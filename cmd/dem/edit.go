@@ -0,0 +1,404 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+	"github.com/ThomasHabets/qpov/pkg/pak"
+)
+
+// readDemoFile reads a demo from disk, or from the pakfiles if it's not on disk.
+func readDemoFile(p pak.MultiPak, fn string) ([]byte, error) {
+	if _, err := os.Stat(fn); err == nil {
+		return os.ReadFile(fn)
+	}
+	r, err := p.Get(fn)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// openEditDemo opens a demo that is to be written back out.
+func openEditDemo(p pak.MultiPak, fn string) (*dem.Demo, error) {
+	if ext := strings.ToLower(path.Ext(fn)); ext != ".dem" {
+		return nil, fmt.Errorf("can only edit .dem demos, not %q", ext)
+	}
+	data, err := readDemoFile(p, fn)
+	if err != nil {
+		return nil, err
+	}
+	return dem.Open(bytes.NewReader(data))
+}
+
+// createOutput creates the output demo file, and returns a function that
+// closes it.
+func createOutput(fn string) (*bufio.Writer, func()) {
+	f, err := os.Create(fn)
+	if err != nil {
+		log.Fatalf("Creating %q: %v", fn, err)
+	}
+	w := bufio.NewWriter(f)
+	return w, func() {
+		if err := w.Flush(); err != nil {
+			log.Fatalf("Writing %q: %v", fn, err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatalf("Closing %q: %v", fn, err)
+		}
+	}
+}
+
+// blockTime returns the time of the last time message in the block, if any.
+func blockTime(msgs []dem.Message) (float64, bool) {
+	t, ok := 0.0, false
+	for _, msg := range msgs {
+		if m, isTime := msg.(*dem.MsgTime); isTime {
+			t, ok = float64(*m), true
+		}
+	}
+	return t, ok
+}
+
+// endsSignon returns true if the block finishes the signon of the client.
+// Blocks up to and including this one hold the level and baseline state.
+func endsSignon(msgs []dem.Message) bool {
+	for _, msg := range msgs {
+		if m, ok := msg.(*dem.MsgClientState); ok && m.State == 3 {
+			return true
+		}
+	}
+	return false
+}
+
+// persistent returns true for messages that change state that lasts beyond
+// the block they're in, and therefore needs to be kept when cutting away the
+// start of a demo.
+func persistent(msg dem.Message) bool {
+	switch msg.(type) {
+	case *dem.MsgLightStyle, *dem.MsgPlayerName, *dem.MsgFrags, *dem.MsgSetColors,
+		*dem.MsgSpawnStatic, *dem.MsgSpawnStaticSound, *dem.MsgSpawnBaseline,
+		*dem.MsgCDTrack, *dem.MsgFog, *dem.MsgSkybox, *dem.MsgPlayerState,
+		*dem.MsgKilledMonster, *dem.MsgFoundSecret, *dem.MsgCameraPos:
+		return true
+	}
+	return false
+}
+
+type editBlock struct {
+	header dem.BlockHeader
+	msgs   []dem.Message
+}
+
+// cutDemo writes the part of the demo between from and to seconds.
+// The signon blocks are always kept, as are messages before the cut that
+// change persistent state. The time of the kept part is rebased to start
+// right after the signon.
+func cutDemo(w io.Writer, d *dem.Demo, from, to float64) error {
+	out, err := dem.NewWriter(w, d.CDTrack)
+	if err != nil {
+		return err
+	}
+	var signon []editBlock
+	var carry []dem.Message
+	inSignon := true
+	signonTime := 0.0
+	started := false
+	shift := 0.0
+	var last dem.BlockHeader
+	for {
+		block, err := d.ReadBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		msgs, err := block.Messages()
+		if err != nil {
+			return err
+		}
+		last = block.Header
+		t, hasTime := blockTime(msgs)
+
+		if started {
+			if hasTime && t > to {
+				break
+			}
+			for n, msg := range msgs {
+				switch m := msg.(type) {
+				case *dem.ServerInfo:
+					// New level, with its own time.
+					shift = 0
+				case *dem.MsgTime:
+					nt := dem.MsgTime(float64(*m) - shift)
+					msgs[n] = &nt
+				}
+			}
+			if err := out.WriteBlock(block.Header, msgs); err != nil {
+				return fmt.Errorf("block %d: %w", block.Num, err)
+			}
+			continue
+		}
+
+		for _, msg := range msgs {
+			if _, ok := msg.(*dem.ServerInfo); ok {
+				signon, carry = nil, nil
+				inSignon = true
+				signonTime = 0
+			}
+		}
+		if inSignon {
+			signon = append(signon, editBlock{block.Header, msgs})
+			if hasTime {
+				signonTime = t
+			}
+			inSignon = !endsSignon(msgs)
+			continue
+		}
+		if !hasTime || t < from {
+			for _, msg := range msgs {
+				if persistent(msg) {
+					carry = append(carry, msg)
+				}
+			}
+			continue
+		}
+
+		// First block to keep.
+		if t > to {
+			break
+		}
+		for _, b := range signon {
+			if err := out.WriteBlock(b.header, b.msgs); err != nil {
+				return fmt.Errorf("signon: %w", err)
+			}
+		}
+		if len(carry) > 0 {
+			if err := out.WriteBlock(signon[len(signon)-1].header, carry); err != nil {
+				return fmt.Errorf("carried state: %w", err)
+			}
+		}
+		started = true
+		shift = t - signonTime
+		for n, msg := range msgs {
+			if m, ok := msg.(*dem.MsgTime); ok {
+				nt := dem.MsgTime(float64(*m) - shift)
+				msgs[n] = &nt
+			}
+		}
+		if err := out.WriteBlock(block.Header, msgs); err != nil {
+			return fmt.Errorf("block %d: %w", block.Num, err)
+		}
+	}
+	if !started {
+		return fmt.Errorf("no gameplay between %gs and %gs", from, to)
+	}
+	return out.WriteBlock(last, []dem.Message{&dem.MsgDisconnect{}})
+}
+
+// gameplayTimes returns the first and last time of the gameplay of a demo.
+func gameplayTimes(d *dem.Demo) (float64, float64, error) {
+	first, last := math.NaN(), 0.0
+	inSignon := true
+	for {
+		block, err := d.ReadBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		msgs, err := block.Messages()
+		if err != nil {
+			return 0, 0, err
+		}
+		if inSignon {
+			inSignon = !endsSignon(msgs)
+			continue
+		}
+		if t, ok := blockTime(msgs); ok {
+			if math.IsNaN(first) {
+				first = t
+			}
+			last = t
+		}
+	}
+	if math.IsNaN(first) {
+		return 0, 0, fmt.Errorf("no gameplay in demo")
+	}
+	return first, last, nil
+}
+
+// concatDemos writes the demos one after the other. The time of each demo
+// is rebased to continue where the one before it ended, so that playback
+// doesn't wait for the clock of the next demo to catch up.
+func concatDemos(w io.Writer, demos []*dem.Demo) error {
+	if len(demos) == 0 {
+		return fmt.Errorf("no demos to join")
+	}
+	out, err := dem.NewWriter(w, demos[0].CDTrack)
+	if err != nil {
+		return err
+	}
+	end := math.Inf(-1)
+	for n, d := range demos {
+		lastDemo := n == len(demos)-1
+		shift := math.NaN()
+		for {
+			block, err := d.ReadBlock()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("demo %d: %w", n, err)
+			}
+			msgs, err := block.Messages()
+			if err != nil {
+				return fmt.Errorf("demo %d: %w", n, err)
+			}
+			if !lastDemo {
+				var keep []dem.Message
+				for _, msg := range msgs {
+					if _, ok := msg.(*dem.MsgDisconnect); !ok {
+						keep = append(keep, msg)
+					}
+				}
+				if len(keep) == 0 {
+					continue
+				}
+				msgs = keep
+			}
+			for i, msg := range msgs {
+				m, ok := msg.(*dem.MsgTime)
+				if !ok {
+					continue
+				}
+				if math.IsNaN(shift) {
+					shift = 0
+					if n > 0 {
+						shift = end - float64(*m)
+					}
+				}
+				nt := dem.MsgTime(float64(*m) + shift)
+				msgs[i] = &nt
+				end = math.Max(end, float64(nt))
+			}
+			if err := out.WriteBlock(block.Header, msgs); err != nil {
+				return fmt.Errorf("demo %d block %d: %w", n, block.Num, err)
+			}
+		}
+	}
+	return nil
+}
+
+func cut(p pak.MultiPak, args ...string) {
+	fs := flag.NewFlagSet("cut", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -pak <pak0,pak1,...> cut [options] <demofile.dem>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	from := fs.Float64("from", 0, "Demo time in seconds to start at.")
+	to := fs.Float64("to", math.Inf(1), "Demo time in seconds to end at.")
+	out := fs.String("out", "cut.dem", "Output demo file.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalf("Need to specify one demo name.")
+	}
+	demo := fs.Arg(0)
+	d, err := openEditDemo(p, demo)
+	if err != nil {
+		log.Fatalf("Opening demo %q: %v", demo, err)
+	}
+	w, done := createOutput(*out)
+	if err := cutDemo(w, d, *from, *to); err != nil {
+		log.Fatalf("Cutting %q: %v", demo, err)
+	}
+	done()
+}
+
+func trim(p pak.MultiPak, args ...string) {
+	fs := flag.NewFlagSet("trim", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -pak <pak0,pak1,...> trim [options] <demofile.dem>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	start := fs.Float64("start", 0, "Seconds to remove from the start of the gameplay.")
+	end := fs.Float64("end", 0, "Seconds to remove from the end of the gameplay.")
+	out := fs.String("out", "trim.dem", "Output demo file.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalf("Need to specify one demo name.")
+	}
+	demo := fs.Arg(0)
+	d, err := openEditDemo(p, demo)
+	if err != nil {
+		log.Fatalf("Opening demo %q: %v", demo, err)
+	}
+	first, last, err := gameplayTimes(d)
+	if err != nil {
+		log.Fatalf("Reading %q: %v", demo, err)
+	}
+	if d, err = openEditDemo(p, demo); err != nil {
+		log.Fatalf("Opening demo %q: %v", demo, err)
+	}
+	w, done := createOutput(*out)
+	if err := cutDemo(w, d, first+*start, last-*end); err != nil {
+		log.Fatalf("Trimming %q: %v", demo, err)
+	}
+	done()
+}
+
+func concat(p pak.MultiPak, args ...string) {
+	fs := flag.NewFlagSet("concat", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -pak <pak0,pak1,...> concat [options] <demofile.dem> ...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	out := fs.String("out", "concat.dem", "Output demo file.")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		log.Fatalf("Need to specify demo names.")
+	}
+	var demos []*dem.Demo
+	for _, demo := range fs.Args() {
+		d, err := openEditDemo(p, demo)
+		if err != nil {
+			log.Fatalf("Opening demo %q: %v", demo, err)
+		}
+		demos = append(demos, d)
+	}
+	w, done := createOutput(*out)
+	if err := concatDemos(w, demos); err != nil {
+		log.Fatalf("Joining demos: %v", err)
+	}
+	done()
+}
@@ -0,0 +1,207 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+)
+
+func timeMsg(t float64) *dem.MsgTime {
+	m := dem.MsgTime(t)
+	return &m
+}
+
+// writeTestDemo writes a demo with one signon block, and one block per second of gameplay.
+func writeTestDemo(t *testing.T, level string, seconds int) []byte {
+	var b bytes.Buffer
+	w, err := dem.NewWriter(&b, "-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := [][]dem.Message{{
+		&dem.ServerInfo{ServerVersion: 15, MaxClients: 1, Level: level, Models: []string{"maps/e1m1.bsp", "maps/e1m1.bsp"}, Sounds: []string{""}},
+		&dem.MsgClientState{State: 1},
+		&dem.MsgClientState{State: 3},
+		timeMsg(1),
+	}}
+	for n := 2; n < seconds+2; n++ {
+		blocks = append(blocks, []dem.Message{
+			timeMsg(float64(n)),
+			&dem.MsgLightStyle{Index: uint8(n), Style: "m"},
+			&dem.MsgPrint{Text: level},
+		})
+	}
+	blocks = append(blocks, []dem.Message{&dem.MsgDisconnect{}})
+	for _, msgs := range blocks {
+		if err := w.WriteBlock(dem.BlockHeader{}, msgs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+// readTestDemo returns all messages of a demo, block by block.
+func readTestDemo(t *testing.T, data []byte) [][]dem.Message {
+	d, err := dem.Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret [][]dem.Message
+	for {
+		block, err := d.ReadBlock()
+		if err == io.EOF {
+			return ret
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := block.Messages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, msgs)
+	}
+}
+
+func TestCut(t *testing.T) {
+	in := writeTestDemo(t, "e1m1", 5)
+	d, err := dem.Open(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := cutDemo(&out, d, 3.5, 5.5); err != nil {
+		t.Fatal(err)
+	}
+	got := readTestDemo(t, out.Bytes())
+	want := readTestDemo(t, in)
+	want = [][]dem.Message{
+		want[0],                  // Signon.
+		{want[1][1], want[2][1]}, // Carried light styles.
+		{timeMsg(1), want[3][1], want[3][2]},
+		{timeMsg(2), want[4][1], want[4][2]},
+		{&dem.MsgDisconnect{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Cut demo:\n got %v\nwant %v", got, want)
+	}
+
+	d, err = dem.Open(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cutDemo(io.Discard, d, 10, 20); err == nil {
+		t.Errorf("Cut after end of demo: expected error")
+	}
+}
+
+func TestGameplayTimes(t *testing.T) {
+	d, err := dem.Open(bytes.NewReader(writeTestDemo(t, "e1m1", 5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, last, err := gameplayTimes(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 2 || last != 6 {
+		t.Errorf("Gameplay times: got %g-%g, want 2-6", first, last)
+	}
+}
+
+func TestConcat(t *testing.T) {
+	var demos []*dem.Demo
+	for _, level := range []string{"e1m1", "e1m2"} {
+		d, err := dem.Open(bytes.NewReader(writeTestDemo(t, level, 2)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		demos = append(demos, d)
+	}
+	var out bytes.Buffer
+	if err := concatDemos(&out, demos); err != nil {
+		t.Fatal(err)
+	}
+	got := readTestDemo(t, out.Bytes())
+	if want := 2*3 + 1; len(got) != want {
+		t.Fatalf("Got %d blocks, want %d", len(got), want)
+	}
+	if got, want := got[3][0].(*dem.ServerInfo).Level, "e1m2"; got != want {
+		t.Errorf("Second level: got %q, want %q", got, want)
+	}
+	var times []float64
+	for n, msgs := range got[:len(got)-1] {
+		for _, msg := range msgs {
+			switch m := msg.(type) {
+			case *dem.MsgDisconnect:
+				t.Errorf("Disconnect in block %d", n)
+			case *dem.MsgTime:
+				times = append(times, float64(*m))
+			}
+		}
+	}
+	// The second demo continues where the first ended.
+	if want := []float64{1, 2, 3, 3, 4, 5}; !reflect.DeepEqual(times, want) {
+		t.Errorf("Times: got %v, want %v", times, want)
+	}
+}
+
+func TestConcatPlayback(t *testing.T) {
+	var demos []*dem.Demo
+	for _, level := range []string{"e1m1", "e1m2"} {
+		d, err := dem.Open(bytes.NewReader(writeTestDemo(t, level, 2)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		demos = append(demos, d)
+	}
+	var out bytes.Buffer
+	if err := concatDemos(&out, demos); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dem.Open(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := dem.NewPlayer(d)
+	p.Smoothing = dem.SmoothLinear
+	levels := make(map[string]int)
+	last := math.Inf(-1)
+	for f, err := range p.Frames(10) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Time <= last {
+			t.Errorf("Frame %d at %g, after frame at %g", f.Num, f.Time, last)
+		}
+		last = f.Time
+		levels[f.State.ServerInfo.Level]++
+	}
+	// Two seconds of gameplay from each demo.
+	if want := map[string]int{"e1m1": 20, "e1m2": 20}; !reflect.DeepEqual(levels, want) {
+		t.Errorf("Frames per level: got %v, want %v", levels, want)
+	}
+}
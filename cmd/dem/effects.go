@@ -0,0 +1,398 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+// This file contains the client side effects, the things that Quake draws
+// without the server telling it to, such as rocket trails.
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+	"github.com/ThomasHabets/qpov/pkg/mdl"
+	"github.com/ThomasHabets/qpov/pkg/pak"
+)
+
+const (
+	// Degrees per second that EF_ROTATE items spin.
+	rotateSpeed = 100.0
+
+	// Distance between trail puffs.
+	trailStep = 4.0
+
+	// If an entity moved further than this since the last state, it was
+	// a teleport or respawn and should not get a trail.
+	maxTrailLength = 300.0
+
+	// Radius of the dynamic light attached to rockets.
+	rocketLightRadius = 200.0
+
+	// Size of an explosion fireball when it's fully expanded.
+	explosionRadius = 60.0
+
+	// Starting radius of the explosion light, and how fast it shrinks.
+	explosionLightRadius = 350.0
+	explosionLightDecay  = 300.0
+
+	// Distance between the models making up a lightning beam.
+	beamSegment = 30.0
+
+	// Radius of lights from entity effects.
+	brightLightRadius = 400.0
+	dimLightRadius    = 200.0
+
+	// EF_BRIGHTFIELD particles around the entity.
+	brightFieldRadius    = 64.0
+	brightFieldParticles = 32
+)
+
+// modelCache loads model headers on demand, and remembers them.
+type modelCache struct {
+	p pak.MultiPak
+
+	mu     sync.Mutex // Frames are written in parallel.
+	flags  map[string]mdl.Flags
+	groups map[string][]mdl.FrameGroup
+}
+
+func newModelCache(p pak.MultiPak) *modelCache {
+	return &modelCache{
+		p:      p,
+		flags:  make(map[string]mdl.Flags),
+		groups: make(map[string][]mdl.FrameGroup),
+	}
+}
+
+// Pose returns the frame macro number to use for an entity frame at time t.
+// Frame groups (such as flames) animate on their own over time. If the model
+// can't be loaded the frame is used as is.
+func (c *modelCache) Pose(name string, frame int, t float64) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	groups, found := c.groups[name]
+	if !found {
+		if strings.HasSuffix(name, ".mdl") {
+			r, err := c.p.Get(name)
+			if err != nil {
+				log.Printf("Getting model %q for frames: %v", name, err)
+			} else if m, err := mdl.Load(r); err != nil {
+				log.Printf("Loading model %q for frames: %v", name, err)
+			} else {
+				groups = m.Groups
+			}
+		}
+		c.groups[name] = groups
+	}
+	if groups == nil {
+		return frame
+	}
+	if frame < 0 || frame >= len(groups) {
+		return 0
+	}
+	return groups[frame].Pose(t)
+}
+
+// Flags returns the model flags of a model, or zero if it's not an .mdl
+// or can't be loaded.
+func (c *modelCache) Flags(name string) mdl.Flags {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, found := c.flags[name]; found {
+		return f
+	}
+	c.flags[name] = 0
+	if !strings.HasSuffix(name, ".mdl") {
+		return 0
+	}
+	r, err := c.p.Get(name)
+	if err != nil {
+		log.Printf("Getting model %q for flags: %v", name, err)
+		return 0
+	}
+	h, err := mdl.LoadHeader(r)
+	if err != nil {
+		log.Printf("Loading model header %q: %v", name, err)
+		return 0
+	}
+	c.flags[name] = h.Flags
+	return h.Flags
+}
+
+// entityFlags returns the model flags of entity number n.
+func entityFlags(mc *modelCache, state *dem.State, n int) mdl.Flags {
+	e := &state.Entities[n]
+	if e.Model == 0 || int(e.Model) >= len(state.ServerInfo.Models) {
+		return 0
+	}
+	return mc.Flags(state.ServerInfo.Models[e.Model])
+}
+
+// applyModelFlags changes entity state according to their model flags.
+// Right now that's just spinning pickup items.
+func applyModelFlags(mc *modelCache, state *dem.State) {
+	spin := float32(math.Mod(rotateSpeed*state.Time, 360))
+	for n := range state.Entities {
+		if !state.Entities[n].Visible {
+			continue
+		}
+		if entityFlags(mc, state, n).Has(mdl.EF_ROTATE) {
+			state.Entities[n].Angle.Y = spin
+		}
+	}
+}
+
+// paletteColor returns a Quake palette color as a POV-Ray color vector.
+func paletteColor(n int) string {
+	r, g, b, _ := mdl.QuakePalette[n&0xff].RGBA()
+	return fmt.Sprintf("%.3f,%.3f,%.3f", float64(r)/0xffff, float64(g)/0xffff, float64(b)/0xffff)
+}
+
+// trailStyle returns the look of a trail at position i (0 being the entity
+// end, 1 being the oldest end) as palette index, transparency and if it glows.
+func trailStyle(flags mdl.Flags, n int, i float64) (int, float64, bool) {
+	switch {
+	case flags.Has(mdl.EF_ROCKET):
+		// Fire close to the rocket, fading to smoke.
+		ramp := []int{0x6d, 0x6b, 6, 5, 4, 3}
+		c := ramp[int(i*float64(len(ramp)-1))]
+		return c, 0.4 + 0.5*i, i < 0.3
+	case flags.Has(mdl.EF_GRENADE):
+		return []int{6, 5, 4, 3}[n&3], 0.5 + 0.4*i, false
+	case flags.Has(mdl.EF_GIB):
+		return 67 + n&3, 0.2 + 0.6*i, false
+	case flags.Has(mdl.EF_ZOMGIB):
+		return 67 + n&3, 0.5 + 0.4*i, false
+	case flags.Has(mdl.EF_TRACER):
+		return 52 + (n&4)<<1, 0.3 + 0.6*i, true
+	case flags.Has(mdl.EF_TRACER2):
+		return 230 + (n&4)<<1, 0.3 + 0.6*i, true
+	case flags.Has(mdl.EF_TRACER3):
+		return 152 + n&3, 0.3 + 0.6*i, true
+	}
+	return 0, 1, false
+}
+
+// writeModelEffects writes trails and lights for entities whose models have
+// flags saying they should have them.
+// The trail goes from where the entity was in the previous state to where it is now.
+// If there's no previous state, no trails are written.
+func writeModelEffects(w io.Writer, mc *modelCache, prev, state *dem.State) {
+	for n, e := range state.Entities {
+		if !e.Visible || n == state.CameraEnt {
+			continue
+		}
+		flags := entityFlags(mc, state, n)
+		if flags.Has(mdl.EF_ROCKET) {
+			fmt.Fprintf(w, "// Rocket light for entity %d\nlight_source { <%s> rgb<%s>*2 fade_distance %g fade_power 2 }\n",
+				n, e.Pos.String(), paletteColor(0xf8), rocketLightRadius/4)
+		}
+		if !flags.Trail() || prev == nil || n >= len(prev.Entities) {
+			continue
+		}
+		old := prev.Entities[n]
+		if old.Model != e.Model {
+			continue
+		}
+		dx := float64(e.Pos.X - old.Pos.X)
+		dy := float64(e.Pos.Y - old.Pos.Y)
+		dz := float64(e.Pos.Z - old.Pos.Z)
+		dist := math.Sqrt(dx*dx + dy*dy + dz*dz)
+		if dist < trailStep || dist > maxTrailLength {
+			continue
+		}
+		fmt.Fprintf(w, "// Trail for entity %d (%v)\nunion {\n", n, flags)
+		steps := int(dist / trailStep)
+		for i := 0; i < steps; i++ {
+			f := float64(i) / float64(steps)
+			c, transparency, glow := trailStyle(flags, i, f)
+			fin := "diffuse 0.6"
+			if glow {
+				fin = "emission 1 diffuse 0"
+			}
+			p := dem.Vertex{
+				X: e.Pos.X - float32(f*dx),
+				Y: e.Pos.Y - float32(f*dy),
+				Z: e.Pos.Z - float32(f*dz),
+			}
+			fmt.Fprintf(w, "  sphere { <%s>, %g pigment { rgbt<%s,%.2f> } finish { %s } }\n", p.String(), 1.5+2*f, paletteColor(c), transparency, fin)
+		}
+		fmt.Fprintf(w, "  no_shadow\n}\n")
+	}
+}
+
+// beamModel returns the model that a beam is drawn with.
+func beamModel(te *dem.TempEntity) string {
+	switch te.Type {
+	case dem.TE_LIGHTNING1:
+		return "progs/bolt.mdl"
+	case dem.TE_LIGHTNING2:
+		return "progs/bolt2.mdl"
+	case dem.TE_LIGHTNING3:
+		return "progs/bolt3.mdl"
+	}
+	return "progs/beam.mdl"
+}
+
+// explosionColor returns the palette color of an explosion that has
+// come i (0-1) of the way through its life.
+func explosionColor(te *dem.TempEntity, i float64) int {
+	switch {
+	case te.Type == dem.TE_TAREXPLOSION:
+		return 150 + int(i*5)
+	case te.Type == dem.TE_EXPLOSION2 && !te.QW:
+		return int(te.ColorStart) + int(i*float64(te.ColorLength))
+	}
+	ramp := []int{0x6f, 0x6d, 0x6b, 0x69, 0x67, 0x65, 0x63, 0x61}
+	return ramp[int(i*float64(len(ramp)-1))]
+}
+
+// writeTempEntities writes the explosions and beams active in the state.
+func writeTempEntities(w io.Writer, state *dem.State) {
+	for n := range state.TempEntities {
+		te := &state.TempEntities[n]
+		if !te.Active(state.Time) {
+			continue
+		}
+		age := state.Time - te.Start
+		switch {
+		case te.Explosion():
+			writeExplosion(w, te, age)
+		case te.Beam():
+			writeBeam(w, state, te)
+		}
+	}
+}
+
+// writeExplosion writes an expanding fireball, with a light inside.
+func writeExplosion(w io.Writer, te *dem.TempEntity, age float64) {
+	i := age / te.Duration()
+	fmt.Fprintf(w, "// Explosion\nsphere { <%s>, %g pigment { rgbt<%s,%.2f> } finish { emission 1 diffuse 0 } no_shadow }\n",
+		te.Pos.String(), explosionRadius*(0.2+0.8*i), paletteColor(explosionColor(te, i)), 0.3+0.7*i)
+	if r := explosionLightRadius - explosionLightDecay*age; r > 0 {
+		fmt.Fprintf(w, "light_source { <%s> rgb<%s>*%.2f fade_distance %g fade_power 2 }\n",
+			te.Pos.String(), paletteColor(explosionColor(te, 0)), 2*(1-i), r/4)
+	}
+}
+
+// writeBeam writes a lightning beam as a row of bolt models, the way Quake draws them.
+func writeBeam(w io.Writer, state *dem.State, te *dem.TempEntity) {
+	name := beamModel(te)
+	found := false
+	for _, m := range state.ServerInfo.Models {
+		found = found || m == name
+	}
+	if !found {
+		// Not precached, so not included.
+		return
+	}
+	start := te.Pos
+	if int(te.Entity) == state.CameraEnt {
+		// Keep the beam attached to the gun.
+		start = state.Entities[te.Entity].Pos
+	}
+	dx := float64(te.End.X - start.X)
+	dy := float64(te.End.Y - start.Y)
+	dz := float64(te.End.Z - start.Z)
+	dist := math.Sqrt(dx*dx + dy*dy + dz*dz)
+	if dist == 0 {
+		return
+	}
+	yaw := math.Atan2(dy, dx) * 180 / math.Pi
+	pitch := math.Atan2(dz, math.Sqrt(dx*dx+dy*dy)) * 180 / math.Pi
+	skin := *prefix + path.Join(name, "skin_0.png")
+	fmt.Fprintf(w, "// Beam from entity %d\n", te.Entity)
+	for i := 0; float64(i)*beamSegment < dist; i++ {
+		f := float64(i) * beamSegment / dist
+		p := dem.Vertex{
+			X: start.X + float32(f*dx),
+			Y: start.Y + float32(f*dy),
+			Z: start.Z + float32(f*dz),
+		}
+		// Quake gives each segment a random roll.
+		roll := (i*137 + int(te.Start*1000)) % 360
+		a := dem.Vertex{X: float32(roll), Y: float32(pitch), Z: float32(yaw)}
+		fmt.Fprintf(w, "%s(<%s>,<%s>,\"%s\")\n", frameName(name, 0), p.String(), a.String(), skin)
+	}
+}
+
+// writeEntityLights writes lights from entity effects, and muzzle flashes.
+func writeEntityLights(w io.Writer, state *dem.State) {
+	for n, e := range state.Entities {
+		if !e.Visible || e.Effects == 0 {
+			continue
+		}
+		radius := 0.0
+		pos := e.Pos
+		switch {
+		case e.Effects&dem.EF_BRIGHTLIGHT != 0:
+			radius = brightLightRadius
+			pos.Z += 16
+		case e.Effects&(dem.EF_DIMLIGHT|dem.EF_BLUE|dem.EF_RED) != 0:
+			radius = dimLightRadius
+		}
+		color := "1,0.8,0.6"
+		switch e.Effects & (dem.EF_BLUE | dem.EF_RED) {
+		case dem.EF_BLUE:
+			color = "0.4,0.4,1"
+		case dem.EF_RED:
+			color = "1,0.3,0.3"
+		case dem.EF_BLUE | dem.EF_RED:
+			color = "1,0.3,1"
+		}
+		if radius > 0 {
+			fmt.Fprintf(w, "// Light of entity %d\nlight_source { <%s> rgb<%s> fade_distance %g fade_power 2 }\n",
+				n, pos.String(), color, radius/4)
+		}
+		if e.Effects&dem.EF_BRIGHTFIELD != 0 {
+			writeBrightField(w, n, e.Pos, state.Time)
+		}
+	}
+	for _, l := range state.Lights {
+		if !l.Active(state.Time) {
+			continue
+		}
+		fmt.Fprintf(w, "// Muzzle flash of entity %d\nlight_source { <%s> rgb<1,0.8,0.6> fade_distance %g fade_power 2 }\n",
+			l.Entity, l.Pos.String(), l.Radius/4)
+	}
+}
+
+// writeBrightField writes the swirl of particles around an EF_BRIGHTFIELD entity.
+func writeBrightField(w io.Writer, n int, pos dem.Vertex, t float64) {
+	fmt.Fprintf(w, "// Bright field of entity %d\nunion {\n", n)
+	for i := 0; i < brightFieldParticles; i++ {
+		// Spread evenly over a sphere, spinning over time.
+		z := 1 - 2*(float64(i)+0.5)/brightFieldParticles
+		r := math.Sqrt(1 - z*z)
+		a := float64(i)*math.Pi*(3-math.Sqrt(5)) + t
+		p := dem.Vertex{
+			X: pos.X + float32(brightFieldRadius*r*math.Cos(a)),
+			Y: pos.Y + float32(brightFieldRadius*r*math.Sin(a)),
+			Z: pos.Z + float32(brightFieldRadius*z),
+		}
+		fmt.Fprintf(w, "  sphere { <%s>, 1 }\n", p.String())
+	}
+	fmt.Fprintf(w, "  pigment { rgb<%s> } finish { emission 1 diffuse 0 } no_shadow\n}\n", paletteColor(0x6f))
+}
@@ -0,0 +1,157 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+	"github.com/ThomasHabets/qpov/pkg/pak"
+)
+
+// Types of events.
+const (
+	eventLevel        = "level"
+	eventIntermission = "intermission"
+	eventFinale       = "finale"
+	eventSecret       = "secret"
+	eventMonsterKill  = "monster_kill"
+	eventFrag         = "frag"
+)
+
+// demoEvent is something that happened in the demo, for chaptering.
+type demoEvent struct {
+	Time float64 `json:"time"` // Seconds into the video.
+	Type string  `json:"type"`
+
+	// Level changes.
+	Map   string `json:"map,omitempty"`
+	Level string `json:"level,omitempty"`
+
+	// Intermission and finale text.
+	Text string `json:"text,omitempty"`
+
+	// Frags.
+	Player string `json:"player,omitempty"`
+	Frags  *int   `json:"frags,omitempty"` // Frags after the change.
+	Delta  int    `json:"delta,omitempty"`
+
+	// Number of secrets found or monsters killed in the level so far.
+	Count int `json:"count,omitempty"`
+}
+
+// eventLog collects events from demo messages, timed to the video.
+type eventLog struct {
+	clock    videoClock
+	events   []demoEvent
+	frags    map[uint8]int
+	secrets  int
+	monsters int
+}
+
+func newEventLog(fps float64) *eventLog {
+	return &eventLog{clock: videoClock{fps: fps}, frags: make(map[uint8]int)}
+}
+
+// message adds the events of a message, which has been applied to s.
+func (el *eventLog) message(msg dem.Message, s *dem.State) {
+	el.clock.message(msg, s)
+	e := demoEvent{Time: el.clock.now()}
+	switch m := msg.(type) {
+	case *dem.ServerInfo:
+		el.secrets = 0
+		el.monsters = 0
+		e.Type = eventLevel
+		if len(m.Models) > 0 {
+			e.Map = m.Models[0]
+		}
+		e.Level = plainText(m.Level)
+	case *dem.MsgIntermission:
+		e.Type = eventIntermission
+		e.Text = strings.TrimSpace(plainText(m.Text))
+	case *dem.MsgFinale:
+		e.Type = eventFinale
+		e.Text = strings.TrimSpace(plainText(m.Text))
+	case *dem.MsgFoundSecret:
+		el.secrets++
+		e.Type = eventSecret
+		e.Count = el.secrets
+	case *dem.MsgKilledMonster:
+		el.monsters++
+		e.Type = eventMonsterKill
+		e.Count = el.monsters
+	case *dem.MsgFrags:
+		frags := int(int16(m.Frags))
+		delta := frags - el.frags[m.Player]
+		el.frags[m.Player] = frags
+		// Players leaving have their name and frags cleared.
+		if delta == 0 || int(m.Player) >= len(s.Players) || s.Players[m.Player].Name == "" {
+			return
+		}
+		e.Type = eventFrag
+		e.Player = plainText(s.Players[m.Player].Name)
+		e.Frags = &frags
+		e.Delta = delta
+	default:
+		return
+	}
+	el.events = append(el.events, e)
+}
+
+// writeEvents writes the events as a JSON array.
+func writeEvents(w io.Writer, events []demoEvent) error {
+	if events == nil {
+		events = []demoEvent{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(events)
+}
+
+func events(p pak.MultiPak, args ...string) {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -pak <pak0,pak1,...> events [options] <demofile.dem|.qwd|.mvd>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fps := fs.Float64("fps", 30.0, "Frames per second of the video, as given to convert.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalf("Need to specify one demo name.")
+	}
+	demo := fs.Arg(0)
+	d, err := readDemo(p, demo)
+	if err != nil {
+		log.Fatalf("Opening demo %q: %v", demo, err)
+	}
+	el := newEventLog(*fps)
+	if _, err := applyDemo(d, el.message); err != nil {
+		log.Fatalf("Demo error: %v", err)
+	}
+	if err := writeEvents(os.Stdout, el.events); err != nil {
+		log.Fatalf("Writing events: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+)
+
+func TestEventLog(t *testing.T) {
+	el := newEventLog(30)
+	playMessages([]timedMessage{
+		{0, &dem.ServerInfo{Level: "the Slipgate Complex", Models: []string{"maps/e1m1.bsp"}}},
+		{0, &dem.MsgPlayerName{Index: 0, Name: "player"}},
+		{0, &dem.MsgFrags{Player: 0, Frags: 0}},
+		{1, &dem.MsgKilledMonster{}},
+		{2, &dem.MsgKilledMonster{}},
+		{3, &dem.MsgFoundSecret{}},
+		{4, &dem.MsgFrags{Player: 0, Frags: 2}},
+		{5, &dem.MsgFrags{Player: 0, Frags: 0xffff}},
+		{6, &dem.MsgPrint{Text: "ignored\n"}},
+		{7, &dem.MsgIntermission{}},
+		{8, &dem.ServerInfo{Models: []string{"maps/e1m2.bsp"}}},
+		{9, &dem.MsgFoundSecret{}},
+		{10, &dem.MsgPlayerName{Index: 0, Name: ""}},
+		{10, &dem.MsgFrags{Player: 0, Frags: 0}},
+		{11, &dem.MsgFinale{Text: " The end \n"}},
+	}, el.message)
+	two, minusOne := 2, -1
+	want := []demoEvent{
+		{Time: 0, Type: eventLevel, Map: "maps/e1m1.bsp", Level: "the Slipgate Complex"},
+		{Time: 1, Type: eventMonsterKill, Count: 1},
+		{Time: 2, Type: eventMonsterKill, Count: 2},
+		{Time: 3, Type: eventSecret, Count: 1},
+		{Time: 4, Type: eventFrag, Player: "player", Frags: &two, Delta: 2},
+		{Time: 5, Type: eventFrag, Player: "player", Frags: &minusOne, Delta: -3},
+		{Time: 7, Type: eventIntermission},
+		{Time: 8, Type: eventLevel, Map: "maps/e1m2.bsp"},
+		{Time: 9, Type: eventSecret, Count: 1},
+		{Time: 11, Type: eventFinale, Text: "The end"},
+	}
+	var got, exp bytes.Buffer
+	if err := writeEvents(&got, el.events); err != nil {
+		t.Fatal(err)
+	}
+	writeEvents(&exp, want)
+	if got.String() != exp.String() {
+		t.Errorf("Got events:\n%s\nwant:\n%s", got.String(), exp.String())
+	}
+
+	got.Reset()
+	writeEvents(&got, nil)
+	if got.String() != "[]\n" {
+		t.Errorf("No events: got %q, want []", got.String())
+	}
+}
+
+func TestEventLogVideoTime(t *testing.T) {
+	el := newEventLog(10)
+	playMessages([]timedMessage{
+		// Recorded mid-game. The first frame is at 12.4s.
+		{12.34, &dem.ServerInfo{Models: []string{"maps/e1m1.bsp"}}},
+		{15.4, &dem.MsgFoundSecret{}},
+		{20.4, &dem.ServerInfo{Models: []string{"maps/e1m2.bsp"}}},
+		// The server time starts over on the new level, and the video
+		// continues from 20.4s.
+		{1, &dem.MsgKilledMonster{}},
+		{6, &dem.MsgFoundSecret{}},
+	}, el.message)
+	var got []float64
+	for _, e := range el.events {
+		got = append(got, e.Time)
+	}
+	if want := []float64{0, 3, 8, 8, 13}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Event times: got %v, want %v", got, want)
+	}
+}
+
+func TestEventLogQW(t *testing.T) {
+	el := newEventLog(10)
+	applyQWTestDemo(t, bytes.Join([][]byte{
+		qwTestFrame(1, qwTestServerData("The Abandoned Base")...),
+		qwTestFrame(2, uint8(0x1b)),
+		qwTestFrame(3, uint8(0x1c), uint8(0x1b)),
+	}, nil), el.message)
+	var got []demoEvent
+	for _, e := range el.events {
+		e.Time = math.Round(e.Time*1000) / 1000
+		got = append(got, e)
+	}
+	want := []demoEvent{
+		{Time: 0, Type: eventLevel, Level: "The Abandoned Base"},
+		{Time: 1, Type: eventMonsterKill, Count: 1},
+		{Time: 2, Type: eventSecret, Count: 1},
+		{Time: 2, Type: eventMonsterKill, Count: 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got events %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+)
+
+// manifestFile is the file in the output directory with the content hashes
+// of the POV files written.
+const manifestFile = "manifest.json"
+
+// Names of samples of motion blurred frames and eyes of stereo frames, as
+// from povName, without extension.
+var (
+	blurSampleRE = regexp.MustCompile(`^(.*)-blur\d+$`)
+	stereoEyeRE  = regexp.MustCompile(`^(.*)-(sbs|ou)-(left|right)$`)
+)
+
+// povJob is a frame for the frame writer, with everything that depends on
+// earlier frames already worked out.
+type povJob struct {
+	fn          string // File name in the output directory.
+	level       string
+	prev, state *dem.State
+	cam         dem.Camera
+	weapon      *dem.Entity      // Weapon in view, if drawn.
+	particles   *strings.Builder // POV of the particle effects, if simulated.
+}
+
+// manifest lists the POV files written to an output directory.
+type manifest struct {
+	Frames map[string]string `json:"frames"` // File name to SHA-256 of the contents.
+}
+
+// frameWriter writes POV files with a pool of workers. The file of a frame
+// only depends on its job, so the output is the same no matter the number
+// of workers.
+//
+// Frames that the manifest says have changed since the last run have their
+// rendered PNG removed, so that they're rendered again. In incremental mode,
+// frames that haven't changed aren't written again.
+type frameWriter struct {
+	mc          *modelCache
+	dir         string
+	opts        frameOptions
+	incremental bool
+
+	jobs chan *povJob
+	wg   sync.WaitGroup
+
+	mu       sync.Mutex
+	old      map[string]string // From the manifest of the last run.
+	manifest manifest
+	skipped  int
+}
+
+// newFrameWriter starts a frame writer with workers writing frames. Fewer
+// than one worker means one per CPU.
+func newFrameWriter(mc *modelCache, dir string, opts frameOptions, workers int, incremental bool) (*frameWriter, error) {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	fw := &frameWriter{
+		mc:          mc,
+		dir:         dir,
+		opts:        opts,
+		incremental: incremental,
+		jobs:        make(chan *povJob, 2*workers),
+		old:         make(map[string]string),
+		manifest:    manifest{Frames: make(map[string]string)},
+	}
+	old, err := readManifest(path.Join(dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	for fn, h := range old.Frames {
+		// Frames not written this run are kept in the manifest.
+		fw.old[fn] = h
+		fw.manifest.Frames[fn] = h
+	}
+	for n := 0; n < workers; n++ {
+		fw.wg.Add(1)
+		go fw.worker()
+	}
+	return fw, nil
+}
+
+// readManifest reads a manifest, or returns an empty one if there is none.
+func readManifest(fn string) (*manifest, error) {
+	m := &manifest{}
+	data, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("parsing manifest %q: %v", fn, err)
+	}
+	return m, nil
+}
+
+// add queues a frame for writing.
+func (fw *frameWriter) add(job *povJob) {
+	fw.jobs <- job
+}
+
+func (fw *frameWriter) worker() {
+	defer fw.wg.Done()
+	for job := range fw.jobs {
+		if err := fw.write(job); err != nil {
+			log.Fatalf("Writing frame %q: %v", job.fn, err)
+		}
+	}
+}
+
+// write writes the POV file of a frame, unless it's unchanged in
+// incremental mode.
+func (fw *frameWriter) write(job *povJob) error {
+	var buf bytes.Buffer
+	if err := writePOV(&buf, fw.mc, job, fw.opts); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	h := hex.EncodeToString(sum[:])
+	fn := path.Join(fw.dir, job.fn)
+
+	fw.mu.Lock()
+	old, found := fw.old[job.fn]
+	fw.manifest.Frames[job.fn] = h
+	fw.mu.Unlock()
+
+	if fw.incremental && found && old == h {
+		if _, err := os.Stat(fn); err == nil {
+			fw.mu.Lock()
+			fw.skipped++
+			fw.mu.Unlock()
+			return nil
+		}
+	}
+	if err := os.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if found && old != h {
+		for _, png := range renderedPNGs(fn) {
+			if err := os.Remove(png); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// renderedPNGs returns the PNG files rendered from a POV file. Samples of
+// motion blurred frames are also in the PNG they're averaged into, and eyes
+// of stereo frames in the PNG of the frame.
+func renderedPNGs(fn string) []string {
+	base := strings.TrimSuffix(fn, ".pov")
+	ret := []string{base + ".png"}
+	for _, re := range []*regexp.Regexp{blurSampleRE, stereoEyeRE} {
+		if m := re.FindStringSubmatch(base); m != nil {
+			base = m[1]
+			ret = append(ret, base+".png")
+		}
+	}
+	return ret
+}
+
+// close waits for the frames to be written, and writes the manifest.
+func (fw *frameWriter) close() error {
+	close(fw.jobs)
+	fw.wg.Wait()
+	if fw.incremental {
+		log.Printf("Skipped %d unchanged frames", fw.skipped)
+	}
+	data, err := json.MarshalIndent(&fw.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Written atomically, so that an interrupted run doesn't leave a
+	// manifest of frames that weren't written.
+	fn := path.Join(fw.dir, manifestFile)
+	if err := os.WriteFile(fn+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
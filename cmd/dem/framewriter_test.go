@@ -0,0 +1,146 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+)
+
+// testJobs returns POV jobs of frames with the camera at x = frame number,
+// or x = -1 for the frame moved.
+func testJobs(n, moved int) []*povJob {
+	var ret []*povJob
+	for num := 0; num < n; num++ {
+		s := dem.NewState()
+		s.ServerInfo.Models = []string{"maps/e1m1.bsp"}
+		s.Time = float64(num)
+		cam := dem.Camera{Pos: dem.Vertex{X: float32(num)}}
+		if num == moved {
+			cam.Pos.X = -1
+		}
+		ret = append(ret, &povJob{
+			fn:    fmt.Sprintf("frame-%08d.pov", num),
+			level: "maps/e1m1.bsp",
+			prev:  s,
+			state: s,
+			cam:   cam,
+		})
+	}
+	return ret
+}
+
+// runFrameWriter writes jobs, returning the number of frames skipped.
+func runFrameWriter(t *testing.T, dir string, workers int, incremental bool, jobs []*povJob) int {
+	t.Helper()
+	fw, err := newFrameWriter(newModelCache(nil), dir, frameOptions{}, workers, incremental)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range jobs {
+		fw.add(j)
+	}
+	if err := fw.close(); err != nil {
+		t.Fatal(err)
+	}
+	return fw.skipped
+}
+
+// readDir returns the contents of the files in a directory.
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := make(map[string]string)
+	for _, e := range ents {
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret[e.Name()] = string(data)
+	}
+	return ret
+}
+
+func TestFrameWriterDeterministic(t *testing.T) {
+	one, many := t.TempDir(), t.TempDir()
+	runFrameWriter(t, one, 1, false, testJobs(20, -1))
+	runFrameWriter(t, many, 8, false, testJobs(20, -1))
+	a, b := readDir(t, one), readDir(t, many)
+	if got, want := len(a), 21; got != want {
+		t.Errorf("got %d files, want %d", got, want)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("output differs between 1 and 8 workers")
+	}
+}
+
+func TestFrameWriterIncremental(t *testing.T) {
+	dir := t.TempDir()
+	if got := runFrameWriter(t, dir, 4, true, testJobs(5, -1)); got != 0 {
+		t.Errorf("first run skipped %d frames", got)
+	}
+	// Mark the files, to see which are written again, and render them.
+	for num := 0; num < 5; num++ {
+		fn := filepath.Join(dir, fmt.Sprintf("frame-%08d", num))
+		for _, ext := range []string{".pov", ".png"} {
+			if err := os.WriteFile(fn+ext, []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	os.Remove(filepath.Join(dir, "frame-00000003.pov"))
+
+	if got, want := runFrameWriter(t, dir, 4, true, testJobs(5, 1)), 3; got != want {
+		t.Errorf("got %d frames skipped, want %d", got, want)
+	}
+	files := readDir(t, dir)
+	for num, want := range []bool{false, true, false, true, false} {
+		fn := fmt.Sprintf("frame-%08d", num)
+		if got := files[fn+".pov"] != "old"; got != want {
+			t.Errorf("frame %d: written %v, want %v", num, got, want)
+		}
+		// Only frames known to have changed are rendered again.
+		_, png := files[fn+".png"]
+		if want := num != 1; png != want {
+			t.Errorf("frame %d: PNG kept %v, want %v", num, png, want)
+		}
+	}
+
+	// Not incremental writes all frames, and keeps frames of other runs
+	// in the manifest.
+	if got := runFrameWriter(t, dir, 4, false, testJobs(2, -1)); got != 0 {
+		t.Errorf("not incremental skipped %d frames", got)
+	}
+	m, err := readManifest(filepath.Join(dir, manifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(m.Frames), 5; got != want {
+		t.Errorf("got %d frames in manifest, want %d", got, want)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+	"github.com/ThomasHabets/qpov/pkg/pak"
+	"github.com/ThomasHabets/qpov/pkg/wad"
+)
+
+const (
+	// Size of the Quake screen that the status bar is made for.
+	hudBaseWidth  = 320
+	hudBaseHeight = 200
+
+	sbarHeight  = 24
+	numWidth    = 24 // Width of the big status bar digits.
+	faceAnim    = 0.2
+	centerTime  = 2 // Seconds center prints are shown, as Quake's scr_centertime.
+	centerLines = 4 // Center prints with more lines start near the top.
+
+	// First character of the small yellow digits in the console font.
+	concharsYellowZero = 18
+)
+
+var (
+	hudWeapons = []string{"shotgun", "sshotgun", "nailgun", "snailgun", "rlaunch", "srlaunch", "lightng"}
+	hudItems   = []string{"sb_key1", "sb_key2", "sb_invis", "sb_invuln", "sb_suit", "sb_quad"}
+)
+
+// hud draws the Quake status bar and center prints, to be put on top of
+// the rendered frames.
+type hud struct {
+	width, height int // Size of the overlay.
+	scale         int // Size of a Quake pixel in the overlay.
+
+	wad      *wad.WAD
+	conchars *image.Paletted
+	pics     map[string]*image.Paletted
+}
+
+func newHUD(w *wad.WAD, width, height int) (*hud, error) {
+	c, err := w.Conchars()
+	if err != nil {
+		return nil, err
+	}
+	scale := width / hudBaseWidth
+	if s := height / hudBaseHeight; s < scale {
+		scale = s
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	return &hud{
+		width:    width,
+		height:   height,
+		scale:    scale,
+		wad:      w,
+		conchars: c,
+		pics:     make(map[string]*image.Paletted),
+	}, nil
+}
+
+// loadHUD loads the pictures of the HUD from gfx.wad, for overlays of
+// the size WxH.
+func loadHUD(p pak.MultiPak, size string) (*hud, error) {
+	width, height, err := parseSize(size)
+	if err != nil {
+		return nil, err
+	}
+	r, err := p.Get("gfx.wad")
+	if err != nil {
+		return nil, fmt.Errorf("looking up gfx.wad: %v", err)
+	}
+	w, err := wad.Load(r)
+	if err != nil {
+		return nil, fmt.Errorf("loading gfx.wad: %v", err)
+	}
+	return newHUD(w, width, height)
+}
+
+// parseSize parses an image size written as WxH.
+func parseSize(s string) (int, int, error) {
+	parts := strings.Split(s, "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("want WxH, got %q", s)
+	}
+	w, err := strconv.Atoi(parts[0])
+	if err != nil || w <= 0 {
+		return 0, 0, fmt.Errorf("bad width in %q", s)
+	}
+	h, err := strconv.Atoi(parts[1])
+	if err != nil || h <= 0 {
+		return 0, 0, fmt.Errorf("bad height in %q", s)
+	}
+	return w, h, nil
+}
+
+// pic returns a picture of the WAD, or nil if it doesn't have it.
+func (h *hud) pic(name string) *image.Paletted {
+	p, found := h.pics[name]
+	if !found {
+		p, _ = h.wad.Pic(name)
+		h.pics[name] = p
+	}
+	return p
+}
+
+func (h *hud) drawPic(img draw.Image, x, y int, name string) {
+	p := h.pic(name)
+	if p == nil {
+		return
+	}
+	draw.Draw(img, p.Bounds().Add(image.Pt(x, y)), p, image.Point{}, draw.Over)
+}
+
+func (h *hud) drawChar(img draw.Image, x, y int, c byte) {
+	src := image.Pt(int(c%16)*wad.CharSize, int(c/16)*wad.CharSize)
+	draw.Draw(img, image.Rect(x, y, x+wad.CharSize, y+wad.CharSize), h.conchars, src, draw.Over)
+}
+
+// drawNum draws a number with the big status bar digits, right aligned
+// in the width of digits. Red digits are for values running low.
+func (h *hud) drawNum(img draw.Image, x, y, num, digits int, red bool) {
+	s := strconv.Itoa(num)
+	if len(s) > digits {
+		s = s[len(s)-digits:]
+	}
+	x += (digits - len(s)) * numWidth
+	prefix := "num_"
+	if red {
+		prefix = "anum_"
+	}
+	for _, c := range s {
+		name := prefix + string(c)
+		if c == '-' {
+			name = prefix + "minus"
+		}
+		h.drawPic(img, x, y, name)
+		x += numWidth
+	}
+}
+
+// face returns the picture of the face of the player.
+func face(s *dem.State) string {
+	switch {
+	case s.Items&(dem.IT_INVISIBILITY|dem.IT_INVULNERABILITY) == dem.IT_INVISIBILITY|dem.IT_INVULNERABILITY:
+		return "face_inv2"
+	case s.Items&dem.IT_QUAD != 0:
+		return "face_quad"
+	case s.Items&dem.IT_INVISIBILITY != 0:
+		return "face_invis"
+	case s.Items&dem.IT_INVULNERABILITY != 0:
+		return "face_invuln"
+	}
+	f := s.Health / 20
+	if f < 0 {
+		f = 0
+	}
+	if f > 4 {
+		f = 4
+	}
+	if s.DamageFlash.Percent > 0 && s.Time >= s.DamageFlash.Time && s.Time < s.DamageFlash.Time+faceAnim {
+		return fmt.Sprintf("face_p%d", 5-f)
+	}
+	return fmt.Sprintf("face%d", 5-f)
+}
+
+// drawInventory draws the weapons, ammo counts and items above the status bar.
+func (h *hud) drawInventory(img draw.Image, x, y int, s *dem.State) {
+	h.drawPic(img, x, y, "ibar")
+	for n, w := range hudWeapons {
+		bit := dem.IT_SHOTGUN << uint(n)
+		if s.Items&uint32(bit) == 0 {
+			continue
+		}
+		prefix := "inv_"
+		if s.ActiveWeapon == bit {
+			prefix = "inv2_"
+		}
+		h.drawPic(img, x+n*24, y+8, prefix+w)
+	}
+	for n, count := range s.AmmoCounts {
+		for k, c := range fmt.Sprintf("%3d", count) {
+			if c >= '0' && c <= '9' {
+				h.drawChar(img, x+(6*n+1+k)*8-2, y, byte(concharsYellowZero+c-'0'))
+			}
+		}
+	}
+	for n, item := range hudItems {
+		if s.Items&(dem.IT_KEY1<<uint(n)) != 0 {
+			h.drawPic(img, x+192+n*16, y+8, item)
+		}
+	}
+	for n := 0; n < 4; n++ {
+		if s.Items&(dem.IT_SIGIL1<<uint(n)) != 0 {
+			h.drawPic(img, x+hudBaseWidth-32+n*8, y+8, fmt.Sprintf("sb_sigil%d", n+1))
+		}
+	}
+}
+
+// drawStatusBar draws the armor, face, health and ammo.
+func (h *hud) drawStatusBar(img draw.Image, x, y int, s *dem.State) {
+	h.drawPic(img, x, y, "sbar")
+	if s.Items&dem.IT_INVULNERABILITY != 0 {
+		h.drawNum(img, x+24, y, 666, 3, true)
+		h.drawPic(img, x, y, "disc")
+	} else {
+		h.drawNum(img, x+24, y, s.Armor, 3, s.Armor <= 25)
+		switch {
+		case s.Items&dem.IT_ARMOR3 != 0:
+			h.drawPic(img, x, y, "sb_armor3")
+		case s.Items&dem.IT_ARMOR2 != 0:
+			h.drawPic(img, x, y, "sb_armor2")
+		case s.Items&dem.IT_ARMOR1 != 0:
+			h.drawPic(img, x, y, "sb_armor1")
+		}
+	}
+	h.drawPic(img, x+112, y, face(s))
+	h.drawNum(img, x+136, y, s.Health, 3, s.Health <= 25)
+	switch {
+	case s.Items&dem.IT_SHELLS != 0:
+		h.drawPic(img, x+224, y, "sb_shells")
+	case s.Items&dem.IT_NAILS != 0:
+		h.drawPic(img, x+224, y, "sb_nails")
+	case s.Items&dem.IT_ROCKETS != 0:
+		h.drawPic(img, x+224, y, "sb_rocket")
+	case s.Items&dem.IT_CELLS != 0:
+		h.drawPic(img, x+224, y, "sb_cells")
+	}
+	h.drawNum(img, x+248, y, s.Ammo, 3, s.Ammo <= 10)
+}
+
+// drawCenterPrint draws the center print text, if it's still shown.
+func (h *hud) drawCenterPrint(img draw.Image, s *dem.State) {
+	if s.CenterPrint == "" || s.Time < s.CenterPrintTime || s.Time >= s.CenterPrintTime+centerTime {
+		return
+	}
+	b := img.Bounds()
+	lines := strings.Split(strings.TrimRight(s.CenterPrint, "\n"), "\n")
+	y := 48
+	if len(lines) <= centerLines {
+		y = b.Dy() * 35 / 100
+	}
+	for _, l := range lines {
+		x := (b.Dx() - len(l)*wad.CharSize) / 2
+		for n := 0; n < len(l); n++ {
+			h.drawChar(img, x+n*wad.CharSize, y, l[n])
+		}
+		y += wad.CharSize
+	}
+}
+
+// draw returns the overlay of the state. It's transparent where there's
+// no HUD.
+func (h *hud) draw(s *dem.State) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, h.width/h.scale, h.height/h.scale))
+	if !s.Intermission {
+		x := (img.Bounds().Dx() - hudBaseWidth) / 2
+		y := img.Bounds().Dy() - sbarHeight
+		h.drawInventory(img, x, y-sbarHeight, s)
+		h.drawStatusBar(img, x, y, s)
+	}
+	h.drawCenterPrint(img, s)
+	if h.scale == 1 {
+		return img
+	}
+
+	// Scale up with nearest neighbour, for the blocky look of Quake.
+	ret := image.NewRGBA(image.Rect(0, 0, h.width, h.height))
+	for y := 0; y < h.height; y++ {
+		for x := 0; x < h.width; x++ {
+			ret.SetRGBA(x, y, img.RGBAAt(x/h.scale, y/h.scale))
+		}
+	}
+	return ret
+}
+
+// writeFrame writes the overlay of a frame as a PNG file.
+func (h *hud) writeFrame(outDir string, f *dem.Frame) error {
+	fn := path.Join(outDir, fmt.Sprintf("frame-%08d-hud.png", f.Num))
+	fo, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(fo, h.draw(f.State)); err != nil {
+		fo.Close()
+		return fmt.Errorf("encoding %q: %v", fn, err)
+	}
+	return fo.Close()
+}
@@ -0,0 +1,139 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+	"github.com/ThomasHabets/qpov/pkg/wad"
+)
+
+// testPicLump returns a picture lump of one color.
+func testPicLump(name string, w, h int32, color byte) *wad.Lump {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, [2]int32{w, h})
+	b.Write(bytes.Repeat([]byte{color}, int(w*h)))
+	return &wad.Lump{Name: name, Type: wad.TypeQPic, Data: b.Bytes()}
+}
+
+// testHUD returns a HUD with a status bar and the letter A.
+func testHUD(t *testing.T, width, height int) *hud {
+	conchars := make([]byte, wad.ConcharsSize*wad.ConcharsSize)
+	a := 'A'
+	for y := 0; y < wad.CharSize; y++ {
+		for x := 0; x < wad.CharSize; x++ {
+			conchars[(int(a/16)*wad.CharSize+y)*wad.ConcharsSize+int(a%16)*wad.CharSize+x] = 15
+		}
+	}
+	w := &wad.WAD{Lumps: map[string]*wad.Lump{
+		"conchars": {Name: "conchars", Type: wad.TypeMipTex, Data: conchars},
+		"sbar":     testPicLump("sbar", 320, 24, 4),
+	}}
+	h, err := newHUD(w, width, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestParseSize(t *testing.T) {
+	if w, h, err := parseSize("1600x900"); err != nil || w != 1600 || h != 900 {
+		t.Errorf("parseSize: got %d %d %v, want 1600 900", w, h, err)
+	}
+	for _, bad := range []string{"", "1600", "1600x", "x900", "0x900", "1600x900x2", "axb"} {
+		if _, _, err := parseSize(bad); err == nil {
+			t.Errorf("parseSize(%q): expected error", bad)
+		}
+	}
+}
+
+func TestFace(t *testing.T) {
+	for _, test := range []struct {
+		health int
+		items  uint32
+		hurt   float64 // Time since damage, or 0 for none.
+		want   string
+	}{
+		{100, 0, 0, "face1"},
+		{250, 0, 0, "face1"},
+		{79, 0, 0, "face2"},
+		{10, 0, 0, "face5"},
+		{-20, 0, 0, "face5"},
+		{50, 0, 0.1, "face_p3"},
+		{50, 0, 0.3, "face3"},
+		{50, dem.IT_QUAD, 0.1, "face_quad"},
+		{50, dem.IT_INVISIBILITY | dem.IT_INVULNERABILITY, 0, "face_inv2"},
+		{50, dem.IT_INVULNERABILITY, 0, "face_invuln"},
+	} {
+		s := dem.NewState()
+		s.Health = test.health
+		s.Items = test.items
+		s.Time = 10
+		if test.hurt > 0 {
+			(&dem.MsgDamage{Blood: 10}).Apply(s)
+			s.Time += test.hurt
+		}
+		if got := face(s); got != test.want {
+			t.Errorf("Health %d, items %x, hurt %g: got %q, want %q", test.health, test.items, test.hurt, got, test.want)
+		}
+	}
+}
+
+func TestHUDDraw(t *testing.T) {
+	h := testHUD(t, 800, 450)
+	if h.scale != 2 {
+		t.Errorf("Got scale %d, want 2", h.scale)
+	}
+	s := dem.NewState()
+	s.Time = 1
+	img := h.draw(s)
+	if got := img.Bounds().Size(); got.X != 800 || got.Y != 450 {
+		t.Fatalf("Got size %v, want 800x450", got)
+	}
+	opaque := func(x, y int) bool { return img.RGBAAt(x, y).A != 0 }
+	if !opaque(400, 449) || !opaque(80, 402) {
+		t.Errorf("No status bar at the bottom")
+	}
+	if opaque(79, 449) || opaque(400, 401) || opaque(400, 225) {
+		t.Errorf("Status bar drawn outside of the bottom center")
+	}
+
+	// Center print.
+	s.CenterPrint = "A\n"
+	s.CenterPrintTime = 0.5
+	img = h.draw(s)
+	if y := 450 / 2 * 35 / 100 * 2; !opaque(400, y) || opaque(400, y-1) || opaque(391, y) {
+		t.Errorf("Center print not drawn at 35%% height")
+	}
+	s.Time = 2.5
+	img = h.draw(s)
+	if opaque(400, 450/2*35/100*2) {
+		t.Errorf("Center print shown after %d seconds", centerTime)
+	}
+
+	s.Intermission = true
+	img = h.draw(s)
+	if opaque(400, 449) {
+		t.Errorf("Status bar drawn during intermission")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"fmt"
+	"math"
+)
+
+// motionBlur samples frames at several times within the shutter interval,
+// to be rendered and averaged. The demo is played at rate times the frame
+// rate, and the samples of a frame are the sub-frames around its time.
+// The shutter is samples/rate of the frame interval.
+type motionBlur struct {
+	samples int
+	rate    int
+}
+
+// newMotionBlur returns the motion blur closest to the shutter, as a
+// fraction of the frame interval, or nil for no motion blur.
+func newMotionBlur(samples int, shutter float64) (*motionBlur, error) {
+	if samples <= 1 {
+		return nil, nil
+	}
+	if shutter <= 0 || shutter > 1 {
+		return nil, fmt.Errorf("shutter %g not in (0,1]", shutter)
+	}
+	rate := int(math.Round(float64(samples) / shutter))
+	if rate < samples {
+		rate = samples
+	}
+	return &motionBlur{samples: samples, rate: rate}, nil
+}
+
+// sample returns the frame and sample number of a sub-frame, and false if
+// it's not sampled. Sample samples/2 is at the time of the frame.
+func (mb *motionBlur) sample(sub int) (int, int, bool) {
+	frame := (sub + mb.rate/2) / mb.rate
+	i := sub - frame*mb.rate + mb.samples/2
+	return frame, i, i >= 0 && i < mb.samples
+}
+
+// povName returns the file name of the POV file of a frame, as seen by an
+// eye in stereo, and as a sample of it if motion blurred.
+func povName(frame int, eye string, sample int) string {
+	fn := fmt.Sprintf("frame-%08d", frame)
+	if eye != "" {
+		fn += "-" + eye
+	}
+	if sample >= 0 {
+		fn += fmt.Sprintf("-blur%02d", sample)
+	}
+	return fn + ".pov"
+}
@@ -0,0 +1,101 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewMotionBlur(t *testing.T) {
+	for _, test := range []struct {
+		samples int
+		shutter float64
+		want    *motionBlur
+		err     bool
+	}{
+		{1, 0.5, nil, false},
+		{0, 0, nil, false},
+		{4, 0.5, &motionBlur{samples: 4, rate: 8}, false},
+		{3, 1, &motionBlur{samples: 3, rate: 3}, false},
+		{3, 0.4, &motionBlur{samples: 3, rate: 8}, false},
+		{2, 0, nil, true},
+		{2, 1.5, nil, true},
+	} {
+		got, err := newMotionBlur(test.samples, test.shutter)
+		if (err != nil) != test.err {
+			t.Errorf("%d samples, shutter %g: got error %v, want error %v", test.samples, test.shutter, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d samples, shutter %g: got %+v, want %+v", test.samples, test.shutter, got, test.want)
+		}
+	}
+}
+
+func TestMotionBlurSample(t *testing.T) {
+	mb := &motionBlur{samples: 4, rate: 8}
+	type sample struct{ frame, i int }
+	var got []sample
+	for sub := 0; sub < 20; sub++ {
+		if frame, i, ok := mb.sample(sub); ok {
+			got = append(got, sample{frame, i})
+		} else if i >= 0 && i < mb.samples {
+			t.Errorf("sub-frame %d: sample %d not sampled", sub, i)
+		}
+	}
+	want := []sample{
+		{0, 2}, {0, 3},
+		{1, 0}, {1, 1}, {1, 2}, {1, 3},
+		{2, 0}, {2, 1}, {2, 2}, {2, 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The middle sample is at the time of the frame.
+	for frame := 0; frame < 5; frame++ {
+		if f, i, ok := mb.sample(frame * mb.rate); f != frame || i != mb.samples/2 || !ok {
+			t.Errorf("frame %d: got frame %d sample %d %v", frame, f, i, ok)
+		}
+	}
+}
+
+func TestPOVName(t *testing.T) {
+	for _, test := range []struct {
+		frame  int
+		eye    string
+		sample int
+		want   string
+		pngs   []string
+	}{
+		{12, "", -1, "frame-00000012.pov", []string{"frame-00000012.png"}},
+		{12, "", 3, "frame-00000012-blur03.pov", []string{"frame-00000012-blur03.png", "frame-00000012.png"}},
+		{12, "sbs-left", -1, "frame-00000012-sbs-left.pov", []string{"frame-00000012-sbs-left.png", "frame-00000012.png"}},
+		{12, "ou-right", 0, "frame-00000012-ou-right-blur00.pov", []string{"frame-00000012-ou-right-blur00.png", "frame-00000012-ou-right.png", "frame-00000012.png"}},
+	} {
+		got := povName(test.frame, test.eye, test.sample)
+		if got != test.want {
+			t.Errorf("frame %d eye %q sample %d: got %q, want %q", test.frame, test.eye, test.sample, got, test.want)
+		}
+		if pngs := renderedPNGs(got); !reflect.DeepEqual(pngs, test.pngs) {
+			t.Errorf("%q: got PNGs %q, want %q", got, pngs, test.pngs)
+		}
+	}
+}
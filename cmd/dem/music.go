@@ -0,0 +1,85 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ThomasHabets/qpov/pkg/sound"
+)
+
+// musicExts are the file types of music tracks, in order of preference.
+var musicExts = []string{".wav", ".ogg", ".mp3", ".flac"}
+
+// musicLoader loads the CD tracks of Quake from a directory, with files
+// named like track02.ogg. Files other than WAV are decoded by ffmpeg, run
+// from the path in ffmpeg.
+type musicLoader struct {
+	dir    string
+	ffmpeg string
+}
+
+// load returns the channels of a track.
+func (ml *musicLoader) load(track int) ([]*sound.Sound, error) {
+	for _, ext := range musicExts {
+		fn := filepath.Join(ml.dir, fmt.Sprintf("track%02d%s", track, ext))
+		if _, err := os.Stat(fn); err != nil {
+			continue
+		}
+		if ext != ".wav" {
+			return ml.decode(fn)
+		}
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return sound.LoadWAVChannels(f)
+	}
+	return nil, fmt.Errorf("no track %02d in %q", track, ml.dir)
+}
+
+// decode decodes a music file to WAV with ffmpeg.
+func (ml *musicLoader) decode(fn string) ([]*sound.Sound, error) {
+	var out, stderr bytes.Buffer
+	cmd := exec.Command(ml.ffmpeg, "-nostdin", "-loglevel", "error", "-i", fn, "-f", "wav", "-acodec", "pcm_s16le", "-")
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("decoding %q with %s: %v: %s", fn, ml.ffmpeg, err, strings.TrimSpace(stderr.String()))
+	}
+	return sound.LoadWAVChannels(&out)
+}
+
+// forcedTrack returns the track set by the first line of a demo, which
+// Quake plays instead of the tracks of the levels, or -1 if none.
+func forcedTrack(header string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(header))
+	if err != nil {
+		return -1
+	}
+	return n
+}
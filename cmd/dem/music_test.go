@@ -0,0 +1,83 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/sound"
+)
+
+func TestForcedTrack(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		want   int
+	}{
+		{"-1", -1},
+		{"", -1},
+		{"4", 4},
+		{" 2\r", 2},
+		{"x", -1},
+	} {
+		if got := forcedTrack(test.header); got != test.want {
+			t.Errorf("%q: got %d, want %d", test.header, got, test.want)
+		}
+	}
+}
+
+func TestMusicLoader(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "track02.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sound.WriteWAV(f, 100, []float32{0.5, -0.5, 0.25, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "track03.ogg"), []byte("not ogg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ml := &musicLoader{dir: dir, ffmpeg: "false"}
+	chans, err := ml.load(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(chans), 2; got != want {
+		t.Fatalf("got %d channels, want %d", got, want)
+	}
+	for n, want := range [][]float32{{0.5, 0.25}, {-0.5, 0}} {
+		if got := chans[n].Samples; !reflect.DeepEqual(got, want) {
+			t.Errorf("channel %d: got %v, want %v", n, got, want)
+		}
+	}
+	if _, err := ml.load(3); err == nil {
+		t.Errorf("decoding with a failing ffmpeg: expected error")
+	}
+	if _, err := ml.load(4); err == nil {
+		t.Errorf("missing track: expected error")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"io"
+	"math"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+	"github.com/ThomasHabets/qpov/pkg/particle"
+)
+
+// particleEffects feeds a particle system from the demo.
+type particleEffects struct {
+	sys *particle.System
+
+	// Where the trail of each entity was last extended to.
+	trails map[int]dem.Vertex
+}
+
+func newParticleEffects(seed uint64) *particleEffects {
+	return &particleEffects{
+		sys:    particle.New(seed),
+		trails: make(map[int]dem.Vertex),
+	}
+}
+
+// message adds the particles of a demo message seen at demo time t.
+func (pe *particleEffects) message(msg dem.Message, t float64) {
+	switch m := msg.(type) {
+	case *dem.MsgParticle:
+		pe.sys.Particle(t, m)
+	case *dem.MsgTempEntity:
+		pe.sys.TempEntity(t, m)
+	}
+}
+
+// frame extends the trails of moving models to where they are in the state,
+// and runs the simulation to the time of the state.
+func (pe *particleEffects) frame(mc *modelCache, state *dem.State) {
+	seen := make(map[int]bool)
+	for n, e := range state.Entities {
+		if !e.Visible || n == state.CameraEnt {
+			continue
+		}
+		trail, ok := particle.TrailForFlags(entityFlags(mc, state, n))
+		if !ok {
+			continue
+		}
+		seen[n] = true
+		if old, found := pe.trails[n]; found {
+			dx := float64(e.Pos.X - old.X)
+			dy := float64(e.Pos.Y - old.Y)
+			dz := float64(e.Pos.Z - old.Z)
+			if math.Sqrt(dx*dx+dy*dy+dz*dz) <= maxTrailLength {
+				pe.sys.Trail(state.Time, old, e.Pos, trail)
+			}
+		}
+		pe.trails[n] = e.Pos
+	}
+	for n := range pe.trails {
+		if !seen[n] {
+			delete(pe.trails, n)
+		}
+	}
+	pe.sys.Run(state.Time)
+}
+
+// skip runs the particles of a frame that isn't written, so that the frames
+// after it have the same particles as if it were.
+func (pe *particleEffects) skip(mc *modelCache, state *dem.State) {
+	if pe == nil || state.ServerInfo.Models == nil {
+		return
+	}
+	applyModelFlags(mc, state)
+	pe.frame(mc, state)
+}
+
+// write writes the particles alive at the time of the state.
+func (pe *particleEffects) write(w io.Writer, state *dem.State) {
+	io.WriteString(w, pe.sys.POV(state.Time))
+}
@@ -0,0 +1,126 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+	"github.com/ThomasHabets/qpov/pkg/mdl"
+	"github.com/ThomasHabets/qpov/pkg/particle"
+)
+
+// writeParticleDemo writes a demo with a rocket flying, explosions and
+// blood, with a block every 0.1s from 1s to 13s.
+func writeParticleDemo(t *testing.T) []byte {
+	var b bytes.Buffer
+	w, err := dem.NewWriter(&b, "-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := [][]dem.Message{{
+		&dem.ServerInfo{ServerVersion: 15, MaxClients: 1, Level: "test", Models: []string{"maps/test.bsp", "progs/missile.mdl"}, Sounds: []string{""}},
+		&dem.MsgClientState{State: 1},
+		&dem.MsgClientState{State: 3},
+		timeMsg(1),
+	}}
+	model := uint8(1)
+	for n := 1; n <= 120; n++ {
+		x := float32(n * 10)
+		msgs := []dem.Message{
+			timeMsg(1 + float64(n)/10),
+			&dem.MsgUpdate{Entity: 2, Model: &model, X: &x},
+		}
+		if n%7 == 0 {
+			msgs = append(msgs, &dem.MsgTempEntity{Type: dem.TE_EXPLOSION, Pos: dem.Vertex{X: x, Y: 100}})
+		}
+		if n%5 == 0 {
+			msgs = append(msgs, &dem.MsgParticle{Pos: dem.Vertex{Y: x}, Dir: dem.Vertex{Z: 1}, Count: 20, Color: 73})
+		}
+		blocks = append(blocks, msgs)
+	}
+	blocks = append(blocks, []dem.Message{&dem.MsgDisconnect{}})
+	for _, msgs := range blocks {
+		if err := w.WriteBlock(dem.BlockHeader{}, msgs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+// particleFrames plays the demo from time start, and returns the particles
+// of the frames from time from on, by frame number.
+func particleFrames(t *testing.T, data []byte, start, from float64) map[int]string {
+	const fps = 10
+	d, err := dem.Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := openPlayer("test.dem", d, bytes.NewReader(data), start, fps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := newModelCache(nil)
+	mc.flags["progs/missile.mdl"] = mdl.EF_ROCKET
+	pe := newParticleEffects(1)
+	p.OnMessage = func(msg dem.Message, s *dem.State) {
+		pe.message(msg, s.Time)
+	}
+	ret := make(map[int]string)
+	for f, err := range p.Frames(fps) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		pe.skip(mc, f.State)
+		if f.Time >= from {
+			var b strings.Builder
+			pe.write(&b, f.State)
+			ret[f.Num] = b.String()
+		}
+	}
+	return ret
+}
+
+func TestSeekParticles(t *testing.T) {
+	data := writeParticleDemo(t)
+	const from = 9.05
+	full := particleFrames(t, data, 0, from)
+	first := -1
+	for n := range full {
+		if first < 0 || n < first {
+			first = n
+		}
+	}
+	if first < 0 || full[first] == "" {
+		t.Fatalf("No particles at the first frame")
+	}
+	seeked := particleFrames(t, data, from-particle.MaxLife, from)
+	if !reflect.DeepEqual(full, seeked) {
+		for n, want := range full {
+			if got := seeked[n]; got != want {
+				t.Errorf("Frame %d: got %d bytes of particles, want %d", n, len(got), len(want))
+			}
+		}
+		t.Errorf("Got %d frames, want %d", len(seeked), len(full))
+	}
+}
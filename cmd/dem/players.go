@@ -0,0 +1,70 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+	"github.com/ThomasHabets/qpov/pkg/pak"
+)
+
+// writePlayers writes the table of players in the state. Empty slots are
+// left out.
+func writePlayers(w io.Writer, s *dem.State) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Slot\tEntity\tName\tShirt\tPants\tFrags\n")
+	for n, p := range s.Players {
+		if p.Name == "" {
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%d\t%d\t%d\n", n, dem.PlayerEntity(n), p.Name, p.Colors>>4, p.Colors&0xf, p.Frags)
+	}
+	return tw.Flush()
+}
+
+func players(p pak.MultiPak, args ...string) {
+	fs := flag.NewFlagSet("players", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -pak <pak0,pak1,...> players [options] <demofile.dem|.qwd|.mvd>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalf("Need to specify one demo name.")
+	}
+	demo := fs.Arg(0)
+	d, err := readDemo(p, demo)
+	if err != nil {
+		log.Fatalf("Opening demo %q: %v", demo, err)
+	}
+	s, err := applyDemo(d, nil)
+	if err != nil {
+		log.Fatalf("Demo error: %v", err)
+	}
+	if err := writePlayers(os.Stdout, s); err != nil {
+		log.Fatal(err)
+	}
+}
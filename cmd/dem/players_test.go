@@ -0,0 +1,50 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+)
+
+func TestWritePlayers(t *testing.T) {
+	s := dem.NewState()
+	for _, m := range []dem.Message{
+		&dem.MsgPlayerName{Index: 0, Name: "player"},
+		&dem.MsgPlayerName{Index: 3, Name: "other"},
+		&dem.MsgSetColors{Player: 3, Color: 0x4d},
+		&dem.MsgFrags{Player: 3, Frags: 0xfffe},
+	} {
+		m.Apply(s)
+	}
+	var b bytes.Buffer
+	if err := writePlayers(&b, s); err != nil {
+		t.Fatal(err)
+	}
+	want := `Slot  Entity  Name    Shirt  Pants  Frags
+0     1       player  0      0      0
+3     4       other   4      13     -2
+`
+	if got := b.String(); got != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+	"github.com/ThomasHabets/qpov/pkg/sound"
+)
+
+// soundEvent is a sound message, at demo time.
+type soundEvent struct {
+	time float64
+	msg  dem.Message
+	name string // Sound file of sounds started.
+}
+
+// frameTime is when a frame was rendered, and where sounds were heard from.
+type frameTime struct {
+	num      int
+	time     float64
+	listener sound.Listener
+}
+
+// soundTrack collects the sounds of a demo being converted, and mixes
+// them into a track aligned with the rendered frames.
+type soundTrack struct {
+	load        func(string) (*sound.Sound, error)
+	fps         float64
+	thirdPerson bool // Sounds of the camera entity aren't heard at full volume.
+	mixer       *sound.Mixer
+
+	// music, if set, loads the channels of CD tracks, which are played at
+	// musicVolume. forceTrack, unless -1, is played instead of the tracks
+	// of the levels.
+	music       func(int) ([]*sound.Sound, error)
+	musicVolume float64
+	forceTrack  int
+
+	sounds  map[string]*sound.Sound // Nil for sounds that can't be loaded.
+	tracks  map[int][]*sound.Sound  // Nil for tracks that can't be loaded.
+	started bool
+	events  []soundEvent
+	frames  []frameTime
+}
+
+func newSoundTrack(load func(string) (*sound.Sound, error), fps float64) *soundTrack {
+	return &soundTrack{
+		load:        load,
+		fps:         fps,
+		mixer:       sound.NewMixer(),
+		musicVolume: 1,
+		forceTrack:  -1,
+		sounds:      make(map[string]*sound.Sound),
+		tracks:      make(map[int][]*sound.Sound),
+	}
+}
+
+// soundName returns the file of a precached sound, or "" if there is none.
+func soundName(s *dem.State, n int) string {
+	if n <= 0 || n >= len(s.ServerInfo.Sounds) {
+		return ""
+	}
+	return s.ServerInfo.Sounds[n]
+}
+
+// message records sound messages, which have been applied to s.
+func (st *soundTrack) message(msg dem.Message, s *dem.State) {
+	if !st.started {
+		// Playback may start after the music started, such as when
+		// skipping ahead.
+		st.started = true
+		before := s.CDTracks
+		if _, ok := msg.(*dem.MsgCDTrack); ok {
+			before = before[:len(before)-1]
+		}
+		if n := len(before); n > 0 {
+			st.events = append(st.events, soundEvent{time: before[n-1].Time, msg: &before[n-1].Track})
+		}
+	}
+	e := soundEvent{time: s.Time, msg: msg}
+	switch m := msg.(type) {
+	case *dem.MsgPlaySound:
+		if e.name = soundName(s, m.Sound); e.name == "" {
+			return
+		}
+	case *dem.MsgSpawnStaticSound:
+		if e.name = soundName(s, int(m.Sound)); e.name == "" {
+			return
+		}
+	case *dem.MsgStopSound, *dem.ServerInfo, *dem.MsgCDTrack:
+	default:
+		return
+	}
+	st.events = append(st.events, e)
+}
+
+// listener returns where the camera hears sounds from.
+func listener(cam dem.Camera, entity int) sound.Listener {
+	return sound.Listener{
+		Pos:    sound.Vertex{X: float64(cam.Pos.X), Y: float64(cam.Pos.Y), Z: float64(cam.Pos.Z)},
+		Right:  rightVector(cam.Angle),
+		Entity: entity,
+	}
+}
+
+// frame records where sounds are heard from in a frame.
+func (st *soundTrack) frame(f *dem.Frame) {
+	ent := f.State.CameraEnt
+	if st.thirdPerson {
+		ent = 0
+	}
+	st.frames = append(st.frames, frameTime{num: f.Num, time: f.Time, listener: listener(f.Camera, ent)})
+}
+
+// sound returns a loaded sound, or nil if it can't be loaded.
+func (st *soundTrack) sound(name string) *sound.Sound {
+	s, found := st.sounds[name]
+	if !found {
+		var err error
+		if s, err = st.load(name); err != nil {
+			log.Printf("Failed to load sound %q: %v", name, err)
+			s = nil
+		} else {
+			s = s.Resample(st.mixer.Rate)
+		}
+		st.sounds[name] = s
+	}
+	return s
+}
+
+// track returns the channels of a loaded CD track, or nil if it can't be
+// loaded.
+func (st *soundTrack) track(n int) []*sound.Sound {
+	chans, found := st.tracks[n]
+	if !found {
+		var err error
+		if chans, err = st.music(n); err != nil {
+			log.Printf("Failed to load music: %v", err)
+			chans = nil
+		}
+		for c := range chans {
+			chans[c] = chans[c].Resample(st.mixer.Rate)
+		}
+		st.tracks[n] = chans
+	}
+	return chans
+}
+
+// playMusic changes the music at track time t.
+func (st *soundTrack) playMusic(t float64, m *dem.MsgCDTrack) {
+	if st.music == nil {
+		return
+	}
+	n := int(m.Track)
+	if st.forceTrack != -1 {
+		n = st.forceTrack
+	}
+	if chans := st.track(n); chans != nil {
+		st.mixer.PlayMusic(t, chans, st.musicVolume)
+	} else {
+		st.mixer.StopMusic(t)
+	}
+}
+
+// schedule plays the sounds in the mixer at their time in the track, and
+// returns the length of the track in seconds.
+func (st *soundTrack) schedule() float64 {
+	if len(st.frames) == 0 {
+		return 0
+	}
+	first := st.frames[0].num
+	trackTime := func(f frameTime) float64 {
+		return float64(f.num-first) / st.fps
+	}
+	for _, f := range st.frames {
+		st.mixer.Listen(trackTime(f), f.listener)
+	}
+
+	// Events are in demo time, and the track is in frame time. Demo time
+	// continues across level changes, but if it still goes backwards, no
+	// frames are rendered until it catches up, so the track time of events
+	// never goes backwards. Sounds started before then aren't heard.
+	cur := 0
+	floor := math.Inf(-1)
+	for _, e := range st.events {
+		for cur+1 < len(st.frames) && st.frames[cur+1].time <= e.time {
+			cur++
+		}
+		t := trackTime(st.frames[cur]) + e.time - st.frames[cur].time
+		if t < floor {
+			if _, ok := e.msg.(*dem.MsgPlaySound); ok {
+				continue
+			}
+			t = floor
+		}
+		floor = t
+		switch m := e.msg.(type) {
+		case *dem.MsgPlaySound:
+			if s := st.sound(e.name); s != nil {
+				pos := sound.Vertex{X: float64(m.X), Y: float64(m.Y), Z: float64(m.Z)}
+				st.mixer.Play(t, s, int(m.Entity), m.Channel, pos, float64(m.Volume)/255, float64(m.Attenuation)/64)
+			}
+		case *dem.MsgSpawnStaticSound:
+			if s := st.sound(e.name); s != nil {
+				pos := sound.Vertex{X: float64(m.Pos.X), Y: float64(m.Pos.Y), Z: float64(m.Pos.Z)}
+				st.mixer.PlayStatic(t, s, pos, float64(m.Volume)/255, float64(m.Attenuation)/64)
+			}
+		case *dem.MsgStopSound:
+			st.mixer.Stop(t, int(m.Entity), int(m.Channel))
+		case *dem.ServerInfo:
+			st.mixer.StopAll(t)
+		case *dem.MsgCDTrack:
+			st.playMusic(t, m)
+		}
+	}
+	last := st.frames[len(st.frames)-1]
+	return trackTime(last) + 1/st.fps
+}
+
+// write writes the mixed track as a WAV file.
+func (st *soundTrack) write(w io.Writer) error {
+	return st.mixer.WriteWAV(w, st.schedule())
+}
+
+// writeFile writes the mixed track to a WAV file.
+func (st *soundTrack) writeFile(fn string) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err := st.write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %q: %v", fn, err)
+	}
+	return f.Close()
+}
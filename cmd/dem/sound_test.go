@@ -0,0 +1,172 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+	"github.com/ThomasHabets/qpov/pkg/sound"
+)
+
+func TestListener(t *testing.T) {
+	for _, test := range []struct {
+		angle dem.Vertex
+		want  sound.Vertex
+	}{
+		{dem.Vertex{}, sound.Vertex{Y: -1}},
+		{dem.Vertex{Y: 90}, sound.Vertex{X: 1}},
+		{dem.Vertex{X: 45, Y: 180}, sound.Vertex{Y: 1}},
+		{dem.Vertex{Z: 90}, sound.Vertex{Z: -1}},
+	} {
+		l := listener(dem.Camera{Pos: dem.Vertex{X: 1, Y: 2, Z: 3}, Angle: test.angle}, 5)
+		got := l.Right
+		if math.Abs(got.X-test.want.X) > 1e-6 || math.Abs(got.Y-test.want.Y) > 1e-6 || math.Abs(got.Z-test.want.Z) > 1e-6 {
+			t.Errorf("angle %v: got right %v, want %v", test.angle, got, test.want)
+		}
+		if want := (sound.Vertex{X: 1, Y: 2, Z: 3}); l.Pos != want || l.Entity != 5 {
+			t.Errorf("angle %v: got pos %v entity %d, want %v 5", test.angle, l.Pos, l.Entity, want)
+		}
+	}
+}
+
+func TestSoundTrack(t *testing.T) {
+	const rate = 100
+	loads := 0
+	st := newSoundTrack(func(name string) (*sound.Sound, error) {
+		loads++
+		if name != "a.wav" {
+			return nil, fmt.Errorf("no such sound")
+		}
+		s := &sound.Sound{Rate: rate, Samples: make([]float32, rate), LoopStart: -1}
+		for n := range s.Samples {
+			s.Samples[n] = 1
+		}
+		return s, nil
+	}, 10)
+	st.mixer.Rate = rate
+	st.mixer.Volume = 1
+
+	s := dem.NewState()
+	play := func(tm float64, snd int) {
+		s.Time = tm
+		m := &dem.MsgPlaySound{Sound: snd, Entity: 1, Channel: 1, Volume: 255}
+		m.Apply(s)
+		st.message(m, s)
+	}
+	level := func(tm float64) {
+		s.Time = tm
+		m := &dem.ServerInfo{Sounds: []string{"", "a.wav", "missing.wav"}}
+		m.Apply(s)
+		st.message(m, s)
+	}
+	frame := func(num int) {
+		st.frame(&dem.Frame{Num: num, Time: float64(num) / 10, State: s})
+	}
+
+	// Playback starts at frame 5.
+	level(0)
+	frame(5)
+	frame(6)
+	play(0.7, 1)
+	play(0.7, 2)
+	frame(7)
+	st.message(&dem.MsgPrint{Text: "ignored"}, s)
+	frame(8)
+	frame(9)
+	// Time going backwards. Frames start when it passes the old time.
+	level(0.95)
+	play(0.2, 1)
+	frame(10)
+	play(1.05, 1)
+	frame(11)
+
+	if got, want := len(st.events), 6; got != want {
+		t.Fatalf("got %d events, want %d", got, want)
+	}
+	out := st.mixer.Mix(st.schedule())
+	if got, want := len(out), 2*70; got != want {
+		t.Fatalf("got %d samples, want %d", got, want)
+	}
+	for n := 0; n < len(out)/2; n++ {
+		var want float32
+		if (n >= 20 && n < 45) || n >= 55 {
+			want = 1
+		}
+		if out[2*n] != want || out[2*n+1] != want {
+			t.Errorf("sample %d: got %g/%g, want %g", n, out[2*n], out[2*n+1], want)
+		}
+	}
+	if got, want := loads, 2; got != want {
+		t.Errorf("got %d sound loads, want %d", got, want)
+	}
+}
+
+func TestSoundTrackMusic(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		forceTrack int
+		want       []float32
+	}{
+		{"level tracks", -1, []float32{2, 4, 1, 3, 0, 0, 1, 3, 2, 4}},
+		{"forced track", 2, []float32{2, 4, 1, 3, 1, 3, 1, 3, 2, 4}},
+	} {
+		var loads []int
+		st := newSoundTrack(func(string) (*sound.Sound, error) {
+			return nil, fmt.Errorf("no sounds")
+		}, 10)
+		st.mixer.Rate = 10
+		st.music = func(n int) ([]*sound.Sound, error) {
+			loads = append(loads, n)
+			if n != 2 {
+				return nil, fmt.Errorf("no track %d", n)
+			}
+			return []*sound.Sound{
+				{Rate: 10, Samples: []float32{1, 2}, LoopStart: -1},
+				{Rate: 10, Samples: []float32{3, 4}, LoopStart: -1},
+			}, nil
+		}
+		st.forceTrack = test.forceTrack
+
+		// Playback starts after the music started.
+		s := dem.NewState()
+		(&dem.MsgCDTrack{Track: 2, Loop: 2}).Apply(s)
+		s.Time = 0.5
+		st.message(&dem.MsgPrint{Text: "ignored"}, s)
+		for num := 5; num < 10; num++ {
+			if num == 7 || num == 8 {
+				s.Time = float64(num) / 10
+				m := &dem.MsgCDTrack{Track: uint8(10 - num), Loop: uint8(10 - num)}
+				m.Apply(s)
+				st.message(m, s)
+			}
+			st.frame(&dem.Frame{Num: num, Time: float64(num) / 10, State: s})
+		}
+		if got := st.mixer.Mix(st.schedule()); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+		if test.forceTrack == -1 && !reflect.DeepEqual(loads, []int{2, 3}) {
+			t.Errorf("%s: loaded tracks %v, want [2 3]", test.name, loads)
+		}
+	}
+}
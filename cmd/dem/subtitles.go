@@ -0,0 +1,364 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+	"github.com/ThomasHabets/qpov/pkg/pak"
+)
+
+const (
+	printTime  = 3  // Seconds console prints are shown, as Quake's con_notifytime.
+	printSpeed = 8  // Characters per second of finale text, as Quake's scr_printspeed.
+	lineWidth  = 40 // Characters per line of center prints in Quake.
+
+	// Finale text is split into subtitles of this many lines, shown for
+	// at least finaleMinTime.
+	finaleLines   = 2
+	finaleMinTime = 2
+)
+
+// Kinds of subtitles.
+const (
+	subPrint  = "print"
+	subCenter = "center"
+	subFinale = "finale"
+)
+
+// videoClock maps demo time to the time of the video rendered by convert,
+// where 0 is the first frame. Demo time continues across level changes, and
+// as in the sound track, it's never taken to go back.
+type videoClock struct {
+	fps     float64
+	started bool
+	start   float64 // Demo time of the first frame.
+	end     float64 // Latest demo time.
+}
+
+// message updates the clock with a message, which has been applied to s.
+func (c *videoClock) message(msg dem.Message, s *dem.State) {
+	if _, ok := msg.(*dem.MsgTime); !ok {
+		return
+	}
+	if !c.started {
+		// Frames are at multiples of 1/fps, from the first time update.
+		c.started = true
+		c.start = math.Ceil(s.Time*c.fps) / c.fps
+		c.end = s.Time
+	}
+	c.end = math.Max(c.end, s.Time)
+}
+
+// now returns the video time of the last message, to the millisecond.
+func (c *videoClock) now() float64 {
+	if !c.started {
+		return 0
+	}
+	return math.Max(0, math.Round((c.end-c.start)*1000)/1000)
+}
+
+// subtitle is text shown from start to end.
+type subtitle struct {
+	start, end float64
+	kind       string
+	text       string
+}
+
+// subtitler collects subtitles from demo messages, timed to the video.
+type subtitler struct {
+	clock    videoClock
+	subs     []subtitle
+	line     string  // Printed text not yet ended with a newline.
+	lineTime float64 // When the line started.
+	center   int     // Index of the last center print or finale, or -1.
+}
+
+func newSubtitler(fps float64) *subtitler {
+	return &subtitler{clock: videoClock{fps: fps}, center: -1}
+}
+
+// plainText turns Quake text into plain text. Red letters become normal
+// letters, and the special characters become their closest ASCII.
+func plainText(s string) string {
+	var b strings.Builder
+	for n := 0; n < len(s); n++ {
+		c := s[n] & 0x7f
+		switch {
+		case c == '\n':
+			b.WriteByte(c)
+		case c >= 0x12 && c <= 0x1b:
+			b.WriteByte('0' + c - 0x12)
+		case c == 0x10:
+			b.WriteByte('[')
+		case c == 0x11:
+			b.WriteByte(']')
+		case c == 0x1c:
+			b.WriteByte('.')
+		case c == 0x1d:
+			b.WriteByte('<')
+		case c == 0x1e:
+			b.WriteByte('-')
+		case c == 0x1f:
+			b.WriteByte('>')
+		case c >= ' ' && c < 0x7f:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// wrapText splits text into lines of at most width characters, breaking
+// at spaces where possible.
+func wrapText(s string, width int) []string {
+	var ret []string
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		for len(l) > width {
+			cut := strings.LastIndexByte(l[:width+1], ' ')
+			if cut <= 0 {
+				cut = width
+			}
+			ret = append(ret, strings.TrimSpace(l[:cut]))
+			l = strings.TrimSpace(l[cut:])
+		}
+		ret = append(ret, l)
+	}
+	return ret
+}
+
+// endCenter ends the shown center print or finale, if any.
+func (st *subtitler) endCenter(t float64) {
+	if st.center < 0 {
+		return
+	}
+	for n := st.center; n < len(st.subs); n++ {
+		if st.subs[n].kind == subPrint {
+			continue
+		}
+		if st.subs[n].start >= t {
+			st.subs = append(st.subs[:n], st.subs[n+1:]...)
+			n--
+			continue
+		}
+		if st.subs[n].end > t {
+			st.subs[n].end = t
+		}
+	}
+	st.center = -1
+}
+
+// print adds console text, showing each line when it's complete.
+func (st *subtitler) print(t float64, text string) {
+	if st.line == "" {
+		st.lineTime = t
+	}
+	st.line += text
+	for {
+		n := strings.IndexByte(st.line, '\n')
+		if n < 0 {
+			break
+		}
+		if l := strings.TrimSpace(st.line[:n]); l != "" {
+			st.subs = append(st.subs, subtitle{start: st.lineTime, end: t + printTime, kind: subPrint, text: l})
+		}
+		st.line = st.line[n+1:]
+		st.lineTime = t
+	}
+}
+
+// finale adds text typed out over the screen, split into subtitles of a
+// few lines each.
+func (st *subtitler) finale(t float64, text string) {
+	var lines []string
+	for _, l := range wrapText(text, lineWidth) {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+	st.center = len(st.subs)
+	for len(lines) > 0 {
+		n := finaleLines
+		if n > len(lines) {
+			n = len(lines)
+		}
+		chunk := strings.Join(lines[:n], "\n")
+		lines = lines[n:]
+		d := float64(len(chunk)) / printSpeed
+		if d < finaleMinTime {
+			d = finaleMinTime
+		}
+		st.subs = append(st.subs, subtitle{start: t, end: t + d, kind: subFinale, text: chunk})
+		t += d
+	}
+}
+
+// message adds the subtitles of a message, which has been applied to s.
+func (st *subtitler) message(msg dem.Message, s *dem.State) {
+	st.clock.message(msg, s)
+	t := st.clock.now()
+	switch m := msg.(type) {
+	case *dem.MsgPrint:
+		st.print(t, plainText(m.Text))
+	case *dem.MsgCenterPrint:
+		st.endCenter(t)
+		text := strings.Join(wrapText(plainText(m.Text), lineWidth), "\n")
+		if text = strings.TrimSpace(text); text != "" {
+			st.center = len(st.subs)
+			st.subs = append(st.subs, subtitle{start: t, end: t + centerTime, kind: subCenter, text: text})
+		}
+	case *dem.MsgIntermission:
+		st.endCenter(t)
+		st.finale(t, plainText(m.Text))
+	case *dem.MsgFinale:
+		st.endCenter(t)
+		st.finale(t, plainText(m.Text))
+	case *dem.MsgCutscene:
+		st.endCenter(t)
+		st.finale(t, plainText(m.Text))
+	case *dem.ServerInfo:
+		// New level.
+		st.endCenter(t)
+	}
+}
+
+// subtitles returns the subtitles, ordered by start time.
+func (st *subtitler) subtitles() []subtitle {
+	ret := append([]subtitle(nil), st.subs...)
+	if l := strings.TrimSpace(st.line); l != "" {
+		ret = append(ret, subtitle{start: st.lineTime, end: st.lineTime + printTime, kind: subPrint, text: l})
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].start < ret[j].start })
+	return ret
+}
+
+// subTime splits seconds into hours, minutes, seconds and milliseconds.
+func subTime(t float64) (int, int, int, int) {
+	if t < 0 {
+		t = 0
+	}
+	ms := int(t*1000 + 0.5)
+	return ms / 3600000, ms / 60000 % 60, ms / 1000 % 60, ms % 1000
+}
+
+// writeSRT writes subtitles in the SubRip format.
+func writeSRT(w io.Writer, subs []subtitle) error {
+	bw := bufio.NewWriter(w)
+	for n, s := range subs {
+		h1, m1, s1, ms1 := subTime(s.start)
+		h2, m2, s2, ms2 := subTime(s.end)
+		fmt.Fprintf(bw, "%d\n%02d:%02d:%02d,%03d --> %02d:%02d:%02d,%03d\n%s\n\n", n+1, h1, m1, s1, ms1, h2, m2, s2, ms2, s.text)
+	}
+	return bw.Flush()
+}
+
+// assHeader is the start of an Advanced SubStation Alpha file, with a
+// style for each kind of subtitle. Prints are at the top left, like the
+// Quake console, and the rest in the middle of the screen.
+const assHeader = `[Script Info]
+ScriptType: v4.00+
+PlayResX: 640
+PlayResY: 480
+
+[V4+ Styles]
+Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding
+Style: print,Monospace,16,&H00FFFFFF,&H00FFFFFF,&H00000000,&H80000000,0,0,0,0,100,100,0,0,1,1,0,7,10,10,10,1
+Style: center,Monospace,20,&H00FFFFFF,&H00FFFFFF,&H00000000,&H80000000,0,0,0,0,100,100,0,0,1,1,0,5,10,10,10,1
+Style: finale,Monospace,20,&H00FFFFFF,&H00FFFFFF,&H00000000,&H80000000,0,0,0,0,100,100,0,0,1,1,0,5,10,10,10,1
+
+[Events]
+Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text
+`
+
+// assTime formats a time as H:MM:SS.CC.
+func assTime(t float64) string {
+	h, m, s, ms := subTime(t)
+	return fmt.Sprintf("%d:%02d:%02d.%02d", h, m, s, ms/10)
+}
+
+// writeASS writes subtitles in the Advanced SubStation Alpha format.
+func writeASS(w io.Writer, subs []subtitle) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(assHeader)
+	r := strings.NewReplacer("\n", `\N`, "{", `\{`, "}", `\}`)
+	for _, s := range subs {
+		fmt.Fprintf(bw, "Dialogue: 0,%s,%s,%s,,0,0,0,,%s\n", assTime(s.start), assTime(s.end), s.kind, r.Replace(s.text))
+	}
+	return bw.Flush()
+}
+
+func subtitles(p pak.MultiPak, args ...string) {
+	fs := flag.NewFlagSet("subtitles", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -pak <pak0,pak1,...> subtitles [options] <demofile.dem|.qwd|.mvd>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	format := fs.String("format", "srt", "Subtitle format: srt or ass.")
+	fps := fs.Float64("fps", 30.0, "Frames per second of the video, as given to convert.")
+	out := fs.String("out", "", "File to write the subtitles to, instead of stdout.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalf("Need to specify one demo name.")
+	}
+	var write func(io.Writer, []subtitle) error
+	switch *format {
+	case "srt":
+		write = writeSRT
+	case "ass":
+		write = writeASS
+	default:
+		log.Fatalf("Unknown subtitle format %q", *format)
+	}
+
+	demo := fs.Arg(0)
+	d, err := readDemo(p, demo)
+	if err != nil {
+		log.Fatalf("Opening demo %q: %v", demo, err)
+	}
+	st := newSubtitler(*fps)
+	if _, err := applyDemo(d, st.message); err != nil {
+		log.Fatalf("Demo error: %v", err)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := write(w, st.subtitles()); err != nil {
+		log.Fatalf("Writing subtitles: %v", err)
+	}
+}
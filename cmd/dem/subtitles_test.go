@@ -0,0 +1,234 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+)
+
+func TestPlainText(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"hello\n", "hello\n"},
+		{"\x02\xc8ello", "Hello"},
+		{"\x10\x12\x1b\x11\x1c\x1d\x1e\x1f", "[09].<->"},
+		{"a\rb\x7f", "ab"},
+	} {
+		if got := plainText(test.in); got != test.want {
+			t.Errorf("plainText(%q): got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	for _, test := range []struct {
+		in    string
+		width int
+		want  []string
+	}{
+		{"", 10, []string{""}},
+		{"short", 10, []string{"short"}},
+		{"one two three", 7, []string{"one two", "three"}},
+		{"  a\nb  ", 7, []string{"a", "b"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+	} {
+		if got := wrapText(test.in, test.width); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("wrapText(%q, %d): got %q, want %q", test.in, test.width, got, test.want)
+		}
+	}
+}
+
+// timedMessage is a message at a demo time.
+type timedMessage struct {
+	time float64
+	msg  dem.Message
+}
+
+// playMessages applies the messages to a new state and passes them to f,
+// with a time update before each message at a new time.
+func playMessages(msgs []timedMessage, f func(dem.Message, *dem.State)) {
+	s := dem.NewState()
+	for n, m := range msgs {
+		if n == 0 || m.time != s.Time {
+			tm := timeMsg(m.time)
+			tm.Apply(s)
+			f(tm, s)
+		}
+		m.msg.Apply(s)
+		f(m.msg, s)
+	}
+}
+
+// checkSubtitles compares subtitles, allowing for rounding.
+func checkSubtitles(t *testing.T, got, want []subtitle) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("Got %d subtitles %+v, want %d", len(got), got, len(want))
+	}
+	for n := range want {
+		g, w := got[n], want[n]
+		if g.kind != w.kind || g.text != w.text || math.Abs(g.start-w.start) > 0.001 || math.Abs(g.end-w.end) > 0.001 {
+			t.Errorf("Subtitle %d: got %+v, want %+v", n, g, w)
+		}
+	}
+}
+
+// qwTestFrame builds a .qwd frame with a server packet at time t. The
+// packet starts with empty packet entities, which carry the time. Strings
+// are written null terminated, and other values as little endian.
+func qwTestFrame(t float32, msgs ...interface{}) []byte {
+	var data bytes.Buffer
+	for _, m := range append([]interface{}{uint32(1), uint32(0), uint8(0x2f), uint16(0)}, msgs...) {
+		if s, ok := m.(string); ok {
+			m = append([]byte(s), 0)
+		}
+		binary.Write(&data, binary.LittleEndian, m)
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, t)
+	binary.Write(&b, binary.LittleEndian, uint8(1)) // dem_read.
+	binary.Write(&b, binary.LittleEndian, uint32(data.Len()))
+	b.Write(data.Bytes())
+	return b.Bytes()
+}
+
+// qwTestServerData is a QuakeWorld svc_serverdata of player 0 on a level.
+func qwTestServerData(level string) []interface{} {
+	return []interface{}{uint8(0x0b), uint32(28), uint32(1), "qw", uint8(0), level, [10]float32{}}
+}
+
+// applyQWTestDemo passes the messages of a .qwd demo to f.
+func applyQWTestDemo(t *testing.T, data []byte, f func(dem.Message, *dem.State)) {
+	t.Helper()
+	d, err := openDemo("test.qwd", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyDemo(d, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubtitler(t *testing.T) {
+	st := newSubtitler(30)
+	playMessages([]timedMessage{
+		{0, &dem.MsgClientState{State: 1}},
+		{1, &dem.MsgPrint{Text: "You got the "}},
+		{1.5, &dem.MsgPrint{Text: "shotgun\nA\n"}},
+		{2, &dem.MsgCenterPrint{Text: "Secret"}},
+		{3, &dem.MsgCenterPrint{Text: "Other\n"}},
+		{10, &dem.MsgFinale{Text: "line one\nline two\nthree"}},
+		{11, &dem.ServerInfo{}},
+		{20, &dem.MsgPrint{Text: "unfinished"}},
+	}, st.message)
+	want := []subtitle{
+		{1, 4.5, subPrint, "You got the shotgun"},
+		{1.5, 4.5, subPrint, "A"},
+		{2, 3, subCenter, "Secret"},
+		{3, 5, subCenter, "Other"},
+		{10, 11, subFinale, "line one\nline two"},
+		{20, 23, subPrint, "unfinished"},
+	}
+	checkSubtitles(t, st.subtitles(), want)
+}
+
+func TestSubtitlerVideoTime(t *testing.T) {
+	st := newSubtitler(10)
+	playMessages([]timedMessage{
+		// Recorded mid-game. The first frame is at 12.4s.
+		{12.34, &dem.MsgPrint{Text: "start\n"}},
+		{15.4, &dem.MsgCenterPrint{Text: "later"}},
+		{20.4, &dem.ServerInfo{}},
+		// The server time starts over on the new level, and the video
+		// continues from 20.4s.
+		{1, &dem.MsgPrint{Text: "new level\n"}},
+		{3, &dem.MsgCenterPrint{Text: "welcome"}},
+		{6, &dem.MsgPrint{Text: "later\n"}},
+	}, st.message)
+	want := []subtitle{
+		{0, 3, subPrint, "start"},
+		{3, 5, subCenter, "later"},
+		{8, 11, subPrint, "new level"},
+		{10, 12, subCenter, "welcome"},
+		{13, 16, subPrint, "later"},
+	}
+	checkSubtitles(t, st.subtitles(), want)
+}
+
+func TestSubtitlerQW(t *testing.T) {
+	st := newSubtitler(10)
+	applyQWTestDemo(t, bytes.Join([][]byte{
+		qwTestFrame(1, append(qwTestServerData("The Abandoned Base"), uint8(0x08), uint8(2), "hello\n")...),
+		qwTestFrame(2, uint8(0x1a), "center"),
+		qwTestFrame(3, uint8(0x09), "bf\n", uint8(0x08), uint8(3), "chat\n"),
+	}, nil), st.message)
+	want := []subtitle{
+		{0, 3, subPrint, "hello"},
+		{1, 3, subCenter, "center"},
+		{2, 5, subPrint, "chat"},
+	}
+	checkSubtitles(t, st.subtitles(), want)
+}
+
+func TestFinaleTiming(t *testing.T) {
+	st := newSubtitler(30)
+	st.finale(10, "line one\nline two\nthree")
+	want := []subtitle{
+		{10, 10 + 17.0/printSpeed, subFinale, "line one\nline two"},
+		{10 + 17.0/printSpeed, 12 + 17.0/printSpeed, subFinale, "three"},
+	}
+	if got := st.subtitles(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteSubtitles(t *testing.T) {
+	subs := []subtitle{
+		{1.5, 3725.25, subCenter, "Hello\n{world}"},
+	}
+	var b bytes.Buffer
+	if err := writeSRT(&b, subs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "1\n00:00:01,500 --> 01:02:05,250\nHello\n{world}\n\n"; got != want {
+		t.Errorf("SRT: got %q, want %q", got, want)
+	}
+
+	b.Reset()
+	if err := writeASS(&b, subs); err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	if !strings.HasPrefix(got, "[Script Info]\n") {
+		t.Errorf("ASS has no header: %q", got)
+	}
+	if want := "Dialogue: 0,0:00:01.50,1:02:05.25,center,,0,0,0,,Hello\\N\\{world\\}\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("ASS: got %q, want it to end with %q", got, want)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"math"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+)
+
+const (
+	// Idle sway, as Quake's v_iroll, v_ipitch and v_iyaw cycles and levels.
+	idleRollCycle  = 0.5
+	idleRollLevel  = 0.1
+	idlePitchCycle = 1
+	idlePitchLevel = 0.3
+	idleYawCycle   = 2
+	idleYawLevel   = 0.3
+
+	// How much Quake raises the weapon at the default view size, to
+	// show the same amount of it.
+	viewWeaponRaise = 2
+)
+
+// viewWeapon returns the weapon to draw in front of the camera, or nil if
+// there is none. It bobs with the movement of the player, and sways by
+// the sway scale (Quake's v_idlescale). If viewBob is set the camera is
+// already bobbing up and down, so the weapon only needs to move forward.
+func viewWeapon(f *dem.Frame, sway float64, viewBob bool) *dem.Entity {
+	s := f.State
+	if s.ViewWeapon == 0 || s.ViewWeapon >= len(s.ServerInfo.Models) || s.Intermission {
+		return nil
+	}
+	bob := dem.ViewBob(s)
+	pitch := float64(f.Camera.Angle.X) * math.Pi / 180
+	yaw := float64(f.Camera.Angle.Y) * math.Pi / 180
+	pos := f.Camera.Pos
+	pos.X += float32(math.Cos(pitch) * math.Cos(yaw) * bob * 0.4)
+	pos.Y += float32(math.Cos(pitch) * math.Sin(yaw) * bob * 0.4)
+	pos.Z += float32(-math.Sin(pitch)*bob*0.4 + viewWeaponRaise)
+	if !viewBob {
+		pos.Z += float32(bob)
+	}
+
+	// The weapon doesn't kick with the view.
+	angle := f.Camera.Angle
+	angle.X -= s.PunchAngle.X
+	angle.Y -= s.PunchAngle.Y
+	angle.Z -= s.PunchAngle.Z
+	angle.X += float32(sway * math.Sin(f.Time*idlePitchCycle) * idlePitchLevel)
+	angle.Y -= float32(sway * math.Sin(f.Time*idleYawCycle) * idleYawLevel)
+	angle.Z -= float32(sway * math.Sin(f.Time*idleRollCycle) * idleRollLevel)
+	return &dem.Entity{
+		Model:   uint16(s.ViewWeapon),
+		Frame:   uint16(s.ViewWeaponFrame),
+		Pos:     pos,
+		Angle:   angle,
+		Visible: true,
+	}
+}
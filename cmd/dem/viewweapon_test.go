@@ -0,0 +1,61 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+)
+
+func TestViewWeapon(t *testing.T) {
+	s := dem.NewState()
+	s.ServerInfo.Models = []string{"", "maps/e1m1.bsp", "progs/v_shot.mdl"}
+	s.CameraEnt = 1
+	f := &dem.Frame{
+		Time:   1,
+		State:  s,
+		Prev:   s,
+		Next:   s,
+		Camera: dem.Camera{Pos: dem.Vertex{X: 1, Y: 2, Z: 3}, Angle: dem.Vertex{X: 10, Y: 20}},
+	}
+	if w := viewWeapon(f, 0, false); w != nil {
+		t.Errorf("Got weapon %+v with no weapon model", w)
+	}
+	s.ViewWeapon = 2
+	s.ViewWeaponFrame = 3
+	want := dem.Entity{
+		Model:   2,
+		Frame:   3,
+		Pos:     dem.Vertex{X: 1, Y: 2, Z: 3 + viewWeaponRaise},
+		Angle:   f.Camera.Angle,
+		Visible: true,
+	}
+	if w := viewWeapon(f, 0, false); w == nil || *w != want {
+		t.Errorf("Got weapon %+v, want %+v", w, want)
+	}
+	if w := viewWeapon(f, 1, false); w == nil || w.Angle == want.Angle {
+		t.Errorf("Weapon doesn't sway: %+v", w)
+	}
+	s.Intermission = true
+	if w := viewWeapon(f, 0, false); w != nil {
+		t.Errorf("Got weapon %+v during intermission", w)
+	}
+}
@@ -138,6 +138,7 @@ func info(p pak.MultiPak, args ...string) {
 	fmt.Printf("Filename: %s\n", model)
 	fmt.Printf("  Triangles: %v\n", len(m.Triangles))
 	fmt.Printf("  EyePosition: %v\n", m.Header.EyePosition)
+	fmt.Printf("  Flags: %v\n", m.Header.Flags)
 	fmt.Printf("Skins: %v\n", len(m.Skins))
 	fmt.Printf("  %6s %16s\n", "Frame#", "Name")
 	for n, f := range m.Frames {
@@ -0,0 +1,140 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+)
+
+// blurSampleRE matches the samples of motion blurred frames, as written by
+// dem convert -motion_blur.
+var blurSampleRE = regexp.MustCompile(`^(.*)-blur\d+$`)
+
+// blurFrame returns the frame that a file name without extension is a
+// motion blur sample of, if it is one.
+func blurFrame(base string) (string, bool) {
+	m := blurSampleRE.FindStringSubmatch(base)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// averageBlur averages the rendered samples of motion blurred frames into
+// the PNG of the frame, for frames that don't have one yet.
+func averageBlur(povs []string) error {
+	samples := make(map[string][]string)
+	for _, f := range povs {
+		base := f[:len(f)-len(path.Ext(f))]
+		if frame, ok := blurFrame(base); ok {
+			samples[frame] = append(samples[frame], base+".png")
+		}
+	}
+	var frames []string
+	for frame := range samples {
+		frames = append(frames, frame)
+	}
+	sort.Strings(frames)
+	for _, frame := range frames {
+		if _, err := os.Stat(frame + ".png"); err == nil {
+			continue
+		}
+		sort.Strings(samples[frame])
+		if err := averagePNGs(frame+".png", samples[frame]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// averagePNGs writes the average of PNG files of the same size.
+func averagePNGs(out string, in []string) error {
+	var sum []uint64
+	var bounds image.Rectangle
+	for n, fn := range in {
+		img, err := readPNG(fn)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			bounds = img.Bounds()
+			sum = make([]uint64, 4*bounds.Dx()*bounds.Dy())
+		} else if img.Bounds() != bounds {
+			return fmt.Errorf("%q is %v, not %v like %q", fn, img.Bounds(), bounds, in[0])
+		}
+		i := 0
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, g, b, a := img.At(x, y).RGBA()
+				sum[i] += uint64(r)
+				sum[i+1] += uint64(g)
+				sum[i+2] += uint64(b)
+				sum[i+3] += uint64(a)
+				i += 4
+			}
+		}
+	}
+	if len(in) == 0 {
+		return fmt.Errorf("no samples for %q", out)
+	}
+	avg := image.NewRGBA64(bounds)
+	n := uint64(len(in))
+	i := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			avg.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(sum[i] / n),
+				G: uint16(sum[i+1] / n),
+				B: uint16(sum[i+2] / n),
+				A: uint16(sum[i+3] / n),
+			})
+			i += 4
+		}
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, avg); err != nil {
+		f.Close()
+		return fmt.Errorf("encoding %q: %v", out, err)
+	}
+	return f.Close()
+}
+
+func readPNG(fn string) (image.Image, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %q: %v", fn, err)
+	}
+	return img, nil
+}
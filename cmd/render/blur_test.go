@@ -0,0 +1,101 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestPNG(t *testing.T, fn string, w int, c color.Gray) {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, w, 1))
+	for x := 0; x < w; x++ {
+		img.SetGray(x, 0, c)
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlurFrame(t *testing.T) {
+	for _, test := range []struct {
+		base  string
+		frame string
+		ok    bool
+	}{
+		{"d/frame-00000012-blur03", "d/frame-00000012", true},
+		{"d/frame-00000012", "", false},
+		{"d/frame-blur-00000012", "", false},
+	} {
+		frame, ok := blurFrame(test.base)
+		if frame != test.frame || ok != test.ok {
+			t.Errorf("%q: got %q %v, want %q %v", test.base, frame, ok, test.frame, test.ok)
+		}
+	}
+}
+
+func TestAverageBlur(t *testing.T) {
+	dir := t.TempDir()
+	fn := func(s string) string { return filepath.Join(dir, s) }
+	writeTestPNG(t, fn("frame-00000001-blur00.png"), 2, color.Gray{Y: 0})
+	writeTestPNG(t, fn("frame-00000001-blur01.png"), 2, color.Gray{Y: 100})
+	writeTestPNG(t, fn("frame-00000002-blur00.png"), 2, color.Gray{Y: 10})
+	writeTestPNG(t, fn("frame-00000002.png"), 2, color.Gray{Y: 200})
+	povs := []string{
+		fn("frame-00000001-blur00.pov"),
+		fn("frame-00000001-blur01.pov"),
+		fn("frame-00000002-blur00.pov"),
+		fn("frame-00000003.pov"),
+	}
+	if err := averageBlur(povs); err != nil {
+		t.Fatal(err)
+	}
+	for frame, want := range map[string]uint8{
+		"frame-00000001.png": 50,
+		"frame-00000002.png": 200, // Already averaged.
+	} {
+		img, err := readPNG(fn(frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := color.GrayModel.Convert(img.At(1, 0)).(color.Gray).Y; got != want {
+			t.Errorf("%s: got %d, want %d", frame, got, want)
+		}
+	}
+	if _, err := os.Stat(fn("frame-00000003.png")); err == nil {
+		t.Errorf("frame without motion blur was averaged")
+	}
+
+	writeTestPNG(t, fn("frame-00000004-blur00.png"), 2, color.Gray{})
+	writeTestPNG(t, fn("frame-00000004-blur01.png"), 3, color.Gray{})
+	if err := averageBlur([]string{fn("frame-00000004-blur00.pov"), fn("frame-00000004-blur01.pov")}); err == nil {
+		t.Errorf("samples of different sizes: expected error")
+	}
+}
@@ -49,7 +49,7 @@ func doRender(files <-chan string, done chan<- bool) {
 		func() {
 			ext := path.Ext(f)
 			base := f[:len(f)-len(ext)]
-			if _, err := os.Stat(base + ".png"); err == nil {
+			if rendered(base) {
 				return
 			}
 
@@ -140,6 +140,12 @@ func main() {
 			break
 		}
 	}
+	if err := averageBlur(flag.Args()); err != nil {
+		log.Fatalf("Averaging motion blur samples: %v", err)
+	}
+	if err := stitchStereo(flag.Args()); err != nil {
+		log.Fatalf("Stitching stereo frames: %v", err)
+	}
 	mutex.Lock()
 	defer mutex.Unlock()
 	totalTime := time.Since(st)
@@ -0,0 +1,145 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+)
+
+// stereoEyeRE matches the eyes of stereo frames, as written by
+// dem convert -camera_stereo.
+var stereoEyeRE = regexp.MustCompile(`^(.*)-(sbs|ou)-(left|right)$`)
+
+// stereoFrame returns the frame, layout and eye that a file name without
+// extension is a stereo eye of, if it is one.
+func stereoFrame(base string) (frame, layout, eye string, ok bool) {
+	m := stereoEyeRE.FindStringSubmatch(base)
+	if m == nil {
+		return "", "", "", false
+	}
+	return m[1], m[2], m[3], true
+}
+
+// rendered returns true if the PNG of a file name without extension, or of
+// any frame it's a motion blur sample or stereo eye of, already exists.
+func rendered(base string) bool {
+	for {
+		if _, err := os.Stat(base + ".png"); err == nil {
+			return true
+		}
+		if frame, ok := blurFrame(base); ok {
+			base = frame
+		} else if frame, _, _, ok := stereoFrame(base); ok {
+			base = frame
+		} else {
+			return false
+		}
+	}
+}
+
+type stereoPair struct {
+	layout      string
+	left, right string
+}
+
+// stitchStereo stitches the rendered eyes of stereo frames into the PNG of
+// the frame, for frames that don't have one yet. Side by side puts the left
+// eye on the left, over-under puts it on top.
+func stitchStereo(povs []string) error {
+	pairs := make(map[string]*stereoPair)
+	for _, f := range povs {
+		base := f[:len(f)-len(path.Ext(f))]
+		if frame, ok := blurFrame(base); ok {
+			base = frame
+		}
+		frame, layout, eye, ok := stereoFrame(base)
+		if !ok {
+			continue
+		}
+		p := pairs[frame]
+		if p == nil {
+			p = &stereoPair{layout: layout}
+			pairs[frame] = p
+		}
+		if eye == "left" {
+			p.left = base + ".png"
+		} else {
+			p.right = base + ".png"
+		}
+	}
+	var frames []string
+	for frame := range pairs {
+		frames = append(frames, frame)
+	}
+	sort.Strings(frames)
+	for _, frame := range frames {
+		if _, err := os.Stat(frame + ".png"); err == nil {
+			continue
+		}
+		p := pairs[frame]
+		if p.left == "" || p.right == "" {
+			return fmt.Errorf("frame %q is missing an eye", frame)
+		}
+		if err := stitchPNGs(frame+".png", p.layout, p.left, p.right); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stitchPNGs writes two PNG files of the same size next to each other
+// ("sbs") or on top of each other ("ou").
+func stitchPNGs(out, layout, first, second string) error {
+	a, err := readPNG(first)
+	if err != nil {
+		return err
+	}
+	b, err := readPNG(second)
+	if err != nil {
+		return err
+	}
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return fmt.Errorf("%q is %v, not %v like %q", second, b.Bounds().Size(), a.Bounds().Size(), first)
+	}
+	size := a.Bounds().Size()
+	offset := image.Point{X: size.X}
+	if layout == "ou" {
+		offset = image.Point{Y: size.Y}
+	}
+	img := image.NewRGBA64(image.Rectangle{Max: size.Add(offset)})
+	draw.Draw(img, image.Rectangle{Max: size}, a, a.Bounds().Min, draw.Src)
+	draw.Draw(img, image.Rectangle{Min: offset, Max: offset.Add(size)}, b, b.Bounds().Min, draw.Src)
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return fmt.Errorf("encoding %q: %v", out, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,120 @@
+package main
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStereoFrame(t *testing.T) {
+	for _, test := range []struct {
+		base               string
+		frame, layout, eye string
+		ok                 bool
+	}{
+		{"d/frame-00000012-sbs-left", "d/frame-00000012", "sbs", "left", true},
+		{"d/frame-00000012-ou-right", "d/frame-00000012", "ou", "right", true},
+		{"d/frame-00000012-sbs-left-blur01", "", "", "", false},
+		{"d/frame-00000012", "", "", "", false},
+	} {
+		frame, layout, eye, ok := stereoFrame(test.base)
+		if frame != test.frame || layout != test.layout || eye != test.eye || ok != test.ok {
+			t.Errorf("%q: got %q %q %q %v, want %q %q %q %v", test.base, frame, layout, eye, ok, test.frame, test.layout, test.eye, test.ok)
+		}
+	}
+}
+
+func TestRendered(t *testing.T) {
+	dir := t.TempDir()
+	fn := func(s string) string { return filepath.Join(dir, s) }
+	writeTestPNG(t, fn("frame-00000001.png"), 1, color.Gray{})
+	writeTestPNG(t, fn("frame-00000002-sbs-left.png"), 1, color.Gray{})
+	for _, test := range []struct {
+		base string
+		want bool
+	}{
+		{"frame-00000001", true},
+		{"frame-00000001-blur00", true},
+		{"frame-00000001-ou-right-blur00", true},
+		{"frame-00000002-sbs-left-blur03", true},
+		{"frame-00000002-sbs-right-blur03", false},
+		{"frame-00000003", false},
+	} {
+		if got := rendered(fn(test.base)); got != test.want {
+			t.Errorf("%q: got %v, want %v", test.base, got, test.want)
+		}
+	}
+}
+
+func TestStitchStereo(t *testing.T) {
+	dir := t.TempDir()
+	fn := func(s string) string { return filepath.Join(dir, s) }
+	writeTestPNG(t, fn("frame-00000001-sbs-left.png"), 2, color.Gray{Y: 10})
+	writeTestPNG(t, fn("frame-00000001-sbs-right.png"), 2, color.Gray{Y: 20})
+	writeTestPNG(t, fn("frame-00000002-ou-left.png"), 2, color.Gray{Y: 30})
+	writeTestPNG(t, fn("frame-00000002-ou-right.png"), 2, color.Gray{Y: 40})
+	povs := []string{
+		fn("frame-00000001-sbs-left.pov"),
+		fn("frame-00000001-sbs-right.pov"),
+		fn("frame-00000002-ou-left-blur00.pov"),
+		fn("frame-00000002-ou-right-blur00.pov"),
+		fn("frame-00000003.pov"),
+	}
+	if err := stitchStereo(povs); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		frame string
+		w, h  int
+		x, y  int
+		want  uint8
+	}{
+		{"frame-00000001.png", 4, 1, 1, 0, 10},
+		{"frame-00000001.png", 4, 1, 2, 0, 20},
+		{"frame-00000002.png", 2, 2, 1, 0, 30},
+		{"frame-00000002.png", 2, 2, 1, 1, 40},
+	} {
+		img, err := readPNG(fn(test.frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := img.Bounds().Size(); s.X != test.w || s.Y != test.h {
+			t.Errorf("%s: got size %v, want %dx%d", test.frame, s, test.w, test.h)
+		}
+		if got := color.GrayModel.Convert(img.At(test.x, test.y)).(color.Gray).Y; got != test.want {
+			t.Errorf("%s at %d,%d: got %d, want %d", test.frame, test.x, test.y, got, test.want)
+		}
+	}
+	if _, err := os.Stat(fn("frame-00000003.png")); err == nil {
+		t.Errorf("frame without stereo was stitched")
+	}
+
+	writeTestPNG(t, fn("frame-00000004-sbs-left.png"), 2, color.Gray{})
+	writeTestPNG(t, fn("frame-00000004-sbs-right.png"), 3, color.Gray{})
+	if err := stitchStereo([]string{fn("frame-00000004-sbs-left.pov"), fn("frame-00000004-sbs-right.pov")}); err == nil {
+		t.Errorf("eyes of different sizes: expected error")
+	}
+	if err := stitchStereo([]string{fn("frame-00000005-sbs-left.pov")}); err == nil {
+		t.Errorf("missing eye: expected error")
+	}
+}
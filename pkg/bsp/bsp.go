@@ -36,6 +36,14 @@ import (
 const (
 	// Prefix for all BSP file macros.
 	macroPrefix = "modelprefix_"
+
+	// LightStyleArray is the POV array of light style brightness that
+	// BSP lights are scaled by. Declare it before including the level
+	// to animate the lights. Otherwise all styles are at normal brightness.
+	LightStyleArray = "light_style"
+
+	// Number of light styles.
+	maxLightStyles = 64
 )
 
 var (
@@ -107,8 +115,11 @@ func ModelMacroPrefix(s string) string {
 }
 
 // POVLights returns the static light sources in a BSP, in POV-Ray format.
+// Each light is scaled by its light style in the LightStyleArray array.
 func (bsp *BSP) POVLights() string {
-	ret := []string{}
+	ret := []string{fmt.Sprintf(`#ifndef (%s)
+#declare %s = array[%d] {%s}
+#end`, LightStyleArray, LightStyleArray, maxLightStyles, strings.TrimSuffix(strings.Repeat("1,", maxLightStyles), ","))}
 	for _, ent := range bsp.Raw.Entities {
 		// TODO: There are more complicated light sources.
 		if strings.HasPrefix(ent.Data["classname"], "light") {
@@ -117,14 +128,18 @@ func (bsp *BSP) POVLights() string {
 				brightness = 200.0
 			}
 			brightness /= 200.0 // 200.0 is Quake baseline.
+			style, err := strconv.Atoi(ent.Data["style"])
+			if err != nil || style < 0 || style >= maxLightStyles {
+				style = 0
+			}
 			// TODO: I think brightness should actually multiply with fade_distance, not color.
 			ret = append(ret, fmt.Sprintf(`
 light_source {
   <%v>
-  rgb<1,1,1>*%g*%g
+  rgb<1,1,1>*%g*%g*%s[%d]
   fade_distance %g
   fade_power %g
-}`, ent.Pos.String(), brightness, *lightMultiplier, *lightFadeDistance, *lightFadePower))
+}`, ent.Pos.String(), brightness, *lightMultiplier, LightStyleArray, style, *lightFadeDistance, *lightFadePower))
 		}
 	}
 	return strings.Join(ret, "\n")
@@ -22,6 +22,7 @@ package bsp
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -36,6 +37,9 @@ func TestSizes(t *testing.T) {
 		{RawMipTex{}, fileMiptexSize},
 		{Vertex{}, fileVertexSize},
 		{RawEdge{}, fileEdgeSize},
+		{RawPlane{}, filePlaneSize},
+		{RawNode{}, fileNodeSize},
+		{RawLeaf{}, fileLeafSize},
 	} {
 		typ := reflect.TypeOf(test.obj)
 		got := typ.Size()
@@ -44,3 +48,81 @@ func TestSizes(t *testing.T) {
 		}
 	}
 }
+
+func TestPOVLightStyles(t *testing.T) {
+	b := &BSP{Raw: &Raw{Entities: []Entity{
+		{Data: map[string]string{"classname": "light"}},
+		{Data: map[string]string{"classname": "light_torch_small_walltorch", "style": "5"}},
+		{Data: map[string]string{"classname": "light", "style": "bogus"}},
+		{Data: map[string]string{"classname": "info_player_start", "style": "6"}},
+	}}}
+	got := b.POVLights()
+	if !strings.HasPrefix(got, "#ifndef (light_style)\n") {
+		t.Errorf("Missing default light styles:\n%s", got)
+	}
+	for style, want := range map[string]int{"[0]": 2, "[5]": 1, "[6]": 0} {
+		if n := strings.Count(got, "*light_style"+style); n != want {
+			t.Errorf("Lights with style %s: got %d, want %d", style, n, want)
+		}
+	}
+}
+
+// testTraceBSP returns a level that is solid at x < 0, and water below z = 0
+// where x >= 0.
+func testTraceBSP() *BSP {
+	return &BSP{Raw: &Raw{
+		Models: []RawModel{{NodeID0: 0}},
+		Planes: []RawPlane{
+			{Normal: Vertex{X: 1}},
+			{Normal: Vertex{Z: 1}},
+		},
+		Nodes: []RawNode{
+			{PlaneID: 0, Children: [2]int16{1, ^0}},
+			{PlaneID: 1, Children: [2]int16{^1, ^2}},
+		},
+		Leaves: []RawLeaf{
+			{Contents: ContentsSolid},
+			{Contents: ContentsEmpty},
+			{Contents: ContentsWater},
+		},
+	}}
+}
+
+func TestPointContents(t *testing.T) {
+	b := testTraceBSP()
+	for _, test := range []struct {
+		p    Vertex
+		want int32
+	}{
+		{Vertex{X: 10, Z: 10}, ContentsEmpty},
+		{Vertex{X: 10, Z: -10}, ContentsWater},
+		{Vertex{X: -10, Z: 10}, ContentsSolid},
+		{Vertex{X: -10, Z: -10}, ContentsSolid},
+	} {
+		if got := b.PointContents(test.p); got != test.want {
+			t.Errorf("Contents at %v: got %d, want %d", test.p, got, test.want)
+		}
+	}
+	if got := (&BSP{Raw: &Raw{}}).PointContents(Vertex{}); got != ContentsEmpty {
+		t.Errorf("Contents of empty level: got %d, want %d", got, ContentsEmpty)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	b := testTraceBSP()
+	for _, test := range []struct {
+		a, b Vertex
+		frac float64
+		hit  bool
+	}{
+		{Vertex{X: 10, Z: 10}, Vertex{X: 20, Z: -10}, 1, false},
+		{Vertex{X: 10, Z: 10}, Vertex{X: -10, Z: 10}, 0.5, true},
+		{Vertex{X: 30, Z: -10}, Vertex{X: -10, Z: 10}, 0.75, true},
+		{Vertex{X: -10}, Vertex{X: 10}, 0, true},
+	} {
+		frac, hit := b.Trace(test.a, test.b)
+		if frac != test.frac || hit != test.hit {
+			t.Errorf("Trace %v -> %v: got %g %t, want %g %t", test.a, test.b, frac, hit, test.frac, test.hit)
+		}
+	}
+}
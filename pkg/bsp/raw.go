@@ -45,6 +45,9 @@ const (
 	fileMiptexSize  = 16 + 4 + 4 + 4*4
 	fileVertexSize  = 4 * 3
 	fileEdgeSize    = 2 + 2
+	filePlaneSize   = 3*4 + 4 + 4
+	fileNodeSize    = 4 + 2*2 + 2*3*2 + 2 + 2
+	fileLeafSize    = 4 + 4 + 2*3*2 + 2 + 2 + 4
 
 	// BSP file version.
 	Version = 29
@@ -114,6 +117,36 @@ type RawEdge struct {
 	To   uint16
 }
 
+// A RawPlane is a plane that splits space in BSP nodes and faces.
+// Points p with Normal dot p > Dist are in front of it.
+type RawPlane struct {
+	Normal Vertex
+	Dist   float32
+	Type   int32 // Axis the normal is along (0-2), or closest to (3-5).
+}
+
+// A RawNode is a node of the BSP tree, splitting space by a plane.
+// Children that are negative are leaves, with index ^child.
+type RawNode struct {
+	PlaneID  uint32
+	Children [2]int16 // Front and back.
+	Mins     [3]int16 // Bounding box.
+	Maxs     [3]int16
+	FaceID   uint16
+	FaceNum  uint16
+}
+
+// A RawLeaf is a convex part of space at the bottom of the BSP tree.
+type RawLeaf struct {
+	Contents   int32 // See Contents*.
+	VisOffset  int32 // Offset into the PVS, or -1.
+	Mins       [3]int16
+	Maxs       [3]int16
+	LFaceID    uint16
+	LFaceNum   uint16
+	AmbientSnd [4]uint8 // Water, sky, slime and lava ambient sound levels.
+}
+
 // A RawTexInfo is information about how to apply a texture (MipTex) onto a polygon.
 // Texture coordinates are not attached to vertices directly and interpolated in 2D space,
 // but are instead calculated by mapping world 3D coordinates onto the polygon plane.
@@ -195,6 +228,9 @@ type Raw struct {
 	LEdge      []int32       // Connect faces with edges.
 	TexInfo    []RawTexInfo  // How to apply a miptex to a face.
 	Models     []RawModel    // Parts of geometry. For levels 0 is everything non-movable.
+	Planes     []RawPlane    // Planes of faces and BSP nodes.
+	Nodes      []RawNode     // BSP tree nodes.
+	Leaves     []RawLeaf     // BSP tree leaves.
 }
 
 type myReader interface {
@@ -395,6 +431,51 @@ func LoadRaw(r myReader) (*Raw, error) {
 		}
 	}
 
+	// Load planes.
+	{
+		if raw.Header.Planes.Size%filePlaneSize != 0 {
+			return nil, fmt.Errorf("planes size %v not divisible by %v", raw.Header.Planes.Size, filePlaneSize)
+		}
+		numPlanes := raw.Header.Planes.Size / filePlaneSize
+		raw.Planes = make([]RawPlane, numPlanes, numPlanes)
+		if _, err := r.Seek(int64(raw.Header.Planes.Offset), 0); err != nil {
+			return nil, fmt.Errorf("seeking to planes at %v: %v", raw.Header.Planes.Offset, err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &raw.Planes); err != nil {
+			return nil, fmt.Errorf("reading planes data: %v", err)
+		}
+	}
+
+	// Load nodes.
+	{
+		if raw.Header.Nodes.Size%fileNodeSize != 0 {
+			return nil, fmt.Errorf("nodes size %v not divisible by %v", raw.Header.Nodes.Size, fileNodeSize)
+		}
+		numNodes := raw.Header.Nodes.Size / fileNodeSize
+		raw.Nodes = make([]RawNode, numNodes, numNodes)
+		if _, err := r.Seek(int64(raw.Header.Nodes.Offset), 0); err != nil {
+			return nil, fmt.Errorf("seeking to nodes at %v: %v", raw.Header.Nodes.Offset, err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &raw.Nodes); err != nil {
+			return nil, fmt.Errorf("reading nodes data: %v", err)
+		}
+	}
+
+	// Load leaves.
+	{
+		if raw.Header.Leaves.Size%fileLeafSize != 0 {
+			return nil, fmt.Errorf("leaves size %v not divisible by %v", raw.Header.Leaves.Size, fileLeafSize)
+		}
+		numLeaves := raw.Header.Leaves.Size / fileLeafSize
+		raw.Leaves = make([]RawLeaf, numLeaves, numLeaves)
+		if _, err := r.Seek(int64(raw.Header.Leaves.Offset), 0); err != nil {
+			return nil, fmt.Errorf("seeking to leaves at %v: %v", raw.Header.Leaves.Offset, err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &raw.Leaves); err != nil {
+			return nil, fmt.Errorf("reading leaves data: %v", err)
+		}
+	}
+
 	// Load miptex.
 	{
 		if _, err := r.Seek(int64(raw.Header.Miptex.Offset), 0); err != nil {
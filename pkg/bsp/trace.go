@@ -0,0 +1,107 @@
+package bsp
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+//
+
+// The file contains collision checks against the level geometry.
+
+// Contents of a leaf.
+const (
+	ContentsEmpty = -1
+	ContentsSolid = -2
+	ContentsWater = -3
+	ContentsSlime = -4
+	ContentsLava  = -5
+	ContentsSky   = -6
+)
+
+// planeDist returns the distance from the plane of a node to p. Negative
+// distances are behind the plane.
+func (bsp *BSP) planeDist(node int, p Vertex) float64 {
+	pl := &bsp.Raw.Planes[bsp.Raw.Nodes[node].PlaneID]
+	return pl.Normal.DotProduct(p) - float64(pl.Dist)
+}
+
+// PointContents returns the contents of the level at p, such as
+// ContentsWater. Only the static geometry (model 0) is checked.
+func (bsp *BSP) PointContents(p Vertex) int32 {
+	if len(bsp.Raw.Models) == 0 || len(bsp.Raw.Nodes) == 0 {
+		return ContentsEmpty
+	}
+	node := int(bsp.Raw.Models[0].NodeID0)
+	for {
+		side := 0
+		if bsp.planeDist(node, p) < 0 {
+			side = 1
+		}
+		child := int(bsp.Raw.Nodes[node].Children[side])
+		if child < 0 {
+			return bsp.Raw.Leaves[^child].Contents
+		}
+		node = child
+	}
+}
+
+// Trace follows the line from a to b through the static geometry, and
+// returns how far along it (0-1) it first hits a solid wall. If it's not
+// hit, it returns 1 and false.
+func (bsp *BSP) Trace(a, b Vertex) (float64, bool) {
+	if len(bsp.Raw.Models) == 0 || len(bsp.Raw.Nodes) == 0 {
+		return 1, false
+	}
+	return bsp.trace(int(bsp.Raw.Models[0].NodeID0), a, b, 0, 1)
+}
+
+// trace checks the part of the line from p1 (at fraction f1) to p2 (at f2)
+// against the subtree of child, which is a node or a negated leaf.
+func (bsp *BSP) trace(child int, p1, p2 Vertex, f1, f2 float64) (float64, bool) {
+	if child < 0 {
+		if bsp.Raw.Leaves[^child].Contents == ContentsSolid {
+			return f1, true
+		}
+		return 1, false
+	}
+	node := &bsp.Raw.Nodes[child]
+	d1 := bsp.planeDist(child, p1)
+	d2 := bsp.planeDist(child, p2)
+	switch {
+	case d1 >= 0 && d2 >= 0:
+		return bsp.trace(int(node.Children[0]), p1, p2, f1, f2)
+	case d1 < 0 && d2 < 0:
+		return bsp.trace(int(node.Children[1]), p1, p2, f1, f2)
+	}
+
+	// Split the line on the plane, and check the near side first.
+	frac := d1 / (d1 - d2)
+	mid := Vertex{
+		X: p1.X + float32(frac)*(p2.X-p1.X),
+		Y: p1.Y + float32(frac)*(p2.Y-p1.Y),
+		Z: p1.Z + float32(frac)*(p2.Z-p1.Z),
+	}
+	fmid := f1 + frac*(f2-f1)
+	near, far := node.Children[0], node.Children[1]
+	if d1 < 0 {
+		near, far = far, near
+	}
+	if f, hit := bsp.trace(int(near), p1, mid, f1, fmid); hit {
+		return f, true
+	}
+	return bsp.trace(int(far), mid, p2, fmid, f2)
+}
@@ -0,0 +1,184 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+// The file contains the view blends (color shifts) of the Quake client.
+
+import (
+	"math"
+	"strings"
+
+	"github.com/ThomasHabets/qpov/pkg/bsp"
+)
+
+const (
+	// How fast flashes fade, in percent per second.
+	damageFlashDecay = 150
+	bonusFlashDecay  = 100
+
+	// Most damage flash there can be.
+	maxDamageFlash = 150
+)
+
+// ColorShift tints the view, as Quake's cshift.
+type ColorShift struct {
+	R, G, B uint8
+	Percent float64 // 0-255.
+}
+
+// Color shifts, as in Quake.
+var (
+	shiftWater = ColorShift{R: 130, G: 80, B: 50, Percent: 128}
+	shiftSlime = ColorShift{R: 0, G: 25, B: 5, Percent: 150}
+	shiftLava  = ColorShift{R: 255, G: 80, B: 0, Percent: 150}
+	shiftBonus = ColorShift{R: 215, G: 186, B: 69, Percent: 50}
+
+	shiftQuad            = ColorShift{R: 0, G: 0, B: 255, Percent: 30}
+	shiftSuit            = ColorShift{R: 0, G: 255, B: 0, Percent: 20}
+	shiftInvisibility    = ColorShift{R: 100, G: 100, B: 100, Percent: 100}
+	shiftInvulnerability = ColorShift{R: 255, G: 255, B: 0, Percent: 30}
+)
+
+// ViewFlash is a color shift that fades out, such as from taking damage.
+type ViewFlash struct {
+	ColorShift
+	Time float64 // When the shift was at Percent.
+}
+
+// at returns the color shift at time t, having faded by decay percent per second.
+func (f ViewFlash) at(t, decay float64) ColorShift {
+	c := f.ColorShift
+	if t > f.Time {
+		c.Percent = math.Max(0, c.Percent-(t-f.Time)*decay)
+	}
+	return c
+}
+
+// Blend is the color that the view is blended with, from 0 to 1.
+// A is how much of the color to blend in.
+type Blend struct {
+	R, G, B, A float64
+}
+
+// ContentsShift returns the color shift of the view when in the contents,
+// such as bsp.ContentsWater.
+func ContentsShift(contents int32) ColorShift {
+	switch contents {
+	case bsp.ContentsWater:
+		return shiftWater
+	case bsp.ContentsSlime:
+		return shiftSlime
+	case bsp.ContentsLava:
+		return shiftLava
+	}
+	return ColorShift{}
+}
+
+// ViewContents returns what the view at pos is in, such as
+// bsp.ContentsWater. Without a level, the client data says if the player
+// is in water.
+func (s *State) ViewContents(pos Vertex) int32 {
+	if s.Level != nil {
+		return s.Level.PointContents(bsp.Vertex(pos))
+	}
+	if s.InWater {
+		return bsp.ContentsWater
+	}
+	return bsp.ContentsEmpty
+}
+
+// powerupShift returns the color shift of the active powerup, if any.
+func (s *State) powerupShift() ColorShift {
+	switch {
+	case s.Items&IT_QUAD != 0:
+		return shiftQuad
+	case s.Items&IT_SUIT != 0:
+		return shiftSuit
+	case s.Items&IT_INVISIBILITY != 0:
+		return shiftInvisibility
+	case s.Items&IT_INVULNERABILITY != 0:
+		return shiftInvulnerability
+	}
+	return ColorShift{}
+}
+
+// ViewBlend returns the blend of the view, when the view is in the
+// contents. It combines the contents, damage, bonus and powerup color
+// shifts like Quake does.
+func (s *State) ViewBlend(contents int32) Blend {
+	return blendShifts(
+		ContentsShift(contents),
+		s.DamageFlash.at(s.Time, damageFlashDecay),
+		s.BonusFlash.at(s.Time, bonusFlashDecay),
+		s.powerupShift(),
+	)
+}
+
+// ContentsBlend returns the blend of a view in the contents, without
+// the flashes and powerups of the player.
+func ContentsBlend(contents int32) Blend {
+	return blendShifts(ContentsShift(contents))
+}
+
+// blendShifts combines color shifts, as Quake's V_CalcBlend.
+func blendShifts(shifts ...ColorShift) Blend {
+	var b Blend
+	for _, c := range shifts {
+		a := c.Percent / 255
+		if a <= 0 {
+			continue
+		}
+		b.A += a * (1 - b.A)
+		a /= b.A
+		b.R = b.R*(1-a) + float64(c.R)/255*a
+		b.G = b.G*(1-a) + float64(c.G)/255*a
+		b.B = b.B*(1-a) + float64(c.B)/255*a
+	}
+	b.A = math.Min(1, b.A)
+	return b
+}
+
+func (m MsgDamage) Apply(s *State) {
+	count := math.Max(10, float64(m.Blood)*0.5+float64(m.Armor)*0.5)
+	c := s.DamageFlash.at(s.Time, damageFlashDecay)
+	c.Percent = math.Min(maxDamageFlash, c.Percent+3*count)
+	switch {
+	case m.Armor > m.Blood:
+		c.R, c.G, c.B = 200, 100, 100
+	case m.Armor > 0:
+		c.R, c.G, c.B = 220, 50, 50
+	default:
+		c.R, c.G, c.B = 255, 0, 0
+	}
+	s.DamageFlash = ViewFlash{ColorShift: c, Time: s.Time}
+}
+
+func (m MsgBonusFlash) Apply(s *State) {
+	s.BonusFlash = ViewFlash{ColorShift: shiftBonus, Time: s.Time}
+}
+
+func (m MsgStuffText) Apply(s *State) {
+	// Quake servers flash the screen on pickups with "bf".
+	for _, cmd := range strings.FieldsFunc(m.Text, func(r rune) bool { return r == '\n' || r == ';' }) {
+		if strings.TrimSpace(cmd) == "bf" {
+			MsgBonusFlash{}.Apply(s)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/bsp"
+)
+
+func closeBlend(a, b Blend) bool {
+	const eps = 0.001
+	return math.Abs(a.R-b.R) < eps && math.Abs(a.G-b.G) < eps && math.Abs(a.B-b.B) < eps && math.Abs(a.A-b.A) < eps
+}
+
+func TestViewBlend(t *testing.T) {
+	water := Blend{R: 130.0 / 255, G: 80.0 / 255, B: 50.0 / 255, A: 128.0 / 255}
+	quadA := 30.0 / 255
+	waterQuadA := water.A + quadA*(1-water.A)
+	for _, test := range []struct {
+		name     string
+		contents int32
+		items    uint32
+		msgs     []Message
+		time     float64
+		want     Blend
+	}{
+		{name: "nothing", contents: bsp.ContentsEmpty},
+		{name: "water", contents: bsp.ContentsWater, want: water},
+		{
+			name: "damage",
+			msgs: []Message{&MsgDamage{Blood: 20}},
+			want: Blend{R: 1, A: 30.0 / 255},
+		},
+		{
+			name: "damage fading",
+			msgs: []Message{&MsgDamage{Blood: 20}},
+			time: 0.1,
+			want: Blend{R: 1, A: 15.0 / 255},
+		},
+		{
+			name: "damage faded",
+			msgs: []Message{&MsgDamage{Blood: 20}},
+			time: 0.2,
+		},
+		{
+			name: "damage capped",
+			msgs: []Message{&MsgDamage{Blood: 100}, &MsgDamage{Blood: 100}},
+			want: Blend{R: 1, A: maxDamageFlash / 255.0},
+		},
+		{
+			name: "armor damage",
+			msgs: []Message{&MsgDamage{Armor: 30, Blood: 10}},
+			want: Blend{R: 200.0 / 255, G: 100.0 / 255, B: 100.0 / 255, A: 60.0 / 255},
+		},
+		{
+			name: "bonus",
+			msgs: []Message{&MsgStuffText{Text: "bf\n"}},
+			time: 0.25,
+			want: Blend{R: 215.0 / 255, G: 186.0 / 255, B: 69.0 / 255, A: 25.0 / 255},
+		},
+		{
+			name: "not bonus",
+			msgs: []Message{&MsgStuffText{Text: "bfx\n"}},
+		},
+		{
+			name:  "quad over suit",
+			items: IT_QUAD | IT_SUIT,
+			want:  Blend{B: 1, A: quadA},
+		},
+		{
+			name:     "quad in water",
+			contents: bsp.ContentsWater,
+			items:    IT_QUAD,
+			want: Blend{
+				R: water.R * (1 - quadA/waterQuadA),
+				G: water.G * (1 - quadA/waterQuadA),
+				B: water.B*(1-quadA/waterQuadA) + quadA/waterQuadA,
+				A: waterQuadA,
+			},
+		},
+	} {
+		s := NewState()
+		for _, m := range test.msgs {
+			m.Apply(s)
+		}
+		s.Items = test.items
+		s.Time = test.time
+		if got := s.ViewBlend(test.contents); !closeBlend(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestClientDataBlend(t *testing.T) {
+	s := NewState()
+	(&MsgClientData{Bits: SU_ITEMS | SU_INWATER, Items: IT_QUAD, Health: 100}).Apply(s)
+	if !s.InWater || s.Items != IT_QUAD {
+		t.Errorf("Got in water %t, items %x; want true, %x", s.InWater, s.Items, IT_QUAD)
+	}
+	if got := s.ViewContents(Vertex{}); got != bsp.ContentsWater {
+		t.Errorf("View contents without level: got %d, want water", got)
+	}
+
+	// Items are kept when not sent.
+	(&MsgClientData{Health: 100}).Apply(s)
+	if s.InWater || s.Items != IT_QUAD {
+		t.Errorf("Got in water %t, items %x; want false, %x", s.InWater, s.Items, IT_QUAD)
+	}
+	if got := s.Copy(); got.Items != s.Items || got.InWater != s.InWater {
+		t.Errorf("Copy lost items or water")
+	}
+}
@@ -0,0 +1,216 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// Entities moving further than this along any axis between two
+	// updates have teleported, and are not interpolated. Same as Quake.
+	teleportDistance = 100
+
+	// Time constant of the camera low-pass filter, in seconds.
+	cameraLowPassTime = 0.1
+)
+
+// CameraSmoothing is how the camera moves between the states of the demo.
+type CameraSmoothing int
+
+const (
+	// SmoothLinear interpolates linearly between states.
+	SmoothLinear CameraSmoothing = iota
+
+	// SmoothSpline moves the camera along a Catmull-Rom spline, and turns
+	// it with quaternion slerp.
+	SmoothSpline
+
+	// SmoothLowPass is SmoothSpline with a low-pass filter on top, to
+	// take the edge off shaky movement.
+	SmoothLowPass
+)
+
+var cameraSmoothingNames = map[CameraSmoothing]string{
+	SmoothLinear:  "linear",
+	SmoothSpline:  "spline",
+	SmoothLowPass: "lowpass",
+}
+
+func (c CameraSmoothing) String() string {
+	if s, ok := cameraSmoothingNames[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("CameraSmoothing(%d)", int(c))
+}
+
+// ParseCameraSmoothing parses the name of a camera smoothing, as returned by String().
+func ParseCameraSmoothing(s string) (CameraSmoothing, error) {
+	for c, name := range cameraSmoothingNames {
+		if name == s {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown camera smoothing %q", s)
+}
+
+// teleported returns true if the movement from a to b is a teleport.
+func teleported(a, b Vertex) bool {
+	return math.Abs(float64(b.X-a.X)) > teleportDistance ||
+		math.Abs(float64(b.Y-a.Y)) > teleportDistance ||
+		math.Abs(float64(b.Z-a.Z)) > teleportDistance
+}
+
+// cameraKey is the camera at a time update of the demo.
+type cameraKey struct {
+	time     float64
+	camera   Camera
+	teleport bool // Teleported here from the previous key.
+}
+
+// hermite returns the point at u (0-1) between p1 and p2 on a cubic Hermite
+// spline with tangents m1 and m2.
+func hermite(p1, p2, m1, m2, u float64) float64 {
+	u2 := u * u
+	u3 := u2 * u
+	return (2*u3-3*u2+1)*p1 + (u3-2*u2+u)*m1 + (-2*u3+3*u2)*p2 + (u3-u2)*m2
+}
+
+// splinePos returns the camera position at time t between k1 and k2, on a
+// Catmull-Rom spline. k0 and k3 are the keys before and after, and may be
+// the same as k1 and k2 at the ends or around teleports. Tangents are
+// scaled by time, since keys are not evenly spaced.
+func splinePos(k0, k1, k2, k3 *cameraKey, t float64) Vertex {
+	dt := k2.time - k1.time
+	u := (t - k1.time) / dt
+	tangent := func(a, b *cameraKey, pa, pb float32) float64 {
+		if b.time <= a.time {
+			return 0
+		}
+		return float64(pb-pa) / (b.time - a.time) * dt
+	}
+	axis := func(get func(Vertex) float32) float32 {
+		p0, p1, p2, p3 := get(k0.camera.Pos), get(k1.camera.Pos), get(k2.camera.Pos), get(k3.camera.Pos)
+		return float32(hermite(float64(p1), float64(p2), tangent(k0, k2, p0, p2), tangent(k1, k3, p1, p3), u))
+	}
+	return Vertex{
+		X: axis(func(v Vertex) float32 { return v.X }),
+		Y: axis(func(v Vertex) float32 { return v.Y }),
+		Z: axis(func(v Vertex) float32 { return v.Z }),
+	}
+}
+
+// quat is a rotation quaternion.
+type quat struct {
+	w, x, y, z float64
+}
+
+// quatFromAngles converts pitch, yaw and roll in degrees to a quaternion.
+// Yaw is around Z, pitch around Y and roll around X.
+func quatFromAngles(a Vertex) quat {
+	const half = math.Pi / 360
+	sp, cp := math.Sincos(float64(a.X) * half)
+	sy, cy := math.Sincos(float64(a.Y) * half)
+	sr, cr := math.Sincos(float64(a.Z) * half)
+	return quat{
+		w: cr*cp*cy + sr*sp*sy,
+		x: sr*cp*cy - cr*sp*sy,
+		y: cr*sp*cy + sr*cp*sy,
+		z: cr*cp*sy - sr*sp*cy,
+	}
+}
+
+// angles converts the quaternion back to pitch, yaw and roll in degrees.
+func (q quat) angles() Vertex {
+	const deg = 180 / math.Pi
+	sp := math.Max(-1, math.Min(1, 2*(q.w*q.y-q.z*q.x)))
+	return Vertex{
+		X: float32(math.Asin(sp) * deg),
+		Y: float32(math.Atan2(2*(q.w*q.z+q.x*q.y), 1-2*(q.y*q.y+q.z*q.z)) * deg),
+		Z: float32(math.Atan2(2*(q.w*q.x+q.y*q.z), 1-2*(q.x*q.x+q.y*q.y)) * deg),
+	}
+}
+
+// slerp returns the rotation at u (0-1) of the shortest path from q to r.
+func (q quat) slerp(r quat, u float64) quat {
+	dot := q.w*r.w + q.x*r.x + q.y*r.y + q.z*r.z
+	if dot < 0 {
+		r = quat{-r.w, -r.x, -r.y, -r.z}
+		dot = -dot
+	}
+	var a, b float64
+	if dot > 0.9995 {
+		// Close enough for linear interpolation.
+		a, b = 1-u, u
+	} else {
+		theta := math.Acos(dot)
+		s := math.Sin(theta)
+		a, b = math.Sin((1-u)*theta)/s, math.Sin(u*theta)/s
+	}
+	ret := quat{a*q.w + b*r.w, a*q.x + b*r.x, a*q.y + b*r.y, a*q.z + b*r.z}
+	n := math.Sqrt(ret.w*ret.w + ret.x*ret.x + ret.y*ret.y + ret.z*ret.z)
+	return quat{ret.w / n, ret.x / n, ret.y / n, ret.z / n}
+}
+
+// slerpAngles turns from angles a to b by u (0-1) along the shortest path.
+func slerpAngles(a, b Vertex, u float64) Vertex {
+	return quatFromAngles(a).slerp(quatFromAngles(b), u).angles()
+}
+
+// splineCamera returns the camera at time t. keys must be in time order,
+// with keys[i].time <= t < keys[i+1].time.
+func splineCamera(keys []cameraKey, i int, t float64) Camera {
+	k1 := &keys[i]
+	if i+1 >= len(keys) {
+		return k1.camera
+	}
+	k2 := &keys[i+1]
+	if k2.teleport {
+		// Quake shows the new position right away.
+		if t > k1.time {
+			return k2.camera
+		}
+		return k1.camera
+	}
+	k0, k3 := k1, k2
+	if i > 0 && !k1.teleport {
+		k0 = &keys[i-1]
+	}
+	if i+2 < len(keys) && !keys[i+2].teleport {
+		k3 = &keys[i+2]
+	}
+	return Camera{
+		Pos:   splinePos(k0, k1, k2, k3, t),
+		Angle: slerpAngles(k1.camera.Angle, k2.camera.Angle, (t-k1.time)/(k2.time-k1.time)),
+		FOV:   k1.camera.FOV,
+	}
+}
+
+// lowPass moves the camera from prev towards cur, as a low-pass filter
+// with time step dt.
+func lowPass(prev, cur Camera, dt float64) Camera {
+	alpha := 1 - math.Exp(-dt/cameraLowPassTime)
+	return Camera{
+		Pos:   interpolate(prev.Pos, cur.Pos, alpha),
+		Angle: slerpAngles(prev.Angle, cur.Angle, alpha),
+		FOV:   cur.FOV,
+	}
+}
@@ -0,0 +1,168 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func closeVertex(a, b Vertex, e float64) bool {
+	return math.Abs(float64(a.X-b.X)) < e && math.Abs(float64(a.Y-b.Y)) < e && math.Abs(float64(a.Z-b.Z)) < e
+}
+
+func TestQuatAngles(t *testing.T) {
+	for _, a := range []Vertex{
+		{0, 0, 0},
+		{10, 20, 30},
+		{-45, 170, 0},
+		{80, -90, -10},
+	} {
+		if got := quatFromAngles(a).angles(); !closeVertex(got, a, 0.001) {
+			t.Errorf("Angles %v came back as %v", a, got)
+		}
+	}
+}
+
+func TestSlerpAngles(t *testing.T) {
+	for _, test := range []struct {
+		a, b Vertex
+		u    float64
+		want Vertex
+	}{
+		{Vertex{0, 0, 0}, Vertex{0, 90, 0}, 0.5, Vertex{0, 45, 0}},
+		{Vertex{0, 170, 0}, Vertex{0, -170, 0}, 0.5, Vertex{0, 180, 0}},
+		{Vertex{10, 20, 0}, Vertex{10, 20, 0}, 0.3, Vertex{10, 20, 0}},
+		{Vertex{0, 0, 0}, Vertex{40, 0, 0}, 0.25, Vertex{10, 0, 0}},
+	} {
+		got := slerpAngles(test.a, test.b, test.u)
+		if got.Y < -179 {
+			got.Y += 360
+		}
+		if !closeVertex(got, test.want, 0.001) {
+			t.Errorf("slerpAngles(%v, %v, %g): got %v, want %v", test.a, test.b, test.u, got, test.want)
+		}
+	}
+}
+
+func TestSplineCamera(t *testing.T) {
+	key := func(time, x float32, teleport bool) cameraKey {
+		return cameraKey{time: float64(time), camera: Camera{Pos: Vertex{X: x}}, teleport: teleport}
+	}
+	for _, test := range []struct {
+		keys []cameraKey
+		i    int
+		t    float64
+		want float32
+	}{
+		// Constant speed stays constant, even with uneven keys.
+		{[]cameraKey{key(0, 0, false), key(1, 10, false), key(1.5, 15, false), key(3, 30, false)}, 1, 1.25, 12.5},
+		// Curves are smooth.
+		{[]cameraKey{key(0, 0, false), key(1, 0, false), key(2, 10, false), key(3, 10, false)}, 1, 1.5, 5},
+		{[]cameraKey{key(0, 0, false), key(1, 0, false), key(2, 10, false), key(3, 10, false)}, 1, 1.25, 2.03125},
+		// Teleport shows the new position.
+		{[]cameraKey{key(0, 0, false), key(1, 10, false), key(2, 500, true)}, 1, 1.25, 500},
+		// Teleport doesn't bend the spline.
+		{[]cameraKey{key(0, 0, false), key(1, 500, true), key(2, 510, false), key(3, 520, false)}, 1, 1.5, 505},
+		// Last key.
+		{[]cameraKey{key(0, 0, false), key(1, 10, false)}, 1, 1.5, 10},
+	} {
+		if got := splineCamera(test.keys, test.i, test.t).Pos.X; math.Abs(float64(got-test.want)) > 0.001 {
+			t.Errorf("splineCamera(%v, %d, %g): got %g, want %g", test.keys, test.i, test.t, got, test.want)
+		}
+	}
+}
+
+func TestParseCameraSmoothing(t *testing.T) {
+	for _, c := range []CameraSmoothing{SmoothLinear, SmoothSpline, SmoothLowPass} {
+		got, err := ParseCameraSmoothing(c.String())
+		if err != nil || got != c {
+			t.Errorf("ParseCameraSmoothing(%q): got %v %v, want %v", c.String(), got, err, c)
+		}
+	}
+	if _, err := ParseCameraSmoothing("bezier"); err == nil {
+		t.Errorf("Unknown smoothing: expected error")
+	}
+}
+
+// testCameraDemo is a demo where the camera moves eight units per second,
+// with a teleport at 1.25s.
+func testCameraDemo() []byte {
+	blocks := [][][]byte{{
+		testServerInfo,
+		testMsg(uint8(0x05), uint16(1)),
+		testMsg(uint8(0x16), uint16(1), uint8(3), uint8(0), uint8(0), uint8(0), int16(0), int8(0), int16(0), int8(0), int16(0), int8(0)),
+	}}
+	for n := 1; n <= 20; n++ {
+		x := n * 8
+		if n >= 10 {
+			x += 8000
+		}
+		blocks = append(blocks, [][]byte{
+			testMsg(uint8(0x07), float32(n)/8),
+			testMsg(uint8(0x80|U_ORIGIN1), uint8(1), int16(x)),
+		})
+	}
+	return testDemo(blocks...)
+}
+
+func TestPlayerSmoothing(t *testing.T) {
+	for _, smoothing := range []CameraSmoothing{SmoothLinear, SmoothSpline, SmoothLowPass} {
+		d, err := Open(bytes.NewReader(testCameraDemo()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := NewPlayer(d)
+		p.Smoothing = smoothing
+		var frames []*Frame
+		for f, err := range p.Frames(16) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames = append(frames, f)
+		}
+		if got, want := len(frames), 38; got != want {
+			t.Fatalf("%v: got %d frames, want %d", smoothing, got, want)
+		}
+		for n, f := range frames {
+			if f.Num != n {
+				t.Fatalf("%v: frame %d has number %d", smoothing, n, f.Num)
+			}
+			want := float32(f.Time * 8)
+			switch {
+			case f.Time >= 1.25:
+				want += 1000
+			case f.Time > 1.125:
+				// Teleported to where it is at 1.25.
+				want = 1010
+			}
+			got := f.Camera.Pos.X
+			if smoothing == SmoothLowPass {
+				// Lags behind.
+				if got > want+0.001 || got < want-1 {
+					t.Errorf("%v: frame %d at %g: got %g, want a bit less than %g", smoothing, n, f.Time, got, want)
+				}
+			} else if math.Abs(float64(got-want)) > 0.001 {
+				t.Errorf("%v: frame %d at %g: got %g, want %g", smoothing, n, f.Time, got, want)
+			}
+		}
+	}
+}
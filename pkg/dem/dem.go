@@ -22,23 +22,32 @@ package dem
 //
 // http://demospecs.half-empty.de/lmpc-alpha/
 // http://www.quakewiki.net/archives/demospecs/dem/dem.html
-//
-// TODO
-// * Remove all log.Fatals
-// * Check errors from all read*() calls.
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 
 	"github.com/ThomasHabets/qpov/pkg/bsp"
 )
 
 const (
 	version15         = 15
-	versionQuakeSpasm = 666
+	versionQuakeSpasm = 666 // FitzQuake protocol, also used by QuakeSpasm.
+	versionRMQ        = 999 // FitzQuake protocol with protocol flags.
+
+	// RMQ protocol flags.
+	PRFL_SHORTANGLE  = 1 << 1
+	PRFL_FLOATANGLE  = 1 << 2
+	PRFL_24BITCOORD  = 1 << 3
+	PRFL_FLOATCOORD  = 1 << 4
+	PRFL_EDICTSCALE  = 1 << 5
+	PRFL_ALPHASANITY = 1 << 6
+	PRFL_INT32COORD  = 1 << 7
+	PRFL_MOREFLAGS   = 1 << 31
 
 	// States
 	//	1after model/sound precache, start spawning entities (``prespawn'')
@@ -60,7 +69,44 @@ const (
 	SU_WEAPONFRAME = 0x1000
 	SU_ARMOR       = 0x2000
 	SU_WEAPON      = 0x4000
-	//SU_ = 0x8000
+
+	// FitzQuake client data bits.
+	SU_EXTEND1      = 1 << 15
+	SU_WEAPON2      = 1 << 16
+	SU_ARMOR2       = 1 << 17
+	SU_AMMO2        = 1 << 18
+	SU_SHELLS2      = 1 << 19
+	SU_NAILS2       = 1 << 20
+	SU_ROCKETS2     = 1 << 21
+	SU_CELLS2       = 1 << 22
+	SU_EXTEND2      = 1 << 23
+	SU_WEAPONFRAME2 = 1 << 24
+	SU_WEAPONALPHA  = 1 << 25
+
+	// Client data items.
+	IT_SHOTGUN          = 1 << 0
+	IT_SUPER_SHOTGUN    = 1 << 1
+	IT_NAILGUN          = 1 << 2
+	IT_SUPER_NAILGUN    = 1 << 3
+	IT_GRENADE_LAUNCHER = 1 << 4
+	IT_ROCKET_LAUNCHER  = 1 << 5
+	IT_LIGHTNING        = 1 << 6
+	IT_SHELLS           = 1 << 8
+	IT_NAILS            = 1 << 9
+	IT_ROCKETS          = 1 << 10
+	IT_CELLS            = 1 << 11
+	IT_AXE              = 1 << 12
+	IT_ARMOR1           = 1 << 13
+	IT_ARMOR2           = 1 << 14
+	IT_ARMOR3           = 1 << 15
+	IT_SUPERHEALTH      = 1 << 16
+	IT_KEY1             = 1 << 17
+	IT_KEY2             = 1 << 18
+	IT_INVISIBILITY     = 1 << 19
+	IT_INVULNERABILITY  = 1 << 20
+	IT_SUIT             = 1 << 21
+	IT_QUAD             = 1 << 22
+	IT_SIGIL1           = 1 << 28
 
 	U_MOREBITS   = 0x0001
 	U_ORIGIN1    = 0x0002
@@ -78,8 +124,40 @@ const (
 	U_EFFECTS    = 0x2000
 	U_LONGENTITY = 0x4000
 
+	// FitzQuake entity update bits.
+	U_EXTEND1    = 1 << 15
+	U_ALPHA      = 1 << 16
+	U_FRAME2     = 1 << 17
+	U_MODEL2     = 1 << 18
+	U_LERPFINISH = 1 << 19
+	U_SCALE      = 1 << 20
+	U_EXTEND2    = 1 << 23
+
+	// FitzQuake baseline bits.
+	B_LARGEMODEL = 1 << 0
+	B_LARGEFRAME = 1 << 1
+	B_ALPHA      = 1 << 2
+	B_SCALE      = 1 << 3 // RMQ.
+
+	// FitzQuake sound bits.
+	SND_VOLUME      = 1 << 0
+	SND_ATTENUATION = 1 << 1
+	SND_LARGEENTITY = 1 << 3
+	SND_LARGESOUND  = 1 << 4
+
+	// Volume and attenuation of sounds that don't say.
+	DefaultSoundVolume      = 255
+	DefaultSoundAttenuation = 64
+
 	// Effects
-	EF_MUZZLEFLASH = 0x2
+	EF_BRIGHTFIELD = 1
+	EF_MUZZLEFLASH = 2
+	EF_BRIGHTLIGHT = 4
+	EF_DIMLIGHT    = 8
+	EF_FLAG1       = 16  // QuakeWorld.
+	EF_FLAG2       = 32  // QuakeWorld.
+	EF_BLUE        = 64  // QuakeWorld quad damage.
+	EF_RED         = 128 // QuakeWorld pentagram.
 
 	TE_SPIKE        = 0
 	TE_SUPERSPIKE   = 1
@@ -98,14 +176,49 @@ const (
 	TE_IMPLOSION    = 14
 	TE_RAILTRAIL    = 15
 
-	maxEntities = 1000
+	maxEntities = 8192
+
+	// MaxLightStyles is the number of light styles, as in Quake.
+	MaxLightStyles = 64
+
+	// Light style characters per second.
+	lightStyleRate = 10
+
+	// Size of BlockHeader in the file.
+	blockHeaderSize = 16
+
+	// Largest block we're willing to allocate memory for. Quake itself
+	// is limited to much smaller messages than this.
+	maxBlockSize = 1 << 20
 )
 
 var (
 	Verbose  = false
 	debugEnt = uint16(65000)
+
+	// ErrTruncated is returned when the demo ends in the middle of a block or message.
+	ErrTruncated = errors.New("truncated demo")
+
+	// ErrUnknownMessage is returned when a block contains a message type that is not known.
+	ErrUnknownMessage = errors.New("unknown message type")
 )
 
+// DecodeError is returned when a demo can't be decoded, and says where in the file the
+// problem is. Use errors.Is() to check for ErrTruncated and ErrUnknownMessage.
+type DecodeError struct {
+	Block  int   // Block number, starting at 0.
+	Offset int64 // File offset of the block or message that failed.
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("block %d, offset %d: %v", e.Block, e.Offset, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
 type Vertex struct {
 	X, Y, Z float32
 }
@@ -117,16 +230,48 @@ func (v *Vertex) String() string {
 type Entity struct {
 	Pos     Vertex
 	Angle   Vertex
-	Model   uint8
-	Frame   uint8
+	Model   uint16
+	Frame   uint16
 	Skin    uint8
 	Color   int
+	Effects uint8 // EF_* bits.
+	Alpha   uint8 // FitzQuake encoded alpha. See Opacity().
+	Scale   uint8 // RMQ encoded scale. See Size().
 	Visible bool
+
+	// NoLerp is set if U_NOLERP was sent since the last frame. For the
+	// camera it means a teleport, but servers also set it on every update
+	// of walking monsters.
+	NoLerp bool
+}
+
+// Opacity returns the decoded FitzQuake alpha value of the entity, 0 being invisible and 1 opaque.
+func (e *Entity) Opacity() float64 {
+	if e.Alpha == 0 {
+		// Default.
+		return 1
+	}
+	return float64(e.Alpha-1) / 254
+}
+
+// Size returns the decoded RMQ scale of the entity.
+func (e *Entity) Size() float64 {
+	if e.Scale == 0 {
+		// Default.
+		return 1
+	}
+	return float64(e.Scale) / 16
 }
 
 type Demo struct {
-	r     io.Reader
-	block *bytes.Buffer
+	r      io.Reader
+	offset int64    // Current file offset.
+	proto  protocol // Set by serverinfo messages.
+	qw     *qwDemo  // QuakeWorld state, if this is a QuakeWorld demo.
+
+	// CDTrack is the first line of the file, the CD track playing when
+	// recording started. Usually "-1".
+	CDTrack string
 
 	Level      string
 	CameraEnt  uint16
@@ -143,29 +288,40 @@ type BlockHeader struct {
 	ViewAngle Vertex
 }
 
-func Open(r io.Reader) *Demo {
+// Open starts reading a demo, by reading the initial CD track line.
+func Open(r io.Reader) (*Demo, error) {
+	var offset int64
+	var cdtrack []byte
 	for {
 		ch, err := readUint8(r)
 		if err != nil {
-			log.Fatal(err)
+			return nil, &DecodeError{Offset: offset, Err: truncated(fmt.Errorf("reading CD track line: %w", err))}
 		}
+		offset++
 		if Verbose {
 			log.Printf("Read first line char: %02x", ch)
 		}
 		if ch == '\n' {
 			break
 		}
+		cdtrack = append(cdtrack, ch)
 	}
 	return &Demo{
 		r:        r,
+		offset:   offset,
+		CDTrack:  string(cdtrack),
 		Entities: make([]Entity, maxEntities, maxEntities),
-	}
+	}, nil
 }
 
 type ServerInfo struct {
-	// Protocol version of the server. Quake uses the version value 15 and it is not likely, that this will change.
+	// Protocol version of the server. Quake uses the version value 15,
+	// FitzQuake and QuakeSpasm 666, and RMQ 999.
 	ServerVersion uint32
 
+	// PRFL_* flags. Only used by protocol 999.
+	ProtocolFlags uint32
+
 	MaxClients uint8 // maximum number of clients in this recording. It is 1 in single player recordings or the number after the -listen command line parameter.
 
 	GameType uint8
@@ -175,17 +331,19 @@ type ServerInfo struct {
 	Sounds []string
 }
 
+// readString reads a null terminated string. Quake strings are not UTF-8,
+// so the bytes are kept as they are.
 func readString(r io.Reader) (string, error) {
 	b := make([]byte, 1, 1)
-	ret := ""
+	var ret []byte
 	for {
 		if _, err := r.Read(b); err != nil {
 			return "", err
 		}
 		if b[0] == 0 {
-			return ret, nil
+			return string(ret), nil
 		}
-		ret = fmt.Sprintf("%s%c", ret, b[0])
+		ret = append(ret, b[0])
 	}
 }
 
@@ -193,27 +351,33 @@ func parseServerInfo(r io.Reader) (ServerInfo, error) {
 	var si ServerInfo
 	var err error
 	if err := binary.Read(r, binary.LittleEndian, &si.ServerVersion); err != nil {
-		log.Fatalf("Reading server version: %v", err)
+		return si, fmt.Errorf("reading server version: %w", err)
 	}
-	if (si.ServerVersion != version15) && (si.ServerVersion != versionQuakeSpasm) {
+	switch si.ServerVersion {
+	case version15, versionQuakeSpasm:
+	case versionRMQ:
+		if err := binary.Read(r, binary.LittleEndian, &si.ProtocolFlags); err != nil {
+			return si, fmt.Errorf("reading protocol flags: %w", err)
+		}
+	default:
 		return si, fmt.Errorf("ServerVersion %v not supported", si.ServerVersion)
 	}
 	if err := binary.Read(r, binary.LittleEndian, &si.MaxClients); err != nil {
-		log.Fatalf("Reading max clients: %v", err)
+		return si, fmt.Errorf("reading max clients: %w", err)
 	}
 	if err := binary.Read(r, binary.LittleEndian, &si.GameType); err != nil {
-		log.Fatalf("Reading gametype: %v", err)
+		return si, fmt.Errorf("reading gametype: %w", err)
 	}
 	si.Level, err = readString(r)
 	if err != nil {
-		log.Fatalf("Failed to read map name: %v", err)
+		return si, fmt.Errorf("reading map name: %w", err)
 	}
 
 	// Read model list.
 	for {
 		s, err := readString(r)
 		if err != nil {
-			log.Fatalf("Failed to read model name: %v", err)
+			return si, fmt.Errorf("reading model name: %w", err)
 		}
 		if s == "" {
 			break
@@ -232,7 +396,7 @@ func parseServerInfo(r io.Reader) (ServerInfo, error) {
 	for {
 		s, err := readString(r)
 		if err != nil {
-			log.Fatalf("Failed to read sound name: %v", err)
+			return si, fmt.Errorf("reading sound name: %w", err)
 		}
 		if s == "" {
 			break
@@ -299,14 +463,87 @@ func readInt16(r io.Reader) (int16, error) {
 	return ret, nil
 }
 
-type SoundEvent struct {
+// Fog is the FitzQuake fog setting.
+type Fog struct {
+	Density float32 // 0 means no fog.
+	R, G, B float32 // Color, 0-1.
+}
+
+// TempEntity is a temporary entity spawned in the demo.
+type TempEntity struct {
+	MsgTempEntity
+	Start float64 // Demo time when it was spawned.
+}
+
+// Active returns true if the temp entity is visible at time t.
+func (te *TempEntity) Active(t float64) bool {
+	return t >= te.Start && t < te.Start+te.Duration()
+}
+
+// DynamicLight is a light that's only on for a short time, such as a muzzle flash.
+type DynamicLight struct {
+	Entity   uint16 // Entity that caused it.
+	Pos      Vertex
+	Radius   float32
+	Start    float64 // Demo time when it was turned on.
+	Duration float64
+}
+
+// Active returns true if the light is on at time t.
+func (l *DynamicLight) Active(t float64) bool {
+	return t >= l.Start && t < l.Start+l.Duration
+}
+
+const (
+	// Muzzle flash light, as in Quake.
+	muzzleFlashRadius   = 200
+	muzzleFlashDuration = 0.1
+	muzzleFlashForward  = 18 // Distance in front of the entity.
+	muzzleFlashUp       = 16 // Distance above the entity origin.
+)
+
+// addMuzzleFlash turns on the muzzle flash light of an entity,
+// replacing any old light of that entity.
+func (s *State) addMuzzleFlash(ent uint16) {
+	e := &s.Entities[ent]
+	pitch := float64(e.Angle.X) * math.Pi / 180
+	yaw := float64(e.Angle.Y) * math.Pi / 180
+	var keep []DynamicLight
+	for _, l := range s.Lights {
+		if l.Entity != ent && l.Active(s.Time) {
+			keep = append(keep, l)
+		}
+	}
+	s.Lights = append(keep, DynamicLight{
+		Entity: ent,
+		Pos: Vertex{
+			X: e.Pos.X + float32(muzzleFlashForward*math.Cos(pitch)*math.Cos(yaw)),
+			Y: e.Pos.Y + float32(muzzleFlashForward*math.Cos(pitch)*math.Sin(yaw)),
+			Z: e.Pos.Z - float32(muzzleFlashForward*math.Sin(pitch)) + muzzleFlashUp,
+		},
+		Radius:   muzzleFlashRadius,
+		Start:    s.Time,
+		Duration: muzzleFlashDuration,
+	})
+}
+
+// CDTrackEvent is a change of the music.
+type CDTrackEvent struct {
 	Time  float64
-	Sound MsgPlaySound
+	Track MsgCDTrack
 }
+
 type State struct {
+	// Time is the demo time. The server time starts over on each level, but
+	// Time continues from where the last level ended, so that it doesn't go
+	// back on a level change.
 	Time       float64
+	timeOffset float64 // Added to the server time.
+	newLevel   bool    // Set until the first time update of a new level.
+
 	Entities   []Entity
 	SeenEntity map[uint16]bool
+	baselines  []entityBaseline
 
 	// 2 Means render 3D.
 	ClientState int
@@ -318,22 +555,114 @@ type State struct {
 	ServerInfo         ServerInfo
 	Level              *bsp.BSP
 
-	Sounds []SoundEvent
+	Fog    Fog    // FitzQuake fog.
+	Skybox string // FitzQuake skybox name. Empty means the normal sky.
+
+	// StaticEntities are entities that don't change after being spawned, such as torches.
+	StaticEntities []Entity
+
+	TempEntities []TempEntity
+	Lights       []DynamicLight
+
+	// LightStyles are the animation strings of light styles, e.g. "mmnmmommommnonmmonqnmmo".
+	LightStyles [MaxLightStyles]string
+
+	// CDTracks are the changes of the music, in order. The last one is
+	// playing.
+	CDTracks []CDTrackEvent
+
+	// Players are the player slots. Player n is entity n+1.
+	Players []PlayerInfo
+
+	// ViewWeapon is the model number of the weapon in view, or 0 if none.
+	ViewWeapon      int
+	ViewWeaponFrame int
+
+	// Intermission is set during the intermission and finale, when the
+	// player isn't in the game.
+	Intermission bool
+
+	// View of the player, from client data.
+	ViewHeight float32 // Height of the eyes above the origin.
+	PunchAngle Vertex  // Kick of the view from firing or taking damage.
+	Velocity   Vertex
+	OnGround   bool
+	Dead       bool
+	InWater    bool
+	Items      uint32 // IT_* bits.
+
+	// Screen flashes from taking damage and picking things up.
+	DamageFlash ViewFlash
+	BonusFlash  ViewFlash
+
+	// Status bar of the player, from client data.
+	Health       int
+	Armor        int
+	Ammo         int    // Of the active weapon.
+	AmmoCounts   [4]int // Shells, nails, rockets and cells.
+	ActiveWeapon int    // IT_* bit of the weapon.
+
+	// CenterPrint is the text in the middle of the screen, printed at
+	// CenterPrintTime.
+	CenterPrint     string
+	CenterPrintTime float64
+}
+
+// PlayerInfo is the scoreboard information of a player slot.
+type PlayerInfo struct {
+	Name   string
+	Colors uint8 // Shirt color in the high four bits, pants in the low.
+	Frags  int16
+}
+
+// PlayerEntity returns the entity number of a player slot.
+func PlayerEntity(slot int) int {
+	return slot + 1
+}
+
+// player returns the player slot, adding it if needed.
+func (s *State) player(slot uint8) *PlayerInfo {
+	for int(slot) >= len(s.Players) {
+		s.Players = append(s.Players, PlayerInfo{})
+	}
+	return &s.Players[slot]
+}
+
+// FindPlayer returns the slot of the player with the name, or -1 if there
+// is none. If several players have the name, the first is returned.
+func (s *State) FindPlayer(name string) int {
+	for n, p := range s.Players {
+		if p.Name == name {
+			return n
+		}
+	}
+	return -1
+}
+
+// entityBaseline is what entity fields go back to when an update doesn't
+// send them.
+type entityBaseline struct {
+	alpha, scale uint8
 }
 
 func NewState() *State {
 	return &State{
-		Entities:   make([]Entity, 1000, 1000),
+		Entities:   make([]Entity, maxEntities, maxEntities),
+		baselines:  make([]entityBaseline, maxEntities, maxEntities),
 		SeenEntity: make(map[uint16]bool),
+		ViewHeight: DefaultViewHeight,
 	}
 }
 
 func (s *State) Copy() *State {
 	n := NewState()
 	n.Time = s.Time
+	n.timeOffset = s.timeOffset
+	n.newLevel = s.newLevel
 	for i := range n.Entities {
 		n.Entities[i] = s.Entities[i]
 	}
+	copy(n.baselines, s.baselines)
 	n.CameraViewAngle = s.CameraViewAngle
 	n.CameraSetViewAngle = s.CameraSetViewAngle
 	n.CameraEnt = s.CameraEnt
@@ -342,9 +671,63 @@ func (s *State) Copy() *State {
 	n.SeenEntity = s.SeenEntity
 	n.ServerInfo = s.ServerInfo
 	n.Level = s.Level
+	n.Fog = s.Fog
+	n.Skybox = s.Skybox
+	n.StaticEntities = append([]Entity(nil), s.StaticEntities...)
+	n.TempEntities = append([]TempEntity(nil), s.TempEntities...)
+	n.Lights = append([]DynamicLight(nil), s.Lights...)
+	n.LightStyles = s.LightStyles
+	n.CDTracks = append([]CDTrackEvent(nil), s.CDTracks...)
+	n.Players = append([]PlayerInfo(nil), s.Players...)
+	n.ViewWeapon = s.ViewWeapon
+	n.ViewWeaponFrame = s.ViewWeaponFrame
+	n.Intermission = s.Intermission
+	n.ViewHeight = s.ViewHeight
+	n.PunchAngle = s.PunchAngle
+	n.Velocity = s.Velocity
+	n.OnGround = s.OnGround
+	n.Dead = s.Dead
+	n.InWater = s.InWater
+	n.Items = s.Items
+	n.DamageFlash = s.DamageFlash
+	n.BonusFlash = s.BonusFlash
+	n.Health = s.Health
+	n.Armor = s.Armor
+	n.Ammo = s.Ammo
+	n.AmmoCounts = s.AmmoCounts
+	n.ActiveWeapon = s.ActiveWeapon
+	n.CenterPrint = s.CenterPrint
+	n.CenterPrintTime = s.CenterPrintTime
 	return n
 }
 
+// LightStyle returns the brightness of a light style at the current time.
+func (s *State) LightStyle(n int) float64 {
+	if n < 0 || n >= MaxLightStyles {
+		return 1
+	}
+	return LightStyleBrightness(s.LightStyles[n], s.Time)
+}
+
+// LightStyleBrightness returns the brightness of a light style string at time t.
+// The string is played at 10 characters per second, where 'a' is off and 'm'
+// is normal brightness (1.0). An empty string is normal brightness, and
+// characters below 'a' are off.
+func LightStyleBrightness(style string, t float64) float64 {
+	if len(style) == 0 {
+		return 1
+	}
+	i := int(t*lightStyleRate) % len(style)
+	if i < 0 {
+		i += len(style)
+	}
+	b := int(style[i]) - 'a'
+	if b < 0 {
+		b = 0
+	}
+	return float64(b) / ('m' - 'a')
+}
+
 type Message interface {
 	Apply(*State)
 }
@@ -354,6 +737,7 @@ type MsgIntermission struct {
 }
 
 func (m *MsgIntermission) Apply(s *State) {
+	s.Intermission = true
 	s.CameraSetViewAngle = true
 	s.ViewAngle = s.CameraViewAngle
 }
@@ -363,6 +747,7 @@ type MsgFinale struct {
 }
 
 func (m *MsgFinale) Apply(s *State) {
+	s.Intermission = true
 	s.CameraSetViewAngle = true
 	s.ViewAngle = s.CameraViewAngle
 }
@@ -376,21 +761,25 @@ type MsgLightStyle struct {
 	Style string
 }
 
-func (m MsgLightStyle) Apply(s *State) {}
+func (m MsgLightStyle) Apply(s *State) {
+	if int(m.Index) < MaxLightStyles {
+		s.LightStyles[m.Index] = m.Style
+	}
+}
 
 type MsgPlayerName struct {
 	Index uint8
 	Name  string
 }
 
-func (m MsgPlayerName) Apply(s *State) {}
+func (m MsgPlayerName) Apply(s *State) { s.player(m.Index).Name = m.Name }
 
 type MsgFrags struct {
 	Player uint8
 	Frags  uint16
 }
 
-func (m MsgFrags) Apply(s *State) {}
+func (m MsgFrags) Apply(s *State) { s.player(m.Player).Frags = int16(m.Frags) }
 
 type MsgClientState struct {
 	State uint8
@@ -405,6 +794,15 @@ type MsgUpdate struct {
 	X, Y, Z                            *float32
 	A, B, C                            *float32
 	Model, Skin, Color, Effects, Frame *uint8
+
+	// FitzQuake extensions.
+	Model2, Frame2 *uint8 // High byte of model and frame.
+	Alpha          *uint8
+	Scale          *uint8
+	LerpFinish     *uint8
+
+	// NoLerp says the entity moved in a way that should not be interpolated.
+	NoLerp bool
 }
 
 func (m MsgUpdate) Apply(s *State) {
@@ -430,27 +828,51 @@ func (m MsgUpdate) Apply(s *State) {
 	if m.C != nil {
 		s.Entities[m.Entity].Angle.Z = *m.C
 	}
+	if m.NoLerp {
+		s.Entities[m.Entity].NoLerp = true
+	}
 
 	if m.Model != nil {
 		if m.Entity == debugEnt {
 			log.Printf("  Model; %d", *m.Model)
 		}
-		s.Entities[m.Entity].Model = *m.Model
+		s.Entities[m.Entity].Model = uint16(*m.Model)
 		s.Entities[m.Entity].Skin = 0
 		s.Entities[m.Entity].Color = 0
 		s.Entities[m.Entity].Frame = 0
 	}
+	if m.Model2 != nil {
+		s.Entities[m.Entity].Model = s.Entities[m.Entity].Model&0xff | uint16(*m.Model2)<<8
+	}
 	if m.Skin != nil {
 		s.Entities[m.Entity].Skin = *m.Skin
 	}
 	if m.Color != nil {
 		s.Entities[m.Entity].Color = int(*m.Color)
 	}
+	// Effects are not in the baseline, so if not sent they're off.
+	s.Entities[m.Entity].Effects = 0
 	if m.Effects != nil {
-		// TODO s.Entities[m.Entity].Effects = int(*m.Effects)
+		s.Entities[m.Entity].Effects = *m.Effects
 	}
 	if m.Frame != nil {
-		s.Entities[m.Entity].Frame = *m.Frame
+		s.Entities[m.Entity].Frame = uint16(*m.Frame)
+	}
+	if m.Frame2 != nil {
+		s.Entities[m.Entity].Frame = s.Entities[m.Entity].Frame&0xff | uint16(*m.Frame2)<<8
+	}
+	// Alpha and scale not sent are those of the baseline.
+	s.Entities[m.Entity].Alpha = s.baselines[m.Entity].alpha
+	if m.Alpha != nil {
+		s.Entities[m.Entity].Alpha = *m.Alpha
+	}
+	s.Entities[m.Entity].Scale = s.baselines[m.Entity].scale
+	if m.Scale != nil {
+		s.Entities[m.Entity].Scale = *m.Scale
+	}
+
+	if s.Entities[m.Entity].Effects&EF_MUZZLEFLASH != 0 {
+		MsgMuzzleFlash{Entity: m.Entity}.Apply(s)
 	}
 
 	if false {
@@ -461,10 +883,16 @@ func (m MsgUpdate) Apply(s *State) {
 }
 
 type MsgSpawnBaseline struct {
-	Entity                    uint16
-	X, Y, Z                   float32
-	A, B, C                   float32
-	Model, Frame, Color, Skin uint8
+	Entity       uint16
+	X, Y, Z      float32
+	A, B, C      float32
+	Model, Frame uint16
+	Color, Skin  uint8
+	Alpha        uint8 // FitzQuake alpha.
+	Scale        uint8 // RMQ scale.
+
+	// Version is 1 for svc_spawnbaseline, and 2 for FitzQuake svc_spawnbaseline2.
+	Version int
 }
 
 func (m MsgSpawnBaseline) Apply(s *State) {
@@ -478,12 +906,187 @@ func (m MsgSpawnBaseline) Apply(s *State) {
 	s.Entities[m.Entity].Frame = m.Frame
 	s.Entities[m.Entity].Color = int(m.Color)
 	s.Entities[m.Entity].Skin = m.Skin
+	s.Entities[m.Entity].Alpha = m.Alpha
+	s.Entities[m.Entity].Scale = m.Scale
+	s.baselines[m.Entity] = entityBaseline{alpha: m.Alpha, scale: m.Scale}
+}
+
+// MsgSpawnStatic spawns an entity that never changes, such as a torch.
+// Static entities have no entity number, so Entity is unused.
+type MsgSpawnStatic struct {
+	MsgSpawnBaseline
+}
+
+func (m MsgSpawnStatic) Apply(s *State) {
+	s.StaticEntities = append(s.StaticEntities, Entity{
+		Pos:     Vertex{X: m.X, Y: m.Y, Z: m.Z},
+		Angle:   Vertex{X: m.A, Y: m.B, Z: m.C},
+		Model:   m.Model,
+		Frame:   m.Frame,
+		Color:   int(m.Color),
+		Skin:    m.Skin,
+		Alpha:   m.Alpha,
+		Scale:   m.Scale,
+		Visible: true,
+	})
 }
 
 type MsgDisconnect struct{}
 
 func (m MsgDisconnect) Apply(s *State) {}
 
+// MsgPrint is text printed to the console.
+type MsgPrint struct {
+	Text string
+}
+
+func (m MsgPrint) Apply(s *State) {}
+
+// MsgCenterPrint is text printed in the middle of the screen.
+type MsgCenterPrint struct {
+	Text string
+}
+
+func (m MsgCenterPrint) Apply(s *State) {
+	s.CenterPrint = m.Text
+	s.CenterPrintTime = s.Time
+}
+
+// MsgStuffText is a command for the client to run.
+type MsgStuffText struct {
+	Text string
+}
+
+// MsgClientData is the status of the player: health, ammo, weapon, and
+// view offsets. Fields whose SU_* bit isn't set in Bits were not sent.
+type MsgClientData struct {
+	Bits uint32 // SU_* bits.
+
+	ViewHeight  int8
+	IdealPitch  int8
+	Punch       [3]int8
+	Velocity    [3]int8 // In units of 16 per second.
+	Items       uint32
+	WeaponFrame uint8
+	Armor       uint8
+	Weapon      uint8 // Model number of the view weapon.
+
+	Health       int16
+	Ammo         uint8
+	Shells       uint8
+	Nails        uint8
+	Rockets      uint8
+	Cells        uint8
+	ActiveWeapon uint8
+
+	// FitzQuake high bytes and weapon alpha.
+	Weapon2, Armor2, Ammo2, Shells2, Nails2, Rockets2, Cells2, WeaponFrame2, WeaponAlpha uint8
+}
+
+func (m MsgClientData) Apply(s *State) {
+	s.ViewHeight = DefaultViewHeight
+	if m.Bits&SU_VIEWHEIGHT != 0 {
+		s.ViewHeight = float32(m.ViewHeight)
+	}
+	s.PunchAngle = Vertex{X: float32(m.Punch[0]), Y: float32(m.Punch[1]), Z: float32(m.Punch[2])}
+	s.Velocity = Vertex{X: 16 * float32(m.Velocity[0]), Y: 16 * float32(m.Velocity[1]), Z: 16 * float32(m.Velocity[2])}
+	s.OnGround = m.Bits&SU_ONGROUND != 0
+	s.Dead = m.Health <= 0
+	s.InWater = m.Bits&SU_INWATER != 0
+	if m.Bits&SU_ITEMS != 0 {
+		s.Items = m.Items
+	}
+	s.ViewWeapon = int(m.Weapon) | int(m.Weapon2)<<8
+	s.ViewWeaponFrame = int(m.WeaponFrame) | int(m.WeaponFrame2)<<8
+	s.Health = int(m.Health)
+	s.Armor = int(m.Armor) | int(m.Armor2)<<8
+	s.Ammo = int(m.Ammo) | int(m.Ammo2)<<8
+	s.AmmoCounts = [4]int{
+		int(m.Shells) | int(m.Shells2)<<8,
+		int(m.Nails) | int(m.Nails2)<<8,
+		int(m.Rockets) | int(m.Rockets2)<<8,
+		int(m.Cells) | int(m.Cells2)<<8,
+	}
+	s.ActiveWeapon = int(m.ActiveWeapon)
+}
+
+// MsgStopSound stops the sound playing on an entity channel.
+type MsgStopSound struct {
+	Entity  uint16
+	Channel uint8
+}
+
+func (m MsgStopSound) Apply(s *State) {}
+
+// MsgSetColors sets the shirt and pants colors of a player.
+type MsgSetColors struct {
+	Player uint8
+	Color  uint8
+}
+
+func (m MsgSetColors) Apply(s *State) { s.player(m.Player).Colors = m.Color }
+
+// MsgDamage is the player taking damage, from the direction of Pos.
+type MsgDamage struct {
+	Armor, Blood uint8
+	Pos          Vertex
+}
+
+// MsgSetPause pauses or unpauses the game.
+type MsgSetPause struct {
+	Paused bool
+}
+
+func (m MsgSetPause) Apply(s *State) {}
+
+// MsgKilledMonster counts a killed monster.
+type MsgKilledMonster struct{}
+
+func (m MsgKilledMonster) Apply(s *State) {}
+
+// MsgFoundSecret counts a found secret.
+type MsgFoundSecret struct{}
+
+func (m MsgFoundSecret) Apply(s *State) {}
+
+// MsgSpawnStaticSound starts an ambient sound, such as a torch crackling.
+type MsgSpawnStaticSound struct {
+	Pos         Vertex
+	Sound       uint16
+	Volume      uint8
+	Attenuation uint8 // 64 times the attenuation.
+
+	// Version is 1 for svc_spawnstaticsound, and 2 for FitzQuake svc_spawnstaticsound2.
+	Version int
+}
+
+func (m MsgSpawnStaticSound) Apply(s *State) {}
+
+// MsgCDTrack sets the music.
+type MsgCDTrack struct {
+	Track uint8
+	Loop  uint8 // Track to loop after Track is done.
+}
+
+func (m MsgCDTrack) Apply(s *State) {
+	s.CDTracks = append(s.CDTracks, CDTrackEvent{
+		Time:  s.Time,
+		Track: m,
+	})
+}
+
+// MsgSellScreen shows the shareware "buy the game" screen.
+type MsgSellScreen struct{}
+
+func (m MsgSellScreen) Apply(s *State) {}
+
+// MsgCutscene is like MsgFinale, but for cutscenes in the middle of the game.
+type MsgCutscene struct {
+	Text string
+}
+
+func (m MsgCutscene) Apply(s *State) {}
+
 type MsgPlayerState struct {
 	Key   uint8
 	Value uint32
@@ -497,17 +1100,130 @@ type MsgPlaySound struct {
 	Channel       int // Auto, weapon, voice, item, body
 	Entity        uint16
 	EntityChannel int
-	Volume        int
-	Attenuation   int
+	Volume        int // 0-255.
+	Attenuation   int // 64 times the attenuation.
 }
 
-func (m MsgPlaySound) Apply(s *State) {
-	s.Sounds = append(s.Sounds, SoundEvent{
-		Time:  s.Time,
-		Sound: m,
+// Apply does nothing. Sounds are mixed from the messages, not the state.
+func (m MsgPlaySound) Apply(s *State) {}
+
+// MsgFog is a FitzQuake fog change.
+type MsgFog struct {
+	Density, R, G, B uint8
+	Time             int16 // Fade time in hundredths of a second.
+}
+
+func (m MsgFog) Apply(s *State) {
+	s.Fog = Fog{
+		Density: float32(m.Density) / 255,
+		R:       float32(m.R) / 255,
+		G:       float32(m.G) / 255,
+		B:       float32(m.B) / 255,
+	}
+}
+
+// MsgSkybox is a FitzQuake skybox change.
+type MsgSkybox struct {
+	Name string
+}
+
+func (m MsgSkybox) Apply(s *State) {
+	s.Skybox = m.Name
+}
+
+// MsgBonusFlash is the FitzQuake "bf" message, flashing the screen when picking things up.
+type MsgBonusFlash struct{}
+
+// MsgParticle is a burst of particles, such as blood from a hit.
+// The client draws them. They don't change the state.
+type MsgParticle struct {
+	Pos   Vertex
+	Dir   Vertex // Direction and speed, in units per second divided by 15.
+	Count uint8  // Number of particles. 255 means a rocket explosion.
+	Color uint8  // Palette color. E.g. chunk 0, blood 73, barrel 75 and thunderbolt 225.
+}
+
+func (m MsgParticle) Apply(s *State) {}
+
+// MsgTempEntity is a short lived effect, such as an explosion or a lightning beam.
+type MsgTempEntity struct {
+	Type uint8 // TE_*, or QW_TE_* if QW is set.
+	QW   bool  // QuakeWorld temp entity types.
+
+	Entity      uint16 // Owner of beams.
+	Pos         Vertex // Origin, or start of beams.
+	End         Vertex // End of beams.
+	ColorStart  uint8  // Palette color of TE_EXPLOSION2.
+	ColorLength uint8  // Number of palette colors of TE_EXPLOSION2.
+	Count       uint8  // Amount of QuakeWorld gunshot and blood.
+}
+
+// Beam returns true if the temp entity is a beam from Pos to End.
+func (m *MsgTempEntity) Beam() bool {
+	switch m.Type {
+	case TE_LIGHTNING1, TE_LIGHTNING2, TE_LIGHTNING3:
+		return true
+	case TE_BEAM, TE_RAILTRAIL:
+		return !m.QW
+	}
+	return false
+}
+
+// Explosion returns true if the temp entity is an explosion.
+func (m *MsgTempEntity) Explosion() bool {
+	switch m.Type {
+	case TE_EXPLOSION, TE_TAREXPLOSION:
+		return true
+	case TE_EXPLOSION2:
+		return !m.QW
+	}
+	return false
+}
+
+// Duration returns for how many seconds the effect is visible.
+func (m *MsgTempEntity) Duration() float64 {
+	switch {
+	case m.Explosion():
+		return 0.5
+	case m.Beam():
+		return 0.2
+	case m.Type == TE_LAVASPLASH:
+		return 2.5
+	case m.Type == TE_TELEPORT:
+		return 0.3
+	}
+	return 0.1
+}
+
+func (m MsgTempEntity) Apply(s *State) {
+	var keep []TempEntity
+	for _, te := range s.TempEntities {
+		if s.Time >= te.Start+te.Duration() {
+			continue
+		}
+		if m.Beam() && te.Beam() && m.Entity == te.Entity {
+			// Beams are updated every frame, and replace the old one.
+			continue
+		}
+		keep = append(keep, te)
+	}
+	s.TempEntities = append(keep, TempEntity{
+		MsgTempEntity: m,
+		Start:         s.Time,
 	})
 }
 
+// MsgMuzzleFlash turns on the muzzle flash light of an entity. NetQuake
+// sends it as the EF_MUZZLEFLASH effect of MsgUpdate, and QuakeWorld as
+// a message of its own.
+type MsgMuzzleFlash struct {
+	Entity uint16
+}
+
+func (m MsgMuzzleFlash) Apply(s *State) {
+	s.addMuzzleFlash(m.Entity)
+}
+
 type MsgCameraPos struct {
 	Entity uint16
 }
@@ -527,23 +1243,300 @@ func (m MsgCameraOrientation) Apply(s *State) {
 	s.ViewAngle = s.CameraViewAngle
 }
 
+// Apply starts a new level. As in Quake's CL_ClearState, what was spawned
+// on the old level is removed.
 func (si *ServerInfo) Apply(s *State) {
 	s.ServerInfo = ServerInfo(*si)
+	s.Intermission = false
+	s.StaticEntities = nil
+	s.TempEntities = nil
+	s.Lights = nil
+	s.LightStyles = [MaxLightStyles]string{}
+	s.baselines = make([]entityBaseline, maxEntities, maxEntities)
+	s.newLevel = true
 }
 
 type MsgTime float32
 
-func (m *MsgTime) Apply(s *State) { s.Time = float64(*m) }
+func (m *MsgTime) Apply(s *State) {
+	t := float64(*m)
+	if s.newLevel {
+		s.newLevel = false
+		if t+s.timeOffset < s.Time {
+			// The server time started over on the new level.
+			s.timeOffset = s.Time - t
+		}
+	}
+	s.Time = t + s.timeOffset
+}
 
 type Block struct {
 	Header BlockHeader
+	Num    int   // Block number in the demo, starting at 0.
+	Offset int64 // File offset of the block header.
+	data   int64 // File offset of the block data.
 	buf    *bytes.Buffer
+	size   int
+
+	// Messages decoded but not yet returned, for when one encoded
+	// message turns into many.
+	pending []Message
+
+	// QuakeWorld frame time and incoming sequence number.
+	time     float64
+	sequence uint32
+
+	// Protocol the block is encoded with. Shared with the demo, since
+	// it's changed by the serverinfo message.
+	proto *protocol
+}
+
+// protocol is the encoding version in use.
+type protocol struct {
+	version uint32
+	flags   uint32
+	qw      *qwDemo // Set for QuakeWorld demos.
+}
+
+// fitz returns true if the FitzQuake extensions are in use.
+func (p *protocol) fitz() bool {
+	return p.version == versionQuakeSpasm || p.version == versionRMQ
+}
+
+// coordSize returns the number of bytes used for a coordinate.
+func (p *protocol) coordSize() int {
+	switch {
+	case p.flags&PRFL_FLOATCOORD != 0, p.flags&PRFL_INT32COORD != 0:
+		return 4
+	case p.flags&PRFL_24BITCOORD != 0:
+		return 3
+	}
+	return 2
+}
+
+// protocol returns the protocol to decode the block with.
+func (block *Block) protocol() *protocol {
+	if block.proto == nil {
+		block.proto = &protocol{version: version15}
+	}
+	return block.proto
+}
+
+// readCoord reads a coordinate in the block protocol's format.
+func (block *Block) readCoord() (float32, error) {
+	flags := block.protocol().flags
+	switch {
+	case flags&PRFL_FLOATCOORD != 0:
+		return readFloat(block.buf)
+	case flags&PRFL_INT32COORD != 0:
+		var t int32
+		err := binary.Read(block.buf, binary.LittleEndian, &t)
+		return float32(t) / 16, err
+	case flags&PRFL_24BITCOORD != 0:
+		t, err := readInt16(block.buf)
+		if err != nil {
+			return 0, err
+		}
+		f, err := readUint8(block.buf)
+		return float32(t) + float32(f)/255, err
+	}
+	return readCoord(block.buf)
+}
+
+// readAngle reads an angle in the block protocol's format.
+func (block *Block) readAngle() (float32, error) {
+	flags := block.protocol().flags
+	switch {
+	case flags&PRFL_FLOATANGLE != 0:
+		return readFloat(block.buf)
+	case flags&PRFL_SHORTANGLE != 0:
+		t, err := readInt16(block.buf)
+		return float32(t) * 360.0 / 65536.0, err
+	}
+	return readAngle(block.buf)
+}
+
+// readVertex reads three coordinates.
+func (block *Block) readVertex() (Vertex, error) {
+	var v Vertex
+	var err error
+	for _, p := range []*float32{&v.X, &v.Y, &v.Z} {
+		if *p, err = block.readCoord(); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+// readBaseline reads the part of the baseline shared by spawnbaseline and spawnstatic.
+// Version 2 is the FitzQuake version with flags for larger fields.
+func (block *Block) readBaseline(r *MsgSpawnBaseline, version int) error {
+	var bits uint8
+	var err error
+	r.Version = version
+	if version == 2 {
+		if bits, err = readUint8(block.buf); err != nil {
+			return err
+		}
+	}
+	for _, f := range []struct {
+		bit uint8
+		p   *uint16
+	}{
+		{B_LARGEMODEL, &r.Model},
+		{B_LARGEFRAME, &r.Frame},
+	} {
+		if bits&f.bit != 0 {
+			if *f.p, err = readUint16(block.buf); err != nil {
+				return err
+			}
+		} else {
+			t, err := readUint8(block.buf)
+			if err != nil {
+				return err
+			}
+			*f.p = uint16(t)
+		}
+	}
+	if r.Color, err = readUint8(block.buf); err != nil {
+		return err
+	}
+	if r.Skin, err = readUint8(block.buf); err != nil {
+		return err
+	}
+	for _, p := range []struct{ coord, angle *float32 }{{&r.X, &r.A}, {&r.Y, &r.B}, {&r.Z, &r.C}} {
+		if *p.coord, err = block.readCoord(); err != nil {
+			return err
+		}
+		if *p.angle, err = block.readAngle(); err != nil {
+			return err
+		}
+	}
+	if bits&B_ALPHA != 0 {
+		if r.Alpha, err = readUint8(block.buf); err != nil {
+			return err
+		}
+	}
+	if bits&B_SCALE != 0 {
+		if r.Scale, err = readUint8(block.buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readClientData reads svc_clientdata.
+func (block *Block) readClientData() (*MsgClientData, error) {
+	m := &MsgClientData{}
+	m16, err := readUint16(block.buf)
+	if err != nil {
+		return nil, err
+	}
+	m.Bits = uint32(m16)
+	if m.Bits&SU_EXTEND1 != 0 {
+		t, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		m.Bits |= uint32(t) << 16
+	}
+	if m.Bits&SU_EXTEND2 != 0 {
+		t, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		m.Bits |= uint32(t) << 24
+	}
+	if Verbose {
+		log.Printf("Mask: %04x", m.Bits)
+	}
+	for _, f := range []struct {
+		bit uint32
+		p   *int8
+	}{
+		{SU_VIEWHEIGHT, &m.ViewHeight},
+		{SU_IDEALPITCH, &m.IdealPitch},
+		{SU_PUNCH1, &m.Punch[0]},
+		{SU_VELOCITY1, &m.Velocity[0]},
+		{SU_PUNCH2, &m.Punch[1]},
+		{SU_VELOCITY2, &m.Velocity[1]},
+		{SU_PUNCH3, &m.Punch[2]},
+		{SU_VELOCITY3, &m.Velocity[2]},
+	} {
+		if m.Bits&f.bit != 0 {
+			if *f.p, err = readInt8(block.buf); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if m.Bits&SU_ITEMS != 0 {
+		if m.Items, err = readUint32(block.buf); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range []struct {
+		bit uint32
+		p   *uint8
+	}{
+		{SU_WEAPONFRAME, &m.WeaponFrame},
+		{SU_ARMOR, &m.Armor},
+		{SU_WEAPON, &m.Weapon},
+	} {
+		if m.Bits&f.bit != 0 {
+			if *f.p, err = readUint8(block.buf); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if m.Health, err = readInt16(block.buf); err != nil {
+		return nil, err
+	}
+	for _, p := range []*uint8{&m.Ammo, &m.Shells, &m.Nails, &m.Rockets, &m.Cells, &m.ActiveWeapon} {
+		if *p, err = readUint8(block.buf); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range []struct {
+		bit uint32
+		p   *uint8
+	}{
+		{SU_WEAPON2, &m.Weapon2},
+		{SU_ARMOR2, &m.Armor2},
+		{SU_AMMO2, &m.Ammo2},
+		{SU_SHELLS2, &m.Shells2},
+		{SU_NAILS2, &m.Nails2},
+		{SU_ROCKETS2, &m.Rockets2},
+		{SU_CELLS2, &m.Cells2},
+		{SU_WEAPONFRAME2, &m.WeaponFrame2},
+		{SU_WEAPONALPHA, &m.WeaponAlpha},
+	} {
+		if m.Bits&f.bit != 0 {
+			if *f.p, err = readUint8(block.buf); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// pos returns the current file offset of the decoding.
+func (block *Block) pos() int64 {
+	return block.data + int64(block.size-block.buf.Len())
+}
+
+// skip discards n bytes of the block.
+func (block *Block) skip(n int) error {
+	if block.buf.Len() < n {
+		return ErrTruncated
+	}
+	block.buf.Next(n)
+	return nil
 }
 
 func (block *Block) Messages() ([]Message, error) {
 	messages := []Message{}
 	for {
-		if len(block.buf.String()) == 0 {
+		if block.buf.Len() == 0 && len(block.pending) == 0 {
 			return messages, nil
 		}
 		m, err := block.DecodeMessage()
@@ -554,10 +1547,53 @@ func (block *Block) Messages() ([]Message, error) {
 	}
 }
 
+// DecodeMessage decodes the next message in the block.
+// Errors are of type *DecodeError.
 func (block *Block) DecodeMessage() (Message, error) {
+	if len(block.pending) > 0 {
+		m := block.pending[0]
+		block.pending = block.pending[1:]
+		return m, nil
+	}
+	start := block.pos()
+	decode := block.decodeMessage
+	if block.protocol().qw != nil {
+		decode = block.decodeQWMessage
+	}
+	m, err := decode()
+	if err != nil {
+		return nil, &DecodeError{
+			Block:  block.Num,
+			Offset: start,
+			Err:    truncated(err),
+		}
+	}
+	return m, nil
+}
+
+// truncated turns EOF errors into ErrTruncated, keeping any context.
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %v", ErrTruncated, err)
+	}
+	return err
+}
+
+// checkEntity returns error if the entity number is out of range.
+func checkEntity(e uint16) error {
+	if e >= maxEntities {
+		return fmt.Errorf("entity %d out of range", e)
+	}
+	return nil
+}
+
+func (block *Block) decodeMessage() (Message, error) {
 	typ, err := readUint8(block.buf)
 	if err != nil {
-		log.Fatalf("reading type: %v", err)
+		return nil, err
 	}
 	if Verbose {
 		log.Printf("message type %d (0x%02x)", typ, typ)
@@ -569,69 +1605,92 @@ func (block *Block) DecodeMessage() (Message, error) {
 		return &MsgDisconnect{}, nil
 	case 0x03: // player state
 		r := &MsgPlayerState{}
-		r.Key, _ = readUint8(block.buf)
-		r.Value, _ = readUint32(block.buf)
+		if r.Key, err = readUint8(block.buf); err != nil {
+			return nil, err
+		}
+		if r.Value, err = readUint32(block.buf); err != nil {
+			return nil, err
+		}
 		return r, nil
 	case 0x05: // Camera pos to this entity.
 		r := &MsgCameraPos{}
-		r.Entity, _ = readUint16(block.buf)
+		if r.Entity, err = readUint16(block.buf); err != nil {
+			return nil, err
+		}
+		if err := checkEntity(r.Entity); err != nil {
+			return nil, err
+		}
 		return r, nil
 	case 0x06: // Play sound.
-		snd := MsgPlaySound{}
+		snd := MsgPlaySound{
+			Volume:      DefaultSoundVolume,
+			Attenuation: DefaultSoundAttenuation,
+		}
 		mask, err := readUint8(block.buf)
 		if err != nil {
 			return nil, err
 		}
-		if mask&0x1 != 0 {
+		if mask&SND_VOLUME != 0 {
 			t, err := readUint8(block.buf) // vol
 			if err != nil {
 				return nil, err
 			}
 			snd.Volume = int(t)
 		}
-		if mask&0x2 != 0 {
+		if mask&SND_ATTENUATION != 0 {
 			t, err := readUint8(block.buf) // attenuation
 			if err != nil {
 				return nil, err
 			}
 			snd.Attenuation = int(t)
 		}
-		{
+		if mask&SND_LARGEENTITY != 0 {
+			if snd.Entity, err = readUint16(block.buf); err != nil {
+				return nil, err
+			}
+			t, err := readUint8(block.buf)
+			if err != nil {
+				return nil, err
+			}
+			snd.Channel = int(t)
+		} else {
 			entityChannel, err := readUint16(block.buf)
 			if err != nil {
 				return nil, err
 			}
 			snd.Channel = int(entityChannel) & 0x07
 			snd.Entity = (uint16(entityChannel) >> 3) & 0x1FFF
-			if debugEnt == snd.Entity {
-				log.Printf("Entity %d made a sound", snd.Entity)
-			}
 		}
-		{
+		if debugEnt == snd.Entity {
+			log.Printf("Entity %d made a sound", snd.Entity)
+		}
+		if mask&SND_LARGESOUND != 0 {
+			t, err := readUint16(block.buf)
+			if err != nil {
+				return nil, err
+			}
+			snd.Sound = int(t)
+		} else {
 			t, err := readUint8(block.buf)
 			if err != nil {
 				return nil, err
 			}
 			snd.Sound = int(t)
 		}
-		snd.X, err = readCoord(block.buf)
-		if err != nil {
-			return nil, err
-		}
-		snd.Y, err = readCoord(block.buf)
-		if err != nil {
-			return nil, err
-		}
-		snd.Z, err = readCoord(block.buf)
-		if err != nil {
-			return nil, err
+		for _, p := range []*float32{&snd.X, &snd.Y, &snd.Z} {
+			if *p, err = block.readCoord(); err != nil {
+				return nil, err
+			}
 		}
 		return &snd, nil
 
 	case 0x07: // time
 		t, err := readFloat(block.buf)
+		if err != nil {
+			return nil, err
+		}
 		t2 := MsgTime(t)
-		return &t2, err
+		return &t2, nil
 
 	case 0x08: // Print
 		s, err := readString(block.buf)
@@ -641,6 +1700,7 @@ func (block *Block) DecodeMessage() (Message, error) {
 		if Verbose {
 			log.Printf("Print: %q", s)
 		}
+		return &MsgPrint{Text: s}, nil
 	case 0x09: // Stufftext
 		s, err := readString(block.buf)
 		if err != nil {
@@ -649,16 +1709,17 @@ func (block *Block) DecodeMessage() (Message, error) {
 		if Verbose {
 			log.Printf("Stufftext: %q", s)
 		}
+		return &MsgStuffText{Text: s}, nil
 	case 0x0A: // Camera orientation.
-		x, err := readAngle(block.buf)
+		x, err := block.readAngle()
 		if err != nil {
 			return nil, err
 		}
-		y, err := readAngle(block.buf)
+		y, err := block.readAngle()
 		if err != nil {
 			return nil, err
 		}
-		z, err := readAngle(block.buf)
+		z, err := block.readAngle()
 		if err != nil {
 			return nil, err
 		}
@@ -676,7 +1737,11 @@ func (block *Block) DecodeMessage() (Message, error) {
 		}
 		si, err := parseServerInfo(block.buf)
 		if err != nil {
-			log.Fatalf("Serverinfo: %v", err)
+			return nil, fmt.Errorf("serverinfo: %w", err)
+		}
+		*block.protocol() = protocol{
+			version: si.ServerVersion,
+			flags:   si.ProtocolFlags,
 		}
 		return &si, nil
 	case 0x0c: // light style
@@ -722,321 +1787,366 @@ func (block *Block) DecodeMessage() (Message, error) {
 			Frags:  frags,
 		}, nil
 	case 0x0F: // client data
-		mask, err := readUint16(block.buf)
+		return block.readClientData()
+
+	case 0x10: // stopsound
+		t, err := readUint16(block.buf)
 		if err != nil {
 			return nil, err
 		}
-		if Verbose {
-			log.Printf("Mask: %04x", mask)
-		}
-		if mask&SU_VIEWHEIGHT != 0 {
-			viewOffsetZ, _ := readUint8(block.buf)
-			// TODO: Use this to offset camera in Z axis.
-			_ = viewOffsetZ
-		}
-		if mask&SU_IDEALPITCH != 0 {
-			readUint8(block.buf)
-		}
-		if mask&SU_PUNCH1 != 0 {
-			readUint8(block.buf)
-		}
-		if mask&SU_VELOCITY1 != 0 {
-			readUint8(block.buf)
-		}
-		if mask&SU_PUNCH2 != 0 {
-			readUint8(block.buf)
-		}
-		if mask&SU_VELOCITY2 != 0 {
-			readUint8(block.buf)
-		}
-		if mask&SU_PUNCH3 != 0 {
-			readUint8(block.buf)
-		}
-		if mask&SU_VELOCITY3 != 0 {
-			readUint8(block.buf)
-		}
-		if mask&SU_AIMENT != 0 {
-		}
-		if mask&SU_ONGROUND != 0 {
-		}
-		if mask&SU_INWATER != 0 {
-			// TODO: blend some blue.
-		}
-		if mask&SU_ITEMS != 0 {
-			readUint32(block.buf)
-		}
-		if mask&SU_WEAPONFRAME != 0 {
-			readUint8(block.buf)
-		}
-		if mask&SU_ARMOR != 0 {
-			readUint8(block.buf)
-		}
-		if mask&SU_WEAPON != 0 {
-			readUint8(block.buf)
-		}
-		health, err := readUint16(block.buf)
-		if err != nil {
+		return &MsgStopSound{Entity: t >> 3, Channel: uint8(t & 7)}, nil
+	case 0x11: // set colors
+		r := &MsgSetColors{}
+		if r.Player, err = readUint8(block.buf); err != nil {
 			return nil, err
 		}
-		if Verbose {
-			log.Printf("Health: %v", health)
+		if r.Color, err = readUint8(block.buf); err != nil {
+			return nil, err
 		}
-
-		ammo, err := readUint8(block.buf)
-		if err != nil {
+		return r, nil
+	case 0x12: // particle
+		r := &MsgParticle{}
+		if r.Pos, err = block.readVertex(); err != nil {
 			return nil, err
 		}
-		if Verbose {
-			log.Printf("Ammo: %v", ammo)
+		for _, p := range []*float32{&r.Dir.X, &r.Dir.Y, &r.Dir.Z} {
+			d, err := readInt8(block.buf)
+			if err != nil {
+				return nil, err
+			}
+			*p = float32(d) / 16
 		}
-
-		shells, err := readUint8(block.buf)
-		if err != nil {
+		if r.Count, err = readUint8(block.buf); err != nil {
 			return nil, err
 		}
-		if Verbose {
-			log.Printf("Shells: %v", shells)
+		if r.Color, err = readUint8(block.buf); err != nil {
+			return nil, err
 		}
-
-		ammo_nails, err := readUint8(block.buf)
-		if err != nil {
+		return r, nil
+	case 0x13: // damage
+		r := &MsgDamage{}
+		if r.Armor, err = readUint8(block.buf); err != nil {
 			return nil, err
 		}
-		if Verbose {
-			log.Printf("Nails: %v", ammo_nails)
+		if r.Blood, err = readUint8(block.buf); err != nil {
+			return nil, err
 		}
-
-		ammo_rockets, err := readUint8(block.buf)
-		if err != nil {
+		if r.Pos, err = block.readVertex(); err != nil {
 			return nil, err
 		}
-		if Verbose {
-			log.Printf("Rockets: %v", ammo_rockets)
+		return r, nil
+	case 0x14, 0x2b: // spawnstatic, spawnstatic2
+		r := &MsgSpawnStatic{}
+		version := 1
+		if typ == 0x2b {
+			version = 2
 		}
-
-		ammo_cells, err := readUint8(block.buf)
-		if err != nil {
+		if err := block.readBaseline(&r.MsgSpawnBaseline, version); err != nil {
 			return nil, err
 		}
-		if Verbose {
-			log.Printf("Cells: %v", ammo_cells)
+		return r, nil
+	case 0x16, 0x2a: // spawnbaseline, spawnbaseline2
+		r := &MsgSpawnBaseline{}
+		if r.Entity, err = readUint16(block.buf); err != nil {
+			return nil, err
 		}
-
-		weapon, err := readUint8(block.buf)
-		if err != nil {
+		if err := checkEntity(r.Entity); err != nil {
 			return nil, err
 		}
-		if Verbose {
-			log.Printf("Weapon: %v", weapon)
+		version := 1
+		if typ == 0x2a {
+			version = 2
 		}
-
-	case 0x10: // stopsound
-		readUint16(block.buf)
-
-	case 0x11: // set colors
-		readUint8(block.buf) // player
-		readUint8(block.buf) // color
-	case 0x12: // particle
-		readCoord(block.buf) // origin...
-		readCoord(block.buf)
-		readCoord(block.buf)
-		readInt8(block.buf) // velocity...
-		readInt8(block.buf)
-		readInt8(block.buf)
-		readUint8(block.buf) // count
-		readUint8(block.buf) // color (chunk 0, blood 73, barrel 75 and thunderbolt 225)
-	case 0x13: // damage
-		readUint8(block.buf) // armor
-		readUint8(block.buf) // health
-		readCoord(block.buf) // origin of hit...
-		readCoord(block.buf)
-		readCoord(block.buf)
-	case 0x14: // spawnstatic
-		model, _ := readUint8(block.buf)
-		frame, _ := readUint8(block.buf)
-		color, _ := readUint8(block.buf)
-		skin, _ := readUint8(block.buf)
-		x, _ := readCoord(block.buf)
-		a, _ := readAngle(block.buf)
-		y, _ := readCoord(block.buf)
-		b, _ := readAngle(block.buf)
-		z, _ := readCoord(block.buf)
-		c, _ := readAngle(block.buf)
-		if Verbose {
-			log.Printf("Spawning static %f,%f,%f: %d %d %d %d %f %f %f", x, y, z, model, frame, color, skin, a, b, c)
+		if err := block.readBaseline(r, version); err != nil {
+			return nil, err
 		}
-		// TODO: Spawn something static.
-	case 0x16: // spawnbaseline
-		r := &MsgSpawnBaseline{}
-		r.Entity, _ = readUint16(block.buf)
-
-		r.Model, _ = readUint8(block.buf)
-		r.Frame, _ = readUint8(block.buf)
-		r.Color, _ = readUint8(block.buf)
-		r.Skin, _ = readUint8(block.buf)
-
-		r.X, _ = readCoord(block.buf)
-		r.A, _ = readAngle(block.buf)
-		r.Y, _ = readCoord(block.buf)
-		r.B, _ = readAngle(block.buf)
-		r.Z, _ = readCoord(block.buf)
-		r.C, _ = readAngle(block.buf)
 		return r, nil
 
 	case 0x17: // temp entity
-		entityType, _ := readUint8(block.buf)
+		r := &MsgTempEntity{}
+		if r.Type, err = readUint8(block.buf); err != nil {
+			return nil, err
+		}
 		if Verbose {
-			log.Printf("Temp entity type %d", entityType)
+			log.Printf("Temp entity type %d", r.Type)
 		}
-		switch entityType {
+		switch r.Type {
 		case TE_SPIKE, TE_SUPERSPIKE, TE_GUNSHOT, TE_EXPLOSION, TE_TAREXPLOSION, TE_WIZSPIKE, TE_LAVASPLASH, TE_TELEPORT, TE_KNIGHTSPIKE, TE_IMPLOSION:
-			readCoord(block.buf) // origin...
-			readCoord(block.buf)
-			readCoord(block.buf)
-
+			if r.Pos, err = block.readVertex(); err != nil {
+				return nil, err
+			}
 		case TE_LIGHTNING1, TE_LIGHTNING2, TE_LIGHTNING3, TE_BEAM, TE_RAILTRAIL:
-			ent, _ := readUint16(block.buf)
-			if debugEnt == ent {
-				log.Printf("Lightning from ent %d", ent)
+			if r.Entity, err = readUint16(block.buf); err != nil {
+				return nil, err
+			}
+			if debugEnt == r.Entity {
+				log.Printf("Lightning from ent %d", r.Entity)
+			}
+			if r.Pos, err = block.readVertex(); err != nil {
+				return nil, err
+			}
+			if r.End, err = block.readVertex(); err != nil {
+				return nil, err
 			}
-			readCoord(block.buf) // from...
-			readCoord(block.buf)
-			readCoord(block.buf)
-			readCoord(block.buf) // to...
-			readCoord(block.buf)
-			readCoord(block.buf)
 		case TE_EXPLOSION2:
-			readCoord(block.buf) // origin...
-			readCoord(block.buf)
-			readCoord(block.buf)
-			readUint8(block.buf) // color
-			readUint8(block.buf) // range
+			if r.Pos, err = block.readVertex(); err != nil {
+				return nil, err
+			}
+			if r.ColorStart, err = readUint8(block.buf); err != nil {
+				return nil, err
+			}
+			if r.ColorLength, err = readUint8(block.buf); err != nil {
+				return nil, err
+			}
 		default:
-			return nil, fmt.Errorf("bad temp ent type %d", entityType)
+			return nil, fmt.Errorf("bad temp ent type %d", r.Type)
 		}
-		// TODO: spawn temp entity.
+		return r, nil
 	case 0x18: // setpause
-		readUint8(block.buf)
+		t, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		return &MsgSetPause{Paused: t != 0}, nil
 	case 0x19: // signonnum
-		state, _ := readUint8(block.buf)
+		state, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
 		if Verbose {
 			log.Printf("Set state: %v", state)
 		}
 		return &MsgClientState{State: state}, nil
 	case 0x1a: // centerprint
-		readString(block.buf)
+		t, err := readString(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		return &MsgCenterPrint{Text: t}, nil
 	case 0x1b: // killed monster
+		return &MsgKilledMonster{}, nil
 	case 0x1c: // found secret
-	case 0x1d: // spawnstaticsound
-		readCoord(block.buf) // origin
-		readCoord(block.buf)
-		readCoord(block.buf)
-		readUint8(block.buf) // num
-		readUint8(block.buf) // vol
-		readUint8(block.buf) // attenuation
+		return &MsgFoundSecret{}, nil
+	case 0x1d, 0x2c: // spawnstaticsound, spawnstaticsound2
+		r := &MsgSpawnStaticSound{Version: 1}
+		if r.Pos, err = block.readVertex(); err != nil {
+			return nil, err
+		}
+		if typ == 0x2c {
+			r.Version = 2
+			if r.Sound, err = readUint16(block.buf); err != nil {
+				return nil, err
+			}
+		} else {
+			t, err := readUint8(block.buf)
+			if err != nil {
+				return nil, err
+			}
+			r.Sound = uint16(t)
+		}
+		if r.Volume, err = readUint8(block.buf); err != nil {
+			return nil, err
+		}
+		if r.Attenuation, err = readUint8(block.buf); err != nil {
+			return nil, err
+		}
+		return r, nil
 	case 0x1e: // intermission
-		t, _ := readString(block.buf)
+		t, err := readString(block.buf)
+		if err != nil {
+			return nil, err
+		}
 		return &MsgIntermission{Text: t}, nil
 	case 0x1f: // finale - end screen
-		t, _ := readString(block.buf)
+		t, err := readString(block.buf)
+		if err != nil {
+			return nil, err
+		}
 		return &MsgFinale{Text: t}, nil
 	case 0x20: // CD track
-		readUint8(block.buf) // from track
-		readUint8(block.buf) // to track
+		r := &MsgCDTrack{}
+		if r.Track, err = readUint8(block.buf); err != nil {
+			return nil, err
+		}
+		if r.Loop, err = readUint8(block.buf); err != nil {
+			return nil, err
+		}
+		return r, nil
 	case 0x21: // sell screen
+		return &MsgSellScreen{}, nil
+	case 0x22: // cutscene
+		t, err := readString(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		return &MsgCutscene{Text: t}, nil
+	case 0x25: // skybox
+		name, err := readString(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		return &MsgSkybox{Name: name}, nil
+	case 0x28: // bf
+		return &MsgBonusFlash{}, nil
+	case 0x29: // fog
+		r := &MsgFog{}
+		for _, p := range []*uint8{&r.Density, &r.R, &r.G, &r.B} {
+			if *p, err = readUint8(block.buf); err != nil {
+				return nil, err
+			}
+		}
+		if r.Time, err = readInt16(block.buf); err != nil {
+			return nil, err
+		}
+		return r, nil
 	default:
 		m := &MsgUpdate{}
 		if typ < 0x80 {
-			block.buf = nil
-			return nil, fmt.Errorf("unknown type %d (0x%x), tail: %v", typ, typ, []byte(block.buf.String()))
+			return nil, fmt.Errorf("%w %d (0x%x)", ErrUnknownMessage, typ, typ)
 		}
-		mask := uint16(typ & 0x7F)
+		mask := uint32(typ & 0x7F)
 		if mask&U_MOREBITS != 0 {
-			t, _ := readUint8(block.buf)
-			mask |= uint16(t) << 8
+			t, err := readUint8(block.buf)
+			if err != nil {
+				return nil, err
+			}
+			mask |= uint32(t) << 8
+		}
+		if block.protocol().fitz() {
+			for _, f := range []struct {
+				bit   uint32
+				shift uint
+			}{
+				{U_EXTEND1, 16},
+				{U_EXTEND2, 24},
+			} {
+				if mask&f.bit != 0 {
+					t, err := readUint8(block.buf)
+					if err != nil {
+						return nil, err
+					}
+					mask |= uint32(t) << f.shift
+				}
+			}
 		}
 		if Verbose {
-			log.Printf("Update packet mask %04x: %v", mask, []byte(block.buf.String()))
+			log.Printf("Update packet mask %04x: %v", mask, block.buf.Bytes())
 		}
 		if mask&U_LONGENTITY != 0 {
-			m.Entity, _ = readUint16(block.buf)
+			if m.Entity, err = readUint16(block.buf); err != nil {
+				return nil, err
+			}
 		} else {
-			e, _ := readUint8(block.buf)
+			e, err := readUint8(block.buf)
+			if err != nil {
+				return nil, err
+			}
 			m.Entity = uint16(e)
 		}
+		if err := checkEntity(m.Entity); err != nil {
+			return nil, err
+		}
 		if m.Entity == debugEnt {
 			log.Printf("DebugEnt mask: %04x", mask)
 		}
-		if mask&U_MODEL != 0 {
-			a, err := readUint8(block.buf)
-			if err != nil {
-				log.Fatal(err)
+		m.NoLerp = mask&U_NOLERP != 0
+		for _, f := range []struct {
+			bit uint32
+			p   **uint8
+		}{
+			{U_MODEL, &m.Model},
+			{U_FRAME, &m.Frame},
+			{U_COLORMAP, &m.Color},
+			{U_SKIN, &m.Skin},
+			{U_EFFECTS, &m.Effects},
+		} {
+			if mask&f.bit != 0 {
+				a, err := readUint8(block.buf)
+				if err != nil {
+					return nil, err
+				}
+				*f.p = &a
 			}
-			m.Model = &a
 		}
-		if mask&U_FRAME != 0 {
-			a, err := readUint8(block.buf)
-			if err != nil {
-				log.Fatal(err)
+		for _, f := range []struct {
+			bit   uint32
+			p     **float32
+			angle bool
+		}{
+			{U_ORIGIN1, &m.X, false},
+			{U_ANGLE1, &m.A, true},
+			{U_ORIGIN2, &m.Y, false},
+			{U_ANGLE2, &m.B, true},
+			{U_ORIGIN3, &m.Z, false},
+			{U_ANGLE3, &m.C, true},
+		} {
+			if mask&f.bit == 0 {
+				continue
 			}
-			m.Frame = &a
-		}
-		if mask&U_COLORMAP != 0 {
-			a, _ := readUint8(block.buf)
-			m.Color = &a
-		}
-		if mask&U_SKIN != 0 {
-			a, _ := readUint8(block.buf)
-			m.Skin = &a
-		}
-		if mask&U_EFFECTS != 0 {
-			a, _ := readUint8(block.buf)
-			m.Effects = &a
-			if *m.Effects&0xfd != 0 {
-				log.Printf("Entity %v effect %v", m.Entity, a)
+			var a float32
+			if f.angle {
+				a, err = block.readAngle()
+			} else {
+				a, err = block.readCoord()
 			}
-		}
-		if mask&U_ORIGIN1 != 0 {
-			a, err := readCoord(block.buf)
 			if err != nil {
-				log.Fatal(err)
+				return nil, err
+			}
+			*f.p = &a
+		}
+		for _, f := range []struct {
+			bit uint32
+			p   **uint8
+		}{
+			{U_ALPHA, &m.Alpha},
+			{U_SCALE, &m.Scale},
+			{U_FRAME2, &m.Frame2},
+			{U_MODEL2, &m.Model2},
+			{U_LERPFINISH, &m.LerpFinish},
+		} {
+			if mask&f.bit != 0 {
+				a, err := readUint8(block.buf)
+				if err != nil {
+					return nil, err
+				}
+				*f.p = &a
 			}
-			m.X = &a
-		}
-		if mask&U_ANGLE1 != 0 {
-			a, _ := readAngle(block.buf)
-			m.A = &a
-		}
-		if mask&U_ORIGIN2 != 0 {
-			a, _ := readCoord(block.buf)
-			m.Y = &a
-		}
-		if mask&U_ANGLE2 != 0 {
-			a, _ := readAngle(block.buf)
-			m.B = &a
-		}
-		if mask&U_ORIGIN3 != 0 {
-			a, _ := readCoord(block.buf)
-			m.Z = &a
-		}
-		if mask&U_ANGLE3 != 0 {
-			a, _ := readAngle(block.buf)
-			m.C = &a
 		}
 		return m, nil
 	}
-	return &MsgNop{}, nil
 }
 
+// ReadBlock reads the next block of the demo.
+// At the end of the demo it returns io.EOF. Other errors are of type *DecodeError.
 func (d *Demo) ReadBlock() (*Block, error) {
-	block := &Block{}
+	if d.qw != nil {
+		return d.readQWBlock()
+	}
+	if d.proto.version == 0 {
+		d.proto.version = version15
+	}
+	block := &Block{
+		Num:    d.BlockCount,
+		Offset: d.offset,
+		proto:  &d.proto,
+	}
 	if err := binary.Read(d.r, binary.LittleEndian, &block.Header); err != nil {
-		return nil, err
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, &DecodeError{Block: block.Num, Offset: block.Offset, Err: truncated(fmt.Errorf("reading block header: %w", err))}
+	}
+	if block.Header.Blocksize > maxBlockSize {
+		return nil, &DecodeError{Block: block.Num, Offset: block.Offset, Err: fmt.Errorf("block size %d too large", block.Header.Blocksize)}
 	}
 	data := make([]byte, block.Header.Blocksize, block.Header.Blocksize)
-	if _, err := d.r.Read(data); err != nil {
-		return nil, fmt.Errorf("reading block of size %d: %v", block.Header.Blocksize, err)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return nil, &DecodeError{Block: block.Num, Offset: block.Offset, Err: truncated(fmt.Errorf("reading block of size %d: %w", block.Header.Blocksize, err))}
 	}
+	block.data = block.Offset + blockHeaderSize
 	block.buf = bytes.NewBuffer(data)
+	block.size = len(data)
+	d.BlockCount++
+	d.offset += blockHeaderSize + int64(len(data))
 	return block, nil
 }
@@ -21,12 +21,630 @@ package dem
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
 	"testing"
 )
 
+// testMsg builds the binary form of a message, for tests.
+func testMsg(data ...interface{}) []byte {
+	var b bytes.Buffer
+	for _, d := range data {
+		switch t := d.(type) {
+		case string:
+			b.WriteString(t)
+			b.WriteByte(0)
+		default:
+			if err := binary.Write(&b, binary.LittleEndian, d); err != nil {
+				panic(err)
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// testDemo builds a demo file, for tests.
+func testDemo(blocks ...[][]byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("-1\n")
+	for _, msgs := range blocks {
+		data := bytes.Join(msgs, nil)
+		binary.Write(&b, binary.LittleEndian, BlockHeader{
+			Blocksize: uint32(len(data)),
+			ViewAngle: Vertex{X: 1, Y: 2, Z: 3},
+		})
+		b.Write(data)
+	}
+	return b.Bytes()
+}
+
+// testServerInfo is a minimal serverinfo message.
+var testServerInfo = testMsg(uint8(0x0b), uint32(version15), uint8(1), uint8(0), "The Slipgate Complex",
+	"maps/e1m1.bsp", "*1", "progs/player.mdl", "",
+	"weapons/ric1.wav", "")
+
+// testDemoFile is a small but valid demo.
+var testDemoFile = testDemo(
+	[][]byte{
+		testServerInfo,
+		testMsg(uint8(0x19), uint8(1)), // Signon.
+		testMsg(uint8(0x16), uint16(1), uint8(3), uint8(0), uint8(0), uint8(0), int16(8), int8(0), int16(16), int8(64), int16(24), int8(0)),
+	},
+	[][]byte{
+		testMsg(uint8(0x07), float32(1.5)),
+		testMsg(uint8(0x05), uint16(1)), // Camera.
+		testMsg(uint8(0x80|U_MOREBITS|U_ORIGIN1|U_FRAME), uint8(U_MODEL>>8), uint8(1), uint8(3), uint8(2), int16(80)),
+	},
+)
+
+// testDecode decodes a whole demo and returns the final state.
+func testDecode(t *testing.T, data []byte) *State {
+	d, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s := NewState()
+	for {
+		block, err := d.ReadBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadBlock: %v", err)
+		}
+		msgs, err := block.Messages()
+		if err != nil {
+			t.Fatalf("Messages: %v", err)
+		}
+		for _, m := range msgs {
+			m.Apply(s)
+		}
+	}
+	return s
+}
+
+func TestDecode(t *testing.T) {
+	s := testDecode(t, testDemoFile)
+	if got, want := s.ServerInfo.Models, []string{"maps/e1m1.bsp", "maps/e1m1.bsp", "*1", "progs/player.mdl"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Models: got %q, want %q", got, want)
+	}
+	if got, want := s.Time, 1.5; got != want {
+		t.Errorf("Time: got %v, want %v", got, want)
+	}
+	if got, want := s.CameraEnt, 1; got != want {
+		t.Errorf("CameraEnt: got %v, want %v", got, want)
+	}
+	if got, want := s.Entities[1], (Entity{Pos: Vertex{10, 2, 3}, Angle: Vertex{0, 90, 0}, Model: 3, Frame: 2}); got != want {
+		t.Errorf("Entity: got %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeFitzQuake(t *testing.T) {
+	s := testDecode(t, testDemo(
+		[][]byte{
+			testMsg(uint8(0x0b), uint32(versionQuakeSpasm), uint8(1), uint8(0), "Fitz", "maps/e1m1.bsp", "", ""),
+			// spawnbaseline2 with large model and alpha.
+			testMsg(uint8(0x2a), uint16(1), uint8(B_LARGEMODEL|B_ALPHA), uint16(300), uint8(2), uint8(0), uint8(0),
+				int16(8), int8(0), int16(16), int8(64), int16(24), int8(0), uint8(128)),
+			testMsg(uint8(0x29), uint8(51), uint8(255), uint8(0), uint8(0), int16(100)), // Fog.
+			testMsg(uint8(0x25), "space"), // Skybox.
+			testMsg(uint8(0x28)),          // Bonus flash.
+			// Sound with large entity and sound number.
+			testMsg(uint8(0x06), uint8(SND_LARGEENTITY|SND_LARGESOUND), uint16(2000), uint8(1), uint16(400), int16(0), int16(0), int16(0)),
+		},
+		[][]byte{
+			// Update with high frame byte and alpha.
+			testMsg(uint8(0x80|U_MOREBITS|U_ORIGIN1|U_FRAME), uint8(U_EXTEND1>>8), uint8((U_ALPHA|U_FRAME2)>>16),
+				uint8(1), uint8(4), int16(80), uint8(10), uint8(1)),
+		},
+	))
+	if got, want := s.Entities[1], (Entity{Pos: Vertex{10, 2, 3}, Angle: Vertex{0, 90, 0}, Model: 300, Frame: 260, Alpha: 10}); got != want {
+		t.Errorf("Entity: got %+v, want %+v", got, want)
+	}
+	if got, want := s.Fog, (Fog{Density: 0.2, R: 1}); got != want {
+		t.Errorf("Fog: got %+v, want %+v", got, want)
+	}
+	if got, want := s.Skybox, "space"; got != want {
+		t.Errorf("Skybox: got %q, want %q", got, want)
+	}
+	if got, want := s.Copy().Skybox, "space"; got != want {
+		t.Errorf("Copied skybox: got %q, want %q", got, want)
+	}
+}
+
+func TestDecodeBaselineAlphaScale(t *testing.T) {
+	blocks := [][][]byte{
+		{
+			testMsg(uint8(0x0b), uint32(versionRMQ), uint32(0), uint8(1), uint8(0), "RMQ", "maps/e1m1.bsp", "", ""),
+			// spawnbaseline2 with alpha and scale.
+			testMsg(uint8(0x2a), uint16(1), uint8(B_ALPHA|B_SCALE), uint8(2), uint8(0), uint8(0), uint8(0),
+				int16(0), int8(0), int16(0), int8(0), int16(0), int8(0), uint8(128), uint8(32)),
+		},
+		{
+			testMsg(uint8(0x80|U_MOREBITS), uint8(U_EXTEND1>>8), uint8((U_ALPHA|U_SCALE)>>16), uint8(1), uint8(10), uint8(8)),
+		},
+		{
+			testMsg(uint8(0x80|U_ORIGIN1), uint8(1), int16(80)),
+		},
+	}
+	for n, want := range []Entity{
+		{Model: 2, Alpha: 128, Scale: 32},
+		{Model: 2, Alpha: 10, Scale: 8},
+		// Not sent, so back to the baseline.
+		{Pos: Vertex{X: 10}, Model: 2, Alpha: 128, Scale: 32},
+	} {
+		if got := testDecode(t, testDemo(blocks[:n+1]...)).Entities[1]; got != want {
+			t.Errorf("Entity after block %d: got %+v, want %+v", n, got, want)
+		}
+	}
+}
+
+func TestClientData(t *testing.T) {
+	s := testDecode(t, testDemo(
+		[][]byte{
+			testMsg(uint8(0x0b), uint32(versionQuakeSpasm), uint8(1), uint8(0), "Fitz", "maps/e1m1.bsp", "", ""),
+			// Weapon and frame, with FitzQuake high bytes.
+			testMsg(uint8(0x0f), uint16(SU_WEAPONFRAME|SU_WEAPON|SU_EXTEND1),
+				uint8((SU_WEAPON2|SU_EXTEND2)>>16), uint8(SU_WEAPONFRAME2>>24),
+				uint8(3), uint8(4), int16(100), uint8(0), uint8(0), uint8(0), uint8(0), uint8(0), uint8(0),
+				uint8(1), uint8(2)),
+		},
+	))
+	if got, want := s.ViewWeapon, 0x104; got != want {
+		t.Errorf("ViewWeapon: got %#x, want %#x", got, want)
+	}
+	if got, want := s.ViewWeaponFrame, 0x203; got != want {
+		t.Errorf("ViewWeaponFrame: got %#x, want %#x", got, want)
+	}
+
+	// Not sending the weapon means there is none.
+	(&MsgClientData{}).Apply(s)
+	if s.ViewWeapon != 0 || s.ViewWeaponFrame != 0 {
+		t.Errorf("Weapon not cleared: got %d frame %d", s.ViewWeapon, s.ViewWeaponFrame)
+	}
+}
+
+func TestClientDataStatus(t *testing.T) {
+	s := NewState()
+	(&MsgClientData{
+		Bits:         SU_ARMOR,
+		Armor:        200,
+		Armor2:       1,
+		Health:       -5,
+		Ammo:         20,
+		Shells:       1,
+		Nails:        2,
+		Rockets:      3,
+		Cells:        4,
+		Cells2:       1,
+		ActiveWeapon: IT_ROCKET_LAUNCHER,
+	}).Apply(s)
+	s = s.Copy()
+	if got, want := [3]int{s.Health, s.Armor, s.Ammo}, [3]int{-5, 456, 20}; got != want {
+		t.Errorf("Health, armor and ammo: got %v, want %v", got, want)
+	}
+	if got, want := s.AmmoCounts, [4]int{1, 2, 3, 260}; got != want {
+		t.Errorf("Ammo counts: got %v, want %v", got, want)
+	}
+	if s.ActiveWeapon != IT_ROCKET_LAUNCHER {
+		t.Errorf("Active weapon: got %#x, want %#x", s.ActiveWeapon, IT_ROCKET_LAUNCHER)
+	}
+
+	s.Time = 3
+	MsgCenterPrint{Text: "hello"}.Apply(s)
+	if s = s.Copy(); s.CenterPrint != "hello" || s.CenterPrintTime != 3 {
+		t.Errorf("Center print: got %q at %g, want \"hello\" at 3", s.CenterPrint, s.CenterPrintTime)
+	}
+}
+
+func TestDecodeRMQ(t *testing.T) {
+	s := testDecode(t, testDemo(
+		[][]byte{
+			testMsg(uint8(0x0b), uint32(versionRMQ), uint32(PRFL_FLOATCOORD|PRFL_SHORTANGLE), uint8(1), uint8(0), "RMQ", "maps/e1m1.bsp", "", ""),
+			testMsg(uint8(0x16), uint16(1), uint8(3), uint8(0), uint8(0), uint8(0),
+				float32(8.5), int16(0), float32(-16.25), int16(16384), float32(100000), int16(-16384)),
+		},
+		[][]byte{
+			testMsg(uint8(0x80|U_ORIGIN2), uint8(1), float32(1.75)),
+		},
+	))
+	if got, want := s.ServerInfo.ProtocolFlags, uint32(PRFL_FLOATCOORD|PRFL_SHORTANGLE); got != want {
+		t.Errorf("Protocol flags: got %x, want %x", got, want)
+	}
+	if got, want := s.Entities[1], (Entity{Pos: Vertex{8.5, 1.75, 100000}, Angle: Vertex{0, 90, -90}, Model: 3}); got != want {
+		t.Errorf("Entity: got %+v, want %+v", got, want)
+	}
+}
+
+func TestTempEntities(t *testing.T) {
+	lightning := func(ent uint16, x int16) []byte {
+		return testMsg(uint8(0x17), uint8(TE_LIGHTNING2), ent, int16(0), int16(0), int16(0), x, int16(0), int16(0))
+	}
+	d, err := Open(bytes.NewReader(testDemo(
+		[][]byte{
+			testMsg(uint8(0x07), float32(1)),
+			testMsg(uint8(0x17), uint8(TE_EXPLOSION), int16(8), int16(16), int16(24)),
+			lightning(1, 80),
+			lightning(2, 80),
+		},
+		[][]byte{
+			testMsg(uint8(0x07), float32(1.1)),
+			lightning(1, 160),
+			testMsg(uint8(0x17), uint8(TE_EXPLOSION2), int16(0), int16(0), int16(0), uint8(10), uint8(4)),
+		},
+		[][]byte{
+			testMsg(uint8(0x07), float32(1.5)),
+			testMsg(uint8(0x17), uint8(TE_TELEPORT), int16(0), int16(0), int16(0)),
+		},
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewState()
+	var got [][]TempEntity
+	for {
+		block, err := d.ReadBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := block.Messages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range msgs {
+			m.Apply(s)
+		}
+		got = append(got, s.Copy().TempEntities)
+	}
+	beam := func(ent uint16, x float32, start float64) TempEntity {
+		return TempEntity{MsgTempEntity: MsgTempEntity{Type: TE_LIGHTNING2, Entity: ent, End: Vertex{X: x}}, Start: start}
+	}
+	explosion := TempEntity{MsgTempEntity: MsgTempEntity{Type: TE_EXPLOSION, Pos: Vertex{1, 2, 3}}, Start: 1}
+	explosion2 := TempEntity{MsgTempEntity: MsgTempEntity{Type: TE_EXPLOSION2, ColorStart: 10, ColorLength: 4}, Start: float64(float32(1.1))}
+	want := [][]TempEntity{
+		{explosion, beam(1, 10, 1), beam(2, 10, 1)},
+		// Beam 1 replaced.
+		{explosion, beam(2, 10, 1), beam(1, 20, float64(float32(1.1))), explosion2},
+		// Only the second explosion is still active.
+		{explosion2, {MsgTempEntity: MsgTempEntity{Type: TE_TELEPORT}, Start: 1.5}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Temp entities:\ngot  %+v\nwant %+v", got, want)
+	}
+	if !explosion.Active(1.4) || explosion.Active(1.5) || explosion.Active(0.9) {
+		t.Errorf("Explosion active at wrong time")
+	}
+}
+
+func TestEntityAlphaScale(t *testing.T) {
+	for _, test := range []struct {
+		e              Entity
+		opacity, scale float64
+	}{
+		{Entity{}, 1, 1},
+		{Entity{Alpha: 1, Scale: 16}, 0, 1},
+		{Entity{Alpha: 255, Scale: 32}, 1, 2},
+		{Entity{Alpha: 128, Scale: 8}, 127.0 / 254, 0.5},
+	} {
+		if got, want := test.e.Opacity(), test.opacity; got != want {
+			t.Errorf("Opacity of %d: got %v, want %v", test.e.Alpha, got, want)
+		}
+		if got, want := test.e.Size(), test.scale; got != want {
+			t.Errorf("Size of %d: got %v, want %v", test.e.Scale, got, want)
+		}
+	}
+}
+
+func TestEntityEffects(t *testing.T) {
+	effects := func(ef uint8) []byte {
+		return testMsg(uint8(0x80|U_MOREBITS), uint8(U_EFFECTS>>8), uint8(1), ef)
+	}
+	d, err := Open(bytes.NewReader(testDemo(
+		[][]byte{
+			testMsg(uint8(0x07), float32(1)),
+			effects(EF_MUZZLEFLASH | EF_DIMLIGHT),
+		},
+		[][]byte{
+			testMsg(uint8(0x07), float32(1.05)),
+			effects(EF_MUZZLEFLASH),
+		},
+		[][]byte{
+			testMsg(uint8(0x07), float32(1.5)),
+			testMsg(uint8(0x80), uint8(1)),
+		},
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewState()
+	var got []*State
+	for {
+		block, err := d.ReadBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := block.Messages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range msgs {
+			m.Apply(s)
+		}
+		got = append(got, s.Copy())
+	}
+	light := func(start float64) DynamicLight {
+		return DynamicLight{Entity: 1, Pos: Vertex{18, 0, 16}, Radius: 200, Start: start, Duration: 0.1}
+	}
+	for n, want := range []struct {
+		effects uint8
+		lights  []DynamicLight
+	}{
+		{EF_MUZZLEFLASH | EF_DIMLIGHT, []DynamicLight{light(1)}},
+		// Second flash replaces the first.
+		{EF_MUZZLEFLASH, []DynamicLight{light(float64(float32(1.05)))}},
+		// Effects not sent are off, and the flash is over.
+		{0, []DynamicLight{light(float64(float32(1.05)))}},
+	} {
+		if got := got[n].Entities[1].Effects; got != want.effects {
+			t.Errorf("Block %d: effects: got %x, want %x", n, got, want.effects)
+		}
+		if !reflect.DeepEqual(got[n].Lights, want.lights) {
+			t.Errorf("Block %d: lights: got %+v, want %+v", n, got[n].Lights, want.lights)
+		}
+	}
+	if l := got[2].Lights[0]; l.Active(1.5) || !l.Active(1.1) {
+		t.Errorf("Muzzle flash active at wrong time")
+	}
+}
+
+func TestMuzzleFlashPos(t *testing.T) {
+	for _, test := range []struct {
+		angle Vertex
+		want  Vertex
+	}{
+		{Vertex{}, Vertex{118, 200, 316}},
+		{Vertex{Y: 90}, Vertex{100, 218, 316}},
+		// Positive pitch is looking down.
+		{Vertex{X: 30}, Vertex{115.5885, 200, 307}},
+		{Vertex{X: -30, Y: 180}, Vertex{84.4115, 200, 325}},
+	} {
+		s := NewState()
+		s.Entities[1] = Entity{Pos: Vertex{100, 200, 300}, Angle: test.angle}
+		s.addMuzzleFlash(1)
+		got := s.Lights[0].Pos
+		if math.Abs(float64(got.X-test.want.X)) > 1e-3 || math.Abs(float64(got.Y-test.want.Y)) > 1e-3 || math.Abs(float64(got.Z-test.want.Z)) > 1e-3 {
+			t.Errorf("Angle %v: got %v, want %v", test.angle, got, test.want)
+		}
+	}
+}
+
+func TestLightStyles(t *testing.T) {
+	for _, test := range []struct {
+		style string
+		t     float64
+		want  float64
+	}{
+		{"", 0, 1},
+		{"m", 12.3, 1},
+		{"a", 0, 0},
+		{"z", 0, 25.0 / 12},
+		{"amz", 0.05, 0},
+		{"amz", 0.15, 1},
+		{"amz", 0.25, 25.0 / 12},
+		{"amz", 0.35, 0},
+		{"0", 0, 0},
+		{"A", 0, 0},
+	} {
+		if got := LightStyleBrightness(test.style, test.t); got != test.want {
+			t.Errorf("Style %q at %v: got %v, want %v", test.style, test.t, got, test.want)
+		}
+	}
+
+	s := testDecode(t, testDemo([][]byte{
+		testMsg(uint8(0x07), float32(2)),
+		testMsg(uint8(0x0c), uint8(1), "ma"),
+		testMsg(uint8(0x0c), uint8(63), "a"),
+		testMsg(uint8(0x0c), uint8(64), "a"), // Out of range.
+	})).Copy()
+	for n, want := range map[int]float64{0: 1, 1: 1, 63: 0, 64: 1} {
+		if got := s.LightStyle(n); got != want {
+			t.Errorf("Light style %d: got %v, want %v", n, got, want)
+		}
+	}
+}
+
+func TestStaticEntities(t *testing.T) {
+	s := testDecode(t, testDemo([][]byte{
+		testServerInfo,
+		testMsg(uint8(0x14), uint8(3), uint8(1), uint8(0), uint8(2), int16(8), int8(0), int16(16), int8(64), int16(24), int8(0)),
+		// FitzQuake spawnstatic2 with large frame.
+		testMsg(uint8(0x2b), uint8(B_LARGEFRAME), uint8(2), uint16(300), uint8(0), uint8(0),
+			int16(80), int8(0), int16(0), int8(0), int16(0), int8(0)),
+	})).Copy()
+	want := []Entity{
+		{Pos: Vertex{1, 2, 3}, Angle: Vertex{0, 90, 0}, Model: 3, Frame: 1, Skin: 2, Visible: true},
+		{Pos: Vertex{X: 10}, Model: 2, Frame: 300, Visible: true},
+	}
+	if got := s.StaticEntities; !reflect.DeepEqual(got, want) {
+		t.Errorf("Static entities:\ngot  %+v\nwant %+v", got, want)
+	}
+	for n, e := range s.Entities {
+		if e != (Entity{}) {
+			t.Errorf("Static entity changed entity %d: %+v", n, e)
+		}
+	}
+}
+
+func TestServerInfoClearsLevel(t *testing.T) {
+	s := testDecode(t, testDemo(
+		[][]byte{
+			testServerInfo,
+			testMsg(uint8(0x07), float32(1)),
+			testMsg(uint8(0x0c), uint8(1), "az"),
+			testMsg(uint8(0x14), uint8(3), uint8(1), uint8(0), uint8(2), int16(8), int8(0), int16(16), int8(64), int16(24), int8(0)),
+			testMsg(uint8(0x17), uint8(TE_EXPLOSION), int16(8), int16(16), int16(24)),
+			testMsg(uint8(0x80|U_MOREBITS), uint8(U_EFFECTS>>8), uint8(1), uint8(EF_MUZZLEFLASH)),
+		},
+		[][]byte{
+			testServerInfo,
+			testMsg(uint8(0x14), uint8(2), uint8(0), uint8(0), uint8(0), int16(80), int8(0), int16(0), int8(0), int16(0), int8(0)),
+		},
+	)).Copy()
+	want := []Entity{{Pos: Vertex{X: 10}, Model: 2, Visible: true}}
+	if got := s.StaticEntities; !reflect.DeepEqual(got, want) {
+		t.Errorf("Static entities:\ngot  %+v\nwant %+v", got, want)
+	}
+	if len(s.TempEntities) != 0 {
+		t.Errorf("Temp entities not cleared: %+v", s.TempEntities)
+	}
+	if len(s.Lights) != 0 {
+		t.Errorf("Lights not cleared: %+v", s.Lights)
+	}
+	if s.LightStyles[1] != "" {
+		t.Errorf("Light style not cleared: %q", s.LightStyles[1])
+	}
+}
+
+func TestCDTracks(t *testing.T) {
+	s := testDecode(t, testDemo([][]byte{
+		testMsg(uint8(0x07), float32(2)),
+		testMsg(uint8(0x20), uint8(4), uint8(4)),
+		testMsg(uint8(0x07), float32(5.5)),
+		testMsg(uint8(0x20), uint8(3), uint8(2)),
+	})).Copy()
+	want := []CDTrackEvent{
+		{Time: 2, Track: MsgCDTrack{Track: 4, Loop: 4}},
+		{Time: 5.5, Track: MsgCDTrack{Track: 3, Loop: 2}},
+	}
+	if got := s.CDTracks; !reflect.DeepEqual(got, want) {
+		t.Errorf("CD tracks:\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestDecodeParticle(t *testing.T) {
+	d, err := Open(bytes.NewReader(testDemo([][]byte{
+		testMsg(uint8(0x12), int16(8), int16(16), int16(24), int8(16), int8(-32), int8(0), uint8(20), uint8(73)),
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := d.ReadBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := block.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Message{&MsgParticle{Pos: Vertex{1, 2, 3}, Dir: Vertex{1, -2, 0}, Count: 20, Color: 73}}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %+v, want %+v", msgs, want)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	// Offset of the first message in the first block.
+	const first = 3 + blockHeaderSize
+	for name, test := range map[string]struct {
+		input  []byte
+		err    error
+		block  int
+		offset int64
+	}{
+		"no cd track": {
+			input:  []byte("-1"),
+			err:    ErrTruncated,
+			offset: 2,
+		},
+		"truncated header": {
+			input:  testDemoFile[:first-2],
+			err:    ErrTruncated,
+			offset: 3,
+		},
+		"truncated block": {
+			input:  testDemoFile[:first+5],
+			err:    ErrTruncated,
+			offset: 3,
+		},
+		"truncated serverinfo": {
+			input:  testDemo([][]byte{testServerInfo[:10]}),
+			err:    ErrTruncated,
+			offset: first,
+		},
+		"truncated second message": {
+			input:  testDemo([][]byte{testMsg(uint8(0x01)), testMsg(uint8(0x07), uint16(0))}),
+			err:    ErrTruncated,
+			offset: first + 1,
+		},
+		"second block": {
+			input:  testDemo([][]byte{testMsg(uint8(0x01))}, [][]byte{testMsg(uint8(0x01), uint8(0x01), uint8(0x7f))}),
+			err:    ErrUnknownMessage,
+			block:  1,
+			offset: first + 1 + blockHeaderSize + 2,
+		},
+	} {
+		d, err := Open(bytes.NewReader(test.input))
+		for err == nil {
+			var block *Block
+			block, err = d.ReadBlock()
+			if err == nil {
+				_, err = block.Messages()
+			}
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", name, err, test.err)
+			continue
+		}
+		var de *DecodeError
+		if !errors.As(err, &de) {
+			t.Errorf("%s: error %v is not a DecodeError", name, err)
+			continue
+		}
+		if got, want := de.Block, test.block; got != want {
+			t.Errorf("%s: got block %d, want %d", name, got, want)
+		}
+		if got, want := de.Offset, test.offset; got != want {
+			t.Errorf("%s: got offset %d, want %d", name, got, want)
+		}
+	}
+}
+
+// FuzzDecode checks that no input makes the decoder panic.
+func FuzzDecode(f *testing.F) {
+	f.Add(testDemoFile)
+	f.Add(testDemo([][]byte{testMsg(uint8(0x17), uint8(TE_LIGHTNING1), uint16(1), int16(1), int16(2), int16(3), int16(4), int16(5), int16(6))}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d, err := Open(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		s := NewState()
+		for {
+			block, err := d.ReadBlock()
+			if err != nil {
+				return
+			}
+			msgs, err := block.Messages()
+			if err != nil {
+				return
+			}
+			for _, m := range msgs {
+				m.Apply(s)
+			}
+		}
+	})
+}
+
 func TestSizes(t *testing.T) {
 	for _, test := range []struct {
 		obj  interface{}
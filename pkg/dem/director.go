@@ -0,0 +1,245 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ThomasHabets/qpov/pkg/bsp"
+)
+
+const (
+	// Distance to keep between a chase camera and the wall behind it.
+	chaseWallMargin = 4
+)
+
+// A Director places the camera of frames, instead of using the view of the
+// player that recorded the demo.
+type Director interface {
+	// Camera returns the camera of the frame. f.Camera is the camera of
+	// the demo.
+	Camera(f *Frame) Camera
+}
+
+// lookAngles returns the pitch and yaw of a camera at from looking at to.
+func lookAngles(from, to Vertex) Vertex {
+	const deg = 180 / math.Pi
+	dx := float64(to.X - from.X)
+	dy := float64(to.Y - from.Y)
+	dz := float64(to.Z - from.Z)
+	return Vertex{
+		X: float32(-math.Atan2(dz, math.Hypot(dx, dy)) * deg),
+		Y: float32(math.Atan2(dy, dx) * deg),
+	}
+}
+
+// ChaseCamera follows the camera entity from behind, like Quake's
+// chase_active. It's kept from going through walls, if the level is loaded.
+type ChaseCamera struct {
+	Distance float64 // Behind the eyes.
+	Height   float64 // Above the eyes.
+}
+
+func (c ChaseCamera) Camera(f *Frame) Camera {
+	target := f.Camera.Pos
+	yaw := float64(f.Camera.Angle.Y) * math.Pi / 180
+	want := Vertex{
+		X: target.X - float32(math.Cos(yaw)*c.Distance),
+		Y: target.Y - float32(math.Sin(yaw)*c.Distance),
+		Z: target.Z + float32(c.Height),
+	}
+	pos := want
+	if lvl := f.State.Level; lvl != nil {
+		if frac, hit := lvl.Trace(bsp.Vertex(target), bsp.Vertex(want)); hit {
+			frac -= chaseWallMargin / math.Hypot(c.Distance, c.Height)
+			pos = interpolate(target, want, math.Max(0, frac))
+		}
+	}
+	return Camera{
+		Pos:   pos,
+		Angle: lookAngles(pos, target),
+		FOV:   f.Camera.FOV,
+	}
+}
+
+// OrbitCamera circles around a fixed point, looking at it.
+type OrbitCamera struct {
+	Center Vertex
+	Radius float64
+	Height float64 // Above the center.
+	Period float64 // Seconds per revolution, or 0 to stand still.
+}
+
+func (c OrbitCamera) Camera(f *Frame) Camera {
+	a := 0.0
+	if c.Period != 0 {
+		a = 2 * math.Pi * f.Time / c.Period
+	}
+	pos := Vertex{
+		X: c.Center.X + float32(math.Cos(a)*c.Radius),
+		Y: c.Center.Y + float32(math.Sin(a)*c.Radius),
+		Z: c.Center.Z + float32(c.Height),
+	}
+	return Camera{
+		Pos:   pos,
+		Angle: lookAngles(pos, c.Center),
+		FOV:   f.Camera.FOV,
+	}
+}
+
+// PathKey is a keyframe of a camera path.
+type PathKey struct {
+	Time   float64
+	Pos    Vertex
+	LookAt Vertex
+	FOV    float64
+
+	// Weight is how much of the camera is from the path (1) instead of
+	// from the demo (0).
+	Weight float64
+}
+
+// PathCamera moves along a spline through keyframes, blending with the
+// camera of the demo as the keyframes say. Before the first and after the
+// last keyframe, the camera stays at that keyframe.
+type PathCamera struct {
+	Keys []PathKey // In time order.
+
+	pos, look []cameraKey
+}
+
+// NewPathCamera creates a camera path from keyframes.
+func NewPathCamera(keys []PathKey) (*PathCamera, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("camera path has no keyframes")
+	}
+	keys = append([]PathKey(nil), keys...)
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].Time < keys[j].Time })
+	c := &PathCamera{Keys: keys}
+	for n, k := range keys {
+		if n > 0 && k.Time == keys[n-1].Time {
+			return nil, fmt.Errorf("two camera path keyframes at %gs", k.Time)
+		}
+		c.pos = append(c.pos, cameraKey{time: k.Time, camera: Camera{Pos: k.Pos}})
+		c.look = append(c.look, cameraKey{time: k.Time, camera: Camera{Pos: k.LookAt}})
+	}
+	return c, nil
+}
+
+// ParseCameraPath reads a camera path file. Each line is a keyframe of
+// time, position, look-at point, FOV and optionally weight (default 1):
+//
+//	# time  x y z  look_x look_y look_z  fov  weight
+//	10.5    480 -352 88  544 -352 64  90  1
+//
+// Empty lines and lines starting with # are ignored.
+func ParseCameraPath(r io.Reader) (*PathCamera, error) {
+	var keys []PathKey
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 8 && len(fields) != 9 {
+			return nil, fmt.Errorf("line %d: want 8 or 9 fields, got %d", line, len(fields))
+		}
+		v := []float64{1}
+		for _, f := range fields {
+			n, err := strconv.ParseFloat(f, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			v = append(v, n)
+		}
+		if len(fields) == 9 {
+			v[0] = v[9]
+		}
+		keys = append(keys, PathKey{
+			Time:   v[1],
+			Pos:    Vertex{X: float32(v[2]), Y: float32(v[3]), Z: float32(v[4])},
+			LookAt: Vertex{X: float32(v[5]), Y: float32(v[6]), Z: float32(v[7])},
+			FOV:    v[8],
+			Weight: v[0],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewPathCamera(keys)
+}
+
+// pathSpline returns the point at time t on a spline through the keys.
+func pathSpline(keys []cameraKey, t float64) Vertex {
+	if t <= keys[0].time {
+		return keys[0].camera.Pos
+	}
+	i := len(keys) - 1
+	if t >= keys[i].time {
+		return keys[i].camera.Pos
+	}
+	for keys[i].time > t {
+		i--
+	}
+	k0, k3 := &keys[max(0, i-1)], &keys[min(len(keys)-1, i+2)]
+	return splinePos(k0, &keys[i], &keys[i+1], k3, t)
+}
+
+func (c *PathCamera) Camera(f *Frame) Camera {
+	// FOV and weight change linearly.
+	k1, k2, u := c.Keys[0], c.Keys[0], 0.0
+	for n, k := range c.Keys {
+		if k.Time > f.Time {
+			if n > 0 {
+				k1, k2 = c.Keys[n-1], k
+				u = (f.Time - k1.Time) / (k2.Time - k1.Time)
+			}
+			break
+		}
+		k1, k2 = k, k
+	}
+	w := k1.Weight + u*(k2.Weight-k1.Weight)
+	pos := pathSpline(c.pos, f.Time)
+	path := Camera{
+		Pos:   pos,
+		Angle: lookAngles(pos, pathSpline(c.look, f.Time)),
+		FOV:   k1.FOV + u*(k2.FOV-k1.FOV),
+	}
+	if w >= 1 {
+		return path
+	}
+	demo := f.Camera
+	if demo.FOV == 0 {
+		demo.FOV = DefaultFOV
+	}
+	return Camera{
+		Pos:   interpolate(demo.Pos, path.Pos, w),
+		Angle: slerpAngles(demo.Angle, path.Angle, w),
+		FOV:   demo.FOV + w*(path.FOV-demo.FOV),
+	}
+}
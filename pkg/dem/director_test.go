@@ -0,0 +1,162 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/bsp"
+)
+
+func TestLookAngles(t *testing.T) {
+	for _, test := range []struct {
+		to   Vertex
+		want Vertex
+	}{
+		{Vertex{X: 1}, Vertex{}},
+		{Vertex{Y: 1}, Vertex{Y: 90}},
+		{Vertex{X: -1}, Vertex{Y: 180}},
+		{Vertex{X: 1, Z: -1}, Vertex{X: 45}},
+		{Vertex{Y: 1, Z: 1}, Vertex{X: -45, Y: 90}},
+	} {
+		if got := lookAngles(Vertex{}, test.to); !closeVertex(got, test.want, 0.01) {
+			t.Errorf("lookAngles(%v): got %v, want %v", test.to, got, test.want)
+		}
+	}
+}
+
+func TestChaseCamera(t *testing.T) {
+	// Solid at x < -50.
+	wall := &bsp.BSP{Raw: &bsp.Raw{
+		Models: []bsp.RawModel{{}},
+		Planes: []bsp.RawPlane{{Normal: bsp.Vertex{X: 1}, Dist: -50}},
+		Nodes:  []bsp.RawNode{{Children: [2]int16{^1, ^0}}},
+		Leaves: []bsp.RawLeaf{{Contents: bsp.ContentsSolid}, {Contents: bsp.ContentsEmpty}},
+	}}
+	c := ChaseCamera{Distance: 100, Height: 0}
+	for _, test := range []struct {
+		level *bsp.BSP
+		yaw   float32
+		want  Vertex
+	}{
+		{nil, 0, Vertex{X: -100, Z: 10}},
+		{nil, 90, Vertex{Y: -100, Z: 10}},
+		{wall, 0, Vertex{X: -46, Z: 10}},
+		{wall, 180, Vertex{X: 100, Z: 10}},
+	} {
+		s := NewState()
+		s.Level = test.level
+		f := &Frame{
+			State:  s,
+			Camera: Camera{Pos: Vertex{Z: 10}, Angle: Vertex{Y: test.yaw}},
+		}
+		got := c.Camera(f)
+		if !closeVertex(got.Pos, test.want, 0.01) {
+			t.Errorf("Yaw %g, level %t: got %v, want %v", test.yaw, test.level != nil, got.Pos, test.want)
+		}
+		if want := posAngle(test.yaw); math.Abs(float64(posAngle(got.Angle.Y)-want)) > 0.01 {
+			t.Errorf("Yaw %g, level %t: looking at yaw %g, want %g", test.yaw, test.level != nil, got.Angle.Y, want)
+		}
+	}
+}
+
+func TestOrbitCamera(t *testing.T) {
+	c := OrbitCamera{Center: Vertex{X: 10, Y: 10}, Radius: 100, Height: 0, Period: 4}
+	for _, test := range []struct {
+		time float64
+		pos  Vertex
+		yaw  float32
+	}{
+		{0, Vertex{X: 110, Y: 10}, 180},
+		{1, Vertex{X: 10, Y: 110}, -90},
+		{6, Vertex{X: -90, Y: 10}, 0},
+	} {
+		got := c.Camera(&Frame{Time: test.time})
+		if !closeVertex(got.Pos, test.pos, 0.01) || math.Abs(float64(got.Angle.Y-test.yaw)) > 0.01 {
+			t.Errorf("Time %g: got %v %v, want %v yaw %g", test.time, got.Pos, got.Angle, test.pos, test.yaw)
+		}
+	}
+}
+
+func TestParseCameraPath(t *testing.T) {
+	c, err := ParseCameraPath(strings.NewReader(`
+# time x y z look fov weight
+2  0 0 0  1 0 0  90  0.5
+1  0 0 0  1 0 0  90
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PathKey{
+		{Time: 1, LookAt: Vertex{X: 1}, FOV: 90, Weight: 1},
+		{Time: 2, LookAt: Vertex{X: 1}, FOV: 90, Weight: 0.5},
+	}
+	if len(c.Keys) != len(want) {
+		t.Fatalf("Got %d keys, want %d", len(c.Keys), len(want))
+	}
+	for n := range want {
+		if c.Keys[n] != want[n] {
+			t.Errorf("Key %d: got %+v, want %+v", n, c.Keys[n], want[n])
+		}
+	}
+
+	for _, bad := range []string{
+		"",
+		"1 0 0 0 1 0 0",
+		"1 0 0 0 1 0 0 90 1 1",
+		"1 0 0 0 1 0 0 wide",
+		"1 0 0 0 1 0 0 90\n1 0 0 0 1 0 0 90",
+	} {
+		if _, err := ParseCameraPath(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseCameraPath(%q): expected error", bad)
+		}
+	}
+}
+
+func TestPathCamera(t *testing.T) {
+	c, err := NewPathCamera([]PathKey{
+		{Time: 0, Pos: Vertex{X: 0}, LookAt: Vertex{X: 0, Y: 100}, FOV: 60, Weight: 1},
+		{Time: 1, Pos: Vertex{X: 10}, LookAt: Vertex{X: 10, Y: 100}, FOV: 80, Weight: 1},
+		{Time: 2, Pos: Vertex{X: 20}, LookAt: Vertex{X: 20, Y: 100}, FOV: 100, Weight: 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	demo := Camera{Pos: Vertex{Z: 100}, Angle: Vertex{Y: 90}}
+	for _, test := range []struct {
+		time float64
+		want Camera
+	}{
+		{-1, Camera{Pos: Vertex{}, Angle: Vertex{Y: 90}, FOV: 60}},
+		{0.5, Camera{Pos: Vertex{X: 5}, Angle: Vertex{Y: 90}, FOV: 70}},
+		{1.5, Camera{Pos: Vertex{X: 15 * 0.5, Z: 50}, Angle: Vertex{Y: 90}, FOV: 95}},
+		{3, demo},
+	} {
+		got := c.Camera(&Frame{Time: test.time, Camera: demo})
+		if test.want.FOV == 0 {
+			test.want.FOV = DefaultFOV
+		}
+		if !closeVertex(got.Pos, test.want.Pos, 0.01) || !closeVertex(got.Angle, test.want.Angle, 0.01) || math.Abs(got.FOV-test.want.FOV) > 0.01 {
+			t.Errorf("Time %g: got %+v, want %+v", test.time, got, test.want)
+		}
+	}
+}
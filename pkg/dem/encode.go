@@ -0,0 +1,668 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+var (
+	// ErrNotEncodable is returned when writing a message that can't be
+	// written to a .dem file, such as QuakeWorld only messages.
+	ErrNotEncodable = errors.New("message can't be encoded")
+)
+
+// encoder is a message that can be written back to a demo.
+type encoder interface {
+	encode(e *msgEncoder) error
+}
+
+// msgEncoder builds the data of a block.
+type msgEncoder struct {
+	buf   bytes.Buffer
+	proto *protocol
+}
+
+func (e *msgEncoder) u8(v uint8)   { e.buf.WriteByte(v) }
+func (e *msgEncoder) i8(v int8)    { e.buf.WriteByte(uint8(v)) }
+func (e *msgEncoder) u16(v uint16) { binary.Write(&e.buf, binary.LittleEndian, v) }
+func (e *msgEncoder) i16(v int16)  { binary.Write(&e.buf, binary.LittleEndian, v) }
+func (e *msgEncoder) u32(v uint32) { binary.Write(&e.buf, binary.LittleEndian, v) }
+func (e *msgEncoder) f32(v float32) {
+	binary.Write(&e.buf, binary.LittleEndian, v)
+}
+
+func (e *msgEncoder) str(s string) {
+	e.buf.WriteString(s)
+	e.buf.WriteByte(0)
+}
+
+// coord writes a coordinate in the protocol's format.
+func (e *msgEncoder) coord(v float32) {
+	flags := e.proto.flags
+	switch {
+	case flags&PRFL_FLOATCOORD != 0:
+		e.f32(v)
+	case flags&PRFL_INT32COORD != 0:
+		binary.Write(&e.buf, binary.LittleEndian, int32(math.Round(float64(v)*16)))
+	case flags&PRFL_24BITCOORD != 0:
+		i := math.Floor(float64(v))
+		e.i16(int16(i))
+		e.u8(uint8(math.Round((float64(v) - i) * 255)))
+	default:
+		e.i16(int16(math.Round(float64(v) * 8)))
+	}
+}
+
+// angle writes an angle in the protocol's format.
+func (e *msgEncoder) angle(v float32) {
+	flags := e.proto.flags
+	switch {
+	case flags&PRFL_FLOATANGLE != 0:
+		e.f32(v)
+	case flags&PRFL_SHORTANGLE != 0:
+		e.u16(uint16(int(math.Round(float64(v)*65536/360)) & 0xffff))
+	default:
+		e.u8(uint8(int(math.Round(float64(v)*256/360)) & 0xff))
+	}
+}
+
+func (e *msgEncoder) vertex(v Vertex) {
+	e.coord(v.X)
+	e.coord(v.Y)
+	e.coord(v.Z)
+}
+
+// Writer writes a .dem demo.
+type Writer struct {
+	w     io.Writer
+	proto protocol
+}
+
+// NewWriter starts writing a demo, beginning with the CD track line.
+func NewWriter(w io.Writer, cdtrack string) (*Writer, error) {
+	if _, err := fmt.Fprintf(w, "%s\n", cdtrack); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:     w,
+		proto: protocol{version: version15},
+	}, nil
+}
+
+// WriteBlock encodes the messages and writes them as a block.
+// The block size in the header is set to the size of the messages.
+func (w *Writer) WriteBlock(h BlockHeader, msgs []Message) error {
+	e := msgEncoder{proto: &w.proto}
+	for n, m := range msgs {
+		enc, ok := m.(encoder)
+		if !ok {
+			return fmt.Errorf("message %d of type %T: %w", n, m, ErrNotEncodable)
+		}
+		if err := enc.encode(&e); err != nil {
+			return fmt.Errorf("message %d of type %T: %w", n, m, err)
+		}
+	}
+	h.Blocksize = uint32(e.buf.Len())
+	if err := binary.Write(w.w, binary.LittleEndian, &h); err != nil {
+		return err
+	}
+	_, err := w.w.Write(e.buf.Bytes())
+	return err
+}
+
+func (m MsgNop) encode(e *msgEncoder) error {
+	e.u8(0x01)
+	return nil
+}
+
+func (m MsgDisconnect) encode(e *msgEncoder) error {
+	e.u8(0x02)
+	return nil
+}
+
+func (m MsgPlayerState) encode(e *msgEncoder) error {
+	e.u8(0x03)
+	e.u8(m.Key)
+	e.u32(m.Value)
+	return nil
+}
+
+func (m MsgCameraPos) encode(e *msgEncoder) error {
+	e.u8(0x05)
+	e.u16(m.Entity)
+	return nil
+}
+
+func (m MsgPlaySound) encode(e *msgEncoder) error {
+	var mask uint8
+	if m.Volume != DefaultSoundVolume {
+		mask |= SND_VOLUME
+	}
+	if m.Attenuation != DefaultSoundAttenuation {
+		mask |= SND_ATTENUATION
+	}
+	if m.Entity >= 8192 || m.Channel >= 8 {
+		mask |= SND_LARGEENTITY
+	}
+	if m.Sound >= 256 {
+		mask |= SND_LARGESOUND
+	}
+	if mask&(SND_LARGEENTITY|SND_LARGESOUND) != 0 && !e.proto.fitz() {
+		return fmt.Errorf("sound %d on entity %d needs FitzQuake protocol", m.Sound, m.Entity)
+	}
+	e.u8(0x06)
+	e.u8(mask)
+	if mask&SND_VOLUME != 0 {
+		e.u8(uint8(m.Volume))
+	}
+	if mask&SND_ATTENUATION != 0 {
+		e.u8(uint8(m.Attenuation))
+	}
+	if mask&SND_LARGEENTITY != 0 {
+		e.u16(m.Entity)
+		e.u8(uint8(m.Channel))
+	} else {
+		e.u16(m.Entity<<3 | uint16(m.Channel))
+	}
+	if mask&SND_LARGESOUND != 0 {
+		e.u16(uint16(m.Sound))
+	} else {
+		e.u8(uint8(m.Sound))
+	}
+	e.vertex(Vertex{X: m.X, Y: m.Y, Z: m.Z})
+	return nil
+}
+
+func (m *MsgTime) encode(e *msgEncoder) error {
+	e.u8(0x07)
+	e.f32(float32(*m))
+	return nil
+}
+
+func (m MsgPrint) encode(e *msgEncoder) error {
+	e.u8(0x08)
+	e.str(m.Text)
+	return nil
+}
+
+func (m MsgStuffText) encode(e *msgEncoder) error {
+	e.u8(0x09)
+	e.str(m.Text)
+	return nil
+}
+
+func (m MsgCameraOrientation) encode(e *msgEncoder) error {
+	e.u8(0x0a)
+	e.angle(m.X)
+	e.angle(m.Y)
+	e.angle(m.Z)
+	return nil
+}
+
+func (m ServerInfo) encode(e *msgEncoder) error {
+	e.u8(0x0b)
+	e.u32(m.ServerVersion)
+	if m.ServerVersion == versionRMQ {
+		e.u32(m.ProtocolFlags)
+	}
+	e.u8(m.MaxClients)
+	e.u8(m.GameType)
+	e.str(m.Level)
+	// The first model and sound are not sent.
+	for n, s := range m.Models {
+		if n > 0 {
+			e.str(s)
+		}
+	}
+	e.u8(0)
+	for n, s := range m.Sounds {
+		if n > 0 {
+			e.str(s)
+		}
+	}
+	e.u8(0)
+	*e.proto = protocol{
+		version: m.ServerVersion,
+		flags:   m.ProtocolFlags,
+	}
+	return nil
+}
+
+func (m MsgLightStyle) encode(e *msgEncoder) error {
+	e.u8(0x0c)
+	e.u8(m.Index)
+	e.str(m.Style)
+	return nil
+}
+
+func (m MsgPlayerName) encode(e *msgEncoder) error {
+	e.u8(0x0d)
+	e.u8(m.Index)
+	e.str(m.Name)
+	return nil
+}
+
+func (m MsgFrags) encode(e *msgEncoder) error {
+	e.u8(0x0e)
+	e.u8(m.Player)
+	e.u16(m.Frags)
+	return nil
+}
+
+func (m MsgClientData) encode(e *msgEncoder) error {
+	bits := m.Bits &^ (SU_EXTEND1 | SU_EXTEND2)
+	if bits&0xff0000 != 0 {
+		bits |= SU_EXTEND1
+	}
+	if bits&0xff000000 != 0 {
+		bits |= SU_EXTEND2
+	}
+	e.u8(0x0f)
+	e.u16(uint16(bits))
+	if bits&SU_EXTEND1 != 0 {
+		e.u8(uint8(bits >> 16))
+	}
+	if bits&SU_EXTEND2 != 0 {
+		e.u8(uint8(bits >> 24))
+	}
+	for _, f := range []struct {
+		bit uint32
+		v   int8
+	}{
+		{SU_VIEWHEIGHT, m.ViewHeight},
+		{SU_IDEALPITCH, m.IdealPitch},
+		{SU_PUNCH1, m.Punch[0]},
+		{SU_VELOCITY1, m.Velocity[0]},
+		{SU_PUNCH2, m.Punch[1]},
+		{SU_VELOCITY2, m.Velocity[1]},
+		{SU_PUNCH3, m.Punch[2]},
+		{SU_VELOCITY3, m.Velocity[2]},
+	} {
+		if bits&f.bit != 0 {
+			e.i8(f.v)
+		}
+	}
+	if bits&SU_ITEMS != 0 {
+		e.u32(m.Items)
+	}
+	for _, f := range []struct {
+		bit uint32
+		v   uint8
+	}{
+		{SU_WEAPONFRAME, m.WeaponFrame},
+		{SU_ARMOR, m.Armor},
+		{SU_WEAPON, m.Weapon},
+	} {
+		if bits&f.bit != 0 {
+			e.u8(f.v)
+		}
+	}
+	e.i16(m.Health)
+	for _, v := range []uint8{m.Ammo, m.Shells, m.Nails, m.Rockets, m.Cells, m.ActiveWeapon} {
+		e.u8(v)
+	}
+	for _, f := range []struct {
+		bit uint32
+		v   uint8
+	}{
+		{SU_WEAPON2, m.Weapon2},
+		{SU_ARMOR2, m.Armor2},
+		{SU_AMMO2, m.Ammo2},
+		{SU_SHELLS2, m.Shells2},
+		{SU_NAILS2, m.Nails2},
+		{SU_ROCKETS2, m.Rockets2},
+		{SU_CELLS2, m.Cells2},
+		{SU_WEAPONFRAME2, m.WeaponFrame2},
+		{SU_WEAPONALPHA, m.WeaponAlpha},
+	} {
+		if bits&f.bit != 0 {
+			e.u8(f.v)
+		}
+	}
+	return nil
+}
+
+func (m MsgStopSound) encode(e *msgEncoder) error {
+	e.u8(0x10)
+	e.u16(m.Entity<<3 | uint16(m.Channel&7))
+	return nil
+}
+
+func (m MsgSetColors) encode(e *msgEncoder) error {
+	e.u8(0x11)
+	e.u8(m.Player)
+	e.u8(m.Color)
+	return nil
+}
+
+func (m MsgParticle) encode(e *msgEncoder) error {
+	e.u8(0x12)
+	e.vertex(m.Pos)
+	for _, d := range []float32{m.Dir.X, m.Dir.Y, m.Dir.Z} {
+		e.i8(int8(math.Round(float64(d) * 16)))
+	}
+	e.u8(m.Count)
+	e.u8(m.Color)
+	return nil
+}
+
+func (m MsgDamage) encode(e *msgEncoder) error {
+	e.u8(0x13)
+	e.u8(m.Armor)
+	e.u8(m.Blood)
+	e.vertex(m.Pos)
+	return nil
+}
+
+// encodeBaseline writes the part of the baseline shared by spawnbaseline and spawnstatic.
+func (m *MsgSpawnBaseline) encodeBaseline(e *msgEncoder) error {
+	if m.Version == 2 {
+		var bits uint8
+		if m.Model > 255 {
+			bits |= B_LARGEMODEL
+		}
+		if m.Frame > 255 {
+			bits |= B_LARGEFRAME
+		}
+		if m.Alpha != 0 {
+			bits |= B_ALPHA
+		}
+		if m.Scale != 0 {
+			bits |= B_SCALE
+		}
+		e.u8(bits)
+		for _, f := range []struct {
+			bit uint8
+			v   uint16
+		}{
+			{B_LARGEMODEL, m.Model},
+			{B_LARGEFRAME, m.Frame},
+		} {
+			if bits&f.bit != 0 {
+				e.u16(f.v)
+			} else {
+				e.u8(uint8(f.v))
+			}
+		}
+	} else {
+		if m.Model > 255 || m.Frame > 255 || m.Alpha != 0 || m.Scale != 0 {
+			return fmt.Errorf("model %d frame %d alpha %d scale %d needs version 2 baseline", m.Model, m.Frame, m.Alpha, m.Scale)
+		}
+		e.u8(uint8(m.Model))
+		e.u8(uint8(m.Frame))
+	}
+	e.u8(m.Color)
+	e.u8(m.Skin)
+	e.coord(m.X)
+	e.angle(m.A)
+	e.coord(m.Y)
+	e.angle(m.B)
+	e.coord(m.Z)
+	e.angle(m.C)
+	if m.Version == 2 && m.Alpha != 0 {
+		e.u8(m.Alpha)
+	}
+	if m.Version == 2 && m.Scale != 0 {
+		e.u8(m.Scale)
+	}
+	return nil
+}
+
+func (m MsgSpawnStatic) encode(e *msgEncoder) error {
+	if m.Version == 2 {
+		e.u8(0x2b)
+	} else {
+		e.u8(0x14)
+	}
+	return m.encodeBaseline(e)
+}
+
+func (m MsgSpawnBaseline) encode(e *msgEncoder) error {
+	if m.Version == 2 {
+		e.u8(0x2a)
+	} else {
+		e.u8(0x16)
+	}
+	e.u16(m.Entity)
+	return m.encodeBaseline(e)
+}
+
+func (m MsgTempEntity) encode(e *msgEncoder) error {
+	if m.QW {
+		return fmt.Errorf("QuakeWorld temp entity: %w", ErrNotEncodable)
+	}
+	e.u8(0x17)
+	e.u8(m.Type)
+	switch m.Type {
+	case TE_SPIKE, TE_SUPERSPIKE, TE_GUNSHOT, TE_EXPLOSION, TE_TAREXPLOSION, TE_WIZSPIKE, TE_LAVASPLASH, TE_TELEPORT, TE_KNIGHTSPIKE, TE_IMPLOSION:
+		e.vertex(m.Pos)
+	case TE_LIGHTNING1, TE_LIGHTNING2, TE_LIGHTNING3, TE_BEAM, TE_RAILTRAIL:
+		e.u16(m.Entity)
+		e.vertex(m.Pos)
+		e.vertex(m.End)
+	case TE_EXPLOSION2:
+		e.vertex(m.Pos)
+		e.u8(m.ColorStart)
+		e.u8(m.ColorLength)
+	default:
+		return fmt.Errorf("bad temp ent type %d", m.Type)
+	}
+	return nil
+}
+
+func (m MsgSetPause) encode(e *msgEncoder) error {
+	e.u8(0x18)
+	if m.Paused {
+		e.u8(1)
+	} else {
+		e.u8(0)
+	}
+	return nil
+}
+
+func (m MsgClientState) encode(e *msgEncoder) error {
+	e.u8(0x19)
+	e.u8(m.State)
+	return nil
+}
+
+func (m MsgCenterPrint) encode(e *msgEncoder) error {
+	e.u8(0x1a)
+	e.str(m.Text)
+	return nil
+}
+
+func (m MsgKilledMonster) encode(e *msgEncoder) error {
+	e.u8(0x1b)
+	return nil
+}
+
+func (m MsgFoundSecret) encode(e *msgEncoder) error {
+	e.u8(0x1c)
+	return nil
+}
+
+func (m MsgSpawnStaticSound) encode(e *msgEncoder) error {
+	if m.Version == 2 {
+		e.u8(0x2c)
+	} else {
+		if m.Sound > 255 {
+			return fmt.Errorf("sound %d needs version 2 static sound", m.Sound)
+		}
+		e.u8(0x1d)
+	}
+	e.vertex(m.Pos)
+	if m.Version == 2 {
+		e.u16(m.Sound)
+	} else {
+		e.u8(uint8(m.Sound))
+	}
+	e.u8(m.Volume)
+	e.u8(m.Attenuation)
+	return nil
+}
+
+func (m *MsgIntermission) encode(e *msgEncoder) error {
+	e.u8(0x1e)
+	e.str(m.Text)
+	return nil
+}
+
+func (m *MsgFinale) encode(e *msgEncoder) error {
+	e.u8(0x1f)
+	e.str(m.Text)
+	return nil
+}
+
+func (m MsgCDTrack) encode(e *msgEncoder) error {
+	e.u8(0x20)
+	e.u8(m.Track)
+	e.u8(m.Loop)
+	return nil
+}
+
+func (m MsgSellScreen) encode(e *msgEncoder) error {
+	e.u8(0x21)
+	return nil
+}
+
+func (m MsgCutscene) encode(e *msgEncoder) error {
+	e.u8(0x22)
+	e.str(m.Text)
+	return nil
+}
+
+func (m MsgSkybox) encode(e *msgEncoder) error {
+	e.u8(0x25)
+	e.str(m.Name)
+	return nil
+}
+
+func (m MsgBonusFlash) encode(e *msgEncoder) error {
+	e.u8(0x28)
+	return nil
+}
+
+func (m MsgFog) encode(e *msgEncoder) error {
+	e.u8(0x29)
+	for _, v := range []uint8{m.Density, m.R, m.G, m.B} {
+		e.u8(v)
+	}
+	e.i16(m.Time)
+	return nil
+}
+
+func (m MsgUpdate) encode(e *msgEncoder) error {
+	mask := uint32(U_SIGNAL)
+	if m.NoLerp {
+		mask |= U_NOLERP
+	}
+	if m.Entity > 255 {
+		mask |= U_LONGENTITY
+	}
+	for _, f := range []struct {
+		bit uint32
+		set bool
+	}{
+		{U_MODEL, m.Model != nil},
+		{U_FRAME, m.Frame != nil},
+		{U_COLORMAP, m.Color != nil},
+		{U_SKIN, m.Skin != nil},
+		{U_EFFECTS, m.Effects != nil},
+		{U_ORIGIN1, m.X != nil},
+		{U_ORIGIN2, m.Y != nil},
+		{U_ORIGIN3, m.Z != nil},
+		{U_ANGLE1, m.A != nil},
+		{U_ANGLE2, m.B != nil},
+		{U_ANGLE3, m.C != nil},
+		{U_ALPHA, m.Alpha != nil},
+		{U_SCALE, m.Scale != nil},
+		{U_FRAME2, m.Frame2 != nil},
+		{U_MODEL2, m.Model2 != nil},
+		{U_LERPFINISH, m.LerpFinish != nil},
+	} {
+		if f.set {
+			mask |= f.bit
+		}
+	}
+	if mask&0xff0000 != 0 {
+		mask |= U_EXTEND1
+	}
+	if mask&0xff000000 != 0 {
+		mask |= U_EXTEND2
+	}
+	if mask&(U_EXTEND1|U_EXTEND2) != 0 && !e.proto.fitz() {
+		return fmt.Errorf("update of entity %d needs FitzQuake protocol", m.Entity)
+	}
+	if mask&0xffffff00 != 0 {
+		mask |= U_MOREBITS
+	}
+	e.u8(uint8(mask))
+	if mask&U_MOREBITS != 0 {
+		e.u8(uint8(mask >> 8))
+	}
+	if mask&U_EXTEND1 != 0 {
+		e.u8(uint8(mask >> 16))
+	}
+	if mask&U_EXTEND2 != 0 {
+		e.u8(uint8(mask >> 24))
+	}
+	if mask&U_LONGENTITY != 0 {
+		e.u16(m.Entity)
+	} else {
+		e.u8(uint8(m.Entity))
+	}
+	for _, p := range []*uint8{m.Model, m.Frame, m.Color, m.Skin, m.Effects} {
+		if p != nil {
+			e.u8(*p)
+		}
+	}
+	for _, f := range []struct {
+		p     *float32
+		angle bool
+	}{
+		{m.X, false},
+		{m.A, true},
+		{m.Y, false},
+		{m.B, true},
+		{m.Z, false},
+		{m.C, true},
+	} {
+		switch {
+		case f.p == nil:
+		case f.angle:
+			e.angle(*f.p)
+		default:
+			e.coord(*f.p)
+		}
+	}
+	for _, p := range []*uint8{m.Alpha, m.Scale, m.Frame2, m.Model2, m.LerpFinish} {
+		if p != nil {
+			e.u8(*p)
+		}
+	}
+	return nil
+}
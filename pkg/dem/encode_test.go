@@ -0,0 +1,189 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// rewrite decodes a demo and writes it back out.
+func rewrite(t *testing.T, data []byte) []byte {
+	t.Helper()
+	d, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	var out bytes.Buffer
+	w, err := NewWriter(&out, d.CDTrack)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	for {
+		block, err := d.ReadBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadBlock: %v", err)
+		}
+		msgs, err := block.Messages()
+		if err != nil {
+			t.Fatalf("Messages: %v", err)
+		}
+		if err := w.WriteBlock(block.Header, msgs); err != nil {
+			t.Fatalf("WriteBlock: %v", err)
+		}
+	}
+	return out.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"simple": testDemoFile,
+		"quake": testDemo(
+			[][]byte{
+				testServerInfo,
+				testMsg(uint8(0x08), "Hello\n"),
+				testMsg(uint8(0x09), "bf\n"),
+				testMsg(uint8(0x0c), uint8(1), "mmnmmommommnonmmonqnmmo"),
+				testMsg(uint8(0x0d), uint8(0), "player"),
+				testMsg(uint8(0x0e), uint8(0), uint16(3)),
+				testMsg(uint8(0x11), uint8(0), uint8(0x4d)),
+				testMsg(uint8(0x14), uint8(2), uint8(1), uint8(0), uint8(0), int16(8), int8(0), int16(16), int8(64), int16(24), int8(-64)),
+				testMsg(uint8(0x1d), int16(8), int16(16), int16(24), uint8(1), uint8(255), uint8(3)),
+				testMsg(uint8(0x20), uint8(4), uint8(4)),
+				testMsg(uint8(0x19), uint8(2)),
+				testMsg(uint8(0x19), uint8(3)),
+			},
+			[][]byte{
+				testMsg(uint8(0x07), float32(2.25)),
+				testMsg(uint8(0x0a), int8(10), int8(-20), int8(0)),
+				// Client data with items, weapon and punch.
+				testMsg(uint8(0x0f), uint16(SU_VIEWHEIGHT|SU_PUNCH1|SU_VELOCITY3|SU_ITEMS|SU_ONGROUND|SU_WEAPON),
+					int8(22), int8(-2), int8(5), uint32(0x1001), uint8(2), int16(100),
+					uint8(25), uint8(25), uint8(0), uint8(0), uint8(0), uint8(1)),
+				testMsg(uint8(0x06), uint8(SND_VOLUME), uint8(128), uint16(1<<3|2), uint8(1), int16(8), int16(-8), int16(0)),
+				testMsg(uint8(0x06), uint8(0), uint16(1<<3), uint8(1), int16(0), int16(0), int16(0)),
+				testMsg(uint8(0x10), uint16(1<<3|2)),
+				testMsg(uint8(0x12), int16(8), int16(16), int16(24), int8(16), int8(-16), int8(0), uint8(20), uint8(73)),
+				testMsg(uint8(0x13), uint8(3), uint8(10), int16(8), int16(16), int16(24)),
+				testMsg(uint8(0x17), uint8(TE_EXPLOSION), int16(8), int16(16), int16(24)),
+				testMsg(uint8(0x17), uint8(TE_LIGHTNING2), uint16(1), int16(0), int16(0), int16(0), int16(80), int16(0), int16(0)),
+				testMsg(uint8(0x17), uint8(TE_EXPLOSION2), int16(8), int16(16), int16(24), uint8(10), uint8(8)),
+				testMsg(uint8(0x18), uint8(1)),
+				testMsg(uint8(0x1a), "Centered"),
+				testMsg(uint8(0x1b)),
+				testMsg(uint8(0x1c)),
+				testMsg(uint8(0x01)),
+				// Update with long entity, effects and angles.
+				testMsg(uint8(0x80|U_MOREBITS|U_ORIGIN1|U_ORIGIN2|U_ORIGIN3|U_ANGLE2), uint8((U_LONGENTITY|U_ANGLE1|U_ANGLE3|U_EFFECTS|U_SKIN|U_COLORMAP)>>8),
+					uint16(300), uint8(1), uint8(2), uint8(EF_MUZZLEFLASH),
+					int16(8), int8(1), int16(16), int8(2), int16(24), int8(3)),
+				testMsg(uint8(0x80), uint8(1)),
+			},
+			[][]byte{
+				testMsg(uint8(0x07), float32(2.5)),
+				testMsg(uint8(0x1e), ""),
+				testMsg(uint8(0x1f), "The end"),
+				testMsg(uint8(0x22), "Cut"),
+				testMsg(uint8(0x21)),
+				testMsg(uint8(0x02)),
+			},
+		),
+		"fitzquake": testDemo(
+			[][]byte{
+				testMsg(uint8(0x0b), uint32(versionQuakeSpasm), uint8(1), uint8(0), "Fitz", "maps/e1m1.bsp", "", ""),
+				testMsg(uint8(0x2a), uint16(1), uint8(B_LARGEMODEL|B_ALPHA), uint16(300), uint8(2), uint8(0), uint8(0),
+					int16(8), int8(0), int16(16), int8(64), int16(24), int8(0), uint8(128)),
+				testMsg(uint8(0x2b), uint8(B_LARGEFRAME), uint8(2), uint16(400), uint8(0), uint8(0),
+					int16(8), int8(0), int16(16), int8(64), int16(24), int8(0)),
+				testMsg(uint8(0x2c), int16(8), int16(16), int16(24), uint16(300), uint8(255), uint8(3)),
+				testMsg(uint8(0x29), uint8(51), uint8(255), uint8(0), uint8(0), int16(100)),
+				testMsg(uint8(0x25), "space"),
+				testMsg(uint8(0x28)),
+				testMsg(uint8(0x06), uint8(SND_LARGEENTITY|SND_LARGESOUND), uint16(9000), uint8(1), uint16(400), int16(0), int16(0), int16(0)),
+			},
+			[][]byte{
+				testMsg(uint8(0x80|U_MOREBITS|U_ORIGIN1|U_FRAME|U_NOLERP), uint8(U_EXTEND1>>8), uint8((U_ALPHA|U_FRAME2)>>16),
+					uint8(1), uint8(4), int16(80), uint8(10), uint8(1)),
+				testMsg(uint8(0x0f), uint16(SU_EXTEND1|SU_ITEMS), uint8(SU_WEAPON2>>16), uint32(1), int16(100),
+					uint8(0), uint8(0), uint8(0), uint8(0), uint8(0), uint8(1), uint8(1)),
+			},
+		),
+		"rmq": testDemo(
+			[][]byte{
+				testMsg(uint8(0x0b), uint32(versionRMQ), uint32(PRFL_FLOATCOORD|PRFL_SHORTANGLE), uint8(1), uint8(0), "RMQ", "maps/e1m1.bsp", "", ""),
+				testMsg(uint8(0x16), uint16(1), uint8(3), uint8(0), uint8(0), uint8(0),
+					float32(8.5), int16(0), float32(-16.25), int16(16384), float32(100000), int16(-16384)),
+				testMsg(uint8(0x2a), uint16(2), uint8(B_ALPHA|B_SCALE), uint8(3), uint8(0), uint8(0), uint8(0),
+					float32(0), int16(0), float32(0), int16(0), float32(0), int16(0), uint8(128), uint8(32)),
+			},
+			[][]byte{
+				testMsg(uint8(0x80|U_ORIGIN2), uint8(1), float32(1.75)),
+			},
+		),
+		"24bit": testDemo(
+			[][]byte{
+				testMsg(uint8(0x0b), uint32(versionRMQ), uint32(PRFL_24BITCOORD), uint8(1), uint8(0), "RMQ", "maps/e1m1.bsp", "", ""),
+				testMsg(uint8(0x16), uint16(1), uint8(3), uint8(0), uint8(0), uint8(0),
+					int16(8), uint8(128), int8(0), int16(-17), uint8(1), int8(64), int16(100), uint8(254), int8(0)),
+			},
+		),
+	} {
+		if got := rewrite(t, data); !bytes.Equal(got, data) {
+			t.Errorf("%s: round trip changed the demo:\n got %x\nwant %x", name, got, data)
+		}
+	}
+}
+
+// unencodable is a message without an encoder.
+type unencodable struct{}
+
+func (unencodable) Apply(*State) {}
+
+func TestWriteErrors(t *testing.T) {
+	v := float32(0)
+	for name, msgs := range map[string][]Message{
+		"qw temp entity":  {&MsgTempEntity{Type: TE_EXPLOSION, QW: true}},
+		"large model":     {&MsgSpawnBaseline{Entity: 1, Model: 300, Version: 1}},
+		"large sound":     {&MsgSpawnStaticSound{Sound: 300, Version: 1}},
+		"large entity":    {&MsgPlaySound{Entity: 9000, Volume: DefaultSoundVolume, Attenuation: DefaultSoundAttenuation}},
+		"extended update": {&MsgUpdate{Entity: 1, X: &v, Alpha: new(uint8)}},
+		"unknown message": {unencodable{}},
+	} {
+		var out bytes.Buffer
+		w, err := NewWriter(&out, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteBlock(BlockHeader{}, msgs); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	var out bytes.Buffer
+	w, _ := NewWriter(&out, "")
+	if err := w.WriteBlock(BlockHeader{}, []Message{unencodable{}}); !errors.Is(err, ErrNotEncodable) {
+		t.Errorf("Unknown message: got %v, want ErrNotEncodable", err)
+	}
+}
@@ -0,0 +1,245 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// Demo time between state snapshots in an index.
+	snapshotInterval = 30.0
+)
+
+// IndexBlock is where a block is in the demo, and the demo time after it.
+type IndexBlock struct {
+	Offset int64
+	Time   float64
+}
+
+// snapshot is the state before a block.
+type snapshot struct {
+	block int
+	state *State
+	proto protocol
+}
+
+// Index allows random access to a .dem demo. It's built by reading the
+// whole demo once, recording where each block is and taking periodic
+// snapshots of the state. Seeking then only needs to replay the blocks
+// after the closest snapshot.
+type Index struct {
+	// Blocks of the demo, in file order.
+	Blocks []IndexBlock
+
+	r         io.ReadSeeker
+	cdtrack   string
+	start     float64
+	end       int64 // File offset of the end of the demo.
+	cur       *Demo
+	snapshots []snapshot
+}
+
+// seekReader reads from its own position in a shared io.ReadSeeker, so
+// that many demo readers can use the same file.
+type seekReader struct {
+	r   io.ReadSeeker
+	pos int64
+}
+
+func (s *seekReader) Read(p []byte) (int, error) {
+	if _, err := s.r.Seek(s.pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+// applyBlock applies all messages of a block to the state, the way the
+// client would when playing the demo. Returns true if the block updated the
+// time, which is when entities not seen since last time are hidden.
+func applyBlock(s *State, block *Block) (bool, error) {
+	if !s.CameraSetViewAngle {
+		s.ViewAngle = block.Header.ViewAngle
+	}
+	msgs, err := block.Messages()
+	if err != nil {
+		return false, err
+	}
+	seenTime := false
+	for _, m := range msgs {
+		m.Apply(s)
+		if _, ok := m.(*MsgTime); ok {
+			seenTime = true
+		}
+	}
+	if seenTime {
+		s.markVisible()
+		s.nextFrame()
+	}
+	return seenTime, nil
+}
+
+// NewIndex builds an index of a .dem demo.
+func NewIndex(r io.ReadSeeker) (*Index, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	d, err := Open(&seekReader{r: r})
+	if err != nil {
+		return nil, err
+	}
+	ix := &Index{
+		r:       r,
+		cdtrack: d.CDTrack,
+		start:   math.NaN(),
+	}
+	s := NewState()
+	next := math.Inf(-1)
+	for {
+		if s.Time >= next {
+			snap := s.Copy()
+			snap.SeenEntity = make(map[uint16]bool)
+			ix.snapshots = append(ix.snapshots, snapshot{
+				block: d.BlockCount,
+				state: snap,
+				proto: d.proto,
+			})
+			next = s.Time + snapshotInterval
+		}
+		block, err := d.ReadBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		seenTime, err := applyBlock(s, block)
+		if err != nil {
+			return nil, err
+		}
+		if seenTime && math.IsNaN(ix.start) {
+			ix.start = s.Time
+		}
+		ix.Blocks = append(ix.Blocks, IndexBlock{
+			Offset: block.Offset,
+			Time:   s.Time,
+		})
+	}
+	if math.IsNaN(ix.start) {
+		ix.start = 0
+	}
+	ix.end = d.offset
+	ix.cur = ix.demoAt(ix.snapshots[0])
+	return ix, nil
+}
+
+// Start returns the time of the first time update in the demo.
+func (ix *Index) Start() float64 {
+	return ix.start
+}
+
+// End returns the time of the last block in the demo.
+func (ix *Index) End() float64 {
+	if len(ix.Blocks) == 0 {
+		return 0
+	}
+	return ix.Blocks[len(ix.Blocks)-1].Time
+}
+
+// demoAt returns a demo reader starting at the snapshot.
+func (ix *Index) demoAt(snap snapshot) *Demo {
+	offset := ix.end
+	if snap.block < len(ix.Blocks) {
+		offset = ix.Blocks[snap.block].Offset
+	}
+	return &Demo{
+		r:          &seekReader{r: ix.r, pos: offset},
+		offset:     offset,
+		proto:      snap.proto,
+		CDTrack:    ix.cdtrack,
+		BlockCount: snap.block,
+		Entities:   make([]Entity, maxEntities, maxEntities),
+	}
+}
+
+// blockAfter returns the number of the first block that ends after time t.
+// Since the time of the state continues across level changes, this can be
+// on any level.
+func (ix *Index) blockAfter(t float64) int {
+	for n, b := range ix.Blocks {
+		if b.Time > t {
+			return n
+		}
+	}
+	return len(ix.Blocks)
+}
+
+// replay returns the state after all blocks before the target block, and
+// a demo reader positioned at the target block.
+func (ix *Index) replay(target int) (*State, *Demo, error) {
+	snap := ix.snapshots[0]
+	for _, s := range ix.snapshots {
+		if s.block > target {
+			break
+		}
+		snap = s
+	}
+	d := ix.demoAt(snap)
+	s := snap.state.Copy()
+	s.SeenEntity = make(map[uint16]bool)
+	for d.BlockCount < target {
+		block, err := d.ReadBlock()
+		if err != nil {
+			return nil, nil, fmt.Errorf("replaying to block %d: %w", target, err)
+		}
+		if _, err := applyBlock(s, block); err != nil {
+			return nil, nil, fmt.Errorf("replaying to block %d: %w", target, err)
+		}
+	}
+	return s, d, nil
+}
+
+// SeekTime returns the state at time t, the last state before the time goes
+// past t. Following calls to ReadBlock continue reading after that state.
+func (ix *Index) SeekTime(t float64) (*State, error) {
+	s, d, err := ix.replay(ix.blockAfter(t))
+	if err != nil {
+		return nil, err
+	}
+	ix.cur = d
+	return s, nil
+}
+
+// StateAt returns the state at time t, like SeekTime, but without changing
+// where ReadBlock reads from.
+func (ix *Index) StateAt(t float64) (*State, error) {
+	s, _, err := ix.replay(ix.blockAfter(t))
+	return s, err
+}
+
+// ReadBlock reads the next block, starting at the beginning of the demo or
+// where SeekTime left off. At the end of the demo it returns io.EOF.
+func (ix *Index) ReadBlock() (*Block, error) {
+	return ix.cur.ReadBlock()
+}
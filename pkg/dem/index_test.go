@@ -0,0 +1,209 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// testLongDemo is a demo where entity 1 moves one unit along X per second,
+// for 100 seconds.
+func testLongDemo() []byte {
+	blocks := [][][]byte{{
+		testServerInfo,
+		testMsg(uint8(0x0c), uint8(1), "az"),
+		testMsg(uint8(0x16), uint16(1), uint8(3), uint8(0), uint8(0), uint8(0), int16(0), int8(0), int16(0), int8(0), int16(0), int8(0)),
+	}}
+	for n := 1; n <= 100; n++ {
+		blocks = append(blocks, [][]byte{
+			testMsg(uint8(0x07), float32(n)),
+			testMsg(uint8(0x80|U_ORIGIN1), uint8(1), int16(n*8)),
+		})
+		if n == 70 {
+			blocks[len(blocks)-1] = append(blocks[len(blocks)-1], testMsg(uint8(0x0c), uint8(1), "m"))
+		}
+	}
+	return testDemo(blocks...)
+}
+
+func TestIndex(t *testing.T) {
+	ix, err := NewIndex(bytes.NewReader(testLongDemo()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(ix.Blocks), 101; got != want {
+		t.Fatalf("Got %d blocks, want %d", got, want)
+	}
+	if got, want := ix.Blocks[50].Time, 50.0; got != want {
+		t.Errorf("Time of block 50: got %g, want %g", got, want)
+	}
+	if got := len(ix.snapshots); got < 3 {
+		t.Errorf("Got %d snapshots, want at least 3", got)
+	}
+	if ix.Start() != 1 || ix.End() != 100 {
+		t.Errorf("Start/end: got %g-%g, want 1-100", ix.Start(), ix.End())
+	}
+
+	for _, test := range []struct {
+		t     float64
+		x     float32
+		style string
+	}{
+		{0.5, 0, "az"},
+		{1, 1, "az"},
+		{42.5, 42, "az"},
+		{69.9, 69, "az"},
+		{75, 75, "m"},
+		{1000, 100, "m"},
+	} {
+		s, err := ix.StateAt(test.t)
+		if err != nil {
+			t.Fatalf("StateAt(%g): %v", test.t, err)
+		}
+		if got := s.Entities[1].Pos.X; got != test.x {
+			t.Errorf("StateAt(%g): X got %g, want %g", test.t, got, test.x)
+		}
+		if got := s.LightStyles[1]; got != test.style {
+			t.Errorf("StateAt(%g): light style got %q, want %q", test.t, got, test.style)
+		}
+		if test.x > 0 && !s.Entities[1].Visible {
+			t.Errorf("StateAt(%g): entity not visible", test.t)
+		}
+	}
+
+	// Seek, then keep reading.
+	s, err := ix.SeekTime(42.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 43; n <= 100; n++ {
+		block, err := ix.ReadBlock()
+		if err != nil {
+			t.Fatalf("ReadBlock after seek: %v", err)
+		}
+		if _, err := applyBlock(s, block); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := s.Entities[1].Pos.X, float32(n); got != want {
+			t.Fatalf("X after seek: got %g, want %g", got, want)
+		}
+	}
+	if _, err := ix.ReadBlock(); err != io.EOF {
+		t.Errorf("Read past end: got %v, want EOF", err)
+	}
+
+	// StateAt doesn't move the read position.
+	if _, err := ix.SeekTime(10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ix.StateAt(90); err != nil {
+		t.Fatal(err)
+	}
+	block, err := ix.ReadBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := block.Num, 11; got != want {
+		t.Errorf("Block after seek: got %d, want %d", got, want)
+	}
+}
+
+// testLevelsDemo is a demo of two levels where entity 1 moves one unit
+// along X per second, for 50 seconds each. The server time starts over on
+// the second level, and entity 1 starts at X 100.
+func testLevelsDemo() []byte {
+	var blocks [][][]byte
+	for level := 0; level < 2; level++ {
+		blocks = append(blocks, [][]byte{
+			testServerInfo,
+			testMsg(uint8(0x16), uint16(1), uint8(3), uint8(0), uint8(0), uint8(0), int16(0), int8(0), int16(0), int8(0), int16(0), int8(0)),
+		})
+		for n := 1; n <= 50; n++ {
+			blocks = append(blocks, [][]byte{
+				testMsg(uint8(0x07), float32(n)),
+				testMsg(uint8(0x80|U_ORIGIN1), uint8(1), int16((100*level+n)*8)),
+			})
+		}
+	}
+	return testDemo(blocks...)
+}
+
+func TestIndexLevels(t *testing.T) {
+	ix, err := NewIndex(bytes.NewReader(testLevelsDemo()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second level continues from where the first ended.
+	if ix.Start() != 1 || ix.End() != 99 {
+		t.Errorf("Start/end: got %g-%g, want 1-99", ix.Start(), ix.End())
+	}
+	for _, test := range []struct {
+		t float64
+		x float32
+	}{
+		{25, 25},
+		{55, 106},
+		{60, 111},
+		{99, 150},
+	} {
+		s, err := ix.StateAt(test.t)
+		if err != nil {
+			t.Fatalf("StateAt(%g): %v", test.t, err)
+		}
+		if got := s.Entities[1].Pos.X; got != test.x {
+			t.Errorf("StateAt(%g): X got %g, want %g", test.t, got, test.x)
+		}
+	}
+
+	// Playing from the second level numbers frames the same as playing
+	// the whole demo.
+	full := make(map[int]float32)
+	for f, err := range NewPlayer(ix).Frames(2) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		full[f.Num] = f.State.Entities[1].Pos.X
+	}
+	if got, want := len(full), 196; got != want {
+		t.Errorf("Got %d frames, want %d", got, want)
+	}
+	p, err := NewPlayerAt(ix, 75, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for f, err := range p.Frames(2) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 && f.Time != 75 {
+			t.Errorf("First frame at %g, want 75", f.Time)
+		}
+		if got, want := f.State.Entities[1].Pos.X, full[f.Num]; got != want {
+			t.Errorf("Frame %d: X got %g, want %g", f.Num, got, want)
+		}
+		n++
+	}
+	if got, want := n, 48; got != want {
+		t.Errorf("Got %d frames after seeking, want %d", got, want)
+	}
+}
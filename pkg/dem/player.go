@@ -0,0 +1,542 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"io"
+	"iter"
+	"math"
+
+	"github.com/ThomasHabets/qpov/pkg/bsp"
+)
+
+// BlockReader is a source of demo blocks, such as a Demo or an Index.
+type BlockReader interface {
+	ReadBlock() (*Block, error)
+}
+
+const (
+	// DefaultFOV is the horizontal field of view, in degrees, of cameras
+	// that don't set one.
+	DefaultFOV = 100
+)
+
+// Camera is where the frame is seen from.
+type Camera struct {
+	Pos   Vertex
+	Angle Vertex  // Pitch, yaw and roll.
+	FOV   float64 // Horizontal field of view in degrees, or 0 for DefaultFOV.
+}
+
+// demoCamera returns the camera as seen by the player of the demo, with
+// the view effects of the Quake client.
+func (p *Player) demoCamera(s *State) Camera {
+	pos := s.Entities[s.CameraEnt].Pos
+	pos.Z += s.ViewHeight
+	angle := s.ViewAngle
+	if p.ViewBob {
+		pos.Z += float32(ViewBob(s))
+	}
+	if p.ViewRoll {
+		angle.Z += float32(viewRoll(s))
+	}
+	if s.Dead {
+		angle.Z = deathRoll
+	}
+	angle.X += s.PunchAngle.X
+	angle.Y += s.PunchAngle.Y
+	angle.Z += s.PunchAngle.Z
+	return Camera{
+		Pos:   pos,
+		Angle: angle,
+	}
+}
+
+// Frame is one frame of demo playback.
+type Frame struct {
+	// Num is the frame number, counting from the first frame of the demo
+	// even if playback started later.
+	Num  int
+	Time float64
+
+	// State is the state interpolated to Time, between Prev and Next.
+	State      *State
+	Prev, Next *State
+
+	Camera Camera
+}
+
+// Player plays back a demo as frames at a fixed frame rate, interpolating
+// entity movement between the states of the demo.
+type Player struct {
+	r        BlockReader
+	state    *State
+	prev     *State
+	frameNum int
+	level    string
+
+	// From and To limit the times of frames to generate. Frames outside
+	// of this range are still counted.
+	From, To float64
+
+	// OnMessage, if set, is called with each message after it's been applied.
+	OnMessage func(m Message, s *State)
+
+	// LoadLevel, if set, is called to load the level BSP when the level changes.
+	LoadLevel func(name string) (*bsp.BSP, error)
+
+	// Smoothing is how the camera moves between the states of the demo.
+	Smoothing CameraSmoothing
+
+	// Director, if set, moves the camera away from the view of the demo.
+	Director Director
+
+	// ViewBob and ViewRoll turn on bobbing of the view when moving, and
+	// rolling it when strafing, like the Quake client.
+	ViewBob, ViewRoll bool
+
+	// POVEntity, if set, is the entity to see the demo from instead of the
+	// player that recorded it. POVPlayer does the same by player name.
+	// The view angles are those of the entity.
+	POVEntity int
+	POVPlayer string
+	started   bool
+
+	// Camera keys and frames waiting for the next key, for spline smoothing.
+	keys        []cameraKey
+	keyCamEnt   int
+	camTeleport bool
+	queue       []*Frame
+
+	// Last camera yielded, for low-pass smoothing.
+	lastCam  *Camera
+	lastTime float64
+}
+
+// NewPlayer creates a player starting at the beginning of the demo.
+func NewPlayer(r BlockReader) *Player {
+	return &Player{
+		r:     r,
+		state: NewState(),
+		To:    math.Inf(1),
+	}
+}
+
+// NewPlayerAt creates a player starting at time t of an indexed demo.
+// The frames are numbered as if playback started at the beginning.
+func NewPlayerAt(ix *Index, t, fps float64) (*Player, error) {
+	s, err := ix.SeekTime(t)
+	if err != nil {
+		return nil, err
+	}
+	p := NewPlayer(ix)
+	p.state = s
+	p.prev = s.Copy()
+	p.state.nextFrame()
+	p.frameNum = len(GenTimeFrames(ix.Start(), s.Time, fps))
+	p.From = t
+	return p, nil
+}
+
+// GenTimeFrames returns the times of the frames between from and to.
+// Frame times are multiples of 1/fps, so that they're the same no matter
+// where playback starts.
+func GenTimeFrames(from, to, fps float64) []float64 {
+	frames := []float64{}
+	frameTime := 1.0 / fps
+	frame := int(from / frameTime)
+	for {
+		frameTime := float64(frame) / fps
+		if frameTime >= to {
+			return frames
+		}
+		if frameTime >= from {
+			frames = append(frames, frameTime)
+		}
+		frame++
+	}
+}
+
+// markVisible makes entities visible if they've been seen since the last
+// time update.
+func (s *State) markVisible() {
+	for n := range s.Entities {
+		s.Entities[n].Visible = s.SeenEntity[uint16(n)]
+	}
+	s.Entities[0].Visible = true // World.
+}
+
+// readBlock reads a block and applies it to the current state. Returns true
+// if the time changed.
+func (p *Player) readBlock() (bool, error) {
+	block, err := p.r.ReadBlock()
+	if err != nil {
+		return false, err
+	}
+	if !p.state.CameraSetViewAngle {
+		p.state.ViewAngle = block.Header.ViewAngle
+	}
+	msgs, err := block.Messages()
+	if err != nil {
+		return false, err
+	}
+	seenTime := false
+	for _, msg := range msgs {
+		msg.Apply(p.state)
+		if p.OnMessage != nil {
+			p.OnMessage(msg, p.state)
+		}
+		switch m := msg.(type) {
+		case *MsgTime:
+			seenTime = true
+		case *MsgUpdate:
+			if m.NoLerp && int(m.Entity) == p.state.CameraEnt {
+				p.camTeleport = true
+			}
+		case *ServerInfo:
+			// The camera is somewhere else on the new level.
+			p.camTeleport = true
+		}
+	}
+	p.setPOV(p.state)
+	if p.LoadLevel != nil && len(p.state.ServerInfo.Models) > 0 && p.state.ServerInfo.Models[0] != p.level {
+		p.level = p.state.ServerInfo.Models[0]
+		if p.state.Level, err = p.LoadLevel(p.level); err != nil {
+			return false, err
+		}
+	}
+	return seenTime, nil
+}
+
+// setPOV moves the camera of the state to POVEntity or POVPlayer, if set.
+func (p *Player) setPOV(s *State) {
+	ent := p.POVEntity
+	if p.POVPlayer != "" {
+		slot := s.FindPlayer(p.POVPlayer)
+		if slot < 0 {
+			return
+		}
+		ent = PlayerEntity(slot)
+	}
+	if ent <= 0 || ent >= len(s.Entities) {
+		return
+	}
+	s.CameraEnt = ent
+	s.ViewAngle = entityViewAngle(s.Entities[ent].Angle)
+
+	// The view of the client data is that of the player who recorded the demo.
+	s.ViewHeight = DefaultViewHeight
+	s.PunchAngle = Vertex{}
+	s.Velocity = Vertex{}
+	s.Dead = false
+}
+
+// entityViewAngle returns the view angle of a player entity. Player models
+// only pitch a third of the view angle, and the other way.
+func entityViewAngle(a Vertex) Vertex {
+	return Vertex{X: -3 * a.X, Y: a.Y}
+}
+
+// Frames plays the demo, yielding one frame per 1/fps seconds of demo time.
+// A decoding error ends playback, and is yielded as the last value.
+func (p *Player) Frames(fps float64) iter.Seq2[*Frame, error] {
+	return func(yield func(*Frame, error) bool) {
+		if !p.started && p.prev != nil {
+			// Started by NewPlayerAt.
+			p.setPOV(p.prev)
+			p.setPOV(p.state)
+			p.addKey()
+		}
+		p.started = true
+		for {
+			if p.prev != nil && p.prev.Time >= p.To {
+				p.flush(yield, true)
+				return
+			}
+			seenTime, err := p.readBlock()
+			if err == io.EOF {
+				p.flush(yield, true)
+				return
+			}
+			if err != nil {
+				if p.flush(yield, true) {
+					yield(nil, err)
+				}
+				return
+			}
+			if !seenTime {
+				continue
+			}
+			p.state.markVisible()
+			p.addKey()
+			anyFrame := false
+			if p.prev != nil {
+				var next *State
+				for _, t := range GenTimeFrames(p.prev.Time, p.state.Time, fps) {
+					// TODO: Only generate frames if client state is 2.
+					if t >= p.From && t < p.To {
+						if next == nil {
+							next = p.state
+							if p.Smoothing != SmoothLinear {
+								// Frames are held back until the next key, so
+								// they need their own copy.
+								next = p.state.Copy()
+							}
+						}
+						cur := Interpolate(p.prev, next, t)
+						p.queue = append(p.queue, &Frame{
+							Num:    p.frameNum,
+							Time:   t,
+							State:  cur,
+							Prev:   p.prev,
+							Next:   next,
+							Camera: p.demoCamera(cur),
+						})
+					}
+					anyFrame = true
+					p.frameNum++
+				}
+			}
+			if !p.flush(yield, false) {
+				return
+			}
+
+			// Only wipe old state if we generate any frame at all.
+			if p.prev == nil || anyFrame {
+				p.prev = p.state.Copy()
+				p.state.nextFrame()
+			}
+			p.trimKeys()
+		}
+	}
+}
+
+// nextFrame starts tracking entity changes for the next frame.
+func (s *State) nextFrame() {
+	s.SeenEntity = make(map[uint16]bool)
+	for n := range s.Entities {
+		s.Entities[n].NoLerp = false
+	}
+}
+
+// addKey adds the current camera as a key for spline smoothing.
+func (p *Player) addKey() {
+	k := cameraKey{
+		time:     p.state.Time,
+		camera:   p.demoCamera(p.state),
+		teleport: p.camTeleport,
+	}
+	if n := len(p.keys); n > 0 {
+		last := p.keys[n-1]
+		switch {
+		case k.time < last.time:
+			// Time went backwards.
+			p.keys = nil
+			k.teleport = true
+		case k.time == last.time:
+			k.teleport = k.teleport || last.teleport
+			p.keys = p.keys[:n-1]
+		case teleported(last.camera.Pos, k.camera.Pos) || p.state.CameraEnt != p.keyCamEnt:
+			k.teleport = true
+		}
+	}
+	p.keyCamEnt = p.state.CameraEnt
+	p.camTeleport = false
+	p.keys = append(p.keys, k)
+}
+
+// keyAt returns the index of the last key at or before time t.
+func (p *Player) keyAt(t float64) int {
+	i := 0
+	for n, k := range p.keys {
+		if k.time > t {
+			break
+		}
+		i = n
+	}
+	return i
+}
+
+// trimKeys removes keys no longer needed for frames to come.
+func (p *Player) trimKeys() {
+	if p.prev == nil {
+		return
+	}
+	t := p.prev.Time
+	if len(p.queue) > 0 {
+		t = math.Min(t, p.queue[0].Time)
+	}
+	if p.lastCam != nil {
+		t = math.Min(t, p.lastTime)
+	}
+	if i := p.keyAt(t) - 1; i > 0 {
+		p.keys = append([]cameraKey(nil), p.keys[i:]...)
+	}
+}
+
+// teleportBetween returns true if the camera teleported after time a, up to
+// time b. The camera jumps to the new position right after the key before
+// the teleport.
+func (p *Player) teleportBetween(a, b float64) bool {
+	for n, k := range p.keys {
+		if !k.teleport {
+			continue
+		}
+		if n == 0 {
+			if k.time > a && k.time <= b {
+				return true
+			}
+		} else if j := p.keys[n-1].time; j >= a && j < b {
+			return true
+		}
+	}
+	return false
+}
+
+// flush yields the queued frames whose camera can be calculated. With
+// spline smoothing that needs the key after the frame's keys, unless
+// final is set. Returns false if the consumer stopped the iteration.
+func (p *Player) flush(yield func(*Frame, error) bool, final bool) bool {
+	for len(p.queue) > 0 {
+		f := p.queue[0]
+		if p.Smoothing != SmoothLinear {
+			i := p.keyAt(f.Time)
+			if i+2 >= len(p.keys) && !final {
+				return true
+			}
+			f.Camera = splineCamera(p.keys, i, f.Time)
+		}
+		if p.Smoothing == SmoothLowPass && p.lastCam != nil && f.Time > p.lastTime && !p.teleportBetween(p.lastTime, f.Time) {
+			f.Camera = lowPass(*p.lastCam, f.Camera, f.Time-p.lastTime)
+		}
+		cam := f.Camera
+		p.lastCam = &cam
+		p.lastTime = f.Time
+		if p.Director != nil {
+			f.Camera = p.Director.Camera(f)
+		}
+		p.queue = p.queue[1:]
+		if !yield(f, nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// State returns the current, not interpolated, state of the player.
+func (p *Player) State() *State {
+	return p.state
+}
+
+func interpolate(v0, v1 Vertex, t float64) Vertex {
+	return Vertex{
+		X: float32(float64(v0.X) + t*float64(v1.X-v0.X)),
+		Y: float32(float64(v0.Y) + t*float64(v1.Y-v0.Y)),
+		Z: float32(float64(v0.Z) + t*float64(v1.Z-v0.Z)),
+	}
+}
+
+func posAngle(x float32) float32 {
+	if x < 0 {
+		return x + 360
+	}
+	return x
+}
+
+func interA(a, b, t float64) float64 {
+	switch {
+	case math.Abs(float64(b-a)) < 180:
+		return a + t*(b-a)
+	case a > b:
+		b += 360
+		return a + t*(b-a)
+	default:
+		a += 360
+		return a + t*(b-a)
+	}
+}
+
+func interpolateAngle(v0, v1 Vertex, t float64) Vertex {
+	a := Vertex{
+		X: posAngle(v0.X),
+		Y: posAngle(v0.Y),
+		Z: posAngle(v0.Z),
+	}
+	b := Vertex{
+		X: posAngle(v1.X),
+		Y: posAngle(v1.Y),
+		Z: posAngle(v1.Z),
+	}
+
+	var ret Vertex
+	ret.X = float32(interA(float64(a.X), float64(b.X), t))
+	ret.Y = float32(interA(float64(a.Y), float64(b.Y), t))
+	ret.Z = float32(interA(float64(a.Z), float64(b.Z), t))
+	for ret.X > 180 {
+		ret.X -= 360
+	}
+	for ret.Y > 180 {
+		ret.Y -= 360
+	}
+	for ret.Z > 180 {
+		ret.Z -= 360
+	}
+	return ret
+}
+
+// Interpolate returns the state at time t, between the states s0 and s1.
+// Entities that moved too far are shown at their new position. NoLerp only
+// snaps the camera, since servers also set it on every update of walking
+// monsters.
+func Interpolate(s0, s1 *State, t float64) *State {
+	ival := (t - s0.Time) / (s1.Time - s0.Time)
+	cur := s1.Copy()
+	cur.Time = t
+	cam := s1.CameraEnt
+	if ival == 0 || (cam == s0.CameraEnt && !s1.Entities[cam].NoLerp && !teleported(s0.Entities[cam].Pos, s1.Entities[cam].Pos)) {
+		cur.ViewAngle = interpolateAngle(s0.ViewAngle, s1.ViewAngle, ival)
+	}
+	for n := range s0.Entities {
+		if ival > 0 && ((n == cam && s1.Entities[n].NoLerp) || teleported(s0.Entities[n].Pos, s1.Entities[n].Pos)) {
+			continue
+		}
+		if s0.Entities[n].Model != s1.Entities[n].Model {
+			// If model has changed, choose nearest and stop.
+			if ival < 0.5 {
+				cur.Entities[n] = s0.Entities[n]
+			} else {
+				cur.Entities[n] = s1.Entities[n]
+			}
+			continue
+		}
+		cur.Entities[n].Pos = interpolate(s0.Entities[n].Pos, s1.Entities[n].Pos, ival)
+		cur.Entities[n].Angle = interpolateAngle(s0.Entities[n].Angle, s1.Entities[n].Angle, ival)
+		if ival < 0.5 {
+			cur.Entities[n].Frame = s0.Entities[n].Frame
+			cur.Entities[n].Skin = s0.Entities[n].Skin
+			cur.Entities[n].Color = s0.Entities[n].Color
+		} else {
+			cur.Entities[n].Frame = s1.Entities[n].Frame
+			cur.Entities[n].Skin = s1.Entities[n].Skin
+			cur.Entities[n].Color = s1.Entities[n].Color
+		}
+	}
+	return cur
+}
@@ -0,0 +1,256 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestGenTimeFrames(t *testing.T) {
+	for _, test := range []struct {
+		from, to, fps float64
+		want          []float64
+	}{
+		{0, 1, 4, []float64{0, 0.25, 0.5, 0.75}},
+		{0.1, 1, 4, []float64{0.25, 0.5, 0.75}},
+		{0.25, 0.5, 4, []float64{0.25}},
+		{0.3, 0.4, 4, []float64{}},
+	} {
+		if got := GenTimeFrames(test.from, test.to, test.fps); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("GenTimeFrames(%g, %g, %g): got %v, want %v", test.from, test.to, test.fps, got, test.want)
+		}
+	}
+}
+
+func TestInterpolateAngle(t *testing.T) {
+	for _, test := range []struct {
+		a, b Vertex
+		t    float64
+		want Vertex
+	}{
+		{Vertex{0, 0, 0}, Vertex{0, 90, 0}, 0.5, Vertex{0, 45, 0}},
+		{Vertex{0, 170, 0}, Vertex{0, -170, 0}, 0.5, Vertex{0, 180, 0}},
+		{Vertex{0, -10, 0}, Vertex{0, 10, 0}, 0.25, Vertex{0, -5, 0}},
+	} {
+		if got := interpolateAngle(test.a, test.b, test.t); got != test.want {
+			t.Errorf("interpolateAngle(%v, %v, %g): got %v, want %v", test.a, test.b, test.t, got, test.want)
+		}
+	}
+}
+
+func TestInterpolateTeleport(t *testing.T) {
+	s0, s1 := NewState(), NewState()
+	s0.Time, s1.Time = 1, 2
+	s1.ViewAngle.Y = 90
+	s1.Entities[0].Pos.X = 10
+	s1.Entities[1].Pos.X = 1000
+	s1.Entities[2].Pos.X = 10
+	s1.Entities[2].NoLerp = true
+	cur := Interpolate(s0, s1, 1.25)
+	if got, want := cur.ViewAngle.Y, float32(22.5); got != want {
+		t.Errorf("Fast turn: got %g, want %g", got, want)
+	}
+	for n, want := range []float32{2.5, 1000, 2.5} {
+		if got := cur.Entities[n].Pos.X; got != want {
+			t.Errorf("Entity %d: got %g, want %g", n, got, want)
+		}
+	}
+
+	// The camera teleporting also snaps the view angle.
+	s1.Entities[0].NoLerp = true
+	cur = Interpolate(s0, s1, 1.25)
+	if got, want := cur.ViewAngle.Y, float32(90); got != want {
+		t.Errorf("Turn while teleporting: got %g, want %g", got, want)
+	}
+	if got, want := cur.Entities[0].Pos.X, float32(10); got != want {
+		t.Errorf("Camera teleporting: got %g, want %g", got, want)
+	}
+}
+
+func TestInterpolateStepMonster(t *testing.T) {
+	// Servers set U_NOLERP on every update of a walking monster.
+	x0, x1 := float32(100), float32(108)
+	s0 := NewState()
+	s0.Time = 1
+	MsgUpdate{Entity: 5, X: &x0}.Apply(s0)
+	s1 := s0.Copy()
+	s1.nextFrame()
+	s1.Time = 1.1
+	MsgUpdate{Entity: 5, X: &x1, NoLerp: true}.Apply(s1)
+	if got, want := Interpolate(s0, s1, 1.05).Entities[5].Pos.X, float32(104); math.Abs(float64(got-want)) > 0.001 {
+		t.Errorf("Monster X: got %g, want %g", got, want)
+	}
+}
+
+func TestPlayer(t *testing.T) {
+	d, err := Open(bytes.NewReader(testLongDemo()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPlayer(d)
+	var messages int
+	p.OnMessage = func(Message, *State) { messages++ }
+	var frames []*Frame
+	for f, err := range p.Frames(2) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, f)
+	}
+	if got, want := len(frames), 198; got != want {
+		t.Fatalf("Got %d frames, want %d", got, want)
+	}
+	if messages == 0 {
+		t.Errorf("OnMessage not called")
+	}
+	for n, f := range frames {
+		if f.Num != n {
+			t.Fatalf("Frame %d has number %d", n, f.Num)
+		}
+		if got, want := f.Time, 1+float64(n)/2; got != want {
+			t.Fatalf("Frame %d time: got %g, want %g", n, got, want)
+		}
+		if got, want := f.State.Entities[1].Pos.X, float32(f.Time); got != want {
+			t.Fatalf("Frame %d X: got %g, want %g", n, got, want)
+		}
+	}
+
+	// Starting later numbers frames the same.
+	ix, err := NewIndex(bytes.NewReader(testLongDemo()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = NewPlayerAt(ix, 50.25, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.To = 60
+	var got []*Frame
+	for f, err := range p.Frames(2) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, f)
+	}
+	if len(got) != 19 {
+		t.Fatalf("Got %d frames from 50.25 to 60, want 19", len(got))
+	}
+	for n, f := range got {
+		want := frames[n+99]
+		if f.Num != want.Num || f.Time != want.Time || f.Camera != want.Camera || f.State.Entities[1] != want.State.Entities[1] {
+			t.Errorf("Frame %d after seek: got %d %g %+v, want %d %g %+v", n, f.Num, f.Time, f.State.Entities[1], want.Num, want.Time, want.State.Entities[1])
+		}
+	}
+}
+
+// testPOVDemo is a demo recorded by entity 1, with player 2 moving along
+// the Y axis, looking up to the left.
+func testPOVDemo() []byte {
+	blocks := [][][]byte{{
+		testServerInfo,
+		testMsg(uint8(0x05), uint16(1)),
+		testMsg(uint8(0x0d), uint8(0), "recorder"),
+		testMsg(uint8(0x0d), uint8(1), "other"),
+		testMsg(uint8(0x11), uint8(1), uint8(0x4d)),
+		testMsg(uint8(0x0e), uint8(1), int16(-2)),
+		testMsg(uint8(0x16), uint16(2), uint8(1), uint8(0), uint8(0), uint8(0), int16(0), int8(8), int16(0), int8(64), int16(0), int8(0)),
+	}}
+	for n := 1; n <= 4; n++ {
+		blocks = append(blocks, [][]byte{
+			testMsg(uint8(0x07), float32(n)),
+			testMsg(uint8(0x80|U_ORIGIN1), uint8(1), int16(n*8)),
+			testMsg(uint8(0x80|U_ORIGIN2), uint8(2), int16(n*16)),
+		})
+	}
+	return testDemo(blocks...)
+}
+
+func TestPOV(t *testing.T) {
+	for _, test := range []struct {
+		entity int
+		player string
+		want   int
+	}{
+		{0, "", 1},
+		{2, "", 2},
+		{0, "other", 2},
+		{0, "nobody", 1},
+	} {
+		d, err := Open(bytes.NewReader(testPOVDemo()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := NewPlayer(d)
+		p.POVEntity = test.entity
+		p.POVPlayer = test.player
+		var frames []*Frame
+		for f, err := range p.Frames(1) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames = append(frames, f)
+		}
+		if len(frames) != 3 {
+			t.Fatalf("POV %d %q: got %d frames, want 3", test.entity, test.player, len(frames))
+		}
+		for _, f := range frames {
+			if got := f.State.CameraEnt; got != test.want {
+				t.Errorf("POV %d %q: camera entity %d, want %d", test.entity, test.player, got, test.want)
+			}
+			pos := f.State.Entities[test.want].Pos
+			pos.Z += DefaultViewHeight
+			if f.Camera.Pos != pos {
+				t.Errorf("POV %d %q: camera at %v, want %v", test.entity, test.player, f.Camera.Pos, pos)
+			}
+			want := Vertex{X: 1, Y: 2, Z: 3}
+			if test.want == 2 {
+				want = Vertex{X: -33.75, Y: 90}
+			}
+			if !closeVertex(f.Camera.Angle, want, 0.001) {
+				t.Errorf("POV %d %q: camera angle %v, want %v", test.entity, test.player, f.Camera.Angle, want)
+			}
+		}
+	}
+}
+
+func TestPlayerInfo(t *testing.T) {
+	s := NewState()
+	for _, m := range []Message{
+		&MsgPlayerName{Index: 2, Name: "foo"},
+		&MsgSetColors{Player: 2, Color: 0x4d},
+		&MsgFrags{Player: 0, Frags: 0xffff},
+		&MsgFrags{Player: 2, Frags: 12},
+	} {
+		m.Apply(s)
+	}
+	want := []PlayerInfo{{Frags: -1}, {}, {Name: "foo", Colors: 0x4d, Frags: 12}}
+	if !reflect.DeepEqual(s.Players, want) {
+		t.Errorf("Players: got %+v, want %+v", s.Players, want)
+	}
+	if got := s.FindPlayer("foo"); got != 2 {
+		t.Errorf("FindPlayer: got %d, want 2", got)
+	}
+	if got := s.FindPlayer("bar"); got != -1 {
+		t.Errorf("FindPlayer of missing player: got %d, want -1", got)
+	}
+}
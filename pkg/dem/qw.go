@@ -0,0 +1,1198 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+// This file contains the QuakeWorld demo reader, for both client side
+// .qwd demos and server side multi-view .mvd demos.
+//
+// QuakeWorld messages are turned into the same messages as NetQuake ones,
+// so that the same State can be built from both. Packet entities and
+// player info are delta compressed, so they're resolved here and turned
+// into full MsgUpdates.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+const (
+	qwProtocol = 28
+
+	// Protocol extension magic numbers, that may come before the protocol version.
+	qwExtensionFTE  = 0x58455446 // "FTEX"
+	qwExtensionFTE2 = 0x32455446 // "FTE2"
+	qwExtensionMVD1 = 0x3144564d // "MVD1"
+
+	// FTE extension bits that change the layout of messages decoded here.
+	// Others only add messages, or change things such as the level format.
+	PEXT_SCALE            = 0x00000002
+	PEXT_TRANS            = 0x00000008
+	PEXT_ACCURATETIMINGS  = 0x00000040
+	PEXT_SOUNDDBL         = 0x00000080
+	PEXT_FATNESS          = 0x00000100
+	PEXT_MODELDBL         = 0x00001000
+	PEXT_ENTITYDBL        = 0x00002000
+	PEXT_ENTITYDBL2       = 0x00004000
+	PEXT_FLOATCOORDS      = 0x00008000
+	PEXT_COLOURMOD        = 0x00080000
+	PEXT_SPLITSCREEN      = 0x00100000
+	PEXT_HEXEN2           = 0x00200000
+	PEXT_SETATTACHMENT    = 0x08000000
+	PEXT_CHUNKEDDOWNLOADS = 0x20000000
+	PEXT_DPFLAGS          = 0x80000000
+
+	PEXT2_REPLACEMENTDELTAS = 0x00000008
+	PEXT2_MAXPLAYERS        = 0x00000010
+	PEXT2_PREDINFO          = 0x00000020
+
+	MVD_PEXT1_FLOATCOORDS = 0x00000001
+
+	qwMaxClients  = 32
+	qwMaxEntities = 512
+	qwUpdateMask  = 63 // Packet entities history size, minus one.
+
+	// Demo frame types.
+	qwDemCmd      = 0
+	qwDemRead     = 1
+	qwDemSet      = 2
+	qwDemMultiple = 3
+	qwDemSingle   = 4
+	qwDemStats    = 5
+	qwDemAll      = 6
+
+	// Size of usercmd_t in a dem_cmd frame. It's followed by the view angles.
+	qwUsercmdSize = 24
+
+	// Packet entity bits.
+	QW_U_ANGLE1   = 1 << 0
+	QW_U_ANGLE3   = 1 << 1
+	QW_U_MODEL    = 1 << 2
+	QW_U_COLORMAP = 1 << 3
+	QW_U_SKIN     = 1 << 4
+	QW_U_EFFECTS  = 1 << 5
+	QW_U_SOLID    = 1 << 6
+	QW_U_ORIGIN1  = 1 << 9
+	QW_U_ORIGIN2  = 1 << 10
+	QW_U_ORIGIN3  = 1 << 11
+	QW_U_ANGLE2   = 1 << 12
+	QW_U_FRAME    = 1 << 13
+	QW_U_REMOVE   = 1 << 14
+	QW_U_MOREBITS = 1 << 15
+
+	// Sound bits, in the entity/channel short.
+	QW_SND_VOLUME      = 1 << 15
+	QW_SND_ATTENUATION = 1 << 14
+
+	// Player info bits.
+	PF_MSEC        = 1 << 0
+	PF_COMMAND     = 1 << 1
+	PF_VELOCITY1   = 1 << 2
+	PF_VELOCITY2   = 1 << 3
+	PF_VELOCITY3   = 1 << 4
+	PF_MODEL       = 1 << 5
+	PF_SKINNUM     = 1 << 6
+	PF_EFFECTS     = 1 << 7
+	PF_WEAPONFRAME = 1 << 8
+	PF_DEAD        = 1 << 9
+	PF_GIB         = 1 << 10
+	PF_NOGRAV      = 1 << 11
+
+	// MVD player info bits.
+	DF_ORIGIN      = 1 << 0 // And 1<<1, 1<<2 for the other axes.
+	DF_ANGLES      = 1 << 3 // And 1<<4, 1<<5 for the other axes.
+	DF_EFFECTS     = 1 << 6
+	DF_SKINNUM     = 1 << 7
+	DF_DEAD        = 1 << 8
+	DF_GIB         = 1 << 9
+	DF_WEAPONFRAME = 1 << 10
+	DF_MODEL       = 1 << 11
+
+	// Delta usercmd bits.
+	CM_ANGLE1  = 1 << 0
+	CM_ANGLE3  = 1 << 1
+	CM_FORWARD = 1 << 2
+	CM_SIDE    = 1 << 3
+	CM_UP      = 1 << 4
+	CM_BUTTONS = 1 << 5
+	CM_IMPULSE = 1 << 6
+	CM_ANGLE2  = 1 << 7
+
+	// Temp entities that differ from NetQuake.
+	QW_TE_BLOOD          = 12
+	QW_TE_LIGHTNINGBLOOD = 13
+)
+
+// qwEntity is the state of an entity in a QuakeWorld packet.
+type qwEntity struct {
+	num     uint16
+	pos     Vertex
+	angle   Vertex
+	model   uint8
+	frame   uint8
+	color   uint8
+	skin    uint8
+	effects uint8
+}
+
+// update returns a message setting all fields of the entity.
+func (e qwEntity) update() *MsgUpdate {
+	return &MsgUpdate{
+		Entity:  e.num,
+		X:       &e.pos.X,
+		Y:       &e.pos.Y,
+		Z:       &e.pos.Z,
+		A:       &e.angle.X,
+		B:       &e.angle.Y,
+		C:       &e.angle.Z,
+		Model:   &e.model,
+		Frame:   &e.frame,
+		Color:   &e.color,
+		Skin:    &e.skin,
+		Effects: &e.effects,
+	}
+}
+
+// qwPlayer is the last known state of a QuakeWorld player.
+type qwPlayer struct {
+	pos         Vertex
+	viewAngle   Vertex
+	model       uint8
+	frame       uint8
+	skin        uint8
+	effects     uint8
+	weaponFrame uint8
+}
+
+// qwDemo is the QuakeWorld decoding state that lives across blocks.
+type qwDemo struct {
+	mvd       bool
+	time      float64
+	sequence  uint32 // Incoming sequence of the last packet.
+	viewAngle Vertex // From the last dem_cmd.
+	playerNum int    // Player slot of the recording client.
+	track     int    // Player slot to view MVD demos from.
+
+	info        ServerInfo
+	playerModel uint8
+	headModel   uint8
+	baselines   [qwMaxEntities]qwEntity
+	frames      [qwUpdateMask + 1][]qwEntity // Packet entities history.
+	last        []qwEntity                   // Last packet entities.
+	players     [qwMaxClients]qwPlayer
+}
+
+// qwExtensionLayout are the bits of each protocol extension that change
+// the layout of messages decoded here.
+var qwExtensionLayout = map[uint32]uint32{
+	qwExtensionFTE: PEXT_SCALE | PEXT_TRANS | PEXT_ACCURATETIMINGS | PEXT_SOUNDDBL | PEXT_FATNESS |
+		PEXT_MODELDBL | PEXT_ENTITYDBL | PEXT_ENTITYDBL2 | PEXT_FLOATCOORDS | PEXT_COLOURMOD |
+		PEXT_SPLITSCREEN | PEXT_HEXEN2 | PEXT_SETATTACHMENT | PEXT_CHUNKEDDOWNLOADS | PEXT_DPFLAGS,
+	qwExtensionFTE2: PEXT2_REPLACEMENTDELTAS | PEXT2_MAXPLAYERS | PEXT2_PREDINFO,
+	qwExtensionMVD1: MVD_PEXT1_FLOATCOORDS,
+}
+
+// camera returns the player slot the demo is viewed from.
+func (q *qwDemo) camera() int {
+	if q.mvd {
+		return q.track
+	}
+	return q.playerNum
+}
+
+// OpenQW starts reading a QuakeWorld client demo (.qwd).
+func OpenQW(r io.Reader) (*Demo, error) {
+	return openQW(r, false), nil
+}
+
+// OpenMVD starts reading a QuakeWorld multi-view demo (.mvd), viewed from
+// the first player slot. Use Track to view it from another player.
+func OpenMVD(r io.Reader) (*Demo, error) {
+	return openQW(r, true), nil
+}
+
+func openQW(r io.Reader, mvd bool) *Demo {
+	d := &Demo{
+		r:        r,
+		Entities: make([]Entity, maxEntities, maxEntities),
+		qw:       &qwDemo{mvd: mvd},
+	}
+	d.proto = protocol{
+		version: qwProtocol,
+		qw:      d.qw,
+	}
+	return d
+}
+
+// Track sets which player slot a multi-view demo is viewed from.
+// It should be called before reading any blocks.
+func (d *Demo) Track(player int) {
+	if d.qw != nil {
+		d.qw.track = player
+	}
+}
+
+// readQWBlock reads demo frames until the next frame with a server message.
+func (d *Demo) readQWBlock() (*Block, error) {
+	q := d.qw
+	fail := func(start int64, err error) (*Block, error) {
+		return nil, &DecodeError{Block: d.BlockCount, Offset: start, Err: truncated(err)}
+	}
+	for {
+		start := d.offset
+		var typ uint8
+		if q.mvd {
+			var h [2]uint8
+			if _, err := io.ReadFull(d.r, h[:]); err != nil {
+				if err == io.EOF {
+					return nil, err
+				}
+				return fail(start, fmt.Errorf("reading frame header: %w", err))
+			}
+			q.time += float64(h[0]) / 1000
+			typ = h[1]
+			d.offset += 2
+		} else {
+			var h struct {
+				Time float32
+				Type uint8
+			}
+			if err := binary.Read(d.r, binary.LittleEndian, &h); err != nil {
+				if err == io.EOF {
+					return nil, err
+				}
+				return fail(start, fmt.Errorf("reading frame header: %w", err))
+			}
+			q.time = float64(h.Time)
+			typ = h.Type
+			d.offset += 5
+		}
+
+		hidden := false
+		switch typ & 7 {
+		case qwDemCmd:
+			if q.mvd {
+				return fail(start, fmt.Errorf("dem_cmd frame in MVD"))
+			}
+			var c struct {
+				Cmd       [qwUsercmdSize]byte
+				ViewAngle Vertex
+			}
+			if err := binary.Read(d.r, binary.LittleEndian, &c); err != nil {
+				return fail(start, fmt.Errorf("reading dem_cmd: %w", err))
+			}
+			d.offset += qwUsercmdSize + 3*4
+			q.viewAngle = c.ViewAngle
+			continue
+		case qwDemSet:
+			var seq [2]uint32
+			if err := binary.Read(d.r, binary.LittleEndian, &seq); err != nil {
+				return fail(start, fmt.Errorf("reading dem_set: %w", err))
+			}
+			d.offset += 8
+			q.sequence = seq[1]
+			continue
+		case qwDemMultiple:
+			mask, err := readUint32(d.r)
+			if err != nil {
+				return fail(start, fmt.Errorf("reading player mask: %w", err))
+			}
+			d.offset += 4
+			// Messages to nobody are hidden data, not server messages.
+			hidden = mask == 0
+		case qwDemRead, qwDemSingle, qwDemStats, qwDemAll:
+		default:
+			return fail(start, fmt.Errorf("unknown frame type %d", typ&7))
+		}
+
+		size, err := readUint32(d.r)
+		if err != nil {
+			return fail(start, fmt.Errorf("reading message size: %w", err))
+		}
+		if size > maxBlockSize {
+			return fail(start, fmt.Errorf("message size %d too large", size))
+		}
+		data := make([]byte, size, size)
+		if _, err := io.ReadFull(d.r, data); err != nil {
+			return fail(start, fmt.Errorf("reading message of size %d: %w", size, err))
+		}
+		d.offset += 4 + int64(size)
+
+		block := &Block{
+			Header: BlockHeader{
+				Blocksize: size,
+				ViewAngle: q.viewAngle,
+			},
+			Num:    d.BlockCount,
+			Offset: start,
+			data:   d.offset - int64(size),
+			proto:  &d.proto,
+			time:   q.time,
+		}
+		if q.mvd {
+			block.Header.ViewAngle = q.players[q.track%qwMaxClients].viewAngle
+		}
+		switch {
+		case hidden:
+			data = nil
+		case q.mvd:
+		case len(data) >= 4 && binary.LittleEndian.Uint32(data) == 0xffffffff:
+			// Connectionless packet.
+			data = nil
+		case len(data) < 8:
+			return fail(start, fmt.Errorf("packet of size %d too short for netchan header", len(data)))
+		default:
+			q.sequence = binary.LittleEndian.Uint32(data) &^ (1 << 31)
+			block.data += 8
+			data = data[8:]
+		}
+		block.sequence = q.sequence
+		block.buf = bytes.NewBuffer(data)
+		block.size = len(data)
+		d.BlockCount++
+		return block, nil
+	}
+}
+
+// readAngle16 reads an angle stored as a 16 bit integer.
+func readAngle16(r io.Reader) (float32, error) {
+	t, err := readInt16(r)
+	return float32(t) * 360.0 / 65536.0, err
+}
+
+// infoValue returns the value of a key in a QuakeWorld info string
+// such as `\name\player\team\red`.
+func infoValue(info, key string) string {
+	parts := strings.Split(strings.TrimPrefix(info, `\`), `\`)
+	for i := 0; i+1 < len(parts); i += 2 {
+		if parts[i] == key {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+func (block *Block) decodeQWMessage() (Message, error) {
+	q := block.protocol().qw
+	typ, err := readUint8(block.buf)
+	if err != nil {
+		return nil, err
+	}
+	if Verbose {
+		log.Printf("QW message type %d (0x%02x)", typ, typ)
+	}
+	switch typ {
+	case 0x01: // NOP
+		return &MsgNop{}, nil
+	case 0x02: // disconnect
+		return &MsgDisconnect{}, nil
+	case 0x03: // updatestat
+		// Stat and value.
+		if err := block.skip(2); err != nil {
+			return nil, err
+		}
+	case 0x06: // sound
+		return block.readQWSound()
+	case 0x08: // print
+		if _, err := readUint8(block.buf); err != nil { // Level.
+			return nil, err
+		}
+		s, err := readString(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		if Verbose {
+			log.Printf("Print: %q", s)
+		}
+		return &MsgPrint{Text: s}, nil
+	case 0x09: // stufftext
+		s, err := readString(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		if Verbose {
+			log.Printf("Stufftext: %q", s)
+		}
+		return &MsgStuffText{Text: s}, nil
+	case 0x0a: // setangle
+		player := q.playerNum
+		if q.mvd {
+			p, err := readUint8(block.buf)
+			if err != nil {
+				return nil, err
+			}
+			player = int(p)
+		}
+		var a Vertex
+		for _, p := range []*float32{&a.X, &a.Y, &a.Z} {
+			if *p, err = readAngle(block.buf); err != nil {
+				return nil, err
+			}
+		}
+		if player != q.camera() {
+			return &MsgNop{}, nil
+		}
+		return &MsgCameraOrientation{X: a.X, Y: a.Y, Z: a.Z}, nil
+	case 0x0b: // serverdata
+		return block.readQWServerData()
+	case 0x0c: // light style
+		styleIndex, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		style, err := readString(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		return &MsgLightStyle{
+			Index: styleIndex,
+			Style: style,
+		}, nil
+	case 0x0e: // updatefrags
+		player, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		frags, err := readUint16(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		return &MsgFrags{
+			Player: player,
+			Frags:  frags,
+		}, nil
+	case 0x10: // stopsound
+		t, err := readUint16(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		return &MsgStopSound{Entity: t >> 3, Channel: uint8(t & 7)}, nil
+	case 0x13: // damage
+		r := &MsgDamage{}
+		if r.Armor, err = readUint8(block.buf); err != nil {
+			return nil, err
+		}
+		if r.Blood, err = readUint8(block.buf); err != nil {
+			return nil, err
+		}
+		if r.Pos, err = block.readVertex(); err != nil {
+			return nil, err
+		}
+		return r, nil
+	case 0x14: // spawnstatic
+		r := &MsgSpawnStatic{}
+		if err := block.readBaseline(&r.MsgSpawnBaseline, 1); err != nil {
+			return nil, err
+		}
+		return r, nil
+	case 0x16: // spawnbaseline
+		r := &MsgSpawnBaseline{}
+		if r.Entity, err = readUint16(block.buf); err != nil {
+			return nil, err
+		}
+		if r.Entity >= qwMaxEntities {
+			return nil, fmt.Errorf("baseline entity %d out of range", r.Entity)
+		}
+		if err := block.readBaseline(r, 1); err != nil {
+			return nil, err
+		}
+		q.baselines[r.Entity] = qwEntity{
+			num:   r.Entity,
+			pos:   Vertex{r.X, r.Y, r.Z},
+			angle: Vertex{r.A, r.B, r.C},
+			model: uint8(r.Model),
+			frame: uint8(r.Frame),
+			color: r.Color,
+			skin:  r.Skin,
+		}
+		return r, nil
+	case 0x17: // temp entity
+		r := &MsgTempEntity{QW: true}
+		if r.Type, err = readUint8(block.buf); err != nil {
+			return nil, err
+		}
+		switch r.Type {
+		case TE_SPIKE, TE_SUPERSPIKE, TE_EXPLOSION, TE_TAREXPLOSION, TE_WIZSPIKE, TE_KNIGHTSPIKE, TE_LAVASPLASH, TE_TELEPORT, QW_TE_LIGHTNINGBLOOD:
+		case TE_GUNSHOT, QW_TE_BLOOD:
+			if r.Count, err = readUint8(block.buf); err != nil {
+				return nil, err
+			}
+		case TE_LIGHTNING1, TE_LIGHTNING2, TE_LIGHTNING3:
+			if r.Entity, err = readUint16(block.buf); err != nil {
+				return nil, err
+			}
+			if r.Pos, err = block.readVertex(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("bad temp ent type %d", r.Type)
+		}
+		// Origin, or end of beams.
+		v, err := block.readVertex()
+		if err != nil {
+			return nil, err
+		}
+		if r.Beam() {
+			r.End = v
+		} else {
+			r.Pos = v
+		}
+		return r, nil
+	case 0x18: // setpause
+		if err := block.skip(1); err != nil {
+			return nil, err
+		}
+	case 0x1a: // centerprint
+		t, err := readString(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		return &MsgCenterPrint{Text: t}, nil
+	case 0x1b: // killed monster
+		return &MsgKilledMonster{}, nil
+	case 0x1c: // found secret
+		return &MsgFoundSecret{}, nil
+	case 0x1d: // spawnstaticsound
+		r := &MsgSpawnStaticSound{Version: 1}
+		if r.Pos, err = block.readVertex(); err != nil {
+			return nil, err
+		}
+		t, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		r.Sound = uint16(t)
+		if r.Volume, err = readUint8(block.buf); err != nil {
+			return nil, err
+		}
+		if r.Attenuation, err = readUint8(block.buf); err != nil {
+			return nil, err
+		}
+		return r, nil
+	case 0x1e: // intermission
+		var pos, a Vertex
+		for _, p := range []*float32{&pos.X, &pos.Y, &pos.Z} {
+			if *p, err = readCoord(block.buf); err != nil {
+				return nil, err
+			}
+		}
+		for _, p := range []*float32{&a.X, &a.Y, &a.Z} {
+			if *p, err = readAngle(block.buf); err != nil {
+				return nil, err
+			}
+		}
+		// The view moves to the intermission camera.
+		block.pending = append(block.pending,
+			&MsgCameraOrientation{X: a.X, Y: a.Y, Z: a.Z},
+			&MsgIntermission{})
+		return &MsgUpdate{
+			Entity: uint16(q.camera() + 1),
+			X:      &pos.X,
+			Y:      &pos.Y,
+			Z:      &pos.Z,
+		}, nil
+	case 0x1f: // finale
+		t, err := readString(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		return &MsgFinale{Text: t}, nil
+	case 0x20: // CD track
+		// Unlike NetQuake, there's no loop track. The track loops.
+		t, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		return &MsgCDTrack{Track: t, Loop: t}, nil
+	case 0x21: // sell screen
+	case 0x22: // smallkick
+	case 0x23: // bigkick
+	case 0x24: // updateping
+		// Player and ping.
+		if err := block.skip(1 + 2); err != nil {
+			return nil, err
+		}
+	case 0x25: // updateentertime
+		// Player and time.
+		if err := block.skip(1 + 4); err != nil {
+			return nil, err
+		}
+	case 0x26: // updatestatlong
+		// Stat and value.
+		if err := block.skip(1 + 4); err != nil {
+			return nil, err
+		}
+	case 0x27: // muzzleflash
+		ent, err := readUint16(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkEntity(ent); err != nil {
+			return nil, err
+		}
+		return &MsgMuzzleFlash{Entity: ent}, nil
+	case 0x28: // updateuserinfo
+		slot, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		if err := block.skip(4); err != nil { // User ID.
+			return nil, err
+		}
+		info, err := readString(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		return &MsgPlayerName{
+			Index: slot,
+			Name:  infoValue(info, "name"),
+		}, nil
+	case 0x29: // download
+		size, err := readInt16(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		if err := block.skip(1); err != nil { // Percent.
+			return nil, err
+		}
+		if size > 0 {
+			if err := block.skip(int(size)); err != nil {
+				return nil, err
+			}
+		}
+	case 0x2a: // playerinfo
+		return block.readQWPlayerInfo()
+	case 0x2b: // nails
+		n, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		if err := block.skip(6 * int(n)); err != nil {
+			return nil, err
+		}
+	case 0x2c: // chokecount
+		if err := block.skip(1); err != nil {
+			return nil, err
+		}
+	case 0x2d, 0x2e: // modellist, soundlist
+		return block.readQWList(typ == 0x2d)
+	case 0x2f, 0x30: // packetentities, deltapacketentities
+		ents, err := block.readQWPacketEntities(typ == 0x30)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range ents {
+			block.pending = append(block.pending, e.update())
+		}
+		t := MsgTime(block.time)
+		return &t, nil
+	case 0x31: // maxspeed
+		if err := block.skip(4); err != nil {
+			return nil, err
+		}
+	case 0x32: // entgravity
+		if err := block.skip(4); err != nil {
+			return nil, err
+		}
+	case 0x33: // setinfo
+		slot, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		key, err := readString(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readString(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		if key == "name" {
+			return &MsgPlayerName{
+				Index: slot,
+				Name:  value,
+			}, nil
+		}
+	case 0x34: // serverinfo
+		for i := 0; i < 2; i++ {
+			if _, err := readString(block.buf); err != nil {
+				return nil, err
+			}
+		}
+	case 0x35: // updatepl
+		// Player and packet loss.
+		if err := block.skip(2); err != nil {
+			return nil, err
+		}
+	case 0x36: // nails2
+		n, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		if err := block.skip(7 * int(n)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w %d (0x%x)", ErrUnknownMessage, typ, typ)
+	}
+	return &MsgNop{}, nil
+}
+
+// readQWServerData reads svc_serverdata, which starts a new level.
+func (block *Block) readQWServerData() (Message, error) {
+	q := block.protocol().qw
+	var version uint32
+	for {
+		var err error
+		if version, err = readUint32(block.buf); err != nil {
+			return nil, err
+		}
+		if version != qwExtensionFTE && version != qwExtensionFTE2 && version != qwExtensionMVD1 {
+			break
+		}
+		ext, err := readUint32(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		// Extensions that only add messages are fine until they're used.
+		if bad := ext & qwExtensionLayout[version]; bad != 0 {
+			return nil, fmt.Errorf("protocol extension 0x%x with flags 0x%x not supported", version, bad)
+		}
+	}
+	if version != qwProtocol {
+		return nil, fmt.Errorf("QuakeWorld protocol %d not supported", version)
+	}
+	if err := block.skip(4); err != nil { // Server count.
+		return nil, err
+	}
+	if _, err := readString(block.buf); err != nil { // Game dir.
+		return nil, err
+	}
+	if q.mvd {
+		if err := block.skip(4); err != nil { // Demo time.
+			return nil, err
+		}
+	}
+	playerNum, err := readUint8(block.buf)
+	if err != nil {
+		return nil, err
+	}
+	level, err := readString(block.buf)
+	if err != nil {
+		return nil, err
+	}
+	// Movement variables.
+	if err := block.skip(10 * 4); err != nil {
+		return nil, err
+	}
+
+	// New level, forget everything.
+	*q = qwDemo{
+		mvd:       q.mvd,
+		time:      q.time,
+		sequence:  q.sequence,
+		viewAngle: q.viewAngle,
+		track:     q.track,
+		playerNum: int(playerNum &^ 128), // High bit is set for spectators.
+		info: ServerInfo{
+			ServerVersion: qwProtocol,
+			MaxClients:    qwMaxClients,
+			Level:         level,
+			Sounds:        []string{""},
+		},
+	}
+	if q.camera() >= qwMaxClients {
+		return nil, fmt.Errorf("player %d out of range", q.camera())
+	}
+	block.pending = append(block.pending, &MsgCameraPos{Entity: uint16(q.camera() + 1)})
+	si := q.info
+	return &si, nil
+}
+
+// readQWList reads a chunk of the model or sound list.
+func (block *Block) readQWList(models bool) (Message, error) {
+	q := block.protocol().qw
+	n, err := readUint8(block.buf)
+	if err != nil {
+		return nil, err
+	}
+	list := q.info.Sounds
+	if models {
+		list = q.info.Models
+	}
+	for i := int(n) + 1; ; i++ {
+		s, err := readString(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		if s == "" {
+			break
+		}
+		for len(list) <= i {
+			list = append(list, "")
+		}
+		list[i] = s
+		if !models {
+			continue
+		}
+		if i == 1 {
+			// Model 0 is the level, just like model 1.
+			list[0] = s
+		}
+		switch s {
+		case "progs/player.mdl":
+			q.playerModel = uint8(i)
+		case "progs/h_player.mdl":
+			q.headModel = uint8(i)
+		}
+	}
+	// Index to continue at. Zero when done.
+	if _, err := readUint8(block.buf); err != nil {
+		return nil, err
+	}
+
+	if models {
+		q.info.Models = list
+	} else {
+		q.info.Sounds = list
+	}
+	si := q.info
+	si.Models = append([]string(nil), q.info.Models...)
+	si.Sounds = append([]string(nil), q.info.Sounds...)
+	return &si, nil
+}
+
+// readQWSound reads svc_sound.
+func (block *Block) readQWSound() (Message, error) {
+	snd := MsgPlaySound{
+		Volume:      DefaultSoundVolume,
+		Attenuation: DefaultSoundAttenuation,
+	}
+	ch, err := readUint16(block.buf)
+	if err != nil {
+		return nil, err
+	}
+	if ch&QW_SND_VOLUME != 0 {
+		t, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		snd.Volume = int(t)
+	}
+	if ch&QW_SND_ATTENUATION != 0 {
+		t, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		snd.Attenuation = int(t)
+	}
+	snd.Channel = int(ch & 7)
+	snd.Entity = (ch >> 3) & 1023
+	t, err := readUint8(block.buf)
+	if err != nil {
+		return nil, err
+	}
+	snd.Sound = int(t)
+	for _, p := range []*float32{&snd.X, &snd.Y, &snd.Z} {
+		if *p, err = readCoord(block.buf); err != nil {
+			return nil, err
+		}
+	}
+	return &snd, nil
+}
+
+// readQWUsercmd reads a delta compressed usercmd, keeping only the angles.
+func (block *Block) readQWUsercmd(angle *Vertex) error {
+	bits, err := readUint8(block.buf)
+	if err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		bit uint8
+		p   *float32
+	}{
+		{CM_ANGLE1, &angle.X},
+		{CM_ANGLE2, &angle.Y},
+		{CM_ANGLE3, &angle.Z},
+	} {
+		if bits&f.bit != 0 {
+			if *f.p, err = readAngle16(block.buf); err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range []struct {
+		bit  uint8
+		size int
+	}{
+		{CM_FORWARD, 2},
+		{CM_SIDE, 2},
+		{CM_UP, 2},
+		{CM_BUTTONS, 1},
+		{CM_IMPULSE, 1},
+	} {
+		if bits&f.bit != 0 {
+			if err := block.skip(f.size); err != nil {
+				return err
+			}
+		}
+	}
+	// msec.
+	return block.skip(1)
+}
+
+// readQWPlayerInfo reads svc_playerinfo, and turns it into an update of
+// the player's entity.
+func (block *Block) readQWPlayerInfo() (Message, error) {
+	q := block.protocol().qw
+	num, err := readUint8(block.buf)
+	if err != nil {
+		return nil, err
+	}
+	if num >= qwMaxClients {
+		return nil, fmt.Errorf("player %d out of range", num)
+	}
+	p := &q.players[num]
+	flags, err := readUint16(block.buf)
+	if err != nil {
+		return nil, err
+	}
+	gib := false
+	if q.mvd {
+		// Everything is a delta from the last update.
+		if p.frame, err = readUint8(block.buf); err != nil {
+			return nil, err
+		}
+		for i, c := range []*float32{&p.pos.X, &p.pos.Y, &p.pos.Z} {
+			if flags&(DF_ORIGIN<<uint(i)) != 0 {
+				if *c, err = readCoord(block.buf); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for i, c := range []*float32{&p.viewAngle.X, &p.viewAngle.Y, &p.viewAngle.Z} {
+			if flags&(DF_ANGLES<<uint(i)) != 0 {
+				if *c, err = readAngle16(block.buf); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for _, f := range []struct {
+			bit uint16
+			p   *uint8
+		}{
+			{DF_MODEL, &p.model},
+			{DF_SKINNUM, &p.skin},
+			{DF_EFFECTS, &p.effects},
+			{DF_WEAPONFRAME, &p.weaponFrame},
+		} {
+			if flags&f.bit != 0 {
+				if *f.p, err = readUint8(block.buf); err != nil {
+					return nil, err
+				}
+			}
+		}
+		gib = flags&DF_GIB != 0
+	} else {
+		for _, c := range []*float32{&p.pos.X, &p.pos.Y, &p.pos.Z} {
+			if *c, err = readCoord(block.buf); err != nil {
+				return nil, err
+			}
+		}
+		if p.frame, err = readUint8(block.buf); err != nil {
+			return nil, err
+		}
+		if flags&PF_MSEC != 0 {
+			if err := block.skip(1); err != nil {
+				return nil, err
+			}
+		}
+		if flags&PF_COMMAND != 0 {
+			if err := block.readQWUsercmd(&p.viewAngle); err != nil {
+				return nil, err
+			}
+		}
+		for i := uint(0); i < 3; i++ {
+			if flags&(PF_VELOCITY1<<i) != 0 {
+				if err := block.skip(2); err != nil {
+					return nil, err
+				}
+			}
+		}
+		p.model, p.skin, p.effects, p.weaponFrame = 0, 0, 0, 0
+		for _, f := range []struct {
+			bit uint16
+			p   *uint8
+		}{
+			{PF_MODEL, &p.model},
+			{PF_SKINNUM, &p.skin},
+			{PF_EFFECTS, &p.effects},
+			{PF_WEAPONFRAME, &p.weaponFrame},
+		} {
+			if flags&f.bit != 0 {
+				if *f.p, err = readUint8(block.buf); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if int(num) == q.playerNum {
+			// The server doesn't send the recording player its own command.
+			p.viewAngle = q.viewAngle
+		}
+		gib = flags&PF_GIB != 0
+	}
+
+	e := qwEntity{
+		num:   uint16(num) + 1,
+		pos:   p.pos,
+		model: p.model,
+		frame: p.frame,
+		skin:  p.skin,
+		// Players look up and down only a third of the view angle.
+		angle:   Vertex{X: -p.viewAngle.X / 3, Y: p.viewAngle.Y},
+		effects: p.effects,
+	}
+	if e.model == 0 {
+		e.model = q.playerModel
+	}
+	if gib {
+		e.model = q.headModel
+	}
+	if q.mvd && int(num) == q.track {
+		block.pending = append(block.pending, &MsgCameraOrientation{
+			X: p.viewAngle.X,
+			Y: p.viewAngle.Y,
+			Z: p.viewAngle.Z,
+		})
+	}
+	return e.update(), nil
+}
+
+// readQWPacketEntities reads svc_packetentities and svc_deltapacketentities,
+// and returns the full list of entities in the packet.
+func (block *Block) readQWPacketEntities(delta bool) ([]qwEntity, error) {
+	q := block.protocol().qw
+	var old []qwEntity
+	if delta {
+		from, err := readUint8(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		if q.mvd {
+			// MVDs are always a delta from the previous packet.
+			old = q.last
+		} else {
+			old = q.frames[from&qwUpdateMask]
+		}
+	}
+	var ents []qwEntity
+	oldIndex := 0
+	for {
+		word, err := readUint16(block.buf)
+		if err != nil {
+			return nil, err
+		}
+		if word == 0 {
+			break
+		}
+		num := word & (qwMaxEntities - 1)
+
+		// Entities not mentioned are unchanged.
+		for oldIndex < len(old) && old[oldIndex].num < num {
+			ents = append(ents, old[oldIndex])
+			oldIndex++
+		}
+		base := q.baselines[num]
+		if oldIndex < len(old) && old[oldIndex].num == num {
+			base = old[oldIndex]
+			oldIndex++
+		}
+		if word&QW_U_REMOVE != 0 {
+			continue
+		}
+		e, err := block.readQWDelta(base, word)
+		if err != nil {
+			return nil, err
+		}
+		ents = append(ents, e)
+	}
+	ents = append(ents, old[oldIndex:]...)
+	q.last = ents
+	q.frames[block.sequence&qwUpdateMask] = ents
+	return ents, nil
+}
+
+// readQWDelta reads the changes to an entity in a packet entities message.
+func (block *Block) readQWDelta(e qwEntity, word uint16) (qwEntity, error) {
+	e.num = word & (qwMaxEntities - 1)
+	bits := word &^ (qwMaxEntities - 1)
+	if bits&QW_U_MOREBITS != 0 {
+		t, err := readUint8(block.buf)
+		if err != nil {
+			return e, err
+		}
+		bits |= uint16(t)
+	}
+	var err error
+	for _, f := range []struct {
+		bit uint16
+		p   *uint8
+	}{
+		{QW_U_MODEL, &e.model},
+		{QW_U_FRAME, &e.frame},
+		{QW_U_COLORMAP, &e.color},
+		{QW_U_SKIN, &e.skin},
+		{QW_U_EFFECTS, &e.effects},
+	} {
+		if bits&f.bit != 0 {
+			if *f.p, err = readUint8(block.buf); err != nil {
+				return e, err
+			}
+		}
+	}
+	for _, f := range []struct {
+		bit   uint16
+		p     *float32
+		angle bool
+	}{
+		{QW_U_ORIGIN1, &e.pos.X, false},
+		{QW_U_ANGLE1, &e.angle.X, true},
+		{QW_U_ORIGIN2, &e.pos.Y, false},
+		{QW_U_ANGLE2, &e.angle.Y, true},
+		{QW_U_ORIGIN3, &e.pos.Z, false},
+		{QW_U_ANGLE3, &e.angle.Z, true},
+	} {
+		if bits&f.bit == 0 {
+			continue
+		}
+		if f.angle {
+			*f.p, err = readAngle(block.buf)
+		} else {
+			*f.p, err = readCoord(block.buf)
+		}
+		if err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
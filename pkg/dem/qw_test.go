@@ -0,0 +1,383 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// testQWRead builds a .qwd frame with a server packet.
+func testQWRead(t float32, seq uint32, msgs ...[]byte) []byte {
+	data := bytes.Join(msgs, nil)
+	return testMsg(t, uint8(qwDemRead), uint32(len(data)+8), seq, uint32(0), data)
+}
+
+// testQWCmd builds a .qwd frame with a user command.
+func testQWCmd(t float32, angle Vertex) []byte {
+	return testMsg(t, uint8(qwDemCmd), [qwUsercmdSize]byte{}, angle)
+}
+
+// testMVDFrame builds an .mvd frame.
+func testMVDFrame(msec, typ uint8, extra []byte, msgs ...[]byte) []byte {
+	data := bytes.Join(msgs, nil)
+	return testMsg(msec, typ, extra, uint32(len(data)), data)
+}
+
+func testQWServerData(mvd bool) []byte {
+	var demoTime []byte
+	if mvd {
+		demoTime = testMsg(float32(0))
+	}
+	return testMsg(uint8(0x0b), uint32(qwProtocol), uint32(1), "qw", demoTime, uint8(0), "The Abandoned Base", [10]float32{})
+}
+
+var testQWModelList = testMsg(uint8(0x2d), uint8(0), "maps/dm3.bsp", "progs/player.mdl", "progs/rocket.mdl", "", uint8(0))
+
+// testQWStates decodes a QuakeWorld demo, and returns the state after each block,
+// with SeenEntity only being what was seen in that block.
+func testQWStates(t *testing.T, d *Demo) []*State {
+	var states []*State
+	s := NewState()
+	for {
+		block, err := d.ReadBlock()
+		if err == io.EOF {
+			return states
+		}
+		if err != nil {
+			t.Fatalf("ReadBlock: %v", err)
+		}
+		msgs, err := block.Messages()
+		if err != nil {
+			t.Fatalf("Messages: %v", err)
+		}
+		s.SeenEntity = make(map[uint16]bool)
+		s.ViewAngle = block.Header.ViewAngle
+		for _, m := range msgs {
+			m.Apply(s)
+		}
+		states = append(states, s.Copy())
+	}
+}
+
+func TestDecodeQWD(t *testing.T) {
+	data := bytes.Join([][]byte{
+		testQWRead(1, 1,
+			testQWServerData(false),
+			testQWModelList,
+			testMsg(uint8(0x2e), uint8(0), "weapons/r_exp3.wav", "", uint8(0)),
+			testMsg(uint8(0x16), uint16(40), uint8(3), uint8(0), uint8(0), uint8(0), int16(8), int8(0), int16(16), int8(64), int16(24), int8(0)),
+		),
+		testQWCmd(1.5, Vertex{10, 20, 0}),
+		testQWRead(2, 2,
+			// Player 1, looking 45 degrees down to the right.
+			testMsg(uint8(0x2a), uint8(1), uint16(PF_COMMAND), int16(8), int16(16), int16(24), uint8(4),
+				uint8(CM_ANGLE1|CM_ANGLE2), int16(8192), int16(16384), uint8(13)),
+			testMsg(uint8(0x2f),
+				uint16(40|QW_U_ORIGIN1), int16(800),
+				uint16(41|QW_U_MOREBITS), uint8(QW_U_MODEL), uint8(3),
+				uint16(0)),
+		),
+		testQWRead(3, 3,
+			testMsg(uint8(0x30), uint8(2), uint16(41|QW_U_REMOVE), uint16(0)),
+		),
+		// Connectionless packet.
+		testMsg(float32(4), uint8(qwDemRead), uint32(6), uint32(0xffffffff), "c"),
+	}, nil)
+	d, err := OpenQW(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("OpenQW: %v", err)
+	}
+	states := testQWStates(t, d)
+	if got, want := len(states), 4; got != want {
+		t.Fatalf("Got %d blocks, want %d", got, want)
+	}
+
+	s := states[0]
+	if got, want := s.ServerInfo.Models, []string{"maps/dm3.bsp", "maps/dm3.bsp", "progs/player.mdl", "progs/rocket.mdl"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Models: got %q, want %q", got, want)
+	}
+	if got, want := s.ServerInfo.Sounds, []string{"", "weapons/r_exp3.wav"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Sounds: got %q, want %q", got, want)
+	}
+	if got, want := s.CameraEnt, 1; got != want {
+		t.Errorf("CameraEnt: got %d, want %d", got, want)
+	}
+
+	s = states[1]
+	if got, want := s.Time, 2.0; got != want {
+		t.Errorf("Time: got %v, want %v", got, want)
+	}
+	if got, want := s.ViewAngle, (Vertex{10, 20, 0}); got != want {
+		t.Errorf("ViewAngle: got %v, want %v", got, want)
+	}
+	if got, want := s.SeenEntity, map[uint16]bool{2: true, 40: true, 41: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Seen: got %v, want %v", got, want)
+	}
+	for n, want := range map[int]Entity{
+		2:  {Pos: Vertex{1, 2, 3}, Angle: Vertex{-15, 90, 0}, Model: 2, Frame: 4},
+		40: {Pos: Vertex{100, 2, 3}, Angle: Vertex{0, 90, 0}, Model: 3},
+		41: {Model: 3},
+	} {
+		if got := s.Entities[n]; got != want {
+			t.Errorf("Entity %d: got %+v, want %+v", n, got, want)
+		}
+	}
+
+	s = states[2]
+	if got, want := s.SeenEntity, map[uint16]bool{40: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Seen after delta: got %v, want %v", got, want)
+	}
+	if got, want := s.Entities[40].Pos, (Vertex{100, 2, 3}); got != want {
+		t.Errorf("Entity 40 after delta: got %v, want %v", got, want)
+	}
+}
+
+func TestDecodeMVD(t *testing.T) {
+	data := bytes.Join([][]byte{
+		testMVDFrame(0, qwDemRead, nil, testQWServerData(true), testQWModelList),
+		// Hidden data, which is not server messages.
+		testMVDFrame(0, qwDemMultiple, testMsg(uint32(0)), testMsg(uint8(0xff), uint8(0xff))),
+		testMVDFrame(50, qwDemAll, nil,
+			testMsg(uint8(0x2a), uint8(0), uint16(DF_ORIGIN|DF_ORIGIN<<1|DF_ORIGIN<<2|DF_ANGLES<<1), uint8(5),
+				int16(8), int16(16), int16(24), int16(16384)),
+			testMsg(uint8(0x2a), uint8(1), uint16(DF_ORIGIN|DF_MODEL), uint8(0), int16(80), uint8(3)),
+			testMsg(uint8(0x2f), uint16(0)),
+		),
+		testMVDFrame(50, qwDemAll, nil,
+			testMsg(uint8(0x2a), uint8(1), uint16(0), uint8(1)),
+			testMsg(uint8(0x30), uint8(0), uint16(0)),
+		),
+	}, nil)
+	for _, test := range []struct {
+		track     int
+		viewAngle Vertex
+	}{
+		{0, Vertex{0, 90, 0}},
+		{1, Vertex{}},
+	} {
+		d, err := OpenMVD(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("OpenMVD: %v", err)
+		}
+		d.Track(test.track)
+		states := testQWStates(t, d)
+		if got, want := len(states), 4; got != want {
+			t.Fatalf("Got %d blocks, want %d", got, want)
+		}
+		s := states[3]
+		if got, want := s.CameraEnt, test.track+1; got != want {
+			t.Errorf("Track %d: CameraEnt: got %d, want %d", test.track, got, want)
+		}
+		if got, want := s.ViewAngle, test.viewAngle; got != want {
+			t.Errorf("Track %d: ViewAngle: got %v, want %v", test.track, got, want)
+		}
+		if got, want := s.Time, float64(float32(0.1)); got != want {
+			t.Errorf("Track %d: Time: got %v, want %v", test.track, got, want)
+		}
+		if got, want := s.Entities[2], (Entity{Pos: Vertex{X: 10}, Model: 3, Frame: 1}); got != want {
+			t.Errorf("Track %d: Player entity: got %+v, want %+v", test.track, got, want)
+		}
+		if got, want := s.Entities[1], (Entity{Pos: Vertex{1, 2, 3}, Angle: Vertex{0, 90, 0}, Model: 2, Frame: 5}); got != want {
+			t.Errorf("Track %d: Player entity: got %+v, want %+v", test.track, got, want)
+		}
+	}
+}
+
+func TestDecodeQWCDTrack(t *testing.T) {
+	d, err := OpenQW(bytes.NewReader(bytes.Join([][]byte{
+		testQWRead(1, 1, testQWServerData(false), testMsg(uint8(0x20), uint8(4))),
+		testQWRead(2, 2, testMsg(uint8(0x2f), uint16(0)), testMsg(uint8(0x20), uint8(3))),
+	}, nil)))
+	if err != nil {
+		t.Fatalf("OpenQW: %v", err)
+	}
+	states := testQWStates(t, d)
+	want := []CDTrackEvent{
+		{Time: 0, Track: MsgCDTrack{Track: 4, Loop: 4}},
+		{Time: 2, Track: MsgCDTrack{Track: 3, Loop: 3}},
+	}
+	if got := states[len(states)-1].CDTracks; !reflect.DeepEqual(got, want) {
+		t.Errorf("CD tracks:\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestDecodeQWSounds(t *testing.T) {
+	d, err := OpenQW(bytes.NewReader(testQWRead(1, 1,
+		testQWServerData(false),
+		testMsg(uint8(0x10), uint16(40<<3|2)),
+		testMsg(uint8(0x1d), int16(8), int16(16), int16(24), uint8(3), uint8(200), uint8(64)),
+	)))
+	if err != nil {
+		t.Fatalf("OpenQW: %v", err)
+	}
+	block, err := d.ReadBlock()
+	if err != nil {
+		t.Fatalf("ReadBlock: %v", err)
+	}
+	msgs, err := block.Messages()
+	if err != nil {
+		t.Fatalf("Messages: %v", err)
+	}
+	var got []Message
+	for _, m := range msgs {
+		switch m.(type) {
+		case *MsgStopSound, *MsgSpawnStaticSound:
+			got = append(got, m)
+		}
+	}
+	want := []Message{
+		&MsgStopSound{Entity: 40, Channel: 2},
+		&MsgSpawnStaticSound{Pos: Vertex{1, 2, 3}, Sound: 3, Volume: 200, Attenuation: 64, Version: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeQWDamage(t *testing.T) {
+	d, err := OpenQW(bytes.NewReader(testQWRead(1, 1,
+		testQWServerData(false),
+		testMsg(uint8(0x2f), uint16(0)),
+		testMsg(uint8(0x13), uint8(3), uint8(10), int16(8), int16(16), int16(24)),
+	)))
+	if err != nil {
+		t.Fatalf("OpenQW: %v", err)
+	}
+	s := testQWStates(t, d)[0]
+	want := ViewFlash{ColorShift: ColorShift{R: 220, G: 50, B: 50, Percent: 30}, Time: 1}
+	if got := s.DamageFlash; got != want {
+		t.Errorf("Damage flash: got %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeQWMuzzleFlash(t *testing.T) {
+	d, err := OpenQW(bytes.NewReader(testQWRead(1, 1,
+		testQWServerData(false),
+		testMsg(uint8(0x2f), uint16(0)),
+		testMsg(uint8(0x27), uint16(2)),
+	)))
+	if err != nil {
+		t.Fatalf("OpenQW: %v", err)
+	}
+	s := testQWStates(t, d)[0]
+	if got, want := len(s.Lights), 1; got != want {
+		t.Fatalf("Lights: got %d, want %d", got, want)
+	}
+	if got, want := s.Lights[0].Entity, uint16(2); got != want {
+		t.Errorf("Light entity: got %d, want %d", got, want)
+	}
+	if got, want := s.Lights[0].Radius, float32(muzzleFlashRadius); got != want {
+		t.Errorf("Light radius: got %g, want %g", got, want)
+	}
+}
+
+func TestDecodeQWExtensions(t *testing.T) {
+	// Extensions that don't change the layout of decoded messages: FTE
+	// setview and Half-Life levels, and MVD hidden messages.
+	data := testQWRead(1, 1,
+		append(testMsg(uint8(0x0b), uint32(qwExtensionFTE), uint32(0x201), uint32(qwExtensionMVD1), uint32(0x20)),
+			testQWServerData(false)[1:]...),
+		testMsg(uint8(0x2f), uint16(0)),
+	)
+	d, err := OpenQW(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("OpenQW: %v", err)
+	}
+	s := testQWStates(t, d)[0]
+	if got, want := s.ServerInfo.Level, "The Abandoned Base"; got != want {
+		t.Errorf("Level: got %q, want %q", got, want)
+	}
+}
+
+func TestDecodeQWErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		data []byte
+		err  error
+	}{
+		"unknown message": {
+			data: testQWRead(1, 1, testMsg(uint8(0x04))),
+			err:  ErrUnknownMessage,
+		},
+		"truncated netchan header": {
+			data: testMsg(float32(1), uint8(qwDemRead), uint32(4), uint32(1)),
+		},
+		"truncated frame": {
+			data: testQWRead(1, 1, testMsg(uint8(0x01)))[:10],
+			err:  ErrTruncated,
+		},
+		"extensions": {
+			data: testQWRead(1, 1, testMsg(uint8(0x0b), uint32(qwExtensionFTE), uint32(PEXT_FLOATCOORDS))),
+		},
+	} {
+		d, err := OpenQW(bytes.NewReader(test.data))
+		for err == nil {
+			var block *Block
+			block, err = d.ReadBlock()
+			if err == nil {
+				_, err = block.Messages()
+			}
+		}
+		if err == io.EOF {
+			t.Errorf("%s: no error", name)
+			continue
+		}
+		if test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", name, err, test.err)
+		}
+		var de *DecodeError
+		if !errors.As(err, &de) {
+			t.Errorf("%s: error %v is not a DecodeError", name, err)
+		}
+	}
+}
+
+// FuzzDecodeQW checks that no input makes the QuakeWorld decoder panic.
+func FuzzDecodeQW(f *testing.F) {
+	f.Add(testQWRead(1, 1, testQWServerData(false), testQWModelList, testMsg(uint8(0x2f), uint16(40|QW_U_ORIGIN1), int16(800), uint16(0))), false)
+	f.Add(testMVDFrame(0, qwDemRead, nil, testQWServerData(true), testMsg(uint8(0x2a), uint8(1), uint16(DF_ORIGIN), uint8(0), int16(80))), true)
+	f.Fuzz(func(t *testing.T, data []byte, mvd bool) {
+		open := OpenQW
+		if mvd {
+			open = OpenMVD
+		}
+		d, err := open(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		s := NewState()
+		for {
+			block, err := d.ReadBlock()
+			if err != nil {
+				return
+			}
+			msgs, err := block.Messages()
+			if err != nil {
+				return
+			}
+			for _, m := range msgs {
+				m.Apply(s)
+			}
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+// The file contains the view effects of the Quake client.
+
+import (
+	"math"
+)
+
+const (
+	// DefaultViewHeight is the height of the eyes above the origin of
+	// the player, unless the server says otherwise.
+	DefaultViewHeight = 22
+
+	// View bob, as Quake's cl_bob, cl_bobcycle and cl_bobup.
+	bobScale = 0.02
+	bobCycle = 0.6
+	bobUp    = 0.5
+
+	// View roll when strafing, as Quake's cl_rollangle and cl_rollspeed.
+	rollAngle = 2
+	rollSpeed = 200
+
+	// Roll of the view of a dead player.
+	deathRoll = 80
+)
+
+// ViewBob returns how far the view bobs up at the time of the state, from
+// the speed of the player. It's negative when bobbing down.
+func ViewBob(s *State) float64 {
+	cycle := math.Mod(s.Time, bobCycle) / bobCycle
+	if cycle < bobUp {
+		cycle = math.Pi * cycle / bobUp
+	} else {
+		cycle = math.Pi + math.Pi*(cycle-bobUp)/(1-bobUp)
+	}
+	bob := math.Hypot(float64(s.Velocity.X), float64(s.Velocity.Y)) * bobScale
+	bob = bob*0.3 + bob*0.7*math.Sin(cycle)
+	return math.Max(-7, math.Min(4, bob))
+}
+
+// viewRoll returns the roll of the view from strafing.
+func viewRoll(s *State) float64 {
+	yaw := float64(s.ViewAngle.Y) * math.Pi / 180
+	side := float64(s.Velocity.X)*math.Sin(yaw) - float64(s.Velocity.Y)*math.Cos(yaw)
+	roll := float64(rollAngle)
+	if a := math.Abs(side); a < rollSpeed {
+		roll = a * rollAngle / rollSpeed
+	}
+	if side < 0 {
+		return -roll
+	}
+	return roll
+}
@@ -0,0 +1,118 @@
+package dem
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"math"
+	"testing"
+)
+
+func TestViewBob(t *testing.T) {
+	for _, test := range []struct {
+		t     float64
+		speed float32
+		want  float64
+	}{
+		{0.15, 0, 0},
+		{0.15, 100, 2},
+		{0.15, 320, 4},
+		{0.45, 320, -2.56},
+		{0.75, 320, 4},
+	} {
+		s := NewState()
+		s.Time = test.t
+		s.Velocity = Vertex{X: test.speed * 0.6, Y: test.speed * 0.8, Z: 1000}
+		if got := ViewBob(s); math.Abs(got-test.want) > 0.0001 {
+			t.Errorf("ViewBob at %g, speed %g: got %g, want %g", test.t, test.speed, got, test.want)
+		}
+	}
+}
+
+func TestViewRoll(t *testing.T) {
+	for _, test := range []struct {
+		yaw  float32
+		vel  Vertex
+		want float64
+	}{
+		{0, Vertex{X: 320}, 0},
+		{0, Vertex{Y: -100}, 1},
+		{0, Vertex{Y: 100}, -1},
+		{90, Vertex{X: 320}, 2},
+		{90, Vertex{X: -320}, -2},
+	} {
+		s := NewState()
+		s.ViewAngle.Y = test.yaw
+		s.Velocity = test.vel
+		if got := viewRoll(s); math.Abs(got-test.want) > 0.0001 {
+			t.Errorf("viewRoll(yaw %g, velocity %v): got %g, want %g", test.yaw, test.vel, got, test.want)
+		}
+	}
+}
+
+func TestClientDataView(t *testing.T) {
+	s := NewState()
+	if s.ViewHeight != DefaultViewHeight {
+		t.Errorf("Initial view height: got %g, want %d", s.ViewHeight, DefaultViewHeight)
+	}
+	(&MsgClientData{
+		Bits:       SU_VIEWHEIGHT | SU_ONGROUND,
+		ViewHeight: -8,
+		Punch:      [3]int8{-2, 0, 1},
+		Velocity:   [3]int8{1, -2, 0},
+		Health:     0,
+	}).Apply(s)
+	if s.ViewHeight != -8 || s.PunchAngle != (Vertex{X: -2, Z: 1}) || s.Velocity != (Vertex{X: 16, Y: -32}) || !s.OnGround || !s.Dead {
+		t.Errorf("Got view height %g, punch %v, velocity %v, onground %t, dead %t", s.ViewHeight, s.PunchAngle, s.Velocity, s.OnGround, s.Dead)
+	}
+	if c := s.Copy(); c.ViewHeight != s.ViewHeight || c.PunchAngle != s.PunchAngle || c.Velocity != s.Velocity || c.OnGround != s.OnGround || c.Dead != s.Dead {
+		t.Errorf("View not copied: %+v", c)
+	}
+	(&MsgClientData{Health: 100}).Apply(s)
+	if s.ViewHeight != DefaultViewHeight || s.PunchAngle != (Vertex{}) || s.OnGround || s.Dead {
+		t.Errorf("Got view height %g, punch %v, onground %t, dead %t", s.ViewHeight, s.PunchAngle, s.OnGround, s.Dead)
+	}
+}
+
+func TestDemoCamera(t *testing.T) {
+	s := NewState()
+	s.CameraEnt = 1
+	s.Entities[1].Pos = Vertex{X: 100, Y: 200, Z: 300}
+	s.ViewAngle = Vertex{X: 10, Y: 90}
+	s.ViewHeight = 18
+	s.PunchAngle = Vertex{X: -2}
+	s.Velocity = Vertex{X: 320}
+	s.Time = 0.15
+
+	p := NewPlayer(nil)
+	want := Camera{Pos: Vertex{X: 100, Y: 200, Z: 318}, Angle: Vertex{X: 8, Y: 90}}
+	if got := p.demoCamera(s); got != want {
+		t.Errorf("Camera: got %+v, want %+v", got, want)
+	}
+	p.ViewBob = true
+	p.ViewRoll = true
+	want = Camera{Pos: Vertex{X: 100, Y: 200, Z: 322}, Angle: Vertex{X: 8, Y: 90, Z: 2}}
+	if got := p.demoCamera(s); !closeVertex(got.Pos, want.Pos, 0.001) || !closeVertex(got.Angle, want.Angle, 0.001) {
+		t.Errorf("Camera with bob and roll: got %+v, want %+v", got, want)
+	}
+	s.Dead = true
+	if got := p.demoCamera(s); got.Angle.Z != deathRoll {
+		t.Errorf("Dead camera roll: got %g, want %d", got.Angle.Z, deathRoll)
+	}
+}
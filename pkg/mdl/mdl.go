@@ -28,12 +28,16 @@ import (
 	"image"
 	"io"
 	"log"
+	"math"
 	"strings"
 )
 
 const (
 	version = 6
 	magic   = 1330660425 // "IDPO"
+
+	// Sanity limit on poses per frame group, to not allocate a lot on bad files.
+	maxGroupFrames = 256
 )
 
 var (
@@ -80,10 +84,63 @@ type RawHeader struct {
 	NumFrames    uint32 /* number of frames */
 
 	Synctype uint32 /* 0 = synchron, 1 = random */
-	Flags    uint32 /* state flag */
+	Flags    Flags  /* state flag */
 	Size     float32
 }
 
+// Flags are the model flags from the MDL header. They tell the client which
+// effects (trails, rotation) to apply to every entity using the model.
+type Flags uint32
+
+const (
+	EF_ROCKET  Flags = 1   // Fire and smoke trail, and a light.
+	EF_GRENADE Flags = 2   // Smoke trail.
+	EF_GIB     Flags = 4   // Blood trail.
+	EF_ROTATE  Flags = 8   // Spin around Z axis. Used for pickup items.
+	EF_TRACER  Flags = 16  // Green split trail (wizard spit).
+	EF_ZOMGIB  Flags = 32  // Small blood trail.
+	EF_TRACER2 Flags = 64  // Orange split trail (hellknight spike).
+	EF_TRACER3 Flags = 128 // Purple trail (vore ball).
+)
+
+var flagNames = []struct {
+	flag Flags
+	name string
+}{
+	{EF_ROCKET, "rocket"},
+	{EF_GRENADE, "grenade"},
+	{EF_GIB, "gib"},
+	{EF_ROTATE, "rotate"},
+	{EF_TRACER, "tracer"},
+	{EF_ZOMGIB, "zomgib"},
+	{EF_TRACER2, "tracer2"},
+	{EF_TRACER3, "tracer3"},
+}
+
+// Has returns true if all flags in o are set.
+func (f Flags) Has(o Flags) bool {
+	return f&o == o
+}
+
+// Trail returns true if the model leaves any kind of trail.
+func (f Flags) Trail() bool {
+	return f&(EF_ROCKET|EF_GRENADE|EF_GIB|EF_TRACER|EF_ZOMGIB|EF_TRACER2|EF_TRACER3) != 0
+}
+
+func (f Flags) String() string {
+	var s []string
+	for _, n := range flagNames {
+		if f.Has(n.flag) {
+			s = append(s, n.name)
+			f &^= n.flag
+		}
+	}
+	if f != 0 {
+		s = append(s, fmt.Sprintf("0x%x", uint32(f)))
+	}
+	return strings.Join(s, "|")
+}
+
 type TexCoords struct {
 	Onseam uint32
 	S, T   uint32
@@ -99,12 +156,54 @@ type SimpleFrame struct {
 	Vertices []ModelVertex
 }
 
+// FrameGroup is a frame as entities refer to it. It's either a single pose,
+// or a group of poses that animate over time.
+type FrameGroup struct {
+	First     int       // Index into Frames of the first pose.
+	Intervals []float32 // End time of each pose in a group. Nil for single poses.
+}
+
 type Model struct {
 	Header        RawHeader
 	Skins         []image.Image
 	Triangles     []Triangle
 	TextureCoords []TexCoords
-	Frames        []SimpleFrame
+
+	// Frames are all poses, with the poses of frame groups flattened.
+	Frames []SimpleFrame
+
+	// Groups are the frames that entities refer to, indexing into Frames.
+	Groups []FrameGroup
+}
+
+// Pose returns the index into Frames to show for entity frame number frame
+// at time t. Like Quake, invalid frames show the first pose.
+func (m *Model) Pose(frame int, t float64) int {
+	if frame < 0 || frame >= len(m.Groups) {
+		return 0
+	}
+	return m.Groups[frame].Pose(t)
+}
+
+// Pose returns the index into Frames to show at time t.
+func (g *FrameGroup) Pose(t float64) int {
+	if len(g.Intervals) == 0 {
+		return g.First
+	}
+	full := float64(g.Intervals[len(g.Intervals)-1])
+	if full <= 0 {
+		return g.First
+	}
+	t = math.Mod(t, full)
+	if t < 0 {
+		t += full
+	}
+	for n, i := range g.Intervals {
+		if t < float64(i) {
+			return g.First + n
+		}
+	}
+	return g.First + len(g.Intervals) - 1
 }
 
 func (m *Model) POVFrameID(id int, skin string) string {
@@ -214,20 +313,32 @@ type Skin struct {
 	Data  []uint8
 }
 
+// LoadHeader loads only the header of a model. Useful when only the flags
+// are needed, since it's much faster than loading the whole model.
+func LoadHeader(r io.Reader) (*RawHeader, error) {
+	h := &RawHeader{}
+	if err := binary.Read(r, binary.LittleEndian, h); err != nil {
+		return nil, err
+	}
+	if h.Ident != magic {
+		return nil, fmt.Errorf("bad magic %08x, want %08x", h.Ident, magic)
+	}
+	if h.Version != version {
+		return nil, fmt.Errorf("bad version %d", h.Version)
+	}
+	return h, nil
+}
+
 func Load(r myReader) (*Model, error) {
 	m := &Model{}
 	if Verbose {
 		log.Printf("Loading model...")
 	}
-	if err := binary.Read(r, binary.LittleEndian, &m.Header); err != nil {
+	h, err := LoadHeader(r)
+	if err != nil {
 		return nil, err
 	}
-	if m.Header.Ident != magic {
-		return nil, fmt.Errorf("bad magic %08x, want %08x", m.Header.Ident, magic)
-	}
-	if m.Header.Version != version {
-		return nil, fmt.Errorf("bad version %d", m.Header.Version)
-	}
+	m.Header = *h
 	if Verbose {
 		log.Printf("Scale: %v", m.Header.Scale)
 		log.Printf("Translate: %v", m.Header.Translate)
@@ -285,48 +396,85 @@ func Load(r myReader) (*Model, error) {
 			log.Printf("    Type %d", typ)
 		}
 		if typ == 0 {
-			s := simpleFrame{
-				Verts: make([]modelVertex, m.Header.NumVertices, m.Header.NumVertices),
-			}
-			if err := binary.Read(r, binary.LittleEndian, &s.Bboxmin); err != nil {
-				return nil, err
-			}
-			if err := binary.Read(r, binary.LittleEndian, &s.Bboxmax); err != nil {
+			m.Groups = append(m.Groups, FrameGroup{First: len(m.Frames)})
+			if err := m.loadSimpleFrame(r); err != nil {
 				return nil, err
 			}
-			if err := binary.Read(r, binary.LittleEndian, &s.NameBytes); err != nil {
-				return nil, err
-			}
-			if err := binary.Read(r, binary.LittleEndian, &s.Verts); err != nil {
+			continue
+		}
+
+		// Frame group.
+		var num uint32
+		if err := binary.Read(r, binary.LittleEndian, &num); err != nil {
+			return nil, err
+		}
+		if num == 0 || num > maxGroupFrames {
+			return nil, fmt.Errorf("bad number of frames in group %d: %d", i, num)
+		}
+		var bbox [2]modelVertex
+		if err := binary.Read(r, binary.LittleEndian, &bbox); err != nil {
+			return nil, err
+		}
+		g := FrameGroup{
+			First:     len(m.Frames),
+			Intervals: make([]float32, num),
+		}
+		if err := binary.Read(r, binary.LittleEndian, &g.Intervals); err != nil {
+			return nil, err
+		}
+		if Verbose {
+			log.Printf("    Group of %d, intervals %v", num, g.Intervals)
+		}
+		for j := uint32(0); j < num; j++ {
+			if err := m.loadSimpleFrame(r); err != nil {
 				return nil, err
 			}
-			if Verbose {
-				log.Printf("    Name: %s", s.Name())
-			}
-			sf := SimpleFrame{
-				Name: s.Name(),
-			}
-			for n, v := range s.Verts {
-				sf.Vertices = append(sf.Vertices, ModelVertex{
-					Vertex: Vertex{
-						X: (m.Header.Scale.X*float32(v.X) + m.Header.Translate.X),
-						Y: (m.Header.Scale.Y*float32(v.Y) + m.Header.Translate.Y),
-						Z: (m.Header.Scale.Z*float32(v.Z) + m.Header.Translate.Z),
-					},
-					NormalIndex: int(v.NormalIndex),
-				})
-				if Verbose {
-					log.Printf("Vert %d: %v -> %v", n, v, sf.Vertices[len(sf.Vertices)-1])
-				}
-			}
-			m.Frames = append(m.Frames, sf)
-		} else {
-			return nil, fmt.Errorf("non-simple frames not implemented")
 		}
+		m.Groups = append(m.Groups, g)
 	}
 	return m, nil
 }
 
+// loadSimpleFrame loads a single pose and adds it to Frames.
+func (m *Model) loadSimpleFrame(r io.Reader) error {
+	s := simpleFrame{
+		Verts: make([]modelVertex, m.Header.NumVertices, m.Header.NumVertices),
+	}
+	if err := binary.Read(r, binary.LittleEndian, &s.Bboxmin); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &s.Bboxmax); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &s.NameBytes); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &s.Verts); err != nil {
+		return err
+	}
+	if Verbose {
+		log.Printf("    Name: %s", s.Name())
+	}
+	sf := SimpleFrame{
+		Name: s.Name(),
+	}
+	for n, v := range s.Verts {
+		sf.Vertices = append(sf.Vertices, ModelVertex{
+			Vertex: Vertex{
+				X: (m.Header.Scale.X*float32(v.X) + m.Header.Translate.X),
+				Y: (m.Header.Scale.Y*float32(v.Y) + m.Header.Translate.Y),
+				Z: (m.Header.Scale.Z*float32(v.Z) + m.Header.Translate.Z),
+			},
+			NormalIndex: int(v.NormalIndex),
+		})
+		if Verbose {
+			log.Printf("Vert %d: %v -> %v", n, v, sf.Vertices[len(sf.Vertices)-1])
+		}
+	}
+	m.Frames = append(m.Frames, sf)
+	return nil
+}
+
 type simpleFrame struct {
 	Bboxmin   modelVertex /* bouding box min */
 	Bboxmax   modelVertex /* bouding box max */
@@ -20,6 +20,8 @@ package mdl
 //   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
 
 import (
+	"bytes"
+	"encoding/binary"
 	"reflect"
 	"testing"
 )
@@ -40,3 +42,95 @@ func TestSizes(t *testing.T) {
 		}
 	}
 }
+
+func TestFlags(t *testing.T) {
+	for _, test := range []struct {
+		flags Flags
+		str   string
+		trail bool
+	}{
+		{0, "", false},
+		{EF_ROTATE, "rotate", false},
+		{EF_ROCKET, "rocket", true},
+		{EF_TRACER2 | EF_ROTATE, "rotate|tracer2", true},
+		{EF_GIB | 0x100, "gib|0x100", true},
+	} {
+		if got, want := test.flags.String(), test.str; got != want {
+			t.Errorf("String(%d): got %q, want %q", test.flags, got, want)
+		}
+		if got, want := test.flags.Trail(), test.trail; got != want {
+			t.Errorf("Trail(%v): got %v, want %v", test.flags, got, want)
+		}
+	}
+	if !(EF_GIB | EF_ROTATE).Has(EF_ROTATE) {
+		t.Errorf("Has(EF_ROTATE) false for gib|rotate")
+	}
+}
+
+// testFrame is a pose of a model with one vertex.
+func testFrame(name string, x uint8) []interface{} {
+	var n [16]byte
+	copy(n[:], name)
+	return []interface{}{[2]modelVertex{}, n, modelVertex{X: x}}
+}
+
+func TestLoadGroupFrames(t *testing.T) {
+	var b bytes.Buffer
+	parts := []interface{}{
+		RawHeader{
+			Ident:       magic,
+			Version:     version,
+			Scale:       Vertex{1, 1, 1},
+			NumVertices: 1,
+			NumFrames:   2,
+		},
+		TexCoords{},
+		uint32(0),
+	}
+	parts = append(parts, testFrame("stand", 1)...)
+	parts = append(parts, uint32(1), uint32(2), [2]modelVertex{}, []float32{0.1, 0.3})
+	parts = append(parts, testFrame("flame1", 2)...)
+	parts = append(parts, testFrame("flame2", 3)...)
+	for _, p := range parts {
+		if err := binary.Write(&b, binary.LittleEndian, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := Load(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	var names []string
+	for _, f := range m.Frames {
+		names = append(names, f.Name)
+	}
+	if got, want := names, []string{"stand", "flame1", "flame2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Frames: got %q, want %q", got, want)
+	}
+	if got, want := m.Frames[2].Vertices[0].Vertex.X, float32(3); got != want {
+		t.Errorf("Vertex: got %v, want %v", got, want)
+	}
+	for _, test := range []struct {
+		frame int
+		t     float64
+		want  int
+	}{
+		{0, 0, 0},
+		{0, 10, 0},
+		{1, 0, 1},
+		{1, 0.2, 2},
+		{1, 0.35, 1},
+		{1, 0.55, 2},
+		{2, 0, 0},
+		{-1, 0, 0},
+	} {
+		if got := m.Pose(test.frame, test.t); got != test.want {
+			t.Errorf("Pose(%d, %v): got %d, want %d", test.frame, test.t, got, test.want)
+		}
+	}
+
+	// Truncated group.
+	if _, err := Load(bytes.NewReader(b.Bytes()[:b.Len()-4])); err == nil {
+		t.Errorf("Truncated model loaded without error")
+	}
+}
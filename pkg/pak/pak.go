@@ -79,9 +79,18 @@ type reader struct {
 	pos    int64
 }
 
-func (r *reader) Seek(pos int64, rel int) (int64, error) {
-	if pos >= r.size {
-		pos = r.size - 1
+func (r *reader) Seek(pos int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += r.pos
+	case io.SeekEnd:
+		pos += r.size
+	default:
+		return r.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return r.pos, fmt.Errorf("negative position %d", pos)
 	}
 	r.pos = pos
 	return pos, nil
@@ -91,15 +100,13 @@ func (r *reader) Read(data []byte) (int, error) {
 	if r.pos >= r.size {
 		return 0, io.EOF
 	}
+	if left := r.size - r.pos; int64(len(data)) > left {
+		data = data[:left]
+	}
 	n, err := r.file.ReadAt(data, int64(r.offset+r.pos))
-	if err == nil {
-		r.pos += int64(n)
-
-		// If read too much.
-		if r.pos > r.size {
-			n -= int(r.pos - r.size)
-			r.pos = r.size
-		}
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
 	}
 	return n, err
 }
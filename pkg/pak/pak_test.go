@@ -1,6 +1,9 @@
 package pak
 
 import (
+	"io"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -20,3 +23,45 @@ func TestSizes(t *testing.T) {
 		}
 	}
 }
+
+func TestSeek(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "test.pak")
+	if err := os.WriteFile(fn, []byte("xxhello worldyy"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := &reader{file: f, offset: 2, size: 11}
+	for _, test := range []struct {
+		pos    int64
+		whence int
+		want   int64
+		data   string
+	}{
+		{6, io.SeekStart, 6, "world"},
+		{-5, io.SeekCurrent, 6, "world"},
+		{-11, io.SeekEnd, 0, "hello world"},
+		{20, io.SeekStart, 20, ""},
+	} {
+		got, err := r.Seek(test.pos, test.whence)
+		if err != nil {
+			t.Fatalf("Seek(%d, %d): %v", test.pos, test.whence, err)
+		}
+		if got != test.want {
+			t.Errorf("Seek(%d, %d): got %d, want %d", test.pos, test.whence, got, test.want)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		if string(data) != test.data {
+			t.Errorf("Seek(%d, %d): read %q, want %q", test.pos, test.whence, data, test.data)
+		}
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("Seek to negative position: expected error")
+	}
+}
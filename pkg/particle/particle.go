@@ -0,0 +1,546 @@
+// Package particle simulates Quake particle effects, such as blood,
+// explosions, rocket trails and teleport splashes.
+//
+// The simulation follows the Quake client (r_part.c) with regards to
+// spawning, colors, ramps and gravity. Random numbers are seeded from the
+// seed of the system and the effect itself, so the same demo always gives
+// the same particles, no matter which frames are rendered or in what order
+// the effects are added.
+package particle
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strings"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+	"github.com/ThomasHabets/qpov/pkg/mdl"
+)
+
+const (
+	// StepTime is the simulation time step. Quake steps once per
+	// client frame, this steps as if the client ran at 72 fps.
+	StepTime = 1.0 / 72
+
+	// Gravity is sv_gravity, the default 800.
+	Gravity = 800.0
+
+	// MaxParticles is the most particles alive at the same time. Quake
+	// has 2048 by default, but we can afford more.
+	MaxParticles = 16384
+
+	// Size is the radius of a particle when drawn.
+	Size = 1.0
+
+	// MaxLife is the longest time a particle lives. Particles at a time
+	// only depend on effects up to this long before it.
+	MaxLife = 5.0
+
+	// Distance between trail particles.
+	trailStep = 3.0
+)
+
+// Type is how a particle moves and changes color.
+type Type int
+
+const (
+	Static Type = iota
+	Grav
+	SlowGrav
+	Fire
+	Explode
+	Explode2
+	Blob
+	Blob2
+)
+
+// Trail is the type of trail left by a moving model.
+type Trail int
+
+const (
+	TrailRocket Trail = iota
+	TrailSmoke
+	TrailBlood
+	TrailTracer
+	TrailSlightBlood
+	TrailTracer2
+	TrailVoor
+)
+
+var (
+	ramp1 = []uint8{0x6f, 0x6d, 0x6b, 0x69, 0x67, 0x65, 0x63, 0x61}
+	ramp2 = []uint8{0x6f, 0x6e, 0x6d, 0x6c, 0x6b, 0x6a, 0x68, 0x66}
+	ramp3 = []uint8{0x6d, 0x6b, 6, 5, 4, 3}
+)
+
+// Particle is a single particle.
+type Particle struct {
+	Type  Type
+	Pos   dem.Vertex
+	Vel   dem.Vertex
+	Color uint8   // Palette color.
+	Ramp  float64 // Position in the color ramp of fire and explosions.
+	Start float64 // Demo time it's spawned.
+	Die   float64 // Demo time it's removed.
+}
+
+// System is a set of particles.
+type System struct {
+	Particles []Particle
+
+	seed    uint64
+	time    float64
+	steps   int64 // Time steps since time 0.
+	started bool
+}
+
+// New creates a new particle system. The seed decides all random numbers.
+func New(seed uint64) *System {
+	return &System{seed: seed}
+}
+
+// Time returns the time that the simulation has been run to.
+func (s *System) Time() float64 {
+	return s.time
+}
+
+// rng returns a random number generator for an effect, which only depends
+// on the seed of the system and the arguments.
+func (s *System) rng(kind string, t float64, v ...dem.Vertex) *quakeRand {
+	h := fnv.New64a()
+	h.Write([]byte(kind))
+	binary.Write(h, binary.LittleEndian, math.Float64bits(t))
+	binary.Write(h, binary.LittleEndian, v)
+	return &quakeRand{rand.New(rand.NewPCG(s.seed, h.Sum64()))}
+}
+
+// quakeRand gives random numbers like the C rand() Quake uses.
+type quakeRand struct {
+	r *rand.Rand
+}
+
+// next returns a number between 0 and 32767.
+func (q *quakeRand) next() int {
+	return q.r.IntN(32768)
+}
+
+// add adds a particle, unless there are already too many.
+func (s *System) add(p Particle) {
+	if len(s.Particles) >= MaxParticles {
+		return
+	}
+	s.Particles = append(s.Particles, p)
+}
+
+// Run steps the simulation forward to time t. Particles are only moved
+// after their start time, so effects can be added before running to them.
+// Steps are at multiples of StepTime, so that particles move the same no
+// matter when the simulation started.
+func (s *System) Run(t float64) {
+	if !s.started {
+		// First run. Start at the first effect.
+		s.started = true
+		start := t
+		for _, p := range s.Particles {
+			start = math.Min(start, p.Start)
+		}
+		s.steps = int64(math.Floor(start / StepTime))
+		s.time = float64(s.steps) * StepTime
+	}
+	for float64(s.steps+1)*StepTime <= t {
+		s.steps++
+		s.time = float64(s.steps) * StepTime
+		s.step(s.time)
+	}
+}
+
+// step moves the particles one time step, ending at time t.
+func (s *System) step(t float64) {
+	const ft = StepTime
+	grav := float32(ft * Gravity * 0.05)
+	dvel := float32(4 * ft)
+	keep := s.Particles[:0]
+	for _, p := range s.Particles {
+		if p.Die < t {
+			continue
+		}
+		if p.Start >= t {
+			keep = append(keep, p)
+			continue
+		}
+		p.Pos.X += p.Vel.X * ft
+		p.Pos.Y += p.Vel.Y * ft
+		p.Pos.Z += p.Vel.Z * ft
+		switch p.Type {
+		case Fire:
+			p.Ramp += ft * 5
+			if p.Ramp >= float64(len(ramp3)) {
+				continue
+			}
+			p.Color = ramp3[int(p.Ramp)]
+			p.Vel.Z += grav
+		case Explode:
+			p.Ramp += ft * 10
+			if p.Ramp >= float64(len(ramp1)) {
+				continue
+			}
+			p.Color = ramp1[int(p.Ramp)]
+			p.Vel.X += p.Vel.X * dvel
+			p.Vel.Y += p.Vel.Y * dvel
+			p.Vel.Z += p.Vel.Z*dvel - grav
+		case Explode2:
+			p.Ramp += ft * 15
+			if p.Ramp >= float64(len(ramp2)) {
+				continue
+			}
+			p.Color = ramp2[int(p.Ramp)]
+			p.Vel.X -= p.Vel.X * ft
+			p.Vel.Y -= p.Vel.Y * ft
+			p.Vel.Z -= p.Vel.Z*ft + grav
+		case Blob:
+			p.Vel.X += p.Vel.X * dvel
+			p.Vel.Y += p.Vel.Y * dvel
+			p.Vel.Z += p.Vel.Z*dvel - grav
+		case Blob2:
+			p.Vel.X -= p.Vel.X * dvel
+			p.Vel.Y -= p.Vel.Y * dvel
+			p.Vel.Z -= grav
+		case Grav, SlowGrav:
+			p.Vel.Z -= grav
+		}
+		keep = append(keep, p)
+	}
+	s.Particles = keep
+}
+
+// jitter returns a position randomly moved up to r units along each axis,
+// like Quake's (rand()%(2*r))-r.
+func jitter(q *quakeRand, org dem.Vertex, r int) dem.Vertex {
+	return dem.Vertex{
+		X: org.X + float32(q.next()%(2*r)-r),
+		Y: org.Y + float32(q.next()%(2*r)-r),
+		Z: org.Z + float32(q.next()%(2*r)-r),
+	}
+}
+
+// randomVel returns a random velocity of up to r units per second along each axis.
+func randomVel(q *quakeRand, r int) dem.Vertex {
+	return dem.Vertex{
+		X: float32(q.next()%(2*r) - r),
+		Y: float32(q.next()%(2*r) - r),
+		Z: float32(q.next()%(2*r) - r),
+	}
+}
+
+// Explosion adds a rocket explosion at time t.
+func (s *System) Explosion(t float64, org dem.Vertex) {
+	q := s.rng("explosion", t, org)
+	for i := 0; i < 1024; i++ {
+		typ := Explode
+		if i&1 != 0 {
+			typ = Explode2
+		}
+		s.add(Particle{
+			Type:  typ,
+			Pos:   jitter(q, org, 16),
+			Vel:   randomVel(q, 256),
+			Color: ramp1[0],
+			Ramp:  float64(q.next() & 3),
+			Start: t,
+			Die:   t + MaxLife,
+		})
+	}
+}
+
+// Explosion2 adds an explosion with custom colors at time t.
+func (s *System) Explosion2(t float64, org dem.Vertex, colorStart, colorLength uint8) {
+	q := s.rng("explosion2", t, org)
+	length := int(colorLength)
+	if length == 0 {
+		length = 1
+	}
+	for i := 0; i < 512; i++ {
+		s.add(Particle{
+			Type:  Blob,
+			Pos:   jitter(q, org, 16),
+			Vel:   randomVel(q, 256),
+			Color: uint8(int(colorStart) + i%length),
+			Start: t,
+			Die:   t + 0.3,
+		})
+	}
+}
+
+// BlobExplosion adds a tarbaby explosion at time t.
+func (s *System) BlobExplosion(t float64, org dem.Vertex) {
+	q := s.rng("blob", t, org)
+	for i := 0; i < 1024; i++ {
+		p := Particle{
+			Type:  Blob,
+			Color: uint8(66 + q.next()%6),
+			Start: t,
+			Die:   t + 1 + float64(q.next()&8)*0.05,
+		}
+		if i&1 != 0 {
+			p.Type = Blob2
+			p.Color = uint8(150 + q.next()%6)
+		}
+		p.Pos = jitter(q, org, 16)
+		p.Vel = randomVel(q, 256)
+		s.add(p)
+	}
+}
+
+// Effect adds a burst of count particles at time t, such as blood or spark.
+// Like in Quake, a count of 1024 is a rocket explosion.
+func (s *System) Effect(t float64, org, dir dem.Vertex, color uint8, count int) {
+	if count == 1024 {
+		s.Explosion(t, org)
+		return
+	}
+	q := s.rng("effect", t, org, dir)
+	for i := 0; i < count; i++ {
+		s.add(Particle{
+			Type:  SlowGrav,
+			Pos:   jitter(q, org, 8),
+			Vel:   dem.Vertex{X: dir.X * 15, Y: dir.Y * 15, Z: dir.Z * 15},
+			Color: uint8(int(color)&^7 + q.next()&7),
+			Start: t,
+			Die:   t + 0.1*float64(q.next()%5),
+		})
+	}
+}
+
+// normalize returns the vector scaled to length 1, and the original length.
+func normalize(v dem.Vertex) (dem.Vertex, float64) {
+	l := math.Sqrt(float64(v.X)*float64(v.X) + float64(v.Y)*float64(v.Y) + float64(v.Z)*float64(v.Z))
+	if l == 0 {
+		return v, 0
+	}
+	return dem.Vertex{X: float32(float64(v.X) / l), Y: float32(float64(v.Y) / l), Z: float32(float64(v.Z) / l)}, l
+}
+
+// LavaSplash adds the splash of Chthon rising from the lava at time t.
+func (s *System) LavaSplash(t float64, org dem.Vertex) {
+	q := s.rng("lavasplash", t, org)
+	for i := -16; i < 16; i++ {
+		for j := -16; j < 16; j++ {
+			p := Particle{
+				Type:  SlowGrav,
+				Color: uint8(224 + q.next()&7),
+				Start: t,
+				Die:   t + 2 + float64(q.next()&31)*0.02,
+			}
+			dir := dem.Vertex{
+				X: float32(j*8 + q.next()&7),
+				Y: float32(i*8 + q.next()&7),
+				Z: 256,
+			}
+			p.Pos = dem.Vertex{X: org.X + dir.X, Y: org.Y + dir.Y, Z: org.Z + float32(q.next()&63)}
+			dir, _ = normalize(dir)
+			vel := float32(50 + q.next()&63)
+			p.Vel = dem.Vertex{X: dir.X * vel, Y: dir.Y * vel, Z: dir.Z * vel}
+			s.add(p)
+		}
+	}
+}
+
+// TeleportSplash adds the splash of a teleport at time t.
+func (s *System) TeleportSplash(t float64, org dem.Vertex) {
+	q := s.rng("teleport", t, org)
+	for i := -16; i < 16; i += 4 {
+		for j := -16; j < 16; j += 4 {
+			for k := -24; k < 32; k += 4 {
+				p := Particle{
+					Type:  SlowGrav,
+					Color: uint8(7 + q.next()&7),
+					Start: t,
+					Die:   t + 0.2 + float64(q.next()&7)*0.02,
+				}
+				dir, _ := normalize(dem.Vertex{X: float32(j * 8), Y: float32(i * 8), Z: float32(k * 8)})
+				p.Pos = dem.Vertex{
+					X: org.X + float32(i+q.next()&3),
+					Y: org.Y + float32(j+q.next()&3),
+					Z: org.Z + float32(k+q.next()&3),
+				}
+				vel := float32(50 + q.next()&63)
+				p.Vel = dem.Vertex{X: dir.X * vel, Y: dir.Y * vel, Z: dir.Z * vel}
+				s.add(p)
+			}
+		}
+	}
+}
+
+// TrailForFlags returns the trail that a model with the given flags leaves,
+// if any.
+func TrailForFlags(f mdl.Flags) (Trail, bool) {
+	switch {
+	case f.Has(mdl.EF_ROCKET):
+		return TrailRocket, true
+	case f.Has(mdl.EF_GRENADE):
+		return TrailSmoke, true
+	case f.Has(mdl.EF_GIB):
+		return TrailBlood, true
+	case f.Has(mdl.EF_ZOMGIB):
+		return TrailSlightBlood, true
+	case f.Has(mdl.EF_TRACER):
+		return TrailTracer, true
+	case f.Has(mdl.EF_TRACER2):
+		return TrailTracer2, true
+	case f.Has(mdl.EF_TRACER3):
+		return TrailVoor, true
+	}
+	return 0, false
+}
+
+// Trail adds the trail of a model that moved from start to end at time t.
+func (s *System) Trail(t float64, start, end dem.Vertex, typ Trail) {
+	q := s.rng("trail", t, start, end)
+	vec, l := normalize(dem.Vertex{X: end.X - start.X, Y: end.Y - start.Y, Z: end.Z - start.Z})
+	dec := trailStep
+	if typ == TrailSlightBlood {
+		dec *= 2
+	}
+	// Tracers alternate sides and colors. Unlike in Quake the count
+	// starts over for each trail, so it doesn't depend on earlier trails.
+	tracerCount := 0
+	for ; l > 0; l -= dec {
+		p := Particle{
+			Start: t,
+			Die:   t + 2,
+		}
+		switch typ {
+		case TrailRocket:
+			p.Type = Fire
+			p.Ramp = float64(q.next() & 3)
+			p.Color = ramp3[int(p.Ramp)]
+			p.Pos = jitter(q, start, 3)
+		case TrailSmoke:
+			p.Type = Fire
+			p.Ramp = float64(q.next()&3 + 2)
+			p.Color = ramp3[int(p.Ramp)]
+			p.Pos = jitter(q, start, 3)
+		case TrailBlood, TrailSlightBlood:
+			p.Type = Grav
+			p.Color = uint8(67 + q.next()&3)
+			p.Pos = jitter(q, start, 3)
+		case TrailTracer, TrailTracer2:
+			p.Type = Static
+			p.Die = t + 0.5
+			base := 52
+			if typ == TrailTracer2 {
+				base = 230
+			}
+			p.Color = uint8(base + (tracerCount&4)<<1)
+			p.Pos = start
+			tracerCount++
+			if tracerCount&1 != 0 {
+				p.Vel = dem.Vertex{X: 30 * vec.Y, Y: -30 * vec.X}
+			} else {
+				p.Vel = dem.Vertex{X: -30 * vec.Y, Y: 30 * vec.X}
+			}
+		case TrailVoor:
+			p.Type = Static
+			p.Die = t + 0.3
+			p.Color = uint8(9*16 + 8 + q.next()&3)
+			p.Pos = jitter(q, start, 8)
+		}
+		s.add(p)
+		start.X += vec.X * float32(dec)
+		start.Y += vec.Y * float32(dec)
+		start.Z += vec.Z * float32(dec)
+	}
+}
+
+// TempEntity adds the particles of a temp entity, if it has any.
+func (s *System) TempEntity(t float64, te *dem.MsgTempEntity) {
+	if te.QW {
+		switch te.Type {
+		case dem.QW_TE_BLOOD:
+			s.Effect(t, te.Pos, dem.Vertex{}, 73, 20*int(te.Count))
+			return
+		case dem.QW_TE_LIGHTNINGBLOOD:
+			s.Effect(t, te.Pos, dem.Vertex{}, 225, 50)
+			return
+		case dem.TE_GUNSHOT:
+			s.Effect(t, te.Pos, dem.Vertex{}, 0, 20*int(te.Count))
+			return
+		}
+	}
+	switch te.Type {
+	case dem.TE_SPIKE:
+		s.Effect(t, te.Pos, dem.Vertex{}, 0, 10)
+	case dem.TE_SUPERSPIKE, dem.TE_GUNSHOT:
+		s.Effect(t, te.Pos, dem.Vertex{}, 0, 20)
+	case dem.TE_WIZSPIKE:
+		s.Effect(t, te.Pos, dem.Vertex{}, 20, 30)
+	case dem.TE_KNIGHTSPIKE:
+		s.Effect(t, te.Pos, dem.Vertex{}, 226, 20)
+	case dem.TE_EXPLOSION:
+		s.Explosion(t, te.Pos)
+	case dem.TE_TAREXPLOSION:
+		s.BlobExplosion(t, te.Pos)
+	case dem.TE_LAVASPLASH:
+		s.LavaSplash(t, te.Pos)
+	case dem.TE_TELEPORT:
+		s.TeleportSplash(t, te.Pos)
+	case dem.TE_EXPLOSION2:
+		s.Explosion2(t, te.Pos, te.ColorStart, te.ColorLength)
+	}
+}
+
+// Particle adds the particles of an svc_particle message.
+func (s *System) Particle(t float64, m *dem.MsgParticle) {
+	count := int(m.Count)
+	if count == 255 {
+		count = 1024
+	}
+	s.Effect(t, m.Pos, m.Dir, m.Color, count)
+}
+
+// POV returns the live particles at time t as POV-Ray spheres, one union per color.
+// Like in Quake, particles are not lit, and drawn in their palette color.
+func (s *System) POV(t float64) string {
+	byColor := make(map[uint8][]string)
+	for _, p := range s.Particles {
+		if p.Start > t || p.Die < t {
+			continue
+		}
+		byColor[p.Color] = append(byColor[p.Color], fmt.Sprintf("  sphere { <%s>, %g }\n", p.Pos.String(), Size))
+	}
+	var colors []int
+	for c := range byColor {
+		colors = append(colors, int(c))
+	}
+	sort.Ints(colors)
+	var ret []string
+	for _, c := range colors {
+		r, g, b, _ := mdl.QuakePalette[c].RGBA()
+		ret = append(ret, fmt.Sprintf("union {\n%s  pigment { rgb<%.3f,%.3f,%.3f> } finish { emission 1 diffuse 0 } no_shadow\n}\n",
+			strings.Join(byColor[uint8(c)], ""), float64(r)/0xffff, float64(g)/0xffff, float64(b)/0xffff))
+	}
+	return strings.Join(ret, "")
+}
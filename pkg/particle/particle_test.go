@@ -0,0 +1,185 @@
+package particle
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ThomasHabets/qpov/pkg/dem"
+	"github.com/ThomasHabets/qpov/pkg/mdl"
+)
+
+// sortParticles sorts particles, so that systems can be compared no matter
+// the order effects were added in.
+func sortParticles(ps []Particle) {
+	sort.Slice(ps, func(i, j int) bool {
+		a, b := ps[i], ps[j]
+		if a.Start != b.Start {
+			return a.Start < b.Start
+		}
+		if a.Pos != b.Pos {
+			return a.Pos.X < b.Pos.X || (a.Pos.X == b.Pos.X && (a.Pos.Y < b.Pos.Y || (a.Pos.Y == b.Pos.Y && a.Pos.Z < b.Pos.Z)))
+		}
+		return a.Color < b.Color
+	})
+}
+
+func TestDeterministic(t *testing.T) {
+	effects := []func(s *System){
+		func(s *System) {
+			s.TempEntity(1, &dem.MsgTempEntity{Type: dem.TE_EXPLOSION, Pos: dem.Vertex{X: 100}})
+		},
+		func(s *System) {
+			s.Particle(1.5, &dem.MsgParticle{Pos: dem.Vertex{Y: 10}, Dir: dem.Vertex{Z: 1}, Color: 73, Count: 20})
+		},
+		func(s *System) {
+			s.TempEntity(1.2, &dem.MsgTempEntity{Type: dem.TE_TELEPORT})
+		},
+	}
+	run := func(seed uint64, order ...int) []Particle {
+		s := New(seed)
+		for _, n := range order {
+			effects[n](s)
+		}
+		s.Run(1.6)
+		sortParticles(s.Particles)
+		return s.Particles
+	}
+	a := run(1, 0, 1, 2)
+	if len(a) == 0 {
+		t.Fatalf("No particles")
+	}
+	if b := run(1, 2, 1, 0); !reflect.DeepEqual(a, b) {
+		t.Errorf("Effect order changed the particles")
+	}
+	if b := run(2, 0, 1, 2); reflect.DeepEqual(a, b) {
+		t.Errorf("Seed didn't change the particles")
+	}
+}
+
+func TestRun(t *testing.T) {
+	s := New(0)
+	s.Effect(1, dem.Vertex{}, dem.Vertex{X: 1}, 73, 100)
+	s.Explosion(2, dem.Vertex{})
+	s.Run(0.5)
+	if got, want := len(s.Particles), 1124; got != want {
+		t.Fatalf("Particles before start: got %d, want %d", got, want)
+	}
+	for _, p := range s.Particles {
+		if p.Color&^7 != 72 && p.Color != 0x6f {
+			t.Fatalf("Bad color %d", p.Color)
+		}
+	}
+	old := append([]Particle(nil), s.Particles...)
+
+	// Particles don't move until they start.
+	s.Run(1)
+	if !reflect.DeepEqual(old, s.Particles) {
+		t.Errorf("Particles moved before start")
+	}
+
+	// Effect particles are gone quickly.
+	s.Run(1.5)
+	for _, p := range s.Particles {
+		if p.Start != 2 {
+			t.Errorf("Effect particle still alive at %g: %+v", s.Time(), p)
+		}
+	}
+
+	// Explosions go through their color ramp, and then disappear.
+	s.Run(2.3)
+	colors := map[uint8]bool{}
+	for _, p := range s.Particles {
+		colors[p.Color] = true
+	}
+	if len(colors) < 3 {
+		t.Errorf("Explosion colors not ramping: %v", colors)
+	}
+	s.Run(3)
+	if got := len(s.Particles); got != 0 {
+		t.Errorf("Explosion particles left after ramp: %d", got)
+	}
+}
+
+func TestGravity(t *testing.T) {
+	s := New(0)
+	s.add(Particle{Type: SlowGrav, Vel: dem.Vertex{X: 15}, Start: 1, Die: 10})
+	s.add(Particle{Type: Static, Vel: dem.Vertex{X: 15}, Start: 1, Die: 10})
+	s.Run(0)
+	s.Run(2)
+	dt := s.Time() - 1
+	for _, p := range s.Particles {
+		if got, want := float64(p.Pos.X), 15*dt; math.Abs(got-want) > 0.01 {
+			t.Errorf("%v moved %g along X, want %g", p.Type, got, want)
+		}
+	}
+	if got, want := float64(s.Particles[0].Vel.Z), -Gravity*0.05*dt; math.Abs(got-want) > 0.01 {
+		t.Errorf("Falling speed: got %g, want %g", got, want)
+	}
+	if got := s.Particles[1].Vel.Z; got != 0 {
+		t.Errorf("Static particle falling at %g", got)
+	}
+}
+
+func TestTrail(t *testing.T) {
+	for _, test := range []struct {
+		flags mdl.Flags
+		trail Trail
+		count int
+	}{
+		{mdl.EF_ROCKET | mdl.EF_ROTATE, TrailRocket, 10},
+		{mdl.EF_GRENADE, TrailSmoke, 10},
+		{mdl.EF_ZOMGIB, TrailSlightBlood, 5},
+		{mdl.EF_TRACER2, TrailTracer2, 10},
+	} {
+		trail, ok := TrailForFlags(test.flags)
+		if !ok || trail != test.trail {
+			t.Errorf("Trail for %v: got %v %v, want %v", test.flags, trail, ok, test.trail)
+			continue
+		}
+		s := New(0)
+		s.Trail(1, dem.Vertex{}, dem.Vertex{X: 30}, trail)
+		if got := len(s.Particles); got != test.count {
+			t.Errorf("Trail %v particles: got %d, want %d", trail, got, test.count)
+		}
+	}
+	if _, ok := TrailForFlags(mdl.EF_ROTATE); ok {
+		t.Errorf("Rotating model has trail")
+	}
+}
+
+func TestPOV(t *testing.T) {
+	s := New(0)
+	s.Effect(1, dem.Vertex{}, dem.Vertex{}, 0, 10)
+	if got := s.POV(0.5); got != "" {
+		t.Errorf("POV before start: %q", got)
+	}
+	got := s.POV(1)
+	if n := strings.Count(got, "sphere {"); n != 10 {
+		t.Errorf("Got %d spheres, want 10:\n%s", n, got)
+	}
+	if n, max := strings.Count(got, "union {"), 8; n == 0 || n > max {
+		t.Errorf("Got %d unions, want 1-%d", n, max)
+	}
+}
@@ -0,0 +1,362 @@
+package sound
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	// Distance at which a sound of attenuation 1 can no longer be
+	// heard, as Quake's sound_nominal_clip_dist.
+	nominalClipDist = 1000
+
+	// DefaultRate is the sample rate of the mix.
+	DefaultRate = 44100
+
+	// Sounds are spatialized again this many times per second.
+	spatializeRate = 100
+
+	// Samples per channel mixed at a time when writing.
+	writeBlockSize = 1 << 16
+
+	// Channel playing until stopped.
+	forever = math.MaxInt
+)
+
+// Vertex is a point or direction in the world.
+type Vertex struct {
+	X, Y, Z float64
+}
+
+// Listener is where sounds are heard from.
+type Listener struct {
+	Pos   Vertex
+	Right Vertex // Unit vector to the right of the view.
+
+	// Sounds of this entity are heard at full volume in both ears.
+	Entity int
+}
+
+// channel is a sound playing.
+type channel struct {
+	sound       *Sound
+	entity      int
+	channel     int
+	pos         Vertex
+	volume      float64
+	attenuation float64
+
+	// Output samples of when the sound starts and is stopped.
+	start, end int
+}
+
+// length returns how many samples the channel plays for.
+func (c *channel) length() int {
+	if c.sound.LoopStart >= 0 {
+		return forever
+	}
+	return len(c.sound.Samples)
+}
+
+// stopAt returns the output sample the channel stops playing at.
+func (c *channel) stopAt() int {
+	if l := c.length(); l != forever && c.start+l < c.end {
+		return c.start + l
+	}
+	return c.end
+}
+
+// playing returns true if the channel is playing at output sample n.
+func (c *channel) playing(n int) bool {
+	return n >= c.start && n < c.end && n-c.start < c.length()
+}
+
+// sample returns the sample of the sound at output sample n.
+func (c *channel) sample(n int) float32 {
+	i := n - c.start
+	if l := len(c.sound.Samples); i >= l {
+		i = c.sound.LoopStart + (i-l)%(l-c.sound.LoopStart)
+	}
+	return c.sound.Samples[i]
+}
+
+// music is a track playing in the background, looping.
+type music struct {
+	left, right *Sound
+	volume      float64
+	start, end  int
+}
+
+// sample returns the left and right samples at output sample n.
+func (m *music) sample(n int) (float32, float32) {
+	i := (n - m.start) % len(m.left.Samples)
+	if i < 0 {
+		i += len(m.left.Samples)
+	}
+	return m.left.Samples[i], m.right.Samples[i]
+}
+
+type listenerAt struct {
+	sample int
+	Listener
+}
+
+// Mixer mixes sounds into a stereo track. Sounds are played, stopped and
+// listened to in time order, with times in seconds from the start of the
+// track.
+type Mixer struct {
+	Rate   int
+	Volume float64 // Master volume, as Quake's volume.
+
+	channels  []*channel
+	listeners []listenerAt
+	music     []*music
+}
+
+// NewMixer returns a mixer at the default rate and the default Quake volume.
+func NewMixer() *Mixer {
+	return &Mixer{
+		Rate:   DefaultRate,
+		Volume: 0.7,
+	}
+}
+
+func (m *Mixer) sampleAt(t float64) int {
+	return int(math.Round(t * float64(m.Rate)))
+}
+
+// stop ends channels playing on the entity channel at output sample n.
+func (m *Mixer) stop(n, entity, ch int) {
+	for _, c := range m.channels {
+		if c.entity == entity && c.channel == ch && c.playing(n) {
+			c.end = n
+		}
+	}
+}
+
+// Play starts a sound at time t. The volume is from 0 to 1, and the
+// attenuation is Quake's, where 1 is normal and 0 is heard everywhere.
+// A sound replaces any sound playing on the same entity channel, unless
+// the channel is 0.
+func (m *Mixer) Play(t float64, s *Sound, entity, ch int, pos Vertex, volume, attenuation float64) {
+	n := m.sampleAt(t)
+	if ch != 0 {
+		m.stop(n, entity, ch)
+	}
+	if s.Rate != m.Rate {
+		s = s.Resample(m.Rate)
+	}
+	m.channels = append(m.channels, &channel{
+		sound:       s,
+		entity:      entity,
+		channel:     ch,
+		pos:         pos,
+		volume:      volume,
+		attenuation: attenuation,
+		start:       n,
+		end:         forever,
+	})
+}
+
+// PlayStatic starts an ambient sound at time t, such as a torch. It plays
+// until StopAll, if the sound loops. Otherwise Quake doesn't play it.
+func (m *Mixer) PlayStatic(t float64, s *Sound, pos Vertex, volume, attenuation float64) {
+	if s.LoopStart < 0 {
+		return
+	}
+	m.Play(t, s, 0, 0, pos, volume, attenuation)
+}
+
+// Stop stops the sound playing on an entity channel at time t.
+func (m *Mixer) Stop(t float64, entity, ch int) {
+	m.stop(m.sampleAt(t), entity, ch)
+}
+
+// StopAll stops all sounds at time t, such as on level changes.
+func (m *Mixer) StopAll(t float64) {
+	n := m.sampleAt(t)
+	for _, c := range m.channels {
+		if c.playing(n) {
+			c.end = n
+		}
+	}
+}
+
+// PlayMusic starts music at time t, replacing any music playing. It loops
+// until stopped, like the CD tracks of Quake. Music has one channel for
+// both ears, or a left and a right. The volume is as Quake's bgmvolume.
+func (m *Mixer) PlayMusic(t float64, channels []*Sound, volume float64) {
+	m.StopMusic(t)
+	if len(channels) == 0 || len(channels[0].Samples) == 0 {
+		return
+	}
+	mu := &music{
+		left:   channels[0],
+		right:  channels[0],
+		volume: volume,
+		start:  m.sampleAt(t),
+		end:    forever,
+	}
+	if len(channels) > 1 && len(channels[1].Samples) == len(mu.left.Samples) {
+		mu.right = channels[1]
+	}
+	if mu.left.Rate != m.Rate {
+		mu.left = mu.left.Resample(m.Rate)
+		mu.right = mu.right.Resample(m.Rate)
+	}
+	if len(mu.left.Samples) == 0 {
+		return
+	}
+	m.music = append(m.music, mu)
+}
+
+// StopMusic stops the music at time t.
+func (m *Mixer) StopMusic(t float64) {
+	n := m.sampleAt(t)
+	for _, mu := range m.music {
+		if mu.end > n {
+			mu.end = n
+		}
+	}
+}
+
+// Listen moves the listener at time t.
+func (m *Mixer) Listen(t float64, l Listener) {
+	m.listeners = append(m.listeners, listenerAt{sample: m.sampleAt(t), Listener: l})
+}
+
+// listener returns where the sound is heard from at output sample n.
+func (m *Mixer) listener(n int) Listener {
+	i := sort.Search(len(m.listeners), func(i int) bool { return m.listeners[i].sample > n })
+	if i == 0 {
+		if len(m.listeners) == 0 {
+			return Listener{}
+		}
+		i = 1
+	}
+	return m.listeners[i-1].Listener
+}
+
+// Spatialize returns the left and right volume of a sound at pos, as
+// Quake's SND_Spatialize.
+func Spatialize(l Listener, entity int, pos Vertex, volume, attenuation float64) (float64, float64) {
+	if entity != 0 && entity == l.Entity {
+		return volume, volume
+	}
+	d := Vertex{X: pos.X - l.Pos.X, Y: pos.Y - l.Pos.Y, Z: pos.Z - l.Pos.Z}
+	dist := math.Sqrt(d.X*d.X + d.Y*d.Y + d.Z*d.Z)
+	var dot float64
+	if dist > 0 {
+		dot = (d.X*l.Right.X + d.Y*l.Right.Y + d.Z*l.Right.Z) / dist
+	}
+	scale := volume * (1 - dist*attenuation/nominalClipDist)
+	return math.Max(0, scale*(1-dot)), math.Max(0, scale*(1+dot))
+}
+
+// Mix returns the first length seconds of the track, as interleaved left
+// and right samples.
+func (m *Mixer) Mix(length float64) []float32 {
+	out := make([]float32, 2*m.sampleAt(length))
+	m.mix(out, 0, m.channels)
+	return out
+}
+
+// WriteWAV writes the first length seconds of the track as a 16 bit WAV
+// file. It's mixed a block at a time, so that long tracks don't need to fit
+// in memory.
+func (m *Mixer) WriteWAV(w io.Writer, length float64) error {
+	samples := m.sampleAt(length)
+	bw := bufio.NewWriter(w)
+	if err := writeWAVHeader(bw, m.Rate, 2*samples); err != nil {
+		return err
+	}
+	out := make([]float32, 2*writeBlockSize)
+	var active []*channel
+	next := 0
+	for first := 0; first < samples; first += writeBlockSize {
+		last := min(first+writeBlockSize, samples)
+
+		// Channels are played in time order, so the ones playing in
+		// the block are the ones still playing from the last block, and
+		// the ones starting in it.
+		keep := active[:0]
+		for _, c := range active {
+			if c.stopAt() > first {
+				keep = append(keep, c)
+			}
+		}
+		active = keep
+		for ; next < len(m.channels) && m.channels[next].start < last; next++ {
+			if c := m.channels[next]; c.stopAt() > first {
+				active = append(active, c)
+			}
+		}
+
+		block := out[:2*(last-first)]
+		clear(block)
+		m.mix(block, first, active)
+		if err := writeSamples(bw, block); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// mix adds the channels and the music to out, as interleaved left and right
+// samples starting at output sample first.
+func (m *Mixer) mix(out []float32, first int, channels []*channel) {
+	last := first + len(out)/2
+	block := m.Rate / spatializeRate
+	if block < 1 {
+		block = 1
+	}
+	for _, c := range channels {
+		// Spatialized in blocks from the start of the sound, no matter
+		// which part of the track is mixed.
+		start := max(c.start, 0)
+		from := max(start, first)
+		to := min(c.stopAt(), last)
+		for b := start + (from-start)/block*block; b < to; b += block {
+			l := m.listener(b)
+			left, right := Spatialize(l, c.entity, c.pos, c.volume*m.Volume, c.attenuation)
+			if left == 0 && right == 0 {
+				continue
+			}
+			for n := max(b, first); n < min(b+block, to); n++ {
+				s := c.sample(n)
+				out[2*(n-first)] += s * float32(left)
+				out[2*(n-first)+1] += s * float32(right)
+			}
+		}
+	}
+	for _, mu := range m.music {
+		from := max(mu.start, first, 0)
+		to := min(mu.end, last)
+		for n := from; n < to; n++ {
+			l, r := mu.sample(n)
+			out[2*(n-first)] += l * float32(mu.volume)
+			out[2*(n-first)+1] += r * float32(mu.volume)
+		}
+	}
+}
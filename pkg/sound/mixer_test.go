@@ -0,0 +1,205 @@
+package sound
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSpatialize(t *testing.T) {
+	l := Listener{Right: Vertex{Y: -1}, Entity: 1}
+	for _, test := range []struct {
+		entity      int
+		pos         Vertex
+		attenuation float64
+		left, right float64
+	}{
+		{0, Vertex{}, 1, 1, 1},
+		{0, Vertex{X: 100}, 0, 1, 1},
+		{0, Vertex{X: 500}, 1, 0.5, 0.5},
+		{0, Vertex{Y: -500}, 1, 0, 1},
+		{0, Vertex{Y: 500}, 1, 1, 0},
+		{0, Vertex{X: 2000}, 1, 0, 0},
+		{1, Vertex{Y: 500}, 1, 1, 1},
+	} {
+		left, right := Spatialize(l, test.entity, test.pos, 1, test.attenuation)
+		if math.Abs(left-test.left) > 0.001 || math.Abs(right-test.right) > 0.001 {
+			t.Errorf("Entity %d at %v, attenuation %g: got %g %g, want %g %g", test.entity, test.pos, test.attenuation, left, right, test.left, test.right)
+		}
+	}
+}
+
+// testMix mixes with a rate of 10 samples per second, and no spatialization.
+func testMix(length float64, f func(m *Mixer)) []float32 {
+	m := &Mixer{Rate: 10, Volume: 1}
+	f(m)
+	mix := m.Mix(length)
+	ret := make([]float32, len(mix)/2)
+	for n := range ret {
+		ret[n] = mix[2*n]
+	}
+	return ret
+}
+
+func TestMix(t *testing.T) {
+	one := &Sound{Rate: 10, Samples: []float32{1, 1, 1}, LoopStart: -1}
+	two := &Sound{Rate: 10, Samples: []float32{2, 2}, LoopStart: -1}
+	loop := &Sound{Rate: 10, Samples: []float32{1, 2, 3}, LoopStart: 1}
+	for _, test := range []struct {
+		name string
+		f    func(m *Mixer)
+		want []float32
+	}{
+		{"nothing", func(m *Mixer) {}, []float32{0, 0, 0, 0, 0, 0}},
+		{"play", func(m *Mixer) {
+			m.Play(0.2, one, 1, 1, Vertex{}, 0.5, 0)
+		}, []float32{0, 0, 0.5, 0.5, 0.5, 0}},
+		{"replace", func(m *Mixer) {
+			m.Play(0, one, 1, 1, Vertex{}, 1, 0)
+			m.Play(0.1, two, 1, 1, Vertex{}, 1, 0)
+		}, []float32{1, 2, 2, 0, 0, 0}},
+		{"auto channel doesn't replace", func(m *Mixer) {
+			m.Play(0, one, 1, 0, Vertex{}, 1, 0)
+			m.Play(0.1, two, 1, 0, Vertex{}, 1, 0)
+		}, []float32{1, 3, 3, 0, 0, 0}},
+		{"other entity doesn't replace", func(m *Mixer) {
+			m.Play(0, one, 1, 1, Vertex{}, 1, 0)
+			m.Play(0.1, two, 2, 1, Vertex{}, 1, 0)
+		}, []float32{1, 3, 3, 0, 0, 0}},
+		{"stop", func(m *Mixer) {
+			m.Play(0, one, 1, 1, Vertex{}, 1, 0)
+			m.Stop(0.2, 1, 1)
+		}, []float32{1, 1, 0, 0, 0, 0}},
+		{"started before", func(m *Mixer) {
+			m.Play(-0.1, one, 1, 1, Vertex{}, 1, 0)
+		}, []float32{1, 1, 0, 0, 0, 0}},
+		{"resample", func(m *Mixer) {
+			m.Play(0, &Sound{Rate: 5, Samples: []float32{1, 3}, LoopStart: -1}, 1, 1, Vertex{}, 1, 0)
+		}, []float32{1, 2, 3, 3, 0, 0}},
+		{"static", func(m *Mixer) {
+			m.PlayStatic(0.1, loop, Vertex{}, 1, 0)
+			m.PlayStatic(0.1, one, Vertex{}, 1, 0)
+			m.StopAll(0.5)
+		}, []float32{0, 1, 2, 3, 2, 0}},
+		{"far away", func(m *Mixer) {
+			m.Play(0, one, 1, 1, Vertex{X: 1000}, 1, 1)
+		}, []float32{0, 0, 0, 0, 0, 0}},
+	} {
+		if got := testMix(0.6, test.f); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMixMusic(t *testing.T) {
+	left := &Sound{Rate: 10, Samples: []float32{1, 2}, LoopStart: -1}
+	right := &Sound{Rate: 10, Samples: []float32{3, 4}, LoopStart: -1}
+	for _, test := range []struct {
+		name string
+		f    func(m *Mixer)
+		want []float32
+	}{
+		{"stereo", func(m *Mixer) {
+			m.PlayMusic(0.1, []*Sound{left, right}, 1)
+			m.StopMusic(0.4)
+		}, []float32{0, 0, 1, 3, 2, 4, 1, 3, 0, 0}},
+		{"mono", func(m *Mixer) {
+			m.PlayMusic(-0.1, []*Sound{left}, 0.5)
+		}, []float32{1, 1, 0.5, 0.5, 1, 1, 0.5, 0.5, 1, 1}},
+		{"replace", func(m *Mixer) {
+			m.PlayMusic(0, []*Sound{right}, 1)
+			m.PlayMusic(0.2, []*Sound{left}, 1)
+		}, []float32{3, 3, 4, 4, 1, 1, 2, 2, 1, 1}},
+		{"not spatialized", func(m *Mixer) {
+			m.Listen(0, Listener{Pos: Vertex{X: 5000}})
+			m.PlayMusic(0, []*Sound{left}, 1)
+		}, []float32{1, 1, 2, 2, 1, 1, 2, 2, 1, 1}},
+	} {
+		m := &Mixer{Rate: 10, Volume: 0.5}
+		test.f(m)
+		if got := m.Mix(0.5); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMixListener(t *testing.T) {
+	m := &Mixer{Rate: 1000, Volume: 1}
+	s := &Sound{Rate: 1000, Samples: make([]float32, 40), LoopStart: -1}
+	for n := range s.Samples {
+		s.Samples[n] = 1
+	}
+	// Sound to the left, then the listener turns around.
+	m.Listen(0, Listener{Right: Vertex{Y: -1}})
+	m.Listen(0.02, Listener{Right: Vertex{Y: 1}})
+	m.Play(0, s, 1, 1, Vertex{Y: 1}, 1, 0)
+	mix := m.Mix(0.04)
+	for _, test := range []struct {
+		n           int
+		left, right float32
+	}{
+		{0, 2, 0},
+		{19, 2, 0},
+		{20, 0, 2},
+		{39, 0, 2},
+	} {
+		if l, r := mix[2*test.n], mix[2*test.n+1]; l != test.left || r != test.right {
+			t.Errorf("Sample %d: got %g %g, want %g %g", test.n, l, r, test.left, test.right)
+		}
+	}
+}
+
+func TestMixerWriteWAV(t *testing.T) {
+	m := &Mixer{Rate: 1000, Volume: 0.5}
+	ramp := &Sound{Rate: 1000, Samples: make([]float32, 3000), LoopStart: -1}
+	for n := range ramp.Samples {
+		ramp.Samples[n] = float32(n%100) / 100
+	}
+	loop := &Sound{Rate: 500, Samples: []float32{0.1, 0.2, 0.3, 0.4}, LoopStart: 1}
+	m.Listen(0, Listener{Right: Vertex{Y: -1}})
+	m.PlayStatic(1, loop, Vertex{X: 100}, 1, 1)
+	m.Play(2, ramp, 1, 1, Vertex{Y: 200}, 1, 1)
+	m.PlayMusic(10, []*Sound{loop}, 0.5)
+	m.Listen(64, Listener{Right: Vertex{Y: 1}})
+	// Spans the first two blocks.
+	m.Play(64.5, ramp, 2, 1, Vertex{Y: -300}, 1, 0.5)
+	m.Stop(66, 2, 1)
+	m.Play(100, ramp, 3, 0, Vertex{}, 1, 0)
+	m.StopAll(120)
+	m.StopMusic(125)
+	const length = 140.0
+	if samples := m.sampleAt(length); samples <= 2*writeBlockSize {
+		t.Fatalf("Only %d samples, want more than two blocks", samples)
+	}
+	var want bytes.Buffer
+	if err := WriteWAV(&want, m.Rate, m.Mix(length)); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := m.WriteWAV(&got, length); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("Mixed in blocks differs from mixed at once")
+	}
+}
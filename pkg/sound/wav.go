@@ -0,0 +1,244 @@
+// Package sound loads Quake sounds and mixes them into a stereo track,
+// with the distance attenuation and stereo panning of the Quake client.
+package sound
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	formatPCM = 1
+
+	// Byte offset of the sample offset of the first cue point, from the
+	// start of the cue chunk data.
+	cueSampleOffset = 24
+)
+
+// Sound is a mono sound.
+type Sound struct {
+	Rate    int       // Samples per second.
+	Samples []float32 // From -1 to 1.
+
+	// LoopStart is where looping sounds start over, or -1 if the sound
+	// doesn't loop. Quake only loops sounds with a cue point.
+	LoopStart int
+}
+
+type wavFormat struct {
+	Format        uint16
+	Channels      uint16
+	Rate          uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+}
+
+// LoadWAV loads a PCM WAV file with 8 or 16 bit samples. Stereo sounds
+// are mixed down to mono.
+func LoadWAV(r io.Reader) (*Sound, error) {
+	chans, err := LoadWAVChannels(r)
+	if err != nil {
+		return nil, err
+	}
+	s := chans[0]
+	for _, c := range chans[1:] {
+		for n, v := range c.Samples {
+			s.Samples[n] += v
+		}
+	}
+	for n := range s.Samples {
+		s.Samples[n] /= float32(len(chans))
+	}
+	return s, nil
+}
+
+// LoadWAVChannels loads a PCM WAV file like LoadWAV, but returns each
+// channel as its own sound, such as the left and right of music.
+func LoadWAVChannels(r io.Reader) ([]*Sound, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("not a WAV file")
+	}
+	var format *wavFormat
+	var pcm []byte
+	loopStart := -1
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		pos += 8
+		if size < 0 || pos+size > len(data) {
+			// Some Quake sounds have a data chunk size a bit too large.
+			size = len(data) - pos
+		}
+		chunk := data[pos : pos+size]
+		switch id {
+		case "fmt ":
+			format = &wavFormat{}
+			if err := binary.Read(bytes.NewReader(chunk), binary.LittleEndian, format); err != nil {
+				return nil, fmt.Errorf("bad format chunk: %v", err)
+			}
+		case "data":
+			pcm = chunk
+		case "cue ":
+			if len(chunk) >= cueSampleOffset+4 {
+				loopStart = int(binary.LittleEndian.Uint32(chunk[cueSampleOffset:]))
+			}
+		}
+		pos += size + size&1
+	}
+	if format == nil {
+		return nil, fmt.Errorf("no format chunk")
+	}
+	if pcm == nil {
+		return nil, fmt.Errorf("no data chunk")
+	}
+	if format.Format != formatPCM {
+		return nil, fmt.Errorf("format %d is not PCM", format.Format)
+	}
+	if format.Channels < 1 || format.Rate == 0 {
+		return nil, fmt.Errorf("bad format %d channels at %d Hz", format.Channels, format.Rate)
+	}
+	var sample func([]byte) float32
+	switch format.BitsPerSample {
+	case 8:
+		sample = func(b []byte) float32 { return (float32(b[0]) - 128) / 128 }
+	case 16:
+		sample = func(b []byte) float32 { return float32(int16(binary.LittleEndian.Uint16(b))) / 32768 }
+	default:
+		return nil, fmt.Errorf("%d bit samples not supported", format.BitsPerSample)
+	}
+	width := int(format.BitsPerSample) / 8
+	frame := width * int(format.Channels)
+	length := len(pcm) / frame
+	if loopStart >= length {
+		loopStart = -1
+	}
+	chans := make([]*Sound, format.Channels)
+	for c := range chans {
+		s := &Sound{
+			Rate:      int(format.Rate),
+			Samples:   make([]float32, length),
+			LoopStart: loopStart,
+		}
+		for n := range s.Samples {
+			s.Samples[n] = sample(pcm[n*frame+c*width:])
+		}
+		chans[c] = s
+	}
+	return chans, nil
+}
+
+// Resample returns the sound at another sample rate, using linear
+// interpolation.
+func (s *Sound) Resample(rate int) *Sound {
+	if rate == s.Rate || len(s.Samples) == 0 {
+		ret := *s
+		ret.Rate = rate
+		return &ret
+	}
+	step := float64(s.Rate) / float64(rate)
+	ret := &Sound{
+		Rate:      rate,
+		Samples:   make([]float32, int(float64(len(s.Samples))/step)),
+		LoopStart: s.LoopStart,
+	}
+	if s.LoopStart >= 0 {
+		ret.LoopStart = int(float64(s.LoopStart) / step)
+		if ret.LoopStart >= len(ret.Samples) {
+			ret.LoopStart = -1
+		}
+	}
+	last := len(s.Samples) - 1
+	for n := range ret.Samples {
+		p := float64(n) * step
+		i := int(p)
+		if i >= last {
+			ret.Samples[n] = s.Samples[last]
+			continue
+		}
+		f := float32(p - float64(i))
+		ret.Samples[n] = s.Samples[i]*(1-f) + s.Samples[i+1]*f
+	}
+	return ret
+}
+
+// WriteWAV writes interleaved stereo samples as a 16 bit WAV file.
+// Samples outside of -1 to 1 are clipped.
+func WriteWAV(w io.Writer, rate int, samples []float32) error {
+	bw := bufio.NewWriter(w)
+	if err := writeWAVHeader(bw, rate, len(samples)); err != nil {
+		return err
+	}
+	if err := writeSamples(bw, samples); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeWAVHeader writes the header of a 16 bit stereo WAV file of n
+// interleaved samples.
+func writeWAVHeader(w io.Writer, rate, n int) error {
+	const channels = 2
+	size := uint32(n * 2)
+	for _, v := range []interface{}{
+		[]byte("RIFF"),
+		uint32(36 + size),
+		[]byte("WAVEfmt "),
+		uint32(16),
+		wavFormat{
+			Format:        formatPCM,
+			Channels:      channels,
+			Rate:          uint32(rate),
+			ByteRate:      uint32(rate * channels * 2),
+			BlockAlign:    channels * 2,
+			BitsPerSample: 16,
+		},
+		[]byte("data"),
+		size,
+	} {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSamples writes samples as 16 bit, clipping them to -1 to 1.
+func writeSamples(w io.Writer, samples []float32) error {
+	buf := make([]byte, 2)
+	for _, s := range samples {
+		v := math.Max(-1, math.Min(1, float64(s)))
+		binary.LittleEndian.PutUint16(buf, uint16(int16(math.Round(v*32767))))
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
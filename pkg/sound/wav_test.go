@@ -0,0 +1,161 @@
+package sound
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// testChunk returns a RIFF chunk.
+func testChunk(id string, parts ...interface{}) []byte {
+	var data bytes.Buffer
+	for _, p := range parts {
+		binary.Write(&data, binary.LittleEndian, p)
+	}
+	var b bytes.Buffer
+	b.WriteString(id)
+	binary.Write(&b, binary.LittleEndian, uint32(data.Len()))
+	b.Write(data.Bytes())
+	if data.Len()%2 == 1 {
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+// testWAV returns a WAV file with the chunks.
+func testWAV(chunks ...[]byte) []byte {
+	body := append([]byte("WAVE"), bytes.Join(chunks, nil)...)
+	return testChunk("RIFF", body)
+}
+
+func testFormat(channels, rate, bits int) []byte {
+	return testChunk("fmt ", wavFormat{
+		Format:        formatPCM,
+		Channels:      uint16(channels),
+		Rate:          uint32(rate),
+		ByteRate:      uint32(rate * channels * bits / 8),
+		BlockAlign:    uint16(channels * bits / 8),
+		BitsPerSample: uint16(bits),
+	})
+}
+
+func TestLoadWAV(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data []byte
+		want Sound
+	}{
+		{
+			"8 bit",
+			testWAV(testFormat(1, 11025, 8), testChunk("data", []uint8{128, 192, 0})),
+			Sound{Rate: 11025, Samples: []float32{0, 0.5, -1}, LoopStart: -1},
+		},
+		{
+			"16 bit stereo",
+			testWAV(testFormat(2, 22050, 16), testChunk("data", []int16{16384, 0, -32768, -32768})),
+			Sound{Rate: 22050, Samples: []float32{0.25, -1}, LoopStart: -1},
+		},
+		{
+			"looping",
+			testWAV(
+				testFormat(1, 11025, 8),
+				testChunk("cue ", uint32(1), [5]uint32{}, uint32(1)),
+				testChunk("data", []uint8{128, 128, 128}),
+			),
+			Sound{Rate: 11025, Samples: []float32{0, 0, 0}, LoopStart: 1},
+		},
+		{
+			"odd chunk",
+			testWAV(testChunk("LIST", []byte("x")), testFormat(1, 11025, 8), testChunk("data", []uint8{255})),
+			Sound{Rate: 11025, Samples: []float32{127.0 / 128}, LoopStart: -1},
+		},
+	} {
+		got, err := LoadWAV(bytes.NewReader(test.data))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *got, test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not wav", []byte("RIFF\x04\x00\x00\x00AVI ")},
+		{"no format", testWAV(testChunk("data", []uint8{1}))},
+		{"no data", testWAV(testFormat(1, 11025, 8))},
+		{"24 bit", testWAV(testFormat(1, 11025, 24), testChunk("data", []uint8{1, 2, 3}))},
+	} {
+		if _, err := LoadWAV(bytes.NewReader(test.data)); err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}
+
+func TestLoadWAVChannels(t *testing.T) {
+	got, err := LoadWAVChannels(bytes.NewReader(testWAV(testFormat(2, 22050, 16), testChunk("data", []int16{16384, 0, -32768, 16384}))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Sound{
+		{Rate: 22050, Samples: []float32{0.5, -1}, LoopStart: -1},
+		{Rate: 22050, Samples: []float32{0, 0.5}, LoopStart: -1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v %+v, want %+v %+v", *got[0], *got[1], *want[0], *want[1])
+	}
+}
+
+func TestResample(t *testing.T) {
+	s := &Sound{Rate: 11025, Samples: []float32{0, 1, 0, -1}, LoopStart: 2}
+	got := s.Resample(22050)
+	want := &Sound{Rate: 22050, Samples: []float32{0, 0.5, 1, 0.5, 0, -0.5, -1, -1}, LoopStart: 4}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+	if got := s.Resample(11025); !reflect.DeepEqual(got, s) || got == s {
+		t.Errorf("Same rate: got %+v, want copy of %+v", got, s)
+	}
+}
+
+func TestWriteWAV(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteWAV(&b, 44100, []float32{0.5, 0.5, 2, -2}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.Len(), 44+8; got != want {
+		t.Errorf("Got %d bytes, want %d", got, want)
+	}
+	s, err := LoadWAV(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Rate != 44100 || len(s.Samples) != 2 || math.Abs(float64(s.Samples[0])-0.5) > 0.001 || math.Abs(float64(s.Samples[1])) > 0.001 {
+		t.Errorf("Read back %+v", s)
+	}
+}
@@ -0,0 +1,200 @@
+// Package wad reads WAD2 files, such as the gfx.wad of Quake with the
+// pictures of the status bar and the console font.
+package wad
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+
+	"github.com/ThomasHabets/qpov/pkg/mdl"
+)
+
+const (
+	magic = "WAD2"
+
+	// Lump types.
+	TypePalette = 0x40
+	TypeQTex    = 0x41
+	TypeQPic    = 0x42
+	TypeSound   = 0x43
+	TypeMipTex  = 0x44
+
+	// The console font is 16 by 16 characters of 8 by 8 pixels.
+	ConcharsSize = 128
+	CharSize     = 8
+
+	// Palette index of transparent pixels.
+	picTransparent      = 255
+	concharsTransparent = 0
+
+	// Largest picture that can be loaded.
+	maxPicSize = 4096
+)
+
+type rawHeader struct {
+	Magic     [4]byte
+	NumLumps  int32
+	DirOffset int32
+}
+
+type rawLump struct {
+	FilePos     int32
+	DiskSize    int32
+	Size        int32
+	Type        uint8
+	Compression uint8
+	Pad         [2]uint8
+	Name        [16]byte
+}
+
+// Lump is a named piece of data in a WAD file.
+type Lump struct {
+	Name string
+	Type uint8
+	Data []byte
+}
+
+// WAD is a loaded WAD2 file.
+type WAD struct {
+	// Lumps by lower case name.
+	Lumps map[string]*Lump
+}
+
+// Load reads a whole WAD2 file. Sizes in the file are checked against the
+// size of the file before allocating memory for them.
+func Load(r io.ReadSeeker) (*WAD, error) {
+	fileSize, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var h rawHeader
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if string(h.Magic[:]) != magic {
+		return nil, fmt.Errorf("bad magic %q, want %q", h.Magic[:], magic)
+	}
+	if h.NumLumps < 0 {
+		return nil, fmt.Errorf("bad number of lumps %d", h.NumLumps)
+	}
+	if h.DirOffset < 0 || int64(h.DirOffset)+int64(h.NumLumps)*int64(binary.Size(rawLump{})) > fileSize {
+		return nil, fmt.Errorf("directory of %d lumps at %d is past the end of the %d byte file", h.NumLumps, h.DirOffset, fileSize)
+	}
+	if _, err := r.Seek(int64(h.DirOffset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	dir := make([]rawLump, h.NumLumps)
+	if err := binary.Read(r, binary.LittleEndian, dir); err != nil {
+		return nil, fmt.Errorf("reading directory: %v", err)
+	}
+	w := &WAD{Lumps: make(map[string]*Lump)}
+	for _, l := range dir {
+		raw := l.Name[:]
+		if n := bytes.IndexByte(raw, 0); n >= 0 {
+			raw = raw[:n]
+		}
+		name := strings.ToLower(string(raw))
+		if l.Compression != 0 {
+			return nil, fmt.Errorf("lump %q is compressed", name)
+		}
+		if l.Size < 0 {
+			return nil, fmt.Errorf("lump %q has bad size %d", name, l.Size)
+		}
+		if l.FilePos < 0 || int64(l.FilePos)+int64(l.Size) > fileSize {
+			return nil, fmt.Errorf("lump %q of %d bytes at %d is past the end of the %d byte file", name, l.Size, l.FilePos, fileSize)
+		}
+		if _, err := r.Seek(int64(l.FilePos), io.SeekStart); err != nil {
+			return nil, err
+		}
+		data := make([]byte, l.Size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("reading lump %q: %v", name, err)
+		}
+		w.Lumps[name] = &Lump{
+			Name: name,
+			Type: l.Type,
+			Data: data,
+		}
+	}
+	return w, nil
+}
+
+// palette returns the Quake palette, with one color transparent.
+func palette(transparent uint8) color.Palette {
+	p := make(color.Palette, len(mdl.QuakePalette))
+	copy(p, mdl.QuakePalette)
+	p[transparent] = color.RGBA{}
+	return p
+}
+
+// paletted makes an image out of palette indices.
+func paletted(w, h int, data []byte, transparent uint8) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, w, h), palette(transparent))
+	copy(img.Pix, data)
+	return img
+}
+
+// Pic returns a picture, such as "sbar" or "num_0".
+func (w *WAD) Pic(name string) (*image.Paletted, error) {
+	l, found := w.Lumps[name]
+	if !found {
+		return nil, fmt.Errorf("no picture %q", name)
+	}
+	if l.Type != TypeQPic {
+		return nil, fmt.Errorf("%q is type %#x, not a picture", name, l.Type)
+	}
+	var size struct {
+		Width, Height int32
+	}
+	if err := binary.Read(bytes.NewReader(l.Data), binary.LittleEndian, &size); err != nil {
+		return nil, fmt.Errorf("picture %q: %v", name, err)
+	}
+	if size.Width < 0 || size.Height < 0 || size.Width > maxPicSize || size.Height > maxPicSize {
+		return nil, fmt.Errorf("picture %q has bad size %dx%d", name, size.Width, size.Height)
+	}
+	data := l.Data[8:]
+	if want := int(size.Width * size.Height); len(data) < want {
+		return nil, fmt.Errorf("picture %q is %d bytes, want %d", name, len(data), want)
+	}
+	return paletted(int(size.Width), int(size.Height), data, picTransparent), nil
+}
+
+// Conchars returns the console font. Character c is at column c%16 and
+// row c/16.
+func (w *WAD) Conchars() (*image.Paletted, error) {
+	l, found := w.Lumps["conchars"]
+	if !found {
+		return nil, fmt.Errorf("no conchars")
+	}
+	if want := ConcharsSize * ConcharsSize; len(l.Data) < want {
+		return nil, fmt.Errorf("conchars is %d bytes, want %d", len(l.Data), want)
+	}
+	return paletted(ConcharsSize, ConcharsSize, l.Data, concharsTransparent), nil
+}
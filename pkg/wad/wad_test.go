@@ -0,0 +1,149 @@
+package wad
+
+// QPov
+//
+// Copyright (C) Thomas Habets <thomas@habets.se> 2015
+// https://github.com/ThomasHabets/qpov
+//
+//   This program is free software; you can redistribute it and/or modify
+//   it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation; either version 2 of the License, or
+//   (at your option) any later version.
+//
+//   This program is distributed in the hope that it will be useful,
+//   but WITHOUT ANY WARRANTY; without even the implied warranty of
+//   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//   GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License along
+//   with this program; if not, write to the Free Software Foundation, Inc.,
+//   51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestSizes(t *testing.T) {
+	for _, test := range []struct {
+		obj  interface{}
+		want int
+	}{
+		{rawHeader{}, 12},
+		{rawLump{}, 32},
+	} {
+		typ := reflect.TypeOf(test.obj)
+		if got := typ.Size(); int(got) != test.want {
+			t.Errorf("Size of %q: got %v, want %v", typ.Name(), got, test.want)
+		}
+	}
+}
+
+// testWAD returns a WAD2 file with the lumps.
+func testWAD(lumps ...Lump) []byte {
+	var data bytes.Buffer
+	var dir []rawLump
+	for _, l := range lumps {
+		r := rawLump{
+			FilePos:  int32(12 + data.Len()),
+			DiskSize: int32(len(l.Data)),
+			Size:     int32(len(l.Data)),
+			Type:     l.Type,
+		}
+		copy(r.Name[:], l.Name)
+		dir = append(dir, r)
+		data.Write(l.Data)
+	}
+	var b bytes.Buffer
+	h := rawHeader{NumLumps: int32(len(lumps)), DirOffset: int32(12 + data.Len())}
+	copy(h.Magic[:], magic)
+	binary.Write(&b, binary.LittleEndian, h)
+	b.Write(data.Bytes())
+	binary.Write(&b, binary.LittleEndian, dir)
+	return b.Bytes()
+}
+
+// testPic returns a picture lump.
+func testPic(w, h int32, pix ...byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, [2]int32{w, h})
+	b.Write(pix)
+	return b.Bytes()
+}
+
+func TestLoad(t *testing.T) {
+	w, err := Load(bytes.NewReader(testWAD(
+		Lump{Name: "NUM_1", Type: TypeQPic, Data: testPic(2, 1, 4, 255)},
+		Lump{Name: "short", Type: TypeQPic, Data: testPic(2, 2, 4)},
+		Lump{Name: "conchars", Type: TypeMipTex, Data: make([]byte, ConcharsSize*ConcharsSize)},
+		Lump{Name: "palette", Type: TypePalette, Data: []byte{1, 2, 3}},
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(w.Lumps), 4; got != want {
+		t.Errorf("Got %d lumps, want %d", got, want)
+	}
+	if got := w.Lumps["palette"]; got == nil || !bytes.Equal(got.Data, []byte{1, 2, 3}) {
+		t.Errorf("Palette lump: got %+v", got)
+	}
+
+	pic, err := w.Pic("num_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pic.Bounds().Size(); got.X != 2 || got.Y != 1 {
+		t.Errorf("Picture size: got %v, want 2x1", got)
+	}
+	if _, _, _, a := pic.At(0, 0).RGBA(); a == 0 {
+		t.Errorf("Pixel 0 is transparent")
+	}
+	if got := pic.At(1, 0); got != (color.RGBA{}) {
+		t.Errorf("Pixel 1: got %v, want transparent", got)
+	}
+
+	for _, bad := range []string{"short", "palette", "missing"} {
+		if _, err := w.Pic(bad); err == nil {
+			t.Errorf("Pic(%q): expected error", bad)
+		}
+	}
+
+	c, err := w.Conchars()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.At(0, 0); got != (color.RGBA{}) {
+		t.Errorf("Conchars pixel: got %v, want transparent", got)
+	}
+}
+
+func TestLoadBad(t *testing.T) {
+	good := testWAD(Lump{Name: "a", Type: TypeQPic, Data: testPic(1, 1, 0)})
+	dir := len(good) - binary.Size(rawLump{})
+	// patch returns the good WAD with an int32 changed.
+	patch := func(off int, v int32) []byte {
+		b := append([]byte(nil), good...)
+		binary.LittleEndian.PutUint32(b[off:], uint32(v))
+		return b
+	}
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"magic", append([]byte("WAD3"), good[4:]...)},
+		{"truncated", good[:len(good)-1]},
+		{"too many lumps", patch(4, 1<<30)},
+		{"directory past end", patch(8, int32(dir+1))},
+		{"huge lump", patch(dir+8, 1<<30)},
+		{"lump past end", patch(dir, int32(len(good)))},
+		{"negative lump offset", patch(dir, -1)},
+	} {
+		if _, err := Load(bytes.NewReader(test.data)); err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}